@@ -0,0 +1,117 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/grafana/metrictank/api/response"
+	"github.com/grafana/metrictank/stats"
+)
+
+var (
+	// metric api.request.render.quota_exceeded is the number of render requests rejected because an org exhausted its quota
+	reqRenderQuotaExceeded = stats.NewCounter32("api.request.render.quota_exceeded")
+
+	errQuotaExceeded = response.NewError(http.StatusTooManyRequests, "request rejected because the quota of points to fetch is exhausted")
+)
+
+// Accounting receives the cost of planned render requests, so that operators can meter
+// query cost (e.g. for billing or quotas) per org.
+// Account is invoked synchronously once a request has been planned in full, right before its data gets fetched,
+// once for each org that has requests in the plan, so implementations must be cheap and must not block.
+// Requests that don't fetch any data (planOnly, metaOnly and validateOnly) are not accounted.
+type Accounting interface {
+	Account(org, pointsReturn, pointsFetch uint32)
+}
+
+// accounting is the sink that plans are reported to. nil disables accounting.
+var accounting Accounting
+
+// SetAccounting registers the sink that the cost of planned render requests is reported to.
+// it must be called before the api starts serving requests. nil disables accounting.
+func SetAccounting(a Accounting) {
+	accounting = a
+}
+
+// Quota decides whether orgs may fetch more points, e.g. to enforce cumulative per-org quotas such as
+// a number of points fetched per day. Exhausted is invoked synchronously once a request has been planned in full, once for each
+// org that has requests in the plan, with the points the plan fetches for it (as they would be accounted).
+// Requests that don't fetch any data are not checked.
+// If it returns true for any of them, the request is rejected with status 429.
+// Implementations typically also implement Accounting to track the usage of each org, as only requests that
+// are not rejected get accounted. They must be cheap and must not block.
+type Quota interface {
+	Exhausted(org, pointsFetch uint32) bool
+}
+
+// quota is the checker that plans are submitted to. nil disables quotas.
+var quota Quota
+
+// SetQuota registers the checker that planned render requests are submitted to.
+// it must be called before the api starts serving requests. nil disables quotas.
+func SetQuota(q Quota) {
+	quota = q
+}
+
+// chargePlan checks the quota of the orgs of the given plan, if any, and accounts its costs, if enabled.
+// It must be called with the final plan, right before fetching its data.
+func chargePlan(rp ReqsPlan, planMDP uint32) error {
+	if quota == nil && accounting == nil {
+		return nil
+	}
+	costs := accountingCosts(rp, planMDP)
+	if quota != nil {
+		if err := checkQuota(quota, costs); err != nil {
+			return err
+		}
+	}
+	if accounting != nil {
+		account(accounting, costs)
+	}
+	return nil
+}
+
+// accountingCost is the cost of the requests of an org within a plan
+type accountingCost struct {
+	pointsReturn uint32
+	pointsFetch  uint32
+}
+
+// accountingCosts returns the points returned and fetched by the planned requests, per org.
+// Because PointsReturn depends on where the interval boundaries fall, the figures of each request are
+// rounded up to a multiple of accounting-points-rounding, so that the same query is accounted consistently.
+func accountingCosts(rp ReqsPlan, planMDP uint32) map[uint32]accountingCost {
+	costs := make(map[uint32]accountingCost)
+	for _, req := range rp.List() {
+		cost := costs[req.MKey.Org]
+		cost.pointsReturn += roundPoints(req.PointsReturn(planMDP), uint32(accountingPointsRounding))
+		cost.pointsFetch += roundPoints(req.PointsFetch(), uint32(accountingPointsRounding))
+		costs[req.MKey.Org] = cost
+	}
+	return costs
+}
+
+// account reports the costs of a plan to the sink
+func account(sink Accounting, costs map[uint32]accountingCost) {
+	for org, cost := range costs {
+		sink.Account(org, cost.pointsReturn, cost.pointsFetch)
+	}
+}
+
+// checkQuota returns errQuotaExceeded if any of the orgs of a plan exhausted its quota
+func checkQuota(q Quota, costs map[uint32]accountingCost) error {
+	for org, cost := range costs {
+		if q.Exhausted(org, cost.pointsFetch) {
+			reqRenderQuotaExceeded.Inc()
+			return errQuotaExceeded
+		}
+	}
+	return nil
+}
+
+// roundPoints rounds points up to a multiple of multiple. 0 and 1 mean no rounding
+func roundPoints(points, multiple uint32) uint32 {
+	if multiple <= 1 {
+		return points
+	}
+	return (points + multiple - 1) / multiple * multiple
+}
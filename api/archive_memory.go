@@ -0,0 +1,73 @@
+package api
+
+import (
+	"math"
+
+	"github.com/grafana/metrictank/api/models"
+	"github.com/grafana/metrictank/stats"
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// metric api.request.render.archive_hysteresis.kept is the number of times MDP-optimizable series kept the archive
+// remembered from a previous request, where they would otherwise have been planned to a different archive
+var reqRenderArchiveHysteresisKept = stats.NewCounter32("api.request.render.archive_hysteresis.kept")
+
+// archiveHysteresis remembers the archives chosen for recent requests. nil disables archive hysteresis.
+var archiveHysteresis *archiveMemory
+
+// archiveMemory is a bounded LRU of the archive last chosen for the series of a pattern and schema, and a window size.
+// Interactive panels repeatedly query slightly different windows, which can make the planner flip
+// between archives (and thus resolutions) from one request to the next. By preferring the archive
+// that was chosen last time for a similar window, the resolution remains stable.
+type archiveMemory struct {
+	cache    *lru.Cache
+	rounding float64
+}
+
+// archiveMemoryKey identifies the series of a pattern and schema, and a window size. Windows that differ by less than
+// archive-hysteresis-rounding (relatively) share the same key, unless they straddle a bucket boundary
+type archiveMemoryKey struct {
+	org      uint32
+	schemaID uint16
+	pattern  string
+	window   uint32
+}
+
+func newArchiveMemory(size int, rounding float64) (*archiveMemory, error) {
+	cache, err := lru.New(size)
+	if err != nil {
+		return nil, err
+	}
+	return &archiveMemory{
+		cache:    cache,
+		rounding: rounding,
+	}, nil
+}
+
+// key returns the key of the given requests, which all have the given schema, and window.
+// the requests are planned to the same archive, so they share one key: that of the pattern of the first one.
+// windows are bucketed logarithmically, so that the rounding is proportional to the window size
+func (m *archiveMemory) key(schemaID uint16, reqs []models.Req, window uint32) archiveMemoryKey {
+	if window > 0 {
+		window = uint32(math.Log(float64(window)) / math.Log1p(m.rounding))
+	}
+	return archiveMemoryKey{
+		org:      reqs[0].MKey.Org,
+		schemaID: schemaID,
+		pattern:  reqs[0].Pattern,
+		window:   window,
+	}
+}
+
+// get returns the archive remembered for the given key, if any
+func (m *archiveMemory) get(key archiveMemoryKey) (int, bool) {
+	if archive, ok := m.cache.Get(key); ok {
+		return archive.(int), true
+	}
+	return 0, false
+}
+
+// add remembers the archive chosen for the given key
+func (m *archiveMemory) add(key archiveMemoryKey, archive int) {
+	m.cache.Add(key, archive)
+}
@@ -5,18 +5,29 @@ import (
 	"net"
 	"net/http/httputil"
 	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/grafana/globalconf"
 	"github.com/grafana/metrictank/api/middleware"
 	"github.com/grafana/metrictank/expr"
+	"github.com/raintank/dur"
 	log "github.com/sirupsen/logrus"
 )
 
 var (
-	maxPointsPerReqSoft int
-	maxPointsPerReqHard int
-	maxSeriesPerReq     int
+	maxPointsPerReqSoft         int
+	maxPointsPerReqSoftPasses   int
+	maxPointsPerReqSoftReject   bool
+	maxPointsPerReqSoftStrat    string
+	maxPointsPerReqHard         int
+	maxPointsPerReqHardHeadroom float64
+	maxSeriesPerReq             int
+	maxResponseBytes            int
+	maxPNGroupsPerReq           int
+	maxEffectiveMDP             uint
+	maxDecompressedBodySize     int
 
 	Addr             string
 	UseSSL           bool
@@ -31,6 +42,46 @@ var (
 	tagdbDefaultLimit     uint
 	speculationThreshold  float64
 	optimizations         expr.Optimizations
+	readyLeadStr          string
+	readyLead             uint32
+	readyGranularity      string
+	planFromSnapStr       string
+	planFromSnap          uint32
+	fanoutCostsStr        string
+	fanoutCosts           []uint32
+	fanoutTolerance       float64
+	reduceResCandidates   int
+	planWarmWindowStr     string
+	planWarmWindow        uint32
+	planPreferWarm        bool
+	autoPNGroup           bool
+	mergePNGroups         bool
+	reconcileSingles      bool
+	normalizationPref     string
+	mergeIntervalMismatch string
+	signalDegraded        bool
+	archiveHysteresisSize int
+	archiveHysteresisRnd  float64
+	mdpStrict             bool
+	mdpOvershootCap       float64
+	mdpMaxLossFactor      float64
+	ignoreSoftLimitOrgStr string
+	ignoreSoftLimitOrgs   map[uint32]struct{}
+	rawTimestampsOrgStr   string
+	rawTimestampsOrgs     map[uint32]struct{}
+	minFetchIntervalStr   string
+	minFetchInterval      uint32
+	minFetchIntOrgsStr    string
+	minFetchIntOrgs       map[uint32]uint32
+
+	tailMaxSubscriptions int
+	tailMaxPointsPerSec  int
+
+	planCombinationsLogThreshold int
+	planTimeBudget               time.Duration
+	planTables                   bool
+	planClampTo                  bool
+	accountingPointsRounding     uint
 
 	graphiteProxy *httputil.ReverseProxy
 	timeZone      *time.Location
@@ -40,10 +91,23 @@ func ConfigSetup() {
 	apiCfg := flag.NewFlagSet("http", flag.ExitOnError)
 	apiCfg.IntVar(&maxPointsPerReqSoft, "max-points-per-req-soft", 1000000, "lower resolution rollups will be used to try and keep requests below this number of datapoints. (0 disables limit)")
 	apiCfg.IntVar(&maxPointsPerReqHard, "max-points-per-req-hard", 20000000, "limit of number of datapoints a request can return. Requests that exceed this limit will be rejected. (0 disables limit)")
+	apiCfg.Float64Var(&maxPointsPerReqHardHeadroom, "max-points-per-req-hard-headroom", 0, "fraction of max-points-per-req-hard to reserve for the data that functions such as movingAverage read before the requested time range, for requests that have such functions. e.g. 0.2 rejects such requests once they fetch more than 80% of max-points-per-req-hard. must be >= 0 and < 1")
+	apiCfg.IntVar(&maxPointsPerReqSoftPasses, "max-points-per-req-soft-passes", 0, "maximum number of resolution reduction passes to try and honor max-points-per-req-soft. (0 means no limit)")
+	apiCfg.BoolVar(&maxPointsPerReqSoftReject, "max-points-per-req-soft-reject", false, "reject requests that still exceed max-points-per-req-soft after max-points-per-req-soft-passes passes, rather than accepting them if they honor max-points-per-req-hard")
+	apiCfg.StringVar(&ignoreSoftLimitOrgStr, "ignore-soft-limit-orgs", "", "comma separated list of org ids that may set ignoreSoftLimit=true on render requests, to skip max-points-per-req-soft coarsening (e.g. for trusted export jobs). max-points-per-req-hard still applies")
+	apiCfg.StringVar(&rawTimestampsOrgStr, "raw-timestamps-orgs", "", "comma separated list of org ids that may set rawTimestamps=true on render requests, to get the raw data at the timestamps it was stored with, rather than aligned to its interval (e.g. to debug clock or ingest issues)")
+	apiCfg.StringVar(&maxPointsPerReqSoftStrat, "max-points-per-req-soft-strategy", "sequential", "strategy to reduce resolutions to honor max-points-per-req-soft. 'sequential': each pass reduces all PNGroups (in ascending size order), then all singles (in schema order). 'proportional': each pass reduces whichever PNGroup or schema of singles currently fetches the most points")
 	apiCfg.IntVar(&maxSeriesPerReq, "max-series-per-req", 250000, "limit of number of series a request can operate on. Requests that exceed this limit will be rejected. (0 disables limit)")
+	apiCfg.IntVar(&maxResponseBytes, "max-response-bytes", 0, "limit of the size of render responses, in bytes, for memory safety. Series beyond it are omitted from the response, with a warning that names how many were omitted. The size of each series is measured in the json format, without metadata. Requests may lower it via maxResponseBytes. (0 disables limit)")
+	apiCfg.IntVar(&maxPNGroupsPerReq, "max-pngroups-per-req", 0, "limit of number of pre-normalization groups (PNGroups) a request can plan. Requests that exceed this limit will be rejected. (0 disables limit)")
+	apiCfg.UintVar(&maxEffectiveMDP, "max-effective-mdp", 0, "maximum amount of points per series a render request may ask for via maxDataPoints. Higher values are clamped to it, so that clients can't request densities they can't use. (0 disables)")
+	apiCfg.BoolVar(&mdpStrict, "mdp-strict", false, "reject render requests of which the MDP-optimizable series of a pre-normalization group can't be normalized to an interval that yields at least maxDataPoints/2 points, because the window is too short for the requested maxDataPoints, rather than returning them at the lowest common interval")
+	apiCfg.Float64Var(&mdpOvershootCap, "mdp-overshoot-cap", 0, "if > 0, series that return more than this many times maxDataPoints points after function processing (e.g. due to targetDataPoints or functions that add points) get runtime consolidated down to maxDataPoints. must be >= 1 (0 disables)")
+	apiCfg.Float64Var(&mdpMaxLossFactor, "mdp-max-loss-factor", 0, "if > 0, MDP-optimizable series that are pre-normalized together are not planned to a common interval more than this many times coarser than the finest interval that any of them would be MDP-optimized to by itself, to bound the loss of accuracy. If no common interval meets it, the finest one is used, even if that fetches more points. must be >= 1 (0 disables)")
 	apiCfg.StringVar(&Addr, "listen", ":6060", "http listener address.")
 	apiCfg.BoolVar(&UseSSL, "ssl", false, "use HTTPS")
 	apiCfg.BoolVar(&useGzip, "gzip", true, "use GZIP compression of all responses")
+	apiCfg.IntVar(&maxDecompressedBodySize, "max-decompressed-body-size", 10485760, "limit of the size of gzip or zstd compressed request bodies (Content-Encoding), once decompressed. Larger bodies are rejected, to protect against decompression bombs. (0 disables limit)")
 	apiCfg.StringVar(&certFile, "cert-file", "", "SSL certificate file")
 	apiCfg.StringVar(&keyFile, "key-file", "", "SSL key file")
 	apiCfg.BoolVar(&multiTenant, "multi-tenant", true, "require x-org-id authentication to auth as a specific org. otherwise orgId 1 is assumed")
@@ -54,6 +118,31 @@ func ConfigSetup() {
 	apiCfg.Float64Var(&speculationThreshold, "speculation-threshold", 1, "ratio of peer responses after which speculation is used. Set to 1 to disable.")
 	apiCfg.BoolVar(&optimizations.PreNormalization, "pre-normalization", true, "enable pre-normalization optimization")
 	apiCfg.BoolVar(&optimizations.MDP, "mdp-optimization", false, "enable MaxDataPoints optimization (experimental)")
+	apiCfg.BoolVar(&autoPNGroup, "auto-pngroup", false, "bundle requests that are not pre-normalized together, but have the same raw interval and rollup intervals, into implicit pre-normalization groups. This reduces the amount of data read, but all series of such a group are returned at the same interval, even if they are not combined.")
+	apiCfg.BoolVar(&mergePNGroups, "merge-pngroups", false, "after planning, schedule the fetches of PNGroups that resolved to the same interval and use disjoint schemas together, for better IO locality. This does not change the returned data.")
+	apiCfg.BoolVar(&reconcileSingles, "reconcile-singles", false, "normalize MDP-optimizable series that are not pre-normalized to an interval compatible with the non-MDP-optimizable series of the same schema, if their intervals are not multiples of one another, so that they are normalized at the source when combined by functions")
+	apiCfg.StringVar(&normalizationPref, "normalization-pref", "min-fetch", "how to pick the archive of series that are normalized to a common interval. 'min-fetch': the coarsest archive of which the interval divides the common interval, to fetch as little data as possible. 'max-accuracy': the finest such archive, to fetch more data but lose less information during normalization")
+	apiCfg.StringVar(&mergeIntervalMismatch, "merge-interval-mismatch", "normalize", "how to merge the series of a metric that were returned by different nodes at different intervals, e.g. because the metric resolved to different storage-schemas on different nodes due to diverging config. 'normalize': normalize them to their lowest common interval before merging. 'error': fail the request. Either way, the api.cluster.merge_interval_mismatch metric is incremented")
+	apiCfg.BoolVar(&signalDegraded, "signal-degraded", false, "return render responses that are coarser than requested (due to max-points-per-req-soft, or series being normalized to a common interval) with status 206 Partial Content and a Warning header")
+	apiCfg.IntVar(&archiveHysteresisSize, "archive-hysteresis-size", 0, "remember the archive chosen for MDP-optimizable series that are not pre-normalized, for up to this many combinations of query pattern, storage schema and window size, and prefer it for subsequent requests with a similar window as long as it is still valid, so that their resolution remains stable. (0 disables)")
+	apiCfg.Float64Var(&archiveHysteresisRnd, "archive-hysteresis-rounding", 0.1, "relative amount by which request windows may differ to be considered similar by archive-hysteresis-size")
+	apiCfg.StringVar(&readyLeadStr, "ready-lead", "0", "archives are only used for requests of which the from is at least this long after the archive became ready, to give rollup writes time to settle")
+	apiCfg.StringVar(&readyGranularity, "ready-granularity", readyGranularitySecond, "granularity at which the Ready timestamp of archives is compared to the from of requests. second: archives are read as soon as from is at or after Ready. interval: archives are only read once the first bucket of the request started after Ready, so that coarse rollups aren't read for windows that begin within a bucket that was only partially written")
+	apiCfg.StringVar(&minFetchIntervalStr, "min-fetch-interval", "0", "never read archives with an interval finer than this, e.g. 1min, to protect the store from reads of fine-grained data. The coarsest enabled archive of each schema is always allowed. (0 disables)")
+	apiCfg.StringVar(&minFetchIntOrgsStr, "min-fetch-interval-orgs", "", "comma separated list of orgid:interval pairs that override min-fetch-interval for the given orgs, e.g. 12:1min,34:0")
+	apiCfg.StringVar(&planFromSnapStr, "plan-from-snap", "0", "before planning, snap the from of render requests down to a multiple of this duration (e.g. the coarsest retention interval), so that the chosen archives remain stable as dashboards auto-refresh. Only affects archive selection, not the returned time range. (0 disables)")
+	apiCfg.StringVar(&fanoutCostsStr, "archive-fanout-costs", "", "comma separated estimated cost of the fan-out needed to read each archive, by archive number, e.g. '4,1' if raw data is spread over more shards than the rollups. The last cost applies to all further archives. When reading the highest resolution archive, a coarser one with a lower cost is preferred if its point count is comparable, see archive-fanout-tolerance. (empty disables)")
+	apiCfg.Float64Var(&fanoutTolerance, "archive-fanout-tolerance", 0.25, "relative amount by which the point count of a coarser archive may be lower than that of the highest resolution archive, for it to be preferred due to a lower archive-fanout-costs. e.g. 0.5 allows archives with up to twice the interval")
+	apiCfg.IntVar(&reduceResCandidates, "reduce-res-candidates", 1, "when coarsening a pre-normalization group (e.g. to honor max-points-per-req-soft), consider this many of the next coarser common intervals, and pick the one that reads the fewest chunks (preferring finer ones), rather than always the next one. This avoids reading archives with small chunkspans when a slightly coarser interval reads far fewer chunks. (1 always picks the next interval)")
+	apiCfg.StringVar(&planWarmWindowStr, "plan-warm-window", "1h", "when planning requests with planOnly, chunks of which the span ends within this long before now are assumed to be served from memory (the ring buffer or the chunk cache) rather than the store, to estimate the cache hit ratio. e.g. 6h. Also see plan-prefer-warm")
+	apiCfg.BoolVar(&planPreferWarm, "plan-prefer-warm", false, "plan MDP-optimizable requests of which the window lies entirely within plan-warm-window at the highest resolution, rather than at the lowest one that satisfies maxDataPoints, because recent raw data is served from memory whereas a rollup may have to be read from the store. The response is still consolidated to maxDataPoints")
+	apiCfg.IntVar(&planCombinationsLogThreshold, "plan-combinations-log-threshold", 10000, "log planning of pre-normalization groups that require evaluating more than this many interval combinations (0 disables)")
+	apiCfg.DurationVar(&planTimeBudget, "plan-time-budget", 0, "abandon the exhaustive search for the interval of a pre-normalization group once it takes longer than this, and use the best interval found so far. e.g. 50ms (0 disables)")
+	apiCfg.BoolVar(&planTables, "plan-tables", false, "cache, for each set of retentions, a table of the archive to read for any request window, so that the most common planning step is a table lookup rather than a scan of the retentions. Tables are built on first use, and rebuilt when the schemas get reloaded")
+	apiCfg.BoolVar(&planClampTo, "plan-clamp-to", false, "plan requests of which the to is in the future as if it were now, so that the estimated point counts, and thus the chosen archives and intervals, only account for data that can exist. The response still covers the requested window, with null points beyond now")
+	apiCfg.UintVar(&accountingPointsRounding, "accounting-points-rounding", 0, "round the points returned and fetched by each request up to a multiple of this number, before they are reported to the accounting sink (0 or 1 disables rounding)")
+	apiCfg.IntVar(&tailMaxSubscriptions, "tail-max-subscriptions", 100, "limit of number of concurrent /tail subscriptions. Subscriptions beyond it are rejected. (0 disables limit)")
+	apiCfg.IntVar(&tailMaxPointsPerSec, "tail-max-points-per-sec", 1000, "limit of the rate of points a single /tail subscription may stream, given the number of series matching its target and their interval. Subscriptions that would exceed it are rejected. (0 disables limit)")
 	apiCfg.BoolVar(&middleware.LogHeaders, "log-headers", false, "output query headers in logs")
 	globalconf.Register("http", apiCfg, flag.ExitOnError)
 }
@@ -71,6 +160,131 @@ func ConfigProcess() {
 	}
 	graphiteProxy = NewGraphiteProxy(u)
 
+	readyLead, err = dur.ParseDuration(readyLeadStr)
+	if err != nil {
+		log.Fatalf("API Cannot parse ready-lead %q: %s", readyLeadStr, err.Error())
+	}
+	if readyGranularity != readyGranularitySecond && readyGranularity != readyGranularityInterval {
+		log.Fatalf("API invalid ready-granularity %q. must be %q or %q", readyGranularity, readyGranularitySecond, readyGranularityInterval)
+	}
+
+	if maxPointsPerReqSoftStrat != softStrategySequential && maxPointsPerReqSoftStrat != softStrategyProportional {
+		log.Fatalf("API invalid max-points-per-req-soft-strategy %q. must be %q or %q", maxPointsPerReqSoftStrat, softStrategySequential, softStrategyProportional)
+	}
+
+	if maxPointsPerReqHardHeadroom < 0 || maxPointsPerReqHardHeadroom >= 1 {
+		log.Fatalf("API invalid max-points-per-req-hard-headroom %f. must be >= 0 and < 1", maxPointsPerReqHardHeadroom)
+	}
+
+	if normalizationPref != normalizationPrefMinFetch && normalizationPref != normalizationPrefMaxAccuracy {
+		log.Fatalf("API invalid normalization-pref %q. must be %q or %q", normalizationPref, normalizationPrefMinFetch, normalizationPrefMaxAccuracy)
+	}
+
+	if mergeIntervalMismatch != mergeIntervalMismatchNormalize && mergeIntervalMismatch != mergeIntervalMismatchError {
+		log.Fatalf("API invalid merge-interval-mismatch %q. must be %q or %q", mergeIntervalMismatch, mergeIntervalMismatchNormalize, mergeIntervalMismatchError)
+	}
+
+	ignoreSoftLimitOrgs = make(map[uint32]struct{})
+	for _, org := range strings.Split(ignoreSoftLimitOrgStr, ",") {
+		org = strings.TrimSpace(org)
+		if org == "" {
+			continue
+		}
+		id, err := strconv.ParseUint(org, 10, 32)
+		if err != nil {
+			log.Fatalf("API Cannot parse ignore-soft-limit-orgs %q: %s", ignoreSoftLimitOrgStr, err.Error())
+		}
+		ignoreSoftLimitOrgs[uint32(id)] = struct{}{}
+	}
+
+	rawTimestampsOrgs = make(map[uint32]struct{})
+	for _, org := range strings.Split(rawTimestampsOrgStr, ",") {
+		org = strings.TrimSpace(org)
+		if org == "" {
+			continue
+		}
+		id, err := strconv.ParseUint(org, 10, 32)
+		if err != nil {
+			log.Fatalf("API Cannot parse raw-timestamps-orgs %q: %s", rawTimestampsOrgStr, err.Error())
+		}
+		rawTimestampsOrgs[uint32(id)] = struct{}{}
+	}
+
+	minFetchInterval, err = dur.ParseDuration(minFetchIntervalStr)
+	if err != nil {
+		log.Fatalf("API Cannot parse min-fetch-interval %q: %s", minFetchIntervalStr, err.Error())
+	}
+	minFetchIntOrgs = make(map[uint32]uint32)
+	for _, pair := range strings.Split(minFetchIntOrgsStr, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 {
+			log.Fatalf("API Cannot parse min-fetch-interval-orgs %q: %q is not an orgid:interval pair", minFetchIntOrgsStr, pair)
+		}
+		id, err := strconv.ParseUint(strings.TrimSpace(parts[0]), 10, 32)
+		if err != nil {
+			log.Fatalf("API Cannot parse min-fetch-interval-orgs %q: %s", minFetchIntOrgsStr, err.Error())
+		}
+		interval, err := dur.ParseDuration(strings.TrimSpace(parts[1]))
+		if err != nil {
+			log.Fatalf("API Cannot parse min-fetch-interval-orgs %q: %s", minFetchIntOrgsStr, err.Error())
+		}
+		minFetchIntOrgs[uint32(id)] = interval
+	}
+
+	planFromSnap, err = dur.ParseDuration(planFromSnapStr)
+	if err != nil {
+		log.Fatalf("API Cannot parse plan-from-snap %q: %s", planFromSnapStr, err.Error())
+	}
+
+	fanoutCosts = nil
+	for _, cost := range strings.Split(fanoutCostsStr, ",") {
+		cost = strings.TrimSpace(cost)
+		if cost == "" {
+			continue
+		}
+		c, err := strconv.ParseUint(cost, 10, 32)
+		if err != nil {
+			log.Fatalf("API Cannot parse archive-fanout-costs %q: %s", fanoutCostsStr, err.Error())
+		}
+		fanoutCosts = append(fanoutCosts, uint32(c))
+	}
+	if fanoutTolerance < 0 || fanoutTolerance >= 1 {
+		log.Fatalf("API invalid archive-fanout-tolerance %f. must be >= 0 and < 1", fanoutTolerance)
+	}
+	if reduceResCandidates < 1 {
+		log.Fatalf("API invalid reduce-res-candidates %d. must be >= 1", reduceResCandidates)
+	}
+
+	if mdpOvershootCap != 0 && mdpOvershootCap < 1 {
+		log.Fatalf("API invalid mdp-overshoot-cap %f. must be 0 or >= 1", mdpOvershootCap)
+	}
+	if mdpMaxLossFactor != 0 && mdpMaxLossFactor < 1 {
+		log.Fatalf("API invalid mdp-max-loss-factor %f. must be 0 or >= 1", mdpMaxLossFactor)
+	}
+
+	planWarmWindow, err = dur.ParseDuration(planWarmWindowStr)
+	if err != nil {
+		log.Fatalf("API Cannot parse plan-warm-window %q: %s", planWarmWindowStr, err.Error())
+	}
+
+	if archiveHysteresisSize > 0 {
+		if archiveHysteresisRnd <= 0 {
+			log.Fatalf("API invalid archive-hysteresis-rounding %f. must be > 0", archiveHysteresisRnd)
+		}
+		archiveHysteresis, err = newArchiveMemory(archiveHysteresisSize, archiveHysteresisRnd)
+		if err != nil {
+			log.Fatalf("API Cannot create archive hysteresis cache: %s", err.Error())
+		}
+	}
+
+	if planTables {
+		retTables = newRetTableCache()
+	}
+
 	if timeZoneStr == "local" {
 		timeZone = time.Local
 	} else {
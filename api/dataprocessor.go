@@ -5,7 +5,10 @@ import (
 	"errors"
 	"fmt"
 	"math"
+	"net/http"
 	"runtime"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -13,12 +16,14 @@ import (
 	"github.com/grafana/metrictank/util/align"
 
 	"github.com/grafana/metrictank/api/models"
+	"github.com/grafana/metrictank/api/response"
 	"github.com/grafana/metrictank/cluster"
 	"github.com/grafana/metrictank/consolidation"
 	"github.com/grafana/metrictank/mdata"
 	"github.com/grafana/metrictank/mdata/cache"
 	"github.com/grafana/metrictank/mdata/chunk/tsz"
 	"github.com/grafana/metrictank/schema"
+	"github.com/grafana/metrictank/stats"
 	"github.com/grafana/metrictank/tracing"
 	"github.com/grafana/metrictank/util"
 	opentracing "github.com/opentracing/opentracing-go"
@@ -48,6 +53,7 @@ func doRecover(errp *error) {
 
 type getTargetResp struct {
 	series models.Series
+	raw    models.Series // only set if the request has IncludeRaw
 	err    error
 }
 
@@ -129,6 +135,84 @@ func Fix(in []schema.Point, from, to, interval uint32) []schema.Point {
 	return out
 }
 
+// capMDPOvershoot reports, for each series that returns more points than mdp, by how much it does.
+// This happens despite runtime consolidation, e.g. due to targetDataPoints, and tells how accurate the
+// planner's estimate of the returned points is in practice.
+// if maxRatio > 0, series that return more than maxRatio times mdp points get runtime consolidated to honor mdp.
+// the points are copied, because different series may share their points.
+func capMDPOvershoot(in []models.Series, mdp uint32, maxRatio float64) {
+	if mdp == 0 {
+		return
+	}
+	for i := range in {
+		s := &in[i]
+		points := uint32(len(s.Datapoints))
+		if points <= mdp {
+			continue
+		}
+		reqRenderMDPOvershoot.Value(int(uint64(points) * 100 / uint64(mdp)))
+		if maxRatio == 0 || float64(points) <= maxRatio*float64(mdp) || s.Interval == 0 {
+			continue
+		}
+		cons := s.Consolidator
+		if cons == 0 {
+			cons = consolidation.Avg
+		}
+		aggNum := consolidation.AggEvery(points, mdp)
+		copied := append(pointSlicePool.Get().([]schema.Point)[:0], s.Datapoints...)
+		s.Datapoints, s.Interval = consolidation.ConsolidateNudgedAggNum(copied, s.Interval, aggNum, cons)
+		s.Meta = s.Meta.CopyWithChange(func(in models.SeriesMetaProperties) models.SeriesMetaProperties {
+			// the series may have been runtime consolidated already
+			if in.AggNumRC > 1 {
+				in.AggNumRC *= aggNum
+			} else {
+				in.AggNumRC = aggNum
+			}
+			in.ConsolidatorRC = cons
+			return in
+		})
+		reqRenderMDPOvershootCapped.Inc()
+	}
+}
+
+// alignSeries puts all series onto the same timestamps: those of their common interval within [from, to),
+// filling gaps with nulls, so that the response is a dense matrix.
+// it returns an error if the series don't have a common interval, e.g. due to functions that change it.
+// the points are copied, because different series may share their points.
+func alignSeries(in []models.Series, from, to uint32) error {
+	if len(in) == 0 {
+		return nil
+	}
+	interval := in[0].Interval
+	for _, s := range in {
+		if s.Interval != interval || s.Interval == 0 {
+			return fmt.Errorf("align=strict: series %q has interval %d, whereas series %q has interval %d", s.Target, s.Interval, in[0].Target, interval)
+		}
+	}
+	for i := range in {
+		s := &in[i]
+		points := append(pointSlicePool.Get().([]schema.Point)[:0], s.Datapoints...)
+		s.Datapoints = Fix(points, from, to, interval)
+	}
+	return nil
+}
+
+// reverseSeries puts the points of each series in reverse order, e.g. to return them most-recent-first.
+// the points are copied, because different series may share their points.
+func reverseSeries(in []models.Series) {
+	for i := range in {
+		s := &in[i]
+		if len(s.Datapoints) < 2 {
+			continue
+		}
+		out := pointSlicePool.Get().([]schema.Point)[:0]
+		for j := len(s.Datapoints) - 1; j >= 0; j-- {
+			out = append(out, s.Datapoints[j])
+		}
+		s.Datapoints = out
+	}
+}
+
 // divideContext wraps a divide() call with a context.Context condition
 // important: pointsB will be released to the pool. do not keep a reference to it
 func divideContext(ctx context.Context, pointsA, pointsB []schema.Point) []schema.Point {
@@ -214,6 +298,51 @@ func (s *Server) getTargets(ctx context.Context, ss *models.StorageStats, reqs [
 	return out, nil
 }
 
+// rawSeriesSuffix is appended to the targets of the series that requests with IncludeRaw return in addition to their data:
+// their points as read from the archive, at ArchInterval, before any normalization. see getTarget
+const rawSeriesSuffix = " (raw)"
+
+// splitRawSeries separates the series returned due to IncludeRaw from the others.
+// like the others, raw series may have been returned by several replicas, so they get merged.
+func splitRawSeries(in []models.Series) ([]models.Series, []models.Series, error) {
+	var out, raw []models.Series
+	for _, s := range in {
+		if strings.HasSuffix(s.Target, rawSeriesSuffix) {
+			raw = append(raw, s)
+		} else {
+			out = append(out, s)
+		}
+	}
+	raw, err := mergeSeries(raw, expr.NewDataMap())
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.Sort(models.SeriesByTarget(raw))
+	return out, raw, nil
+}
+
+// getRawTimestampTargets returns the series for the given (planned) requests as they are stored in their raw archive:
+// at the timestamps they were ingested with, without any quantization, normalization or consolidation.
+// Note that this breaks the contract that the points of a series are spaced by its interval, which is why
+// the series can't be processed by functions. This is useful to debug clock or ingest issues.
+func (s *Server) getRawTimestampTargets(ctx context.Context, ss *models.StorageStats, reqs []models.Req) ([]models.Series, error) {
+	rawReqs := make([]models.Req, len(reqs))
+	for i, req := range reqs {
+		req.Archive = 0
+		req.ArchInterval = req.RawInterval
+		req.OutInterval = req.RawInterval
+		req.AggNum = 1
+		req.RawTimestamps = true
+		rawReqs[i] = req
+	}
+	out, err := s.getTargets(ctx, ss, rawReqs)
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(models.SeriesByTarget(out))
+	return out, nil
+}
+
 // getTargetsRemote issues the requests - keyed by node name - on other nodes
 func (s *Server) getTargetsRemote(ctx context.Context, ss *models.StorageStats, remoteReqs map[string][]models.Req) ([]models.Series, error) {
 
@@ -299,13 +428,13 @@ LOOP:
 		wg.Add(1)
 		go func(req models.Req) {
 			pre := time.Now()
-			series, err := s.getTarget(rCtx, ss, req)
+			series, raw, err := s.getTarget(rCtx, ss, req)
 			if err != nil {
 				cancel() // cancel all other requests.
 			} else {
 				getTargetDuration.Value(time.Now().Sub(pre))
 			}
-			responses <- getTargetResp{series, err}
+			responses <- getTargetResp{series, raw, err}
 			wg.Done()
 			// pop an item of our limiter so that other requests can be processed.
 			reqLimiter.Release()
@@ -322,6 +451,9 @@ LOOP:
 			return nil, resp.err
 		}
 		out = append(out, resp.series)
+		if resp.raw.Target != "" {
+			out = append(out, resp.raw)
+		}
 	}
 
 	ss.Trace(span)
@@ -333,7 +465,8 @@ LOOP:
 // getTarget returns the series for the request in canonical form with respect to their OutInterval
 // as ConsolidateContext just processes what it's been given (not "stable" or bucket-aligned to the output interval)
 // we simply make sure to pass it the right input such that the output is canonical.
-func (s *Server) getTarget(ctx context.Context, ss *models.StorageStats, req models.Req) (out models.Series, err error) {
+// if the request has IncludeRaw, it also returns a copy of the points as read from the archive, before normalization.
+func (s *Server) getTarget(ctx context.Context, ss *models.StorageStats, req models.Req) (out, raw models.Series, err error) {
 	defer doRecover(&err)
 	normalize := req.AggNum > 1 // do we need to normalize points at runtime?
 	// normalize is runtime consolidation but only for the purpose of bringing high-res
@@ -345,6 +478,13 @@ func (s *Server) getTarget(ctx context.Context, ss *models.StorageStats, req mod
 		log.Debugf("DP getTarget() %s normalize:false", req.DebugString())
 	}
 
+	// the consolidator only affects the data if we read from a rollup archive or normalize,
+	// we don't report it when we return the raw data as-is.
+	consNormFetch := req.Consolidator
+	if req.Archive == 0 && !normalize {
+		consNormFetch = consolidation.None
+	}
+
 	out = models.Series{
 		Target:       req.Target, // always simply the metric name from index
 		Interval:     req.OutInterval,
@@ -363,31 +503,71 @@ func (s *Server) getTarget(ctx context.Context, ss *models.StorageStats, req mod
 				Archive:               req.Archive,
 				ArchInterval:          req.ArchInterval,
 				AggNumNorm:            req.AggNum,
-				ConsolidatorNormFetch: req.Consolidator,
+				ConsolidatorNormFetch: consNormFetch,
+				CoverageFrom:          req.CoverageFrom,
+				PNGrouped:             req.PNGrouped,
+				MDPReason:             req.MDPReason,
+				Node:                  cluster.Manager.ThisNode().GetName(),
 				Count:                 1,
 			},
 		},
 	}
 
+	if req.RawTimestamps {
+		out.Datapoints, err = s.getSeriesRaw(ctx, ss, req)
+		return out, raw, err
+	}
+
+	// keepRaw sets raw to a copy of the given points, which must be at ArchInterval, if requested
+	keepRaw := func(points []schema.Point) {
+		if !req.IncludeRaw {
+			return
+		}
+		raw = out
+		raw.Target += rawSeriesSuffix
+		raw.Interval = req.ArchInterval
+		raw.Meta = []models.SeriesMetaProperties{out.Meta[0]}
+		raw.Meta[0].AggNumNorm = 1
+		if req.Archive == 0 {
+			raw.Meta[0].ConsolidatorNormFetch = consolidation.None
+		}
+		// when normalizing, the points were read from before the requested range to fill the first bucket
+		raw.Datapoints = pointSlicePool.Get().([]schema.Point)[:0]
+		for _, p := range points {
+			if p.Ts >= req.From && p.Ts < req.To {
+				raw.Datapoints = append(raw.Datapoints, p)
+			}
+		}
+	}
+
 	// the easy case: we're reading the raw data.
 	if req.Archive == 0 {
 		out.Datapoints, err = s.getSeriesFixed(ctx, ss, req, consolidation.None)
-		if err != nil || !normalize {
-			return out, err
+		if err != nil {
+			return out, raw, err
+		}
+		keepRaw(out.Datapoints)
+		if !normalize {
+			return out, raw, nil
 		}
 		out.Datapoints = consolidation.ConsolidateContext(ctx, out.Datapoints, req.AggNum, req.Consolidator)
-		return out, nil
+		return out, raw, nil
 	}
 
 	// here we're reading rollup data
 	if req.Consolidator == consolidation.Avg {
 		sum, err := s.getSeriesFixed(ctx, ss, req, consolidation.Sum)
 		if err != nil {
-			return out, err
+			return out, raw, err
 		}
 		cnt, err := s.getSeriesFixed(ctx, ss, req, consolidation.Cnt)
 		if err != nil {
-			return out, err
+			return out, raw, err
+		}
+		if req.IncludeRaw {
+			avg := divide(append(pointSlicePool.Get().([]schema.Point)[:0], sum...), append(pointSlicePool.Get().([]schema.Point)[:0], cnt...))
+			keepRaw(avg)
+			pointSlicePool.Put(avg[:0])
 		}
 		if normalize {
 			sum = consolidation.ConsolidateContext(ctx, sum, req.AggNum, consolidation.Sum)
@@ -396,12 +576,16 @@ func (s *Server) getTarget(ctx context.Context, ss *models.StorageStats, req mod
 		out.Datapoints = divideContext(ctx, sum, cnt)
 	} else {
 		out.Datapoints, err = s.getSeriesFixed(ctx, ss, req, req.Consolidator)
-		if err != nil || !normalize {
-			return out, err
+		if err != nil {
+			return out, raw, err
+		}
+		keepRaw(out.Datapoints)
+		if !normalize {
+			return out, raw, nil
 		}
 		out.Datapoints = consolidation.ConsolidateContext(ctx, out.Datapoints, req.AggNum, req.Consolidator)
 	}
-	return out, nil
+	return out, raw, nil
 }
 
 func logLoad(typ string, key schema.AMKey, from, to uint32) {
@@ -409,6 +593,7 @@ func logLoad(typ string, key schema.AMKey, from, to uint32) {
 }
 
 // getSeriesFixed fetches the series and returns it in quantized, pre-canonical form with respect to their OutInterval
+// it has a (null) point for every interval within the range, even if the series has no data in it at all.
 // TODO: we can probably forego Fix if archive > 0, because only raw chunks are not quantized yet.
 // the requested consolidator is the one that will be used for selecting the archive to read from
 func (s *Server) getSeriesFixed(ctx context.Context, ss *models.StorageStats, req models.Req, consolidator consolidation.Consolidator) ([]schema.Point, error) {
@@ -440,6 +625,33 @@ func (s *Server) getSeriesFixed(ctx context.Context, ss *models.StorageStats, re
 	return Fix(res.Points, rctx.From, rctx.To, req.ArchInterval), nil
 }
 
+// getSeriesRaw fetches the raw data of the series within the range from (inclusive) - to (exclusive),
+// and returns it at the timestamps it was stored with. Unlike getSeriesFixed, it doesn't quantize them.
+func (s *Server) getSeriesRaw(ctx context.Context, ss *models.StorageStats, req models.Req) ([]schema.Point, error) {
+	select {
+	case <-ctx.Done():
+		//request canceled
+		return nil, nil
+	default:
+	}
+	rctx := newRequestContext(ctx, &req, consolidation.None)
+	rctx.From, rctx.To = req.From, req.To
+	if rctx.From >= rctx.To {
+		return nil, nil
+	}
+	res, err := s.getSeries(rctx, ss)
+	if err != nil {
+		return nil, err
+	}
+	points := s.itersToPoints(rctx, res.Iters)
+	for _, p := range res.Points {
+		if p.Ts >= rctx.From && p.Ts < rctx.To {
+			points = append(points, p)
+		}
+	}
+	return points, nil
+}
+
 // getSeries returns points from mem (and store if needed), within the range from (inclusive) - to (exclusive)
 // it can query for data within aggregated archives, by using fn min/max/sum/cnt and providing the matching agg span as interval
 // pass consolidation.None as consolidator to mean read from raw interval, otherwise we'll read from aggregated series.
@@ -620,12 +832,23 @@ func (s *Server) getSeriesCachedStore(ctx *requestContext, ss *models.StorageSta
 	return iters, nil
 }
 
+// values of merge-interval-mismatch
+const (
+	mergeIntervalMismatchNormalize = "normalize"
+	mergeIntervalMismatchError     = "error"
+)
+
+// metric api.cluster.merge_interval_mismatch is how many times series that were returned for the same metric by different nodes had different intervals, e.g. because their storage-schemas diverge
+var mergeIntervalMismatchCount = stats.NewCounter32("api.cluster.merge_interval_mismatch")
+
 // mergeSeries merges series together if applicable. It does this by categorizing
 // series into groups based on their target, query, consolidator etc. If they collide, they get merged.
 // each first uniquely-identified series's backing datapoints slice is reused
 // any subsequent non-uniquely-identified series is merged into the former and has its
 // datapoints slice returned to the pool. input series must be canonical
-func mergeSeries(in []models.Series, dataMap expr.DataMap) []models.Series {
+// colliding series with different intervals are normalized to a common interval first,
+// or result in an error, depending on merge-interval-mismatch.
+func mergeSeries(in []models.Series, dataMap expr.DataMap) ([]models.Series, error) {
 	type segment struct {
 		target  string
 		query   string
@@ -654,6 +877,9 @@ func mergeSeries(in []models.Series, dataMap expr.DataMap) []models.Series {
 		if len(series) == 1 {
 			merged[i] = series[0]
 		} else {
+			if err := checkMergeIntervals(series); err != nil {
+				return nil, err
+			}
 			// we use the first series in the list as our result.  We check over every
 			// point and if it is null, we then check the other series for a non null
 			// value to use instead.
@@ -677,7 +903,32 @@ func mergeSeries(in []models.Series, dataMap expr.DataMap) []models.Series {
 		}
 		i++
 	}
-	return merged
+	return merged, nil
+}
+
+// checkMergeIntervals checks whether the given colliding series, which represent the same metric, all have the same interval.
+// if they don't, the cluster is inconsistent, e.g. because the metric resolved to different storage-schemas on different nodes.
+// such series can still be merged after normalizing them to a common interval, unless merge-interval-mismatch says otherwise.
+func checkMergeIntervals(series []models.Series) error {
+	var intervals []uint32
+SERIES:
+	for _, s := range series {
+		for _, interval := range intervals {
+			if s.Interval == interval {
+				continue SERIES
+			}
+		}
+		intervals = append(intervals, s.Interval)
+	}
+	if len(intervals) == 1 {
+		return nil
+	}
+	mergeIntervalMismatchCount.Inc()
+	if mergeIntervalMismatch == mergeIntervalMismatchError {
+		return response.NewError(http.StatusInternalServerError, fmt.Sprintf("series %q was returned by different nodes at different intervals %v, likely because their storage-schemas diverge", series[0].Target, intervals))
+	}
+	log.Warnf("DP mergeSeries: series %q was returned by different nodes at different intervals %v, likely because their storage-schemas diverge. normalizing", series[0].Target, intervals)
+	return nil
 }
 
 // requestContext is a more concrete specification to load data based on a models.Req
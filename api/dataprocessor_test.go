@@ -2,12 +2,17 @@ package api
 
 import (
 	"fmt"
+	"io/ioutil"
 	"math"
+	"net/http"
 	"reflect"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/grafana/metrictank/api/models"
+	"github.com/grafana/metrictank/api/response"
 	"github.com/grafana/metrictank/cluster"
 	"github.com/grafana/metrictank/conf"
 	"github.com/grafana/metrictank/consolidation"
@@ -306,6 +311,130 @@ func TestFix(t *testing.T) {
 
 }
 
+func TestReverseSeries(t *testing.T) {
+	shared := []schema.Point{{Val: 1, Ts: 1010}, {Val: math.NaN(), Ts: 1020}, {Val: 3, Ts: 1030}}
+	asc := []models.Series{
+		{Target: "a", Interval: 10, Datapoints: shared},
+		// series may share their points, e.g. when the same data is requested by multiple targets
+		{Target: "b", Interval: 10, Datapoints: shared},
+		{Target: "c", Interval: 10, Datapoints: []schema.Point{{Val: 4, Ts: 1010}}},
+		{Target: "d", Interval: 10},
+	}
+	desc := make([]models.Series, len(asc))
+	copy(desc, asc)
+	reverseSeries(desc)
+
+	for i := range asc {
+		a, d := asc[i].Datapoints, desc[i].Datapoints
+		if len(a) != len(d) {
+			t.Fatalf("series %q: expected %d points, got %d", asc[i].Target, len(a), len(d))
+		}
+		for j := range a {
+			exp, got := a[j], d[len(d)-1-j]
+			if exp.Ts != got.Ts || (exp.Val != got.Val && !(math.IsNaN(exp.Val) && math.IsNaN(got.Val))) {
+				t.Fatalf("series %q: expected point %d to be %v, got %v", asc[i].Target, len(d)-1-j, exp, got)
+			}
+		}
+		for j := 1; j < len(d); j++ {
+			if d[j].Ts >= d[j-1].Ts {
+				t.Fatalf("series %q: expected descending timestamps, got %v", asc[i].Target, d)
+			}
+		}
+	}
+	// the input must not have been modified
+	if shared[0].Ts != 1010 || shared[2].Ts != 1030 {
+		t.Fatalf("expected shared points to be untouched, got %v", shared)
+	}
+}
+
+// TestAlignSeries verifies that align=strict yields a dense matrix: all series on the same timestamps, gaps filled with nulls.
+// the expected output is in testdata/align_strict.golden
+func TestAlignSeries(t *testing.T) {
+	shared := []schema.Point{{Val: 1, Ts: 1020}, {Val: 2, Ts: 1040}}
+	in := []models.Series{
+		// series may share their points, e.g. when the same data is requested by multiple targets
+		{Target: "a", Interval: 20, Datapoints: shared},
+		{Target: "b", Interval: 20, Datapoints: shared},
+		// data ends early and has a gap
+		{Target: "c", Interval: 20, Datapoints: []schema.Point{{Val: 3, Ts: 1000}, {Val: 5, Ts: 1040}}},
+		{Target: "d", Interval: 20},
+	}
+	if err := alignSeries(in, 1000, 1080); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	got, err := models.SeriesByTarget(in).MarshalJSONFast(nil)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	exp, err := ioutil.ReadFile("testdata/align_strict.golden")
+	if err != nil {
+		t.Fatalf("failed to read golden file: %v", err)
+	}
+	if string(got) != strings.TrimSpace(string(exp)) {
+		t.Errorf("expected:\n%s\ngot:\n%s", exp, got)
+	}
+	if shared[0].Ts != 1020 || len(shared) != 2 {
+		t.Errorf("expected shared points to be untouched, got %v", shared)
+	}
+
+	mixed := []models.Series{{Target: "a", Interval: 10}, {Target: "b", Interval: 20}}
+	if err := alignSeries(mixed, 1000, 1080); err == nil {
+		t.Errorf("expected error for series with different intervals, got none")
+	}
+}
+
+// TestCapMDPOvershoot verifies that series that return more points than maxDataPoints are reported,
+// and only consolidated when they exceed the cap.
+func TestCapMDPOvershoot(t *testing.T) {
+	points := func(n int) []schema.Point {
+		out := make([]schema.Point, n)
+		for i := range out {
+			out[i] = schema.Point{Val: float64(i), Ts: uint32(10 * (i + 1))}
+		}
+		return out
+	}
+	// e.g. a function that fills in or interpolates points can return more than the runtime consolidation accounted for
+	shared := points(300)
+	cases := []struct {
+		maxRatio  float64
+		expPoints []int // per series
+		expCapped uint32
+	}{
+		{0, []int{100, 130, 300}, 0},
+		{1, []int{100, 65, 100}, 2},
+		{2, []int{100, 130, 100}, 1},
+	}
+	for _, c := range cases {
+		in := []models.Series{
+			{Target: "a", Interval: 10, Datapoints: points(100)},
+			{Target: "b", Interval: 10, Datapoints: points(130), Consolidator: consolidation.Sum},
+			{Target: "c", Interval: 10, Datapoints: shared, Meta: models.SeriesMeta{{AggNumRC: 2}}},
+		}
+		capped := reqRenderMDPOvershootCapped.Peek()
+		capMDPOvershoot(in, 100, c.maxRatio)
+
+		for i, s := range in {
+			if len(s.Datapoints) != c.expPoints[i] {
+				t.Errorf("cap %f: expected series %s to have %d points, got %d", c.maxRatio, s.Target, c.expPoints[i], len(s.Datapoints))
+			}
+		}
+		if got := reqRenderMDPOvershootCapped.Peek() - capped; got != c.expCapped {
+			t.Errorf("cap %f: expected %d series to be capped, got %d", c.maxRatio, c.expCapped, got)
+		}
+		if c.expCapped == 2 {
+			if in[1].Interval != 20 || in[1].Datapoints[0].Val != 0+1 {
+				t.Errorf("cap %f: expected b to be sum-consolidated to interval 20, got interval %d and points %v", c.maxRatio, in[1].Interval, in[1].Datapoints[:2])
+			}
+			if in[2].Interval != 30 || in[2].Meta[0].AggNumRC != 6 {
+				t.Errorf("cap %f: expected c to be consolidated to interval 30 with aggNum 6 in total, got %d and %d", c.maxRatio, in[2].Interval, in[2].Meta[0].AggNumRC)
+			}
+		}
+	}
+	if len(shared) != 300 || shared[1].Val != 1 {
+		t.Errorf("expected shared points to be untouched, got %v", shared[:2])
+	}
+}
+
 // TestGetSeriesFixed assures that series data is returned in proper form.
 // for each case, we generate a new series of 5 points to cover every possible combination of:
 // * every possible data   offset (against its quantized version)       e.g. offset between 0 and interval-1
@@ -583,7 +712,10 @@ func TestMergeSeries(t *testing.T) {
 		Interval: 10,
 	})
 
-	merged := mergeSeries(out, expr.NewDataMap())
+	merged, err := mergeSeries(out, expr.NewDataMap())
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
 	if len(merged) != 5 {
 		t.Errorf("Expected data to be merged down to 5 series. got %d instead", len(merged))
 	}
@@ -602,6 +734,62 @@ func TestMergeSeries(t *testing.T) {
 	}
 }
 
+// TestMergeSeriesIntervalMismatch simulates a metric that resolved to a 10s schema on one node,
+// and to a 30s schema on another, e.g. because their storage-schemas diverge.
+func TestMergeSeriesIntervalMismatch(t *testing.T) {
+	nan := math.NaN()
+	input := func() []models.Series {
+		return []models.Series{
+			{
+				Target:       "some.series",
+				Consolidator: consolidation.Sum,
+				Interval:     10,
+				Datapoints: []schema.Point{
+					{Val: nan, Ts: 10},
+					{Val: nan, Ts: 20},
+					{Val: nan, Ts: 30},
+					{Val: 1, Ts: 40},
+					{Val: 1, Ts: 50},
+					{Val: 1, Ts: 60},
+				},
+			},
+			{
+				Target:       "some.series",
+				Consolidator: consolidation.Sum,
+				Interval:     30,
+				Datapoints: []schema.Point{
+					{Val: 5, Ts: 30},
+					{Val: 7, Ts: 60},
+				},
+			},
+		}
+	}
+	defer func(orig string) { mergeIntervalMismatch = orig }(mergeIntervalMismatch)
+
+	mergeIntervalMismatch = mergeIntervalMismatchNormalize
+	before := mergeIntervalMismatchCount.Peek()
+	merged, err := mergeSeries(input(), expr.NewDataMap())
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if mergeIntervalMismatchCount.Peek() != before+1 {
+		t.Errorf("expected the mismatch to be counted")
+	}
+	exp := []schema.Point{{Val: 5, Ts: 30}, {Val: 3, Ts: 60}}
+	if len(merged) != 1 || merged[0].Interval != 30 || !reflect.DeepEqual(merged[0].Datapoints, exp) {
+		t.Fatalf("expected a single series at interval 30 with points %v, got %+v", exp, merged)
+	}
+
+	mergeIntervalMismatch = mergeIntervalMismatchError
+	_, err = mergeSeries(input(), expr.NewDataMap())
+	if rerr, ok := err.(response.Error); !ok || rerr.HTTPStatusCode() != http.StatusInternalServerError {
+		t.Fatalf("expected an internal server error, got %v", err)
+	}
+	if mergeIntervalMismatchCount.Peek() != before+2 {
+		t.Errorf("expected the mismatch to be counted")
+	}
+}
+
 // generates and returns a slice of chunks according to specified specs
 func generateChunks(span uint32, start uint32, end uint32) []chunk.Chunk {
 	var chunks []chunk.Chunk
@@ -913,6 +1101,79 @@ func TestGetSeriesAggMetrics(t *testing.T) {
 	}
 }
 
+// TestGetTargetMetaConsolidator validates that the consolidator reported in the series meta
+// is the one that was actually applied: the rollup read and/or used for normalization.
+func TestGetTargetMetaConsolidator(t *testing.T) {
+	cluster.Init("default", "test", time.Now(), "http", 6060)
+	store := mdata.NewMockStore()
+	store.Drop = true
+
+	mdata.SetSingleAgg(conf.Avg, conf.Min, conf.Max)
+	mdata.SetSingleSchema(conf.MustParseRetentions("10s:1h:10min:10:true,60s:1d:1h:2:true"))
+
+	metrics := mdata.NewAggMetrics(store, &cache.MockCache{}, false, nil, 0, 0, 0)
+	srv, _ := NewServer()
+	srv.BindBackendStore(store)
+	srv.BindMemoryStore(metrics)
+
+	id := test.GetMKey(1)
+	metric := metrics.GetOrCreate(id, 0, 0, 10)
+	// values go up and down within each minute, so avg, min and max all differ.
+	for ts := uint32(10); ts <= 1200; ts += 10 {
+		metric.Add(ts, float64(ts%60+5))
+	}
+	rets := mdata.Schemas.Get(0).Retentions.Rets
+
+	cases := []struct {
+		archive   int
+		normalize uint32
+		cons      consolidation.Consolidator
+		expCons   consolidation.Consolidator
+		expVal    float64
+	}{
+		{0, 0, consolidation.Max, consolidation.None, 5},
+		{0, 60, consolidation.Max, consolidation.Max, 55},
+		{1, 0, consolidation.Max, consolidation.Max, 55},
+		{1, 0, consolidation.Min, consolidation.Min, 5},
+		{1, 0, consolidation.Avg, consolidation.Avg, 30},
+		{1, 120, consolidation.Max, consolidation.Max, 55},
+	}
+	for i, c := range cases {
+		req := models.NewReq(id, "", "", 600, 900, 1000, 10, 0, c.cons, 0, cluster.Manager.ThisNode(), 0, 0)
+		req.Plan(c.archive, rets[c.archive])
+		if c.normalize > 0 {
+			req.PlanNormalization(c.normalize)
+		}
+		out, _, err := srv.getTarget(test.NewContext(), &models.StorageStats{}, req)
+		if err != nil {
+			t.Fatalf("case %d: unexpected error %s", i, err)
+		}
+		if len(out.Meta) != 1 {
+			t.Fatalf("case %d: expected 1 meta section, got %d", i, len(out.Meta))
+		}
+		if out.Meta[0].ConsolidatorNormFetch != c.expCons {
+			t.Errorf("case %d: expected meta consolidator %s, got %s", i, c.expCons, out.Meta[0].ConsolidatorNormFetch)
+		}
+		if out.Meta[0].Node != cluster.Manager.ThisNode().GetName() {
+			t.Errorf("case %d: expected meta node %q, got %q", i, cluster.Manager.ThisNode().GetName(), out.Meta[0].Node)
+		}
+		if len(out.Datapoints) == 0 {
+			t.Fatalf("case %d: expected datapoints, got none", i)
+		}
+		if out.Datapoints[0].Val != c.expVal {
+			t.Errorf("case %d: expected first value %f, got %f (points: %v)", i, c.expVal, out.Datapoints[0].Val, out.Datapoints)
+		}
+		// the step reported to clients must be the interval after normalization, not the archive interval
+		if out.Interval != req.OutInterval || out.Datapoints[1].Ts-out.Datapoints[0].Ts != req.OutInterval {
+			t.Errorf("case %d: expected interval %d, got %d (points: %v)", i, req.OutInterval, out.Interval, out.Datapoints)
+		}
+		buf, _ := models.SeriesByTarget([]models.Series{out}).MarshalJSONFast(nil)
+		if expStep := fmt.Sprintf(`"step":%d,`, req.OutInterval); !strings.Contains(string(buf), expStep) {
+			t.Errorf("case %d: expected json output to contain %s, got %s", i, expStep, buf)
+		}
+	}
+}
+
 var dummy []schema.Point
 
 func BenchmarkFix1M(b *testing.B) {
@@ -941,3 +1202,247 @@ func BenchmarkDivide1M(b *testing.B) {
 	}
 	b.SetBytes(int64(l * 12))
 }
+
+// TestGetTargetsIncludeRaw verifies that a request with IncludeRaw returns, next to its normalized series,
+// a copy of the points as read from the archive
+func TestGetTargetsIncludeRaw(t *testing.T) {
+	cluster.Init("default", "test", time.Now(), "http", 6060)
+	store := mdata.NewMockStore()
+	store.Drop = true
+
+	mdata.SetSingleAgg(conf.Avg, conf.Min, conf.Max)
+	mdata.SetSingleSchema(conf.MustParseRetentions("10s:1h:10min:10:true,60s:1d:1h:2:true"))
+
+	metrics := mdata.NewAggMetrics(store, &cache.MockCache{}, false, nil, 0, 0, 0)
+	srv, _ := NewServer()
+	srv.BindBackendStore(store)
+	srv.BindMemoryStore(metrics)
+	getTargetsConcurrency = 1
+	defer func() { getTargetsConcurrency = 0 }()
+
+	id := test.GetMKey(1)
+	metric := metrics.GetOrCreate(id, 0, 0, 10)
+	for ts := uint32(10); ts <= 1200; ts += 10 {
+		metric.Add(ts, float64(ts))
+	}
+	rets := mdata.Schemas.Get(0).Retentions.Rets
+
+	// the request reads raw data, and gets normalized to 60s
+	req := models.NewReq(id, "a", "a", 600, 900, 1000, 10, 0, consolidation.Avg, 0, cluster.Manager.ThisNode(), 0, 0)
+	req.Plan(0, rets[0])
+	req.PlanNormalization(60)
+	req.IncludeRaw = true
+
+	out, err := srv.getTargets(test.NewContext(), &models.StorageStats{}, []models.Req{req})
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	normalized, raw, err := splitRawSeries(out)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if len(normalized) != 1 || len(raw) != 1 {
+		t.Fatalf("expected 1 normalized and 1 raw series, got %d and %d", len(normalized), len(raw))
+	}
+
+	cases := []struct {
+		name        string
+		series      models.Series
+		expTarget   string
+		expInterval uint32
+	}{
+		{"normalized", normalized[0], "a", 60},
+		{"raw", raw[0], "a" + rawSeriesSuffix, 10},
+	}
+	for _, c := range cases {
+		if c.series.Target != c.expTarget {
+			t.Errorf("%s: expected target %q, got %q", c.name, c.expTarget, c.series.Target)
+		}
+		if c.series.Interval != c.expInterval {
+			t.Errorf("%s: expected interval %d, got %d", c.name, c.expInterval, c.series.Interval)
+		}
+		if len(c.series.Datapoints) < 2 || c.series.Datapoints[1].Ts-c.series.Datapoints[0].Ts != c.expInterval {
+			t.Errorf("%s: expected points at interval %d, got %v", c.name, c.expInterval, c.series.Datapoints)
+		}
+	}
+	// the raw points are those that were consolidated into the normalized ones, within the requested range
+	points := raw[0].Datapoints
+	lastTs := normalized[0].Datapoints[len(normalized[0].Datapoints)-1].Ts
+	if len(points) == 0 || points[0].Ts != 600 || points[len(points)-1].Ts != lastTs {
+		t.Errorf("raw: expected points from 600 through %d, got %v", lastTs, points)
+	}
+}
+
+// TestGetRawTimestampTargets ingests points with jittered timestamps, and verifies that they are returned at the timestamps
+// they were stored with, from the raw archive, whereas they are normally aligned to the interval of the archive read.
+func TestGetRawTimestampTargets(t *testing.T) {
+	cluster.Init("default", "test", time.Now(), "http", 6060)
+	store := mdata.NewMockStore()
+	store.Drop = true
+
+	mdata.SetSingleAgg(conf.Avg, conf.Min, conf.Max)
+	mdata.SetSingleSchema(conf.MustParseRetentions("10s:1h:10min:10:true,60s:1d:1h:2:true"))
+
+	metrics := mdata.NewAggMetrics(store, &cache.MockCache{}, false, nil, 0, 0, 0)
+	srv, _ := NewServer()
+	srv.BindBackendStore(store)
+	srv.BindMemoryStore(metrics)
+	getTargetsConcurrency = 1
+	defer func() { getTargetsConcurrency = 0 }()
+
+	id := test.GetMKey(1)
+	metric := metrics.GetOrCreate(id, 0, 0, 10)
+	var exp []schema.Point
+	for ts := uint32(10); ts <= 1200; ts += 10 {
+		jittered := ts - 10 + 1 + ts/10%7 // anywhere within the interval of the point
+		metric.Add(jittered, float64(ts))
+		if jittered >= 600 && jittered < 900 {
+			exp = append(exp, schema.Point{Val: float64(ts), Ts: jittered})
+		}
+	}
+	rets := mdata.Schemas.Get(0).Retentions.Rets
+
+	// the request reads the 60s rollup
+	req := models.NewReq(id, "a", "a", 600, 900, 1000, 10, 0, consolidation.Avg, 0, cluster.Manager.ThisNode(), 0, 0)
+	req.Plan(1, rets[1])
+
+	aligned, err := srv.getTargets(test.NewContext(), &models.StorageStats{}, []models.Req{req})
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	raw, err := srv.getRawTimestampTargets(test.NewContext(), &models.StorageStats{}, []models.Req{req})
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if len(aligned) != 1 || len(raw) != 1 {
+		t.Fatalf("expected 1 aligned and 1 raw series, got %d and %d", len(aligned), len(raw))
+	}
+	if len(aligned[0].Datapoints) == 0 {
+		t.Fatalf("aligned: expected points, got none")
+	}
+	for _, p := range aligned[0].Datapoints {
+		if p.Ts%60 != 0 {
+			t.Fatalf("aligned: expected all points at a multiple of 60, got %v", aligned[0].Datapoints)
+		}
+	}
+	if raw[0].Interval != 10 || raw[0].Meta[0].Archive != 0 {
+		t.Errorf("raw: expected the raw archive at interval 10, got archive %d at interval %d", raw[0].Meta[0].Archive, raw[0].Interval)
+	}
+	if !reflect.DeepEqual(raw[0].Datapoints, exp) {
+		t.Errorf("raw: expected points %v, got %v", exp, raw[0].Datapoints)
+	}
+}
+
+// TestGetTargetsClampTo verifies that a request planned with plan-clamp-to still returns the requested window,
+// with null points beyond now
+func TestGetTargetsClampTo(t *testing.T) {
+	cluster.Init("default", "test", time.Now(), "http", 6060)
+	store := mdata.NewMockStore()
+	store.Drop = true
+
+	mdata.SetSingleAgg(conf.Avg, conf.Min, conf.Max)
+	mdata.SetSingleSchema(conf.MustParseRetentions("10s:1d,60s:2d"))
+
+	metrics := mdata.NewAggMetrics(store, &cache.MockCache{}, false, nil, 0, 0, 0)
+	srv, _ := NewServer()
+	srv.BindBackendStore(store)
+	srv.BindMemoryStore(metrics)
+	getTargetsConcurrency = 1
+	planClampTo = true
+	defer func() {
+		getTargetsConcurrency = 0
+		planClampTo = false
+	}()
+
+	id := test.GetMKey(1)
+	metric := metrics.GetOrCreate(id, 0, 0, 10)
+	for ts := uint32(10); ts <= 1200; ts += 10 {
+		metric.Add(ts, float64(ts))
+	}
+
+	// now is 1200, but the request runs until 1800. without clamping, its 120 points would exceed the soft limit
+	reqs := NewReqMap()
+	reqs.Add(models.NewReq(id, "a", "a", 600, 1800, 0, 10, 0, consolidation.Avg, 0, cluster.Manager.ThisNode(), 0, 0))
+	rp, err := planRequests(1200, 600, 1800, reqs, 0, false, 0, false, 100, 0, 0)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	out, err := srv.getTargets(test.NewContext(), &models.StorageStats{}, rp.List())
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if len(out) != 1 || len(out[0].Datapoints) != 120 {
+		t.Fatalf("expected 1 series with 120 points, got %v", out)
+	}
+	if out[0].Interval != 10 {
+		t.Errorf("expected the raw archive at interval 10, got interval %d", out[0].Interval)
+	}
+	for i, p := range out[0].Datapoints {
+		expTs := 600 + 10*uint32(i)
+		if p.Ts != expTs {
+			t.Fatalf("point %d: expected ts %d, got %d", i, expTs, p.Ts)
+		}
+		if p.Ts <= 1200 && p.Val != float64(p.Ts) {
+			t.Errorf("point %d: expected value %d, got %v", i, p.Ts, p.Val)
+		}
+		if p.Ts > 1200 && !math.IsNaN(p.Val) {
+			t.Errorf("point %d: expected a null beyond now, got %v", i, p.Val)
+		}
+	}
+}
+
+func TestGetTargetsRemoteProvenance(t *testing.T) {
+	manager := cluster.InitMock()
+	manager.Peers = append(manager.Peers, cluster.NewMockNode(true, "query", []int32{0}, nil))
+
+	// each shard's node reports the archive it read, and itself as the node that fetched the series
+	remoteReqs := make(map[string][]models.Req)
+	for i, name := range []string{"shard-a", "shard-b"} {
+		resp := models.GetDataRespV1{
+			Series: []models.Series{
+				{
+					Target: name + ".series",
+					Meta: []models.SeriesMetaProperties{
+						{Archive: uint8(i), ArchInterval: 10 * uint32(i+1), Node: name, Count: 1},
+					},
+				},
+			},
+		}
+		buf, err := resp.MarshalMsg(nil)
+		if err != nil {
+			t.Fatalf("failed to marshal response of %s: %s", name, err)
+		}
+		node := cluster.NewMockNode(false, name, []int32{int32(i + 1)}, buf)
+		node.SetReady(true)
+		manager.Peers = append(manager.Peers, node)
+		req := models.NewReq(test.GetMKey(i), name+".series", name+".series", 0, 600, 1000, 10, 0, consolidation.Avg, 0, node, 0, 0)
+		remoteReqs[name] = []models.Req{req}
+	}
+
+	srv, _ := NewServer()
+	out, err := srv.getTargetsRemote(test.NewContext(), &models.StorageStats{}, remoteReqs)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if len(out) != 2 {
+		t.Fatalf("expected 2 series, got %d", len(out))
+	}
+	sort.Sort(models.SeriesByTarget(out))
+	for i, name := range []string{"shard-a", "shard-b"} {
+		if len(out[i].Meta) != 1 {
+			t.Fatalf("series %d: expected 1 meta section, got %d", i, len(out[i].Meta))
+		}
+		meta := out[i].Meta[0]
+		if meta.Node != name || meta.Archive != uint8(i) {
+			t.Errorf("series %d: expected node %q and archive %d, got node %q and archive %d", i, name, i, meta.Node, meta.Archive)
+		}
+	}
+
+	// the node is only reported when asked for
+	for _, provenance := range []bool{false, true} {
+		buf, _ := models.ResponseWithMeta{Series: out, Node: provenance}.MarshalJSONFast(nil)
+		if got := strings.Contains(string(buf), `"node":"shard-b"`); got != provenance {
+			t.Errorf("provenance %t: expected node in output %t, got %t: %s", provenance, provenance, got, buf)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+// +build gofuzz
+
+package api
+
+import (
+	"encoding/binary"
+	"fmt"
+	"regexp"
+	"sort"
+
+	"github.com/grafana/metrictank/api/models"
+	"github.com/grafana/metrictank/conf"
+	"github.com/grafana/metrictank/mdata"
+)
+
+// Fuzz exercises the interval-combination search of the query planner.
+// the input is decoded into min/max bounds followed by a set of interval lists,
+// each list becomes a schema (with one retention per interval) used by one request.
+func Fuzz(data []byte) int {
+	if len(data) < 9 {
+		return 0
+	}
+	minInterval := binary.LittleEndian.Uint32(data)
+	maxInterval := binary.LittleEndian.Uint32(data[4:])
+	numLists := int(data[8] % 5)
+	data = data[9:]
+
+	var intervalsSet [][]uint32
+	for i := 0; i < numLists && len(data) > 0; i++ {
+		num := int(data[0] % 5)
+		data = data[1:]
+		var intervals []uint32
+		for j := 0; j < num && len(data) >= 4; j++ {
+			intervals = append(intervals, binary.LittleEndian.Uint32(data))
+			data = data[4:]
+		}
+		intervalsSet = append(intervalsSet, intervals)
+	}
+
+	// the raw set may be anything, including empty lists and zero intervals
+	highest := getHighestResFromSetMatching(0, 1, minInterval, maxInterval, intervalsSet)
+	if highest != 0 {
+		checkAchievable("getHighestResFromSetMatching", highest, minInterval, maxInterval, intervalsSet)
+	}
+
+	// to get the lowest res, the intervals must be backed by actual schemas
+	var schemas []conf.Schema
+	var rbr ReqsByRet
+	for _, intervals := range intervalsSet {
+		rets := toRetentions(intervals)
+		if len(rets) == 0 {
+			return 1
+		}
+		schemas = append(schemas, conf.Schema{
+			Pattern:    regexp.MustCompile(".*"),
+			Retentions: conf.BuildFromRetentions(rets...),
+		})
+		id := len(rbr)
+		for range rets {
+			rbr = append(rbr, nil)
+		}
+		// note: schemas are expanded, one entry per retention
+		rbr[id] = []models.Req{{SchemaId: uint16(id), RawInterval: uint32(rets[0].SecondsPerPoint)}}
+	}
+	mdata.Schemas = conf.NewSchemas(schemas)
+	validIntervalsSet, ok := getValidIntervalsSet(&mdata.Schemas, rbr, 0, 1)
+	if !ok {
+		return 1
+	}
+	lowest := getLowestResFromSetMatching(&mdata.Schemas, rbr, 0, 1, minInterval, maxInterval, validIntervalsSet)
+	if lowest != 0 {
+		checkAchievable("getLowestResFromSetMatching", lowest, 0, ^uint32(0), validIntervalsSet)
+	}
+	return 1
+}
+
+// toRetentions returns retentions for the given list of intervals, ignoring 0 and duplicates
+func toRetentions(intervals []uint32) []conf.Retention {
+	seen := make(map[uint32]struct{})
+	var rets []conf.Retention
+	for _, interval := range intervals {
+		if _, ok := seen[interval]; ok || interval == 0 {
+			continue
+		}
+		seen[interval] = struct{}{}
+		rets = append(rets, conf.NewRetentionMT(int(interval), interval, 0, 0, 0))
+	}
+	sort.Slice(rets, func(i, j int) bool { return rets[i].SecondsPerPoint < rets[j].SecondsPerPoint })
+	return rets
+}
+
+// checkAchievable panics if interval is out of bounds or can't be delivered by a read from each of the lists of intervals
+func checkAchievable(fn string, interval, minInterval, maxInterval uint32, intervalsSet [][]uint32) {
+	if interval < minInterval || interval > maxInterval {
+		panic(fmt.Sprintf("%s returned interval %d out of bounds %d-%d for set %v", fn, interval, minInterval, maxInterval, intervalsSet))
+	}
+	for _, intervals := range intervalsSet {
+		var ok bool
+		for _, v := range intervals {
+			if v != 0 && interval%v == 0 {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			panic(fmt.Sprintf("%s returned interval %d not achievable for set %v", fn, interval, intervalsSet))
+		}
+	}
+}
@@ -50,10 +50,32 @@ var (
 	// metric api.request.render.targets is the number of targets a /render request is handling.
 	reqRenderTargetCount = stats.NewMeter32("api.request.render.targets", false)
 
+	// metric api.request.render.mdp_clamped is the number of render requests of which the maxDataPoints was clamped to max-effective-mdp
+	reqRenderMDPClamped = stats.NewCounter32("api.request.render.mdp_clamped")
+
+	// metric api.request.render.mdp_overshoot is the points returned by series that return more points than maxDataPoints, as a percentage of maxDataPoints
+	reqRenderMDPOvershoot = stats.NewMeter32("api.request.render.mdp_overshoot", false)
+
+	// metric api.request.render.mdp_overshoot_capped is the number of series that got runtime consolidated due to mdp-overshoot-cap
+	reqRenderMDPOvershootCapped = stats.NewCounter32("api.request.render.mdp_overshoot_capped")
+
+	// metric api.request.render.response_bytes_truncated is the number of render responses of which series were omitted due to max-response-bytes
+	reqRenderResponseBytesTruncated = stats.NewCounter32("api.request.render.response_bytes_truncated")
+
 	// metric plan.run is the time spent running the plan for a request (function processing of all targets and runtime consolidation)
 	planRunDuration = stats.NewLatencyHistogram15s32("plan.run")
 )
 
+// clampMDP caps the given maxDataPoints to max-effective-mdp, if enabled.
+// note that 0 (no runtime consolidation) is left alone, as it is also used for requests coming from graphite.
+func clampMDP(mdp uint32) uint32 {
+	if maxEffectiveMDP == 0 || mdp <= uint32(maxEffectiveMDP) {
+		return mdp
+	}
+	reqRenderMDPClamped.Inc()
+	return uint32(maxEffectiveMDP)
+}
+
 // map of consolidation methods and the ordered list of rollup aggregations that should
 // be used. e.g. if a user requests 'min' but all we have is 'avg' and 'sum' then use 'avg'.
 var rollupPreference = map[consolidation.Consolidator][]consolidation.Consolidator{
@@ -227,11 +249,54 @@ func (s *Server) renderMetrics(ctx *middleware.Context, request models.GraphiteR
 	}
 
 	stable := request.Process == "stable"
-	mdp := request.MaxDataPoints
+	mdp := clampMDP(request.MaxDataPoints)
+	var noMDPReason string
 	if request.NoProxy {
 		// if this request is coming from graphite, we should not do runtime consolidation
 		// as graphite needs high-res data to perform its processing.
 		mdp = 0
+		noMDPReason = expr.MDPReasonGraphiteOrigin
+	}
+	var interval uint32
+	if request.Interval != "" {
+		interval, err = dur.ParseNDuration(request.Interval)
+		if err != nil {
+			response.Write(ctx, response.NewError(http.StatusBadRequest, fmt.Sprintf("could not parse interval %q: %s", request.Interval, err.Error())))
+			return
+		}
+		// the client asked for an exact resolution: neither MDP-optimization nor runtime consolidation should alter it
+		mdp = 0
+		noMDPReason = expr.MDPReasonInterval
+	}
+
+	if request.Order == "desc" && (request.Format == "pickle" || request.Format == "msgpack") {
+		// these formats only have a start and step, from which consumers derive the timestamps of the points in ascending order
+		response.Write(ctx, response.NewError(http.StatusBadRequest, fmt.Sprintf("order=desc is not supported for format %s", request.Format)))
+		return
+	}
+	if request.EqualizePoints < 0 {
+		response.Write(ctx, response.NewError(http.StatusBadRequest, "equalizePoints must be >= 0"))
+		return
+	}
+	if request.IgnoreSoftLimit && !mayIgnoreSoftLimit(ctx.OrgId) {
+		response.Write(ctx, response.NewError(http.StatusForbidden, "ignoreSoftLimit is not allowed for this org"))
+		return
+	}
+	if request.RawTimestamps {
+		if !mayRequestRawTimestamps(ctx.OrgId) {
+			response.Write(ctx, response.NewError(http.StatusForbidden, "rawTimestamps is not allowed for this org"))
+			return
+		}
+		if request.Align == "strict" {
+			response.Write(ctx, response.NewError(http.StatusBadRequest, "rawTimestamps can't be combined with align=strict"))
+			return
+		}
+	}
+
+	pngroups, err := parsePNGroups(request.PNGroups)
+	if err != nil {
+		response.Write(ctx, response.NewError(http.StatusBadRequest, err.Error()))
+		return
 	}
 
 	opts, err := optimizations.ApplyUserPrefs(request.Optimizations)
@@ -254,10 +319,27 @@ func (s *Server) renderMetrics(ctx *middleware.Context, request models.GraphiteR
 		ctx.Error(err.HTTPStatusCode(), err.Error())
 		return
 	}
+	plan.TargetDataPoints = request.TargetDataPoints
+	plan.MaxPointsFetch = request.MaxPointsFetch
+	plan.Cheapest = request.Cheapest
+	plan.AlignStrict = request.Align == "strict"
+	plan.Interval = interval
+	plan.IgnoreSoftLimit = request.IgnoreSoftLimit
+	plan.EqualizePoints = request.EqualizePoints
+	plan.ValidateOnly = request.ValidateOnly
+	plan.MaxIntervals = request.MaxIntervals
+	plan.PlanOnly = request.PlanOnly
+	plan.MetaOnly = request.MetaOnly
+	plan.RawTimestamps = request.RawTimestamps
+	plan.Counters = request.Counters
+	plan.PNGroups = pngroups
+	if noMDPReason != "" {
+		plan.SetNoMDPReason(noMDPReason)
+	}
 
 	execCtx, execSpan := tracing.NewSpan(ctx.Req.Context(), s.Tracer, "executePlan")
 	defer execSpan.Finish()
-	out, meta, err := s.executePlan(execCtx, ctx.OrgId, plan)
+	out, meta, err := s.executePlan(execCtx, ctx.OrgId, plan, request.IncludeRaw)
 	if err != nil {
 		err := response.WrapError(err)
 		if err.HTTPStatusCode() == http.StatusBadRequest && !request.NoProxy {
@@ -282,6 +364,48 @@ func (s *Server) renderMetrics(ctx *middleware.Context, request models.GraphiteR
 	default:
 	}
 
+	if request.ValidateOnly {
+		unsatisfiable := meta.Unsatisfiable
+		if unsatisfiable == nil {
+			unsatisfiable = []models.UnsatisfiableTarget{}
+		}
+		response.Write(ctx, response.NewJson(http.StatusOK, models.ValidateResponse{Valid: len(unsatisfiable) == 0, Unsatisfiable: unsatisfiable}, ""))
+		return
+	}
+	if request.PlanOnly {
+		response.Write(ctx, response.NewJson(http.StatusOK, meta.Planned, ""))
+		return
+	}
+	if request.MetaOnly {
+		response.Write(ctx, response.NewJson(http.StatusOK, meta.MetaOnly, ""))
+		return
+	}
+
+	if plan.AlignStrict {
+		if err := alignSeries(out, fromUnix, toUnix); err != nil {
+			response.Write(ctx, response.NewError(http.StatusUnprocessableEntity, err.Error()))
+			return
+		}
+	}
+
+	var warning string
+	out, warning = truncateSeries(out, request.MaxSeries)
+	if warning != "" {
+		span.SetTag("truncated", true)
+		meta.Warnings = append(meta.Warnings, warning)
+	}
+	out, warning = truncateSeriesBytes(out, responseBytesLimit(request.MaxResponseBytes))
+	if warning != "" {
+		span.SetTag("truncated", true)
+		meta.Warnings = append(meta.Warnings, warning)
+		// most formats have no metadata, so the warning is also reported in a header
+		ctx.Resp.Header().Add("Warning", fmt.Sprintf("199 metrictank %q", warning))
+	}
+
+	if request.Order == "desc" {
+		reverseSeries(out)
+	}
+
 	noDataPoints := true
 	for _, o := range out {
 		if len(o.Datapoints) != 0 {
@@ -293,18 +417,32 @@ func (s *Server) renderMetrics(ctx *middleware.Context, request models.GraphiteR
 		span.SetTag("nodatapoints", true)
 	}
 
+	code := renderStatus(ctx.Resp, meta.Degraded)
 	switch request.Format {
 	case "msgp":
-		response.Write(ctx, response.NewMsgp(200, models.SeriesByTarget(out)))
+		response.Write(ctx, response.NewMsgp(code, models.SeriesByTarget(out)))
 	case "msgpack":
-		response.Write(ctx, response.NewMsgpack(200, models.SeriesByTarget(out).ForGraphite("msgpack")))
+		response.Write(ctx, response.NewMsgpack(code, models.SeriesByTarget(out).ForGraphite("msgpack")))
 	case "pickle":
-		response.Write(ctx, response.NewPickle(200, models.SeriesByTarget(out)))
+		response.Write(ctx, response.NewPickle(code, models.SeriesByTarget(out)))
+	case "ndjson":
+		// ctx.Resp rather than ctx, so that each line gets flushed
+		response.Write(ctx.Resp, response.NewNDJson(code, models.SeriesByTarget(out)))
+	case "rle":
+		response.Write(ctx, response.NewFastJson(code, models.SeriesRLE(out)))
 	default:
-		if request.Meta {
-			response.Write(ctx, response.NewFastJson(200, models.ResponseWithMeta{Series: models.SeriesByTarget(out), Meta: meta}))
+		hash := request.Hash || len(request.KnownHashes) != 0
+		if request.Meta || request.Trace || request.Coverage || request.Grouping || request.Provenance || hash {
+			var known map[string]struct{}
+			if len(request.KnownHashes) != 0 {
+				known = make(map[string]struct{}, len(request.KnownHashes))
+				for _, h := range request.KnownHashes {
+					known[h] = struct{}{}
+				}
+			}
+			response.Write(ctx, response.NewFastJson(code, models.ResponseWithMeta{Series: models.SeriesByTarget(out), Meta: meta, Trace: request.Trace, Coverage: request.Coverage, Grouping: request.Grouping, Node: request.Provenance, Hash: hash, KnownHashes: known}))
 		} else {
-			response.Write(ctx, response.NewFastJson(200, models.SeriesByTarget(out)))
+			response.Write(ctx, response.NewFastJson(code, models.SeriesByTarget(out)))
 		}
 	}
 	plan.Clean()
@@ -677,8 +815,11 @@ func (s *Server) metricsDeleteRemote(ctx context.Context, orgId uint32, query st
 // executePlan looks up the needed data, retrieves it, and then invokes the processing
 // note if you do something like sum(foo.*) and all of those metrics happen to be on another node,
 // we will collect all the individual series from the peer, and then sum here. that could be optimized
-func (s *Server) executePlan(ctx context.Context, orgId uint32, plan expr.Plan) ([]models.Series, models.RenderMeta, error) {
+// if includeRaw is set, the fetched series are also returned as they were read from their archives, see getTarget
+func (s *Server) executePlan(ctx context.Context, orgId uint32, plan expr.Plan, includeRaw bool) ([]models.Series, models.RenderMeta, error) {
 	var meta models.RenderMeta
+	// all planning steps must agree on which archives cover the requested range, so they use the same now
+	now := uint32(time.Now().Unix())
 
 	minFrom := uint32(math.MaxUint32)
 	var maxTo uint32
@@ -715,6 +856,13 @@ func (s *Server) executePlan(ctx context.Context, orgId uint32, plan expr.Plan)
 		minFrom = util.Min(minFrom, r.From)
 		maxTo = util.Max(maxTo, r.To)
 
+		var counter bool
+		for _, patt := range plan.Counters {
+			if patt == r.Query {
+				counter = true
+			}
+		}
+
 		for _, s := range series {
 			for _, metric := range s.Series {
 				for _, archive := range metric.Defs {
@@ -734,10 +882,13 @@ func (s *Server) executePlan(ctx context.Context, orgId uint32, plan expr.Plan)
 						// requested by the user.  e.g. if the user requested 'min' but we only have 'avg' and 'sum' rollups,
 						// use 'avg'.
 						cons = closestAggMethod(consReq, mdata.Aggregations.Get(archive.AggId).AggregationMethod)
+						// if that is not the requested function, guardRollups reads the raw data instead, or warns if it can't
 					}
 
 					newReq := r.ToModel()
 					newReq.Init(archive, cons, s.Node)
+					newReq.Counter = counter
+					newReq.DeclaredPNGroup = plan.PNGroups[r.Query]
 					reqs.Add(newReq)
 				}
 
@@ -760,15 +911,53 @@ func (s *Server) executePlan(ctx context.Context, orgId uint32, plan expr.Plan)
 
 	meta.RenderStats.SeriesFetch = reqs.cnt
 
+	if plan.ValidateOnly {
+		meta.Unsatisfiable = validateRequests(now, snapFrom(minFrom), maxTo, reqs, plan.MaxDataPoints, plan.TargetDataPoints, plan.Cheapest, getMinFetchInterval(orgId))
+		return nil, meta, nil
+	}
+
 	// note: if 1 series has a movingAvg that requires a long time range extension, it may push other reqs into another archive. can be optimized later
 	var err error
 	var rp *ReqsPlan
-	rp, err = planRequests(uint32(time.Now().Unix()), minFrom, maxTo, reqs, plan.MaxDataPoints, maxPointsPerReqSoft, maxPointsPerReqHard)
+	mpprHard := hardLimit(hasLookback(plan.Reqs, plan.From))
+	rp, err = planRequests(now, snapFrom(minFrom), maxTo, reqs, plan.MaxDataPoints, plan.TargetDataPoints, plan.MaxPointsFetch, plan.Cheapest, softLimit(plan.IgnoreSoftLimit), mpprHard, getMinFetchInterval(orgId))
 	if err != nil {
 		return nil, meta, err
 	}
+	if plan.EqualizePoints > 0 {
+		equalizePoints(now, snapFrom(minFrom), maxTo, plan.MaxDataPoints, plan.EqualizePoints, rp)
+	}
+	if plan.MaxIntervals > 0 {
+		meta.Intervals = limitIntervals(now, snapFrom(minFrom), int(plan.MaxIntervals), rp)
+	}
+	if plan.Interval > 0 {
+		if err := planToInterval(now, snapFrom(minFrom), plan.Interval, rp, mpprHard); err != nil {
+			return nil, meta, err
+		}
+	}
+	if plan.AlignStrict && !rp.NormalizeAll() {
+		return nil, meta, errAlignStrictInterval
+	}
+	if plan.PlanOnly {
+		meta.Planned = planResponse(rp.List(), plan.MaxDataPoints, plan.TargetDataPoints)
+		meta.Planned.WarmChunks, meta.Planned.Chunks = rp.WarmChunks(now, planWarmWindow)
+		if meta.Planned.Chunks > 0 {
+			meta.Planned.CacheHitRatio = float64(meta.Planned.WarmChunks) / float64(meta.Planned.Chunks)
+		}
+		return nil, meta, nil
+	}
+	if plan.MetaOnly {
+		meta.MetaOnly = metaOnlyResponse(rp.List(), plan.MaxDataPoints, plan.TargetDataPoints)
+		return nil, meta, nil
+	}
+	if err := chargePlan(*rp, plan.MaxDataPoints); err != nil {
+		return nil, meta, err
+	}
 	meta.RenderStats.PointsFetch = rp.PointsFetch()
 	meta.RenderStats.PointsReturn = rp.PointsReturn(plan.MaxDataPoints)
+	meta.RenderStats.PNGroupsMerged = uint32(rp.MergedPNGroups())
+	meta.Warnings = append(meta.Warnings, rp.Warnings()...)
+	meta.Degraded = rp.Degraded()
 	reqsList := rp.List()
 
 	span := opentracing.SpanFromContext(ctx)
@@ -780,6 +969,17 @@ func (s *Server) executePlan(ctx context.Context, orgId uint32, plan expr.Plan)
 		log.Debugf("HTTP Render %s - arch:%d archI:%d outI:%d aggN: %d from %s", req, req.Archive, req.ArchInterval, req.OutInterval, req.AggNum, req.Node.GetName())
 	}
 
+	if plan.RawTimestamps {
+		out, err := s.getRawTimestampTargets(ctx, &meta.StorageStats, reqsList)
+		return out, meta, err
+	}
+
+	if includeRaw {
+		for i := range reqsList {
+			reqsList[i].IncludeRaw = true
+		}
+	}
+
 	a := time.Now()
 	out, err := s.getTargets(ctx, &meta.StorageStats, reqsList)
 	if err != nil {
@@ -790,9 +990,21 @@ func (s *Server) executePlan(ctx context.Context, orgId uint32, plan expr.Plan)
 	meta.RenderStats.GetTargetsDuration = b.Sub(a)
 	meta.StorageStats.Trace(span)
 
+	// the raw series are set aside, as the plan may modify or recycle the fetched ones
+	var raw []models.Series
+	if includeRaw {
+		out, raw, err = splitRawSeries(out)
+		if err != nil {
+			return nil, meta, err
+		}
+	}
+
 	dataMap := expr.NewDataMap()
 
-	out = mergeSeries(out, dataMap)
+	out, err = mergeSeries(out, dataMap)
+	if err != nil {
+		return nil, meta, err
+	}
 
 	if len(metaTagEnrichmentData) > 0 {
 		for i := range out {
@@ -822,13 +1034,97 @@ func (s *Server) executePlan(ctx context.Context, orgId uint32, plan expr.Plan)
 
 	preRun := time.Now()
 	out, err = plan.Run(dataMap)
+	if err == nil {
+		capMDPOvershoot(out, plan.MaxDataPoints, mdpOvershootCap)
+	}
 
 	meta.RenderStats.PlanRunDuration = time.Since(preRun)
 	planRunDuration.Value(meta.RenderStats.PlanRunDuration)
 	span.LogFields(traceLog.Float64("PlanRunMillis", durToMillis(meta.RenderStats.PlanRunDuration)))
+
+	if err == nil {
+		out = append(out, raw...)
+	}
 	return out, meta, err
 }
 
+// renderStatus returns the status code of a successful render response.
+// if signal-degraded is enabled and the response is coarser than requested, this is 206 Partial Content,
+// and a Warning header describing why is set.
+func renderStatus(w http.ResponseWriter, degraded string) int {
+	if !signalDegraded || degraded == "" {
+		return http.StatusOK
+	}
+	w.Header().Add("Warning", fmt.Sprintf("199 metrictank %q", "degraded response: "+degraded))
+	return http.StatusPartialContent
+}
+
+// parsePNGroups parses the values of the pngroup render parameter, each of which declares a PNGroup
+// as a semicolon separated list of the patterns of which the series are to be pre-normalized together.
+// it returns the PNGroup of each pattern.
+func parsePNGroups(values []string) (map[string]models.PNGroup, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+	pngroups := make(map[string]models.PNGroup)
+	for i, value := range values {
+		// real PNGroups are derived from pointers, and implicit ones (see auto-pngroup) count down from the top,
+		// so they will not collide with these
+		group := models.PNGroup(math.MaxUint64/2 - uint64(i))
+		for _, patt := range strings.Split(value, ";") {
+			patt = strings.TrimSpace(patt)
+			if patt == "" {
+				return nil, fmt.Errorf("pngroup %q has an empty pattern", value)
+			}
+			if _, ok := pngroups[patt]; ok {
+				return nil, fmt.Errorf("pattern %q is declared in multiple pngroups", patt)
+			}
+			pngroups[patt] = group
+		}
+	}
+	return pngroups, nil
+}
+
+// truncateSeries truncates the response to maxSeries series, if set.
+// it returns a warning if any series were dropped.
+func truncateSeries(out []models.Series, maxSeries uint32) ([]models.Series, string) {
+	if maxSeries == 0 || len(out) <= int(maxSeries) {
+		return out, ""
+	}
+	return out[:maxSeries], fmt.Sprintf("Response truncated to %d of %d series due to maxSeries", maxSeries, len(out))
+}
+
+// responseBytesLimit returns the limit of the size of the response: the requested one, unless max-response-bytes is lower
+func responseBytesLimit(requested uint32) int {
+	if requested != 0 && (maxResponseBytes <= 0 || int(requested) < maxResponseBytes) {
+		return int(requested)
+	}
+	return maxResponseBytes
+}
+
+// truncateSeriesBytes truncates the response to the series that fit within maxBytes, if set.
+// the size of each series is measured as it is encoded in the json format, without metadata.
+// it returns a warning that names how many series were omitted, if any.
+func truncateSeriesBytes(out []models.Series, maxBytes int) ([]models.Series, string) {
+	if maxBytes <= 0 {
+		return out, ""
+	}
+	size := 2 // the brackets around the list of series
+	var buf []byte
+	for i, s := range out {
+		buf, _ = s.MarshalJSONFast(buf[:0])
+		size += len(buf)
+		if i > 0 {
+			size++ // the comma that separates it from the previous series
+		}
+		if size > maxBytes {
+			reqRenderResponseBytesTruncated.Inc()
+			return out[:i], fmt.Sprintf("Response truncated to %d of %d series due to max-response-bytes: %d series omitted", i, len(out), len(out)-i)
+		}
+	}
+	return out, ""
+}
+
 // find the best consolidation method based on what was requested and what aggregations are available.
 func closestAggMethod(requested consolidation.Consolidator, available []conf.Method) consolidation.Consolidator {
 	// if there is only 1 consolidation method available, then that is all we can return.
@@ -2,9 +2,15 @@ package api
 
 import (
 	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/grafana/metrictank/api/models"
-	"github.com/grafana/metrictank/mdata"
+	"github.com/grafana/metrictank/conf"
+	"github.com/grafana/metrictank/schema"
+	"github.com/grafana/metrictank/util"
 )
 
 // ReqMap is a map of requests of data,
@@ -23,13 +29,18 @@ func NewReqMap() *ReqMap {
 }
 
 // Add adds a models.Req to the ReqMap
+// requests with a DeclaredPNGroup are added to that group, regardless of their own PNGroup
 func (r *ReqMap) Add(req models.Req) {
 	r.cnt++
-	if req.PNGroup == 0 {
+	group := req.PNGroup
+	if req.DeclaredPNGroup != 0 {
+		group = req.DeclaredPNGroup
+	}
+	if group == 0 {
 		r.single = append(r.single, req)
 		return
 	}
-	r.pngroups[req.PNGroup] = append(r.pngroups[req.PNGroup], req)
+	r.pngroups[group] = append(r.pngroups[group], req)
 }
 
 // Dump provides a human readable string representation of the ReqsMap
@@ -63,6 +74,58 @@ func (rbr ReqsByRet) OutInterval() uint32 {
 	return 0
 }
 
+// PointsFetch returns how many points the requests will fetch
+func (rbr ReqsByRet) PointsFetch() uint32 {
+	var cnt uint32
+	for _, reqs := range rbr {
+		cnt += pointsFetch(reqs)
+	}
+	return cnt
+}
+
+// HighestPointsFetch returns the highest amount of points any of the requests will fetch
+func (rbr ReqsByRet) HighestPointsFetch() uint32 {
+	var highest uint32
+	for _, reqs := range rbr {
+		highest = util.Max(highest, highestPointsFetch(reqs))
+	}
+	return highest
+}
+
+// highestPointsFetch returns the highest amount of points any of the given requests will fetch
+func highestPointsFetch(reqs []models.Req) uint32 {
+	var highest uint32
+	for _, req := range reqs {
+		highest = util.Max(highest, req.PointsFetch())
+	}
+	return highest
+}
+
+// pointsFetch returns how many points the given requests will fetch
+func pointsFetch(reqs []models.Req) uint32 {
+	var cnt uint32
+	for _, req := range reqs {
+		cnt += req.PointsFetch()
+	}
+	return cnt
+}
+
+// soleSchemaID returns the schema ID of the requests, if they all have the same one
+func (rbr ReqsByRet) soleSchemaID() (uint16, bool) {
+	var schemaID uint16
+	var found bool
+	for i, reqs := range rbr {
+		if len(reqs) == 0 {
+			continue
+		}
+		if found {
+			return 0, false
+		}
+		schemaID, found = uint16(i), true
+	}
+	return schemaID, found
+}
+
 func (rbr ReqsByRet) HasData() bool {
 	for _, reqs := range rbr {
 		if len(reqs) != 0 {
@@ -86,10 +149,10 @@ type GroupData struct {
 	mdpno  ReqsByRet // not MDP-optimizable reqs
 }
 
-func NewGroupData() GroupData {
+func NewGroupData(schemas *conf.Schemas) GroupData {
 	return GroupData{
-		mdpyes: make([][]models.Req, mdata.Schemas.Len()),
-		mdpno:  make([][]models.Req, mdata.Schemas.Len()),
+		mdpyes: make([][]models.Req, schemas.Len()),
+		mdpno:  make([][]models.Req, schemas.Len()),
 	}
 }
 
@@ -97,41 +160,215 @@ func (gd GroupData) Len() int {
 	return gd.mdpno.Len() + gd.mdpyes.Len()
 }
 
+// Add adds the request to the mdpyes or mdpno requests, depending on whether it is MDP-optimizable
+func (gd GroupData) Add(req models.Req) {
+	if req.MaxPoints > 0 {
+		gd.mdpyes[req.SchemaId] = append(gd.mdpyes[req.SchemaId], req)
+	} else {
+		gd.mdpno[req.SchemaId] = append(gd.mdpno[req.SchemaId], req)
+	}
+}
+
 // ReqsPlan holds requests that have been planned, broken down by PNGroup and MDP-optimizability
 type ReqsPlan struct {
 	pngroups map[models.PNGroup]GroupData
 	single   GroupData
 	cnt      uint32
+	schemas  *conf.Schemas // the snapshot of the schemas the plan was made with
+
+	// fetchWith marks PNGroups of which the fetches are scheduled together with those of another PNGroup, see mergePNGroups
+	fetchWith map[models.PNGroup]models.PNGroup
+
+	warnings []string // issues with the plan that should be reported to the user
+	degraded string   // if not empty, why the plan returns coarser data than requested
 }
 
-// NewReqsPlan generates a ReqsPlan based on the provided ReqMap.
-func NewReqsPlan(reqs ReqMap) ReqsPlan {
+// NewReqsPlan generates a ReqsPlan based on the provided ReqMap, for the given schemas.
+// If auto-pngroup is enabled, single requests are bundled into implicit PNGroups, see autoPNGroupKey.
+// note that this does not change the PNGroup of the requests, which is used to tie the data back to the request it came from.
+func NewReqsPlan(schemas *conf.Schemas, reqs ReqMap) ReqsPlan {
 	rp := ReqsPlan{
 		pngroups: make(map[models.PNGroup]GroupData),
-		single:   NewGroupData(),
+		single:   NewGroupData(schemas),
 		cnt:      reqs.cnt,
+		schemas:  schemas,
 	}
 	for group, groupReqs := range reqs.pngroups {
-		data := NewGroupData()
+		data := NewGroupData(schemas)
 		for _, req := range groupReqs {
-			if req.MaxPoints > 0 {
-				data.mdpyes[req.SchemaId] = append(data.mdpyes[req.SchemaId], req)
-			} else {
-				data.mdpno[req.SchemaId] = append(data.mdpno[req.SchemaId], req)
-			}
+			data.Add(req)
 		}
 		rp.pngroups[group] = data
 	}
+	// wildcards typically expand into many series of the same schema and interval,
+	// so we only resolve the key once for each combination
+	type source struct {
+		schemaId    uint16
+		rawInterval uint32
+	}
+	autoGroupsBySource := make(map[source]models.PNGroup)
+	autoGroups := make(map[string]models.PNGroup)
 	for _, req := range reqs.single {
-		if req.MaxPoints > 0 {
-			rp.single.mdpyes[req.SchemaId] = append(rp.single.mdpyes[req.SchemaId], req)
-		} else {
-			rp.single.mdpno[req.SchemaId] = append(rp.single.mdpno[req.SchemaId], req)
+		if !autoPNGroup {
+			rp.single.Add(req)
+			continue
 		}
+		src := source{req.SchemaId, req.RawInterval}
+		group, ok := autoGroupsBySource[src]
+		if !ok {
+			key := autoPNGroupKey(schemas, req)
+			group, ok = autoGroups[key]
+			if !ok {
+				// real PNGroups are derived from pointers, so they will not collide with these
+				group = models.PNGroup(math.MaxUint64 - uint64(len(autoGroups)))
+				autoGroups[key] = group
+				rp.pngroups[group] = NewGroupData(schemas)
+			}
+			autoGroupsBySource[src] = group
+		}
+		rp.pngroups[group].Add(req)
 	}
 	return rp
 }
 
+// autoPNGroupKey returns the key of the implicit PNGroup for the given single request.
+// requests of which the raw interval and the intervals of the rollups are the same can be normalized together
+// without having to resort to an interval that is not natively available to all of them.
+func autoPNGroupKey(schemas *conf.Schemas, req models.Req) string {
+	key := strconv.FormatUint(uint64(req.RawInterval), 10)
+	for _, ret := range schemas.Get(req.SchemaId).Retentions.Rets[1:] {
+		key += "," + strconv.Itoa(ret.SecondsPerPoint)
+	}
+	return key
+}
+
+// outInterval returns the interval that all requests of the group resolved to, or 0 if they resolved to different intervals
+func (gd GroupData) outInterval() uint32 {
+	var interval uint32
+	for _, rbr := range []ReqsByRet{gd.mdpyes, gd.mdpno} {
+		for _, reqs := range rbr {
+			for _, req := range reqs {
+				if interval != 0 && req.OutInterval != interval {
+					return 0
+				}
+				interval = req.OutInterval
+			}
+		}
+	}
+	return interval
+}
+
+// usesSchema returns whether the group has requests for the given schema
+func (gd GroupData) usesSchema(schemaID int) bool {
+	return len(gd.mdpyes[schemaID]) != 0 || len(gd.mdpno[schemaID]) != 0
+}
+
+// mergePNGroups marks PNGroups that resolved to the same interval, and of which the requests use disjoint schemas,
+// so that their fetches get scheduled together. The requests themselves are not modified.
+// It returns the amount of PNGroups that were merged into another one.
+func (rp *ReqsPlan) mergePNGroups() int {
+	groups := make([]models.PNGroup, 0, len(rp.pngroups))
+	for group := range rp.pngroups {
+		groups = append(groups, group)
+	}
+	// process the groups in a deterministic order, so the same plan always merges the same way
+	sort.Slice(groups, func(i, j int) bool { return groups[i] < groups[j] })
+
+	type merged struct {
+		leader  models.PNGroup
+		schemas map[int]struct{}
+	}
+	byInterval := make(map[uint32][]*merged)
+	rp.fetchWith = make(map[models.PNGroup]models.PNGroup)
+
+GROUPS:
+	for _, group := range groups {
+		data := rp.pngroups[group]
+		interval := data.outInterval()
+		if interval == 0 {
+			continue
+		}
+	CANDIDATES:
+		for _, m := range byInterval[interval] {
+			for schemaID := range m.schemas {
+				if data.usesSchema(schemaID) {
+					continue CANDIDATES
+				}
+			}
+			rp.fetchWith[group] = m.leader
+			addSchemas(m.schemas, data)
+			continue GROUPS
+		}
+		m := &merged{leader: group, schemas: make(map[int]struct{})}
+		addSchemas(m.schemas, data)
+		byInterval[interval] = append(byInterval[interval], m)
+	}
+	return len(rp.fetchWith)
+}
+
+// addSchemas adds the ids of the schemas used by the requests of the group to the set
+func addSchemas(set map[int]struct{}, gd GroupData) {
+	for schemaID := range gd.mdpyes {
+		if gd.usesSchema(schemaID) {
+			set[schemaID] = struct{}{}
+		}
+	}
+}
+
+// NormalizeAll normalizes all requests, across PNGroups and singles, to the LCM of their output intervals.
+// it returns false if there is no such interval (the LCM overflows), in which case the requests are left unchanged.
+func (rp ReqsPlan) NormalizeAll() bool {
+	rbrs := []ReqsByRet{rp.single.mdpyes, rp.single.mdpno}
+	for _, data := range rp.pngroups {
+		rbrs = append(rbrs, data.mdpyes, data.mdpno)
+	}
+	var intervals []uint32
+	seen := make(map[uint32]struct{})
+	for _, rbr := range rbrs {
+		for _, reqs := range rbr {
+			for _, req := range reqs {
+				if _, ok := seen[req.OutInterval]; !ok {
+					seen[req.OutInterval] = struct{}{}
+					intervals = append(intervals, req.OutInterval)
+				}
+			}
+		}
+	}
+	if len(intervals) <= 1 {
+		return true
+	}
+	interval := util.Lcm(intervals)
+	if interval == 0 {
+		return false
+	}
+	for _, rbr := range rbrs {
+		for _, reqs := range rbr {
+			for i := range reqs {
+				req := &reqs[i]
+				if req.OutInterval != interval {
+					req.PlanNormalization(interval)
+				}
+			}
+		}
+	}
+	return true
+}
+
+// Degraded returns why the plan returns coarser data than requested, if it does. otherwise it returns ""
+func (rp ReqsPlan) Degraded() string {
+	return rp.degraded
+}
+
+// Warnings returns the issues with the plan that should be reported to the user, if any
+func (rp ReqsPlan) Warnings() []string {
+	return rp.warnings
+}
+
+// MergedPNGroups returns the amount of PNGroups of which the fetches are scheduled together with those of another PNGroup
+func (rp ReqsPlan) MergedPNGroups() int {
+	return len(rp.fetchWith)
+}
+
 // PointsFetch returns how many points this plan will fetch when executed
 func (rp ReqsPlan) PointsFetch() uint32 {
 	var cnt uint32
@@ -196,7 +433,7 @@ func (rp ReqsPlan) Dump() string {
 }
 
 // PointsReturn estimates the amount of points that will be returned for this request
-// best effort: not aware of summarize(), aggregation functions, runtime normalization. but does account for runtime consolidation
+// best effort: not aware of aggregation functions, runtime normalization. but does account for summarize() and runtime consolidation
 func (rp ReqsPlan) PointsReturn(planMDP uint32) uint32 {
 	var cnt uint32
 	for _, rbr := range rp.single.mdpyes {
@@ -224,6 +461,77 @@ func (rp ReqsPlan) PointsReturn(planMDP uint32) uint32 {
 	return cnt
 }
 
+// ChunksFetch estimates the amount of chunks that need to be read, per archive (0 means raw data, 1 means first agg level, etc)
+// raw archives typically have much smaller chunkspans than rollups, so they require many more reads for the same span
+func (rp ReqsPlan) ChunksFetch() map[uint8]uint32 {
+	cnt := make(map[uint8]uint32)
+	for _, req := range rp.List() {
+		ret := rp.schemas.Get(req.SchemaId).Retentions.Rets[req.Archive]
+		cnt[req.Archive] += req.ChunksFetch(ret.ChunkSpan)
+	}
+	return cnt
+}
+
+// ReqChunks lists the chunks that a planned request will read
+type ReqChunks struct {
+	MKey      schema.MKey `json:"mkey"`
+	Target    string      `json:"target"`
+	Archive   uint8       `json:"archive"`
+	ChunkSpan uint32      `json:"chunkSpan"`
+	Starts    []uint32    `json:"starts"`
+}
+
+// Chunks enumerates, for each request, the start timestamps of the chunks covering its time range in its chosen archive.
+// this allows correlating a plan with the chunk cache hits and misses it causes.
+func (rp ReqsPlan) Chunks() []ReqChunks {
+	reqs := rp.List()
+	out := make([]ReqChunks, len(reqs))
+	for i, req := range reqs {
+		ret := rp.schemas.Get(req.SchemaId).Retentions.Rets[req.Archive]
+		out[i] = ReqChunks{
+			MKey:      req.MKey,
+			Target:    req.Target,
+			Archive:   req.Archive,
+			ChunkSpan: ret.ChunkSpan,
+			Starts:    req.Chunks(ret.ChunkSpan),
+		}
+	}
+	return out
+}
+
+// WarmChunks estimates how many of the chunks the plan reads (see Chunks) are warm, i.e. likely served from memory rather than the store.
+// this is a coarse heuristic: chunks of which the span ends within warmWindow before now are assumed to be warm, as recent data is
+// typically still in the ring buffer or in the chunk cache, and older chunks are assumed to be cold.
+func (rp ReqsPlan) WarmChunks(now, warmWindow uint32) (warm, total uint32) {
+	var warmFrom uint32
+	if now > warmWindow {
+		warmFrom = now - warmWindow
+	}
+	for _, rc := range rp.Chunks() {
+		total += uint32(len(rc.Starts))
+		for _, start := range rc.Starts {
+			if start+rc.ChunkSpan > warmFrom {
+				warm++
+			}
+		}
+	}
+	return warm, total
+}
+
+// EffectiveQuery returns a canonical representation of what the plan will execute: for each request
+// the series, time range, consolidation and resolved intervals, as well as the MaxDataPoints used for planning.
+// It is suitable as a cache key or log field: plans that are executed identically yield the same string,
+// irrespective of the order of the requests, the patterns that resolved to the series, or how they were pre-normalized together.
+func (rp ReqsPlan) EffectiveQuery(planMDP uint32) string {
+	reqs := rp.List()
+	lines := make([]string, len(reqs))
+	for i, r := range reqs {
+		lines[i] = fmt.Sprintf("%s|%s|%d-%d|%s|%d:%d:%d:%d", r.MKey, r.Target, r.From, r.To, r.Consolidator, r.Archive, r.ArchInterval, r.AggNum, r.OutInterval)
+	}
+	sort.Strings(lines)
+	return "mdp=" + strconv.FormatUint(uint64(planMDP), 10) + ";" + strings.Join(lines, ";")
+}
+
 // List returns the requests contained within the plan as a slice
 func (rp ReqsPlan) List() []models.Req {
 	l := make([]models.Req, 0, rp.cnt)
@@ -233,7 +541,37 @@ func (rp ReqsPlan) List() []models.Req {
 	for _, reqs := range rp.single.mdpyes {
 		l = append(l, reqs...)
 	}
-	for _, data := range rp.pngroups {
+	if len(rp.fetchWith) == 0 {
+		for _, data := range rp.pngroups {
+			for _, reqs := range data.mdpno {
+				l = append(l, reqs...)
+			}
+			for _, reqs := range data.mdpyes {
+				l = append(l, reqs...)
+			}
+		}
+		return l
+	}
+	// list the requests of merged PNGroups next to each other, so that they get fetched together
+	groups := make([]models.PNGroup, 0, len(rp.pngroups))
+	for group := range rp.pngroups {
+		groups = append(groups, group)
+	}
+	leader := func(group models.PNGroup) models.PNGroup {
+		if l, ok := rp.fetchWith[group]; ok {
+			return l
+		}
+		return group
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		li, lj := leader(groups[i]), leader(groups[j])
+		if li != lj {
+			return li < lj
+		}
+		return groups[i] < groups[j]
+	})
+	for _, group := range groups {
+		data := rp.pngroups[group]
 		for _, reqs := range data.mdpno {
 			l = append(l, reqs...)
 		}
@@ -0,0 +1,662 @@
+package api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/metrictank/api/models"
+	"github.com/grafana/metrictank/api/response"
+	"github.com/grafana/metrictank/cluster"
+	"github.com/grafana/metrictank/conf"
+	"github.com/grafana/metrictank/consolidation"
+	"github.com/grafana/metrictank/expr"
+	"github.com/grafana/metrictank/mdata"
+	"github.com/grafana/metrictank/mdata/cache"
+	"github.com/grafana/metrictank/schema"
+	"github.com/grafana/metrictank/test"
+	"github.com/grafana/metrictank/util/align"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestTruncateSeries(t *testing.T) {
+	in := []models.Series{{Target: "a"}, {Target: "b"}, {Target: "c"}}
+	cases := []struct {
+		maxSeries  uint32
+		expTargets []string
+		expWarning string
+	}{
+		{0, []string{"a", "b", "c"}, ""},
+		{3, []string{"a", "b", "c"}, ""},
+		{5, []string{"a", "b", "c"}, ""},
+		{2, []string{"a", "b"}, "Response truncated to 2 of 3 series due to maxSeries"},
+		{1, []string{"a"}, "Response truncated to 1 of 3 series due to maxSeries"},
+	}
+	for _, c := range cases {
+		out, warning := truncateSeries(in, c.maxSeries)
+		var targets []string
+		for _, s := range out {
+			targets = append(targets, s.Target)
+		}
+		if !reflect.DeepEqual(targets, c.expTargets) {
+			t.Errorf("maxSeries %d: expected targets %v, got %v", c.maxSeries, c.expTargets, targets)
+		}
+		if warning != c.expWarning {
+			t.Errorf("maxSeries %d: expected warning %q, got %q", c.maxSeries, c.expWarning, warning)
+		}
+	}
+}
+
+func TestTruncateSeriesBytes(t *testing.T) {
+	in := []models.Series{
+		{Target: "a", Interval: 10, Datapoints: []schema.Point{{Val: 1, Ts: 10}, {Val: 2, Ts: 20}}},
+		{Target: "b", Interval: 10, Datapoints: []schema.Point{{Val: math.NaN(), Ts: 10}, {Val: 3.5, Ts: 20}}},
+		{Target: "c", Interval: 10, Datapoints: []schema.Point{{Val: 4, Ts: 10}}},
+	}
+	full, _ := models.SeriesByTarget(in).MarshalJSONFast(nil)
+	first, _ := models.SeriesByTarget(in[:1]).MarshalJSONFast(nil)
+	cases := []struct {
+		maxBytes   int
+		expSeries  int
+		expWarning string
+	}{
+		{0, 3, ""},
+		{len(full), 3, ""},
+		{len(full) - 1, 2, "Response truncated to 2 of 3 series due to max-response-bytes: 1 series omitted"},
+		{len(first), 1, "Response truncated to 1 of 3 series due to max-response-bytes: 2 series omitted"},
+		{len(first) - 1, 0, "Response truncated to 0 of 3 series due to max-response-bytes: 3 series omitted"},
+	}
+	for _, c := range cases {
+		out, warning := truncateSeriesBytes(in, c.maxBytes)
+		if len(out) != c.expSeries || warning != c.expWarning {
+			t.Errorf("maxBytes %d: expected %d series and warning %q, got %d and %q", c.maxBytes, c.expSeries, c.expWarning, len(out), warning)
+		}
+		// what remains is a valid response that honors the limit
+		buf, _ := models.SeriesByTarget(out).MarshalJSONFast(nil)
+		var series []struct {
+			Target     string
+			Datapoints [][2]*float64
+		}
+		if err := json.Unmarshal(buf, &series); err != nil || len(series) != c.expSeries {
+			t.Errorf("maxBytes %d: expected a valid json response with %d series, got %q (%v)", c.maxBytes, c.expSeries, buf, err)
+		}
+		if c.maxBytes > 0 && len(buf) > c.maxBytes {
+			t.Errorf("maxBytes %d: expected the response to honor the limit, got %d bytes", c.maxBytes, len(buf))
+		}
+		ndjson, _ := response.NewNDJson(http.StatusOK, models.SeriesByTarget(out)).Body()
+		lines := strings.Split(strings.TrimSuffix(string(ndjson), "\n"), "\n")
+		for _, line := range lines {
+			if len(out) != 0 && !json.Valid([]byte(line)) {
+				t.Errorf("maxBytes %d: expected valid ndjson lines, got %q", c.maxBytes, ndjson)
+			}
+		}
+	}
+
+	defer func() { maxResponseBytes = 0 }()
+	for _, c := range []struct {
+		max       int
+		requested uint32
+		exp       int
+	}{
+		{0, 0, 0},
+		{0, 100, 100},
+		{1000, 0, 1000},
+		{1000, 100, 100},
+		{1000, 5000, 1000},
+	} {
+		maxResponseBytes = c.max
+		if limit := responseBytesLimit(c.requested); limit != c.exp {
+			t.Errorf("max-response-bytes %d, requested %d: expected limit %d, got %d", c.max, c.requested, c.exp, limit)
+		}
+	}
+}
+
+func TestClampMDP(t *testing.T) {
+	mdata.Schemas = conf.NewSchemas([]conf.Schema{
+		{
+			Pattern:    regexp.MustCompile(".*"),
+			Retentions: conf.MustParseRetentions("10s:30d,60s:60d,300s:90d"),
+		},
+	})
+	defer func() { maxEffectiveMDP = 0 }()
+
+	now := uint32(30 * 24 * 3600)
+	from := now - 24*3600
+	// plan returns the interval chosen for an MDP-optimizable request over a day of data
+	plan := func(mdp uint32) uint32 {
+		reqs := NewReqMap()
+		reqs.Add(reqRaw(test.GetMKey(0), from, now, mdp, 10, consolidation.Avg, 0, 0))
+		rp, err := planRequests(now, from, now, reqs, mdp, false, 0, false, 0, 0, 0)
+		if err != nil {
+			t.Fatalf("mdp %d: expected no error, got %v", mdp, err)
+		}
+		return rp.List()[0].ArchInterval
+	}
+
+	// without a cap, no archive can deliver this density, so we read the raw data
+	if mdp := clampMDP(100000); mdp != 100000 {
+		t.Fatalf("expected mdp to remain unclamped, got %d", mdp)
+	}
+	if interval := plan(clampMDP(100000)); interval != 10 {
+		t.Errorf("expected unclamped mdp to read raw data, got interval %d", interval)
+	}
+
+	maxEffectiveMDP = 1000
+	pre := reqRenderMDPClamped.Peek()
+	cases := []struct {
+		mdp     uint32
+		exp     uint32
+		clamped bool
+	}{
+		{0, 0, false},
+		{800, 800, false},
+		{1000, 1000, false},
+		{100000, 1000, true},
+	}
+	for _, c := range cases {
+		clamped := reqRenderMDPClamped.Peek()
+		if mdp := clampMDP(c.mdp); mdp != c.exp {
+			t.Errorf("mdp %d: expected %d, got %d", c.mdp, c.exp, mdp)
+		}
+		if got := reqRenderMDPClamped.Peek() != clamped; got != c.clamped {
+			t.Errorf("mdp %d: expected clamped stat to be incremented: %t, got %t", c.mdp, c.clamped, got)
+		}
+	}
+	if reqRenderMDPClamped.Peek() != pre+1 {
+		t.Errorf("expected clamped stat to be incremented once, got %d", reqRenderMDPClamped.Peek()-pre)
+	}
+
+	// the 60s archive yields 1440 points, enough for the capped mdp
+	if interval := plan(clampMDP(100000)); interval != 60 {
+		t.Errorf("expected clamped mdp to read the 60s archive, got interval %d", interval)
+	}
+}
+
+func TestRenderStatus(t *testing.T) {
+	defer func() { signalDegraded = false }()
+	cases := []struct {
+		signal   bool
+		degraded string
+		exp      int
+	}{
+		{false, "", http.StatusOK},
+		{false, "resolution was reduced", http.StatusOK},
+		{true, "", http.StatusOK},
+		{true, "resolution was reduced", http.StatusPartialContent},
+	}
+	for _, c := range cases {
+		signalDegraded = c.signal
+		w := httptest.NewRecorder()
+		if code := renderStatus(w, c.degraded); code != c.exp {
+			t.Errorf("signal %t, degraded %q: expected status %d, got %d", c.signal, c.degraded, c.exp, code)
+		}
+		warning := w.Header().Get("Warning")
+		if c.exp == http.StatusOK && warning != "" {
+			t.Errorf("signal %t, degraded %q: expected no Warning header, got %q", c.signal, c.degraded, warning)
+		}
+		if exp := `199 metrictank "degraded response: resolution was reduced"`; c.exp == http.StatusPartialContent && warning != exp {
+			t.Errorf("signal %t, degraded %q: expected Warning header %q, got %q", c.signal, c.degraded, exp, warning)
+		}
+	}
+}
+
+func TestParsePNGroups(t *testing.T) {
+	group0 := models.PNGroup(math.MaxUint64 / 2)
+	cases := []struct {
+		values []string
+		exp    map[string]models.PNGroup
+		expErr bool
+	}{
+		{nil, nil, false},
+		{[]string{"a.*"}, map[string]models.PNGroup{"a.*": group0}, false},
+		{[]string{"a.*; b.*", "c.*"}, map[string]models.PNGroup{"a.*": group0, "b.*": group0, "c.*": group0 - 1}, false},
+		{[]string{"a.*;"}, nil, true},
+		{[]string{"a.*;b.*", "b.*"}, nil, true},
+	}
+	for _, c := range cases {
+		pngroups, err := parsePNGroups(c.values)
+		if (err != nil) != c.expErr {
+			t.Errorf("values %q: expected error %t, got %v", c.values, c.expErr, err)
+			continue
+		}
+		if !c.expErr && !reflect.DeepEqual(pngroups, c.exp) {
+			t.Errorf("values %q: expected pngroups %v, got %v", c.values, c.exp, pngroups)
+		}
+	}
+}
+
+func TestRenderCompressedBody(t *testing.T) {
+	cluster.Init("default", "test", time.Now(), "http", 6060)
+	cluster.Manager.SetPriority(0)
+	cluster.Manager.SetReady()
+	defer func(orig int) { maxDecompressedBodySize = orig }(maxDecompressedBodySize)
+	maxDecompressedBodySize = 10000
+
+	srv, _ := newSrv(0, 0)
+	defer srv.Stop()
+	ts := httptest.NewServer(srv.Macaron)
+	defer ts.Close()
+
+	form := url.Values{"format": {"json"}}
+	var targets []string
+	for i := 0; i < 100; i++ {
+		target := "some.series." + strings.Repeat("x", i%10) + ".*"
+		targets = append(targets, target)
+		form.Add("target", target)
+	}
+	body := []byte(form.Encode())
+
+	gzipped := func(in []byte) []byte {
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		w.Write(in)
+		w.Close()
+		return buf.Bytes()
+	}
+	zstded := func(in []byte) []byte {
+		w, _ := zstd.NewWriter(nil)
+		defer w.Close()
+		return w.EncodeAll(in, nil)
+	}
+
+	post := func(encoding string, body []byte) *http.Response {
+		req, _ := http.NewRequest("POST", ts.URL+"/showplan", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if encoding != "" {
+			req.Header.Set("Content-Encoding", encoding)
+		}
+		res, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("failed to post %s request: %s", encoding, err)
+		}
+		return res
+	}
+
+	cases := []struct {
+		encoding string
+		body     []byte
+	}{
+		{"", body},
+		{"gzip", gzipped(body)},
+		{"zstd", zstded(body)},
+	}
+	for _, c := range cases {
+		res := post(c.encoding, c.body)
+		var plan struct {
+			Reqs []struct {
+				Query string
+			}
+		}
+		err := json.NewDecoder(res.Body).Decode(&plan)
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK || err != nil {
+			t.Fatalf("encoding %q: expected status 200 and a json plan, got status %d and error %v", c.encoding, res.StatusCode, err)
+		}
+		var got []string
+		for _, r := range plan.Reqs {
+			got = append(got, r.Query)
+		}
+		if !reflect.DeepEqual(targets, got) {
+			t.Errorf("encoding %q: expected targets %v, got %v", c.encoding, targets, got)
+		}
+	}
+
+	// a body that compresses well, but exceeds the limit once decompressed
+	bomb := []byte("format=json&target=" + strings.Repeat("a", 20000))
+	for _, encoding := range []string{"gzip", "zstd"} {
+		compressed := gzipped(bomb)
+		if encoding == "zstd" {
+			compressed = zstded(bomb)
+		}
+		res := post(encoding, compressed)
+		res.Body.Close()
+		if res.StatusCode != http.StatusRequestEntityTooLarge {
+			t.Errorf("encoding %q: expected status %d for a body exceeding the limit, got %d", encoding, http.StatusRequestEntityTooLarge, res.StatusCode)
+		}
+	}
+
+	res := post("br", body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("expected status %d for an unsupported encoding, got %d", http.StatusUnsupportedMediaType, res.StatusCode)
+	}
+}
+
+// TestRenderOrderFormat verifies that order=desc is rejected for the formats that don't include a timestamp per point
+func TestRenderOrderFormat(t *testing.T) {
+	cluster.Init("default", "test", time.Now(), "http", 6060)
+	cluster.Manager.SetPriority(0)
+	cluster.Manager.SetReady()
+
+	srv, _ := newSrv(0, 0)
+	defer srv.Stop()
+	ts := httptest.NewServer(srv.Macaron)
+	defer ts.Close()
+
+	cases := []struct {
+		format    string
+		order     string
+		expReject bool
+	}{
+		{"json", "desc", false},
+		{"pickle", "asc", false},
+		{"pickle", "desc", true},
+		{"msgpack", "asc", false},
+		{"msgpack", "desc", true},
+	}
+	for _, c := range cases {
+		form := url.Values{"target": {"a.*"}, "format": {c.format}, "order": {c.order}}
+		req, _ := http.NewRequest("POST", ts.URL+"/render", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-Org-Id", "1")
+		res, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("format %s, order %s: failed to post request: %s", c.format, c.order, err)
+		}
+		res.Body.Close()
+		if rejected := res.StatusCode == http.StatusBadRequest; rejected != c.expReject {
+			t.Errorf("format %s, order %s: expected rejection %t, got status %d", c.format, c.order, c.expReject, res.StatusCode)
+		}
+	}
+}
+
+// newExecutePlanSrv returns a server with series a.b and a.c, at an interval of 10s, for executePlan to plan and fetch.
+// the returned function stops it.
+func newExecutePlanSrv(t *testing.T) (*Server, func()) {
+	srv, _ := newSrv(0, 0)
+	mdata.SetSingleSchema(conf.MustParseRetentions("10s:1d,1min:7d,10min:30d"))
+	// the series don't have any data in memory, so it gets looked up in the cache and store
+	ccache := cache.NewCCache()
+	srv.BindCache(ccache)
+
+	now := time.Now().Unix()
+	for i, name := range []string{"a.b", "a.c"} {
+		id := test.GetMKey(i)
+		srv.MetricIndex.AddOrUpdate(id, &schema.MetricData{
+			Id:       id.String(),
+			OrgId:    1,
+			Name:     name,
+			Interval: 10,
+			Value:    1,
+			Time:     now,
+		}, 0)
+	}
+	// the local node serves the index lookup with what's in our index
+	find := models.NewIndexFindResp()
+	nodes, err := srv.MetricIndex.Find(1, "a.*", 0)
+	if err != nil {
+		t.Fatalf("failed to find series: %s", err)
+	}
+	find.Nodes["a.*"] = nodes
+	buf, _ := find.MarshalMsg(nil)
+	manager := cluster.InitMock()
+	node := cluster.NewMockNode(true, "local", []int32{0}, buf)
+	node.SetReady(true)
+	manager.Peers = append(manager.Peers, node)
+	getTargetsConcurrency = 1
+	return srv, func() {
+		getTargetsConcurrency = 0
+		ccache.Stop()
+		srv.Stop()
+	}
+}
+
+func TestExecutePlanPlanOnly(t *testing.T) {
+	srv, stop := newExecutePlanSrv(t)
+	defer stop()
+
+	exprs, err := expr.ParseMany([]string{"a.*"})
+	if err != nil {
+		t.Fatalf("failed to parse target: %s", err)
+	}
+	cases := []struct {
+		window      uint32
+		mdp         uint32
+		expInterval uint32
+	}{
+		{3600, 0, 10},           // raw data, no runtime consolidation
+		{3600, 100, 40},         // 360 raw points, consolidated at runtime by 4
+		{2 * 86400, 800, 240},   // the raw archive doesn't cover the range. 2880 points at 1min, consolidated by 4 as well
+		{10 * 86400, 800, 1200}, // only 10min covers the range. 1440 points, consolidated by 2
+	}
+	for _, c := range cases {
+		to := uint32(time.Now().Unix()) + 1
+		plan, err := expr.NewPlan(exprs, to-c.window, to, c.mdp, true, expr.Optimizations{PreNormalization: true})
+		if err != nil {
+			t.Fatalf("failed to create plan: %s", err)
+		}
+
+		plan.PlanOnly = true
+		_, meta, err := srv.executePlan(test.NewContext(), 1, plan, false)
+		if err != nil {
+			t.Fatalf("window %d, mdp %d: unexpected error %s", c.window, c.mdp, err)
+		}
+		planned := meta.Planned
+		if !reflect.DeepEqual(planned.Intervals, []uint32{c.expInterval}) || len(planned.Series) != 2 {
+			t.Errorf("window %d, mdp %d: expected 2 series at interval %d, got %+v", c.window, c.mdp, c.expInterval, planned)
+		}
+
+		// metaOnly reports the same, along with the points and coverage of each series, but without any data
+		plan.PlanOnly = false
+		plan.MetaOnly = true
+		_, meta, err = srv.executePlan(test.NewContext(), 1, plan, false)
+		if err != nil {
+			t.Fatalf("window %d, mdp %d: unexpected error %s", c.window, c.mdp, err)
+		}
+		if len(meta.MetaOnly) != 2 {
+			t.Fatalf("window %d, mdp %d: expected metadata of 2 series, got %+v", c.window, c.mdp, meta.MetaOnly)
+		}
+		for i, s := range meta.MetaOnly {
+			if s.PlannedSeries != planned.Series[i] || s.Points == 0 || s.CoverageFrom == 0 || s.Datapoints == nil || len(s.Datapoints) != 0 {
+				t.Errorf("window %d, mdp %d: expected metadata of %+v, with points and coverage, and no datapoints, got %+v", c.window, c.mdp, planned.Series[i], s)
+			}
+		}
+
+		// the advertised interval must be the one the series are then rendered at
+		plan.MetaOnly = false
+		out, _, err := srv.executePlan(test.NewContext(), 1, plan, false)
+		if err != nil {
+			t.Fatalf("window %d, mdp %d: unexpected error %s", c.window, c.mdp, err)
+		}
+		if len(out) != 2 {
+			t.Fatalf("window %d, mdp %d: expected 2 series, got %d", c.window, c.mdp, len(out))
+		}
+		for _, s := range out {
+			if s.Interval != c.expInterval {
+				t.Errorf("window %d, mdp %d: expected series %s at the advertised interval %d, got %d", c.window, c.mdp, s.Target, c.expInterval, s.Interval)
+			}
+			// as well as the advertised amount of points
+			for _, m := range meta.MetaOnly {
+				if m.Target == s.Target && int(m.Points) != len(s.Datapoints) {
+					t.Errorf("window %d, mdp %d: expected series %s to have the advertised %d points, got %d", c.window, c.mdp, s.Target, m.Points, len(s.Datapoints))
+				}
+			}
+		}
+	}
+}
+
+// TestExecutePlanNoData verifies that series without any data in the requested range are returned nonetheless,
+// with null points spanning the range
+func TestExecutePlanNoData(t *testing.T) {
+	srv, stop := newExecutePlanSrv(t)
+	defer stop()
+
+	exprs, err := expr.ParseMany([]string{"a.*"})
+	if err != nil {
+		t.Fatalf("failed to parse target: %s", err)
+	}
+	to := uint32(time.Now().Unix()) + 1
+	plan, err := expr.NewPlan(exprs, to-3600, to, 0, true, expr.Optimizations{})
+	if err != nil {
+		t.Fatalf("failed to create plan: %s", err)
+	}
+	out, _, err := srv.executePlan(test.NewContext(), 1, plan, false)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if len(out) != 2 {
+		t.Fatalf("expected 2 series, got %d", len(out))
+	}
+	for _, s := range out {
+		if s.Interval != 10 || len(s.Datapoints) != 360 {
+			t.Errorf("series %s: expected 360 points at interval 10, got %d at interval %d", s.Target, len(s.Datapoints), s.Interval)
+		}
+		for _, p := range s.Datapoints {
+			if !math.IsNaN(p.Val) {
+				t.Errorf("series %s: expected only null points, got %v", s.Target, p)
+				break
+			}
+		}
+	}
+}
+
+// TestExecutePlanRecentlyStarted verifies that a series that only has data for the end of the requested range
+// is returned with null points for the rest of it, so that it spans the range
+func TestExecutePlanRecentlyStarted(t *testing.T) {
+	srv, stop := newExecutePlanSrv(t)
+	defer stop()
+
+	to := uint32(time.Now().Unix()) + 1
+	from := to - 3600
+	// the series started 10 minutes ago
+	start := align.ForwardIfNotAligned(to-600, 10)
+	metric := srv.MemoryStore.GetOrCreate(test.GetMKey(0), 0, 0, 10)
+	for ts := start; ts < to; ts += 10 {
+		metric.Add(ts, 1)
+	}
+
+	// the mock node serves the index lookup for a.*
+	exprs, err := expr.ParseMany([]string{"a.*"})
+	if err != nil {
+		t.Fatalf("failed to parse target: %s", err)
+	}
+	plan, err := expr.NewPlan(exprs, from, to, 0, true, expr.Optimizations{})
+	if err != nil {
+		t.Fatalf("failed to create plan: %s", err)
+	}
+	out, _, err := srv.executePlan(test.NewContext(), 1, plan, false)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	var points []schema.Point
+	for _, s := range out {
+		if s.Target == "a.b" {
+			points = s.Datapoints
+		}
+	}
+	if len(points) != 360 {
+		t.Fatalf("expected series a.b with 360 points, got %d", len(points))
+	}
+	for _, p := range points {
+		if math.IsNaN(p.Val) != (p.Ts < start) {
+			t.Fatalf("expected null points before %d and data from then on, got %v at %d", start, p.Val, p.Ts)
+		}
+	}
+	if first := points[0].Ts; first != align.ForwardIfNotAligned(from, 10) {
+		t.Errorf("expected the first point at %d, got %d", align.ForwardIfNotAligned(from, 10), first)
+	}
+}
+
+// TestExecutePlanConsolidateByFallback verifies that a consolidateBy() that can't be honored due to a missing rollup
+// is reported in the meta, only if the archive that gets read doesn't store it
+func TestExecutePlanConsolidateByFallback(t *testing.T) {
+	srv, stop := newExecutePlanSrv(t)
+	defer stop()
+
+	// the series only have avg, min and max rollups
+	cases := []struct {
+		target     string
+		window     uint32
+		expWarning bool
+	}{
+		{"consolidateBy(a.*, 'max')", 2 * 86400, false},
+		{"consolidateBy(a.*, 'sum')", 3600, false}, // the raw data is read
+		{"consolidateBy(a.*, 'sum')", 2 * 86400, true},
+	}
+	for _, c := range cases {
+		exprs, err := expr.ParseMany([]string{c.target})
+		if err != nil {
+			t.Fatalf("failed to parse target: %s", err)
+		}
+		to := uint32(time.Now().Unix()) + 1
+		plan, err := expr.NewPlan(exprs, to-c.window, to, 800, true, expr.Optimizations{})
+		if err != nil {
+			t.Fatalf("failed to create plan: %s", err)
+		}
+		_, meta, err := srv.executePlan(test.NewContext(), 1, plan, false)
+		if err != nil {
+			t.Fatalf("%s over %ds: unexpected error %s", c.target, c.window, err)
+		}
+		if !c.expWarning {
+			if len(meta.Warnings) != 0 {
+				t.Errorf("%s over %ds: expected no warnings, got %q", c.target, c.window, meta.Warnings)
+			}
+			continue
+		}
+		if len(meta.Warnings) != 1 || !strings.Contains(meta.Warnings[0], "consolidateBy(sum)") {
+			t.Errorf("%s over %ds: expected 1 warning about consolidateBy(sum), got %q", c.target, c.window, meta.Warnings)
+		}
+	}
+}
+
+// TestExecutePlanAccounting verifies that requests are accounted as they are finally planned, and only if they fetch data
+func TestExecutePlanAccounting(t *testing.T) {
+	srv, stop := newExecutePlanSrv(t)
+	defer stop()
+	defer func() { accounting = nil }()
+
+	exprs, err := expr.ParseMany([]string{"a.*"})
+	if err != nil {
+		t.Fatalf("failed to parse target: %s", err)
+	}
+	to := uint32(time.Now().Unix()) + 1
+	cases := []struct {
+		name     string
+		modify   func(plan *expr.Plan)
+		expCount bool
+	}{
+		{"PlanOnly", func(plan *expr.Plan) { plan.PlanOnly = true }, false},
+		{"MetaOnly", func(plan *expr.Plan) { plan.MetaOnly = true }, false},
+		{"ValidateOnly", func(plan *expr.Plan) { plan.ValidateOnly = true }, false},
+		{"Render", func(plan *expr.Plan) {}, true},
+		// the interval gets applied after the initial planning, and makes us read the 1min archive rather than the raw data
+		{"Interval", func(plan *expr.Plan) { plan.Interval = 60 }, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			sink := make(mockAccounting)
+			SetAccounting(sink)
+			plan, err := expr.NewPlan(exprs, to-3600, to, 0, true, expr.Optimizations{})
+			if err != nil {
+				t.Fatalf("failed to create plan: %s", err)
+			}
+			c.modify(&plan)
+			_, meta, err := srv.executePlan(test.NewContext(), 1, plan, false)
+			if err != nil {
+				t.Fatalf("unexpected error %s", err)
+			}
+			if !c.expCount {
+				if len(sink) != 0 {
+					t.Fatalf("expected no accounting, got %v", sink)
+				}
+				return
+			}
+			var got []accountingCost
+			for _, cost := range sink {
+				got = append(got, cost)
+			}
+			if exp := []accountingCost{{meta.RenderStats.PointsReturn, meta.RenderStats.PointsFetch}}; !reflect.DeepEqual(got, exp) {
+				t.Errorf("expected the points of the final plan (%d fetched, %d returned) to be accounted, got %v", meta.RenderStats.PointsFetch, meta.RenderStats.PointsReturn, sink)
+			}
+		})
+	}
+}
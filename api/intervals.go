@@ -0,0 +1,75 @@
+package api
+
+import (
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/grafana/metrictank/api/middleware"
+	"github.com/grafana/metrictank/api/models"
+	"github.com/grafana/metrictank/api/response"
+	"github.com/grafana/metrictank/mdata"
+	"github.com/grafana/metrictank/schema"
+)
+
+// intervals lists, for each series matching the target, the intervals the planner could choose from
+// to read it over the requested time range.
+func (s *Server) intervals(ctx *middleware.Context, req models.Intervals) {
+	now := time.Now()
+	defaultFrom := uint32(now.Add(-time.Duration(24) * time.Hour).Unix())
+	defaultTo := uint32(now.Unix())
+	fromUnix, toUnix, err := getFromTo(req.FromTo, now, defaultFrom, defaultTo)
+	if err != nil {
+		response.Write(ctx, response.NewError(http.StatusBadRequest, err.Error()))
+		return
+	}
+	if fromUnix >= toUnix {
+		response.Write(ctx, response.NewError(http.StatusBadRequest, InvalidTimeRangeErr.Error()))
+		return
+	}
+	// like the render API, from is exclusive
+	fromUnix += 1
+
+	series, err := s.findSeries(ctx.Req.Context(), ctx.OrgId, []string{req.Target}, int64(fromUnix))
+	if err != nil {
+		response.Write(ctx, response.WrapError(err))
+		return
+	}
+	response.Write(ctx, response.NewJson(200, explainIntervals(uint32(now.Unix()), snapFrom(fromUnix), series), ""))
+}
+
+// explainIntervals returns the valid intervals of each of the given series, as considered by the planner
+// (see getValidIntervals). series found on multiple peers are only listed once.
+func explainIntervals(now, from uint32, series []Series) models.IntervalsResp {
+	schemas := mdata.SchemasSnapshot()
+	minTTL := getMinTTL(now, from)
+	resp := models.IntervalsResp{
+		Series: make([]models.IntervalsSeries, 0),
+	}
+	seen := make(map[schema.MKey]struct{})
+	for _, s := range series {
+		for _, node := range s.Series {
+			if !node.Leaf {
+				continue
+			}
+			for _, def := range node.Defs {
+				if _, ok := seen[def.Id]; ok {
+					continue
+				}
+				seen[def.Id] = struct{}{}
+				intervals, _ := getValidIntervals(schemas, def.SchemaId, from, minTTL)
+				if intervals == nil {
+					intervals = make([]uint32, 0)
+				}
+				sort.Slice(intervals, func(i, j int) bool { return intervals[i] < intervals[j] })
+				resp.Series = append(resp.Series, models.IntervalsSeries{
+					Name:      def.NameWithTags(),
+					SchemaId:  def.SchemaId,
+					Intervals: intervals,
+				})
+			}
+		}
+	}
+	sort.SliceStable(resp.Series, func(i, j int) bool { return resp.Series[i].Name < resp.Series[j].Name })
+	return resp
+}
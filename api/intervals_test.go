@@ -0,0 +1,93 @@
+package api
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+
+	"github.com/grafana/metrictank/api/models"
+	"github.com/grafana/metrictank/conf"
+	"github.com/grafana/metrictank/idx"
+	"github.com/grafana/metrictank/mdata"
+)
+
+func TestExplainIntervals(t *testing.T) {
+	// expanded schema ids: a is 0,1,2 and b is 3,4
+	mdata.Schemas = conf.NewSchemas([]conf.Schema{
+		{
+			Name:       "a",
+			Pattern:    regexp.MustCompile("^a"),
+			Retentions: conf.MustParseRetentions("10s:1d,60s:7d,300s:30d"),
+		},
+		{
+			Name:       "b",
+			Pattern:    regexp.MustCompile("^b"),
+			Retentions: conf.MustParseRetentions("15s:1d,120s:7d:2h:2:false"),
+		},
+	})
+	now := uint32(100 * 24 * 3600)
+
+	archive := func(name string, schemaID uint16) idx.Archive {
+		a := idx.NewArchiveBare(name)
+		a.OrgId = 1
+		a.SchemaId = schemaID
+		a.SetId()
+		return a
+	}
+	a, b := archive("a.foo", 0), archive("b.bar", 3)
+	series := []Series{
+		{Pattern: "*.*", Series: []idx.Node{
+			{Path: "b.bar", Leaf: true, Defs: []idx.Archive{b}},
+			{Path: "a", HasChildren: true},
+			{Path: "a.foo", Leaf: true, Defs: []idx.Archive{a}},
+		}},
+		// a replica of a.foo, as found on another peer
+		{Pattern: "*.*", Series: []idx.Node{
+			{Path: "a.foo", Leaf: true, Defs: []idx.Archive{a}},
+		}},
+	}
+
+	cases := []struct {
+		name   string
+		window uint32
+		exp    models.IntervalsResp
+	}{
+		{
+			"Hour",
+			3600,
+			models.IntervalsResp{Series: []models.IntervalsSeries{
+				{Name: "a.foo", SchemaId: 0, Intervals: []uint32{10, 60, 300}},
+				{Name: "b.bar", SchemaId: 3, Intervals: []uint32{15}}, // the rollup of b is not ready
+			}},
+		},
+		{
+			"ThreeDays",
+			3 * 24 * 3600,
+			models.IntervalsResp{Series: []models.IntervalsSeries{
+				{Name: "a.foo", SchemaId: 0, Intervals: []uint32{60, 300}},
+				{Name: "b.bar", SchemaId: 3, Intervals: []uint32{}},
+			}},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			from := now - c.window
+			resp := explainIntervals(now, from, series)
+			if !reflect.DeepEqual(resp, c.exp) {
+				t.Fatalf("expected %+v, got %+v", c.exp, resp)
+			}
+			// the intervals must be those the planner considers valid
+			for _, s := range resp.Series {
+				rbr := make(ReqsByRet, mdata.Schemas.Len())
+				rbr[s.SchemaId] = []models.Req{{SchemaId: s.SchemaId}}
+				set, ok := getValidIntervalsSet(&mdata.Schemas, rbr, from, getMinTTL(now, from))
+				if !ok {
+					set = [][]uint32{{}}
+				}
+				if !reflect.DeepEqual(set, [][]uint32{s.Intervals}) {
+					t.Errorf("series %s: expected intervals %v to match the planner's %v", s.Name, s.Intervals, set)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package middleware
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"gopkg.in/macaron.v1"
+)
+
+// DecompressBody decompresses request bodies sent with a gzip or zstd Content-Encoding,
+// such that the handlers that follow (e.g. CaptureBody and binding) see the plain body.
+// to protect against decompression bombs, bodies that decompress to more than maxSize bytes are rejected.
+// (maxSize 0 disables the limit)
+func DecompressBody(maxSize int64) macaron.Handler {
+	return func(c *macaron.Context) {
+		req := c.Req.Request
+		encoding := strings.ToLower(strings.TrimSpace(req.Header.Get("Content-Encoding")))
+		if encoding == "" || encoding == "identity" {
+			return
+		}
+
+		var r io.Reader
+		switch encoding {
+		case "gzip":
+			gz, err := gzip.NewReader(req.Body)
+			if err != nil {
+				c.PlainText(http.StatusBadRequest, []byte(fmt.Sprintf("failed to decompress gzip request body: %s", err.Error())))
+				return
+			}
+			defer gz.Close()
+			r = gz
+		case "zstd":
+			dec, err := zstd.NewReader(req.Body, zstd.WithDecoderConcurrency(1))
+			if err != nil {
+				c.PlainText(http.StatusBadRequest, []byte(fmt.Sprintf("failed to decompress zstd request body: %s", err.Error())))
+				return
+			}
+			defer dec.Close()
+			r = dec
+		default:
+			c.PlainText(http.StatusUnsupportedMediaType, []byte(fmt.Sprintf("unsupported Content-Encoding %q. supported are gzip and zstd", encoding)))
+			return
+		}
+
+		if maxSize > 0 {
+			// read one more byte than allowed, so we can tell whether the body exceeds the limit
+			r = io.LimitReader(r, maxSize+1)
+		}
+		body, err := ioutil.ReadAll(r)
+		if err != nil {
+			c.PlainText(http.StatusBadRequest, []byte(fmt.Sprintf("failed to decompress %s request body: %s", encoding, err.Error())))
+			return
+		}
+		if maxSize > 0 && int64(len(body)) > maxSize {
+			c.PlainText(http.StatusRequestEntityTooLarge, []byte(fmt.Sprintf("request body exceeds %d bytes once decompressed", maxSize)))
+			return
+		}
+		req.Body.Close()
+
+		// from here on, the request is as if it was sent uncompressed. (this matters when it gets proxied to graphite)
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		req.ContentLength = int64(len(body))
+		req.Header.Del("Content-Encoding")
+		req.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+}
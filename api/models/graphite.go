@@ -48,14 +48,38 @@ type FromTo struct {
 
 type GraphiteRender struct {
 	FromTo
-	MaxDataPoints uint32   `json:"maxDataPoints" form:"maxDataPoints" binding:"Default(800)"`
-	Targets       []string `json:"target" form:"target"`
-	TargetsRails  []string `form:"target[]"` // # Rails/PHP/jQuery common practice format: ?target[]=path.1&target[]=path.2 -> like graphite, we allow this.
-	Format        string   `json:"format" form:"format" binding:"In(,json,msgp,msgpack,pickle)"`
-	NoProxy       bool     `json:"local" form:"local"` //this is set to true by graphite-web when it passes request to cluster servers
-	Meta          bool     `json:"meta" form:"meta"`   // request for meta data, which will be returned as long as the format is compatible (json) and we don't have to go via graphite
-	Process       string   `json:"process" form:"process" binding:"In(,none,stable,any);Default(stable)"`
-	Optimizations string   `json:"optimizations" form:"optimizations"`
+	MaxDataPoints    uint32   `json:"maxDataPoints" form:"maxDataPoints" binding:"Default(800)"`
+	TargetDataPoints bool     `json:"targetDataPoints" form:"targetDataPoints"` // treat MaxDataPoints as a target rather than a ceiling
+	MaxPointsFetch   uint32   `json:"maxPointsFetch" form:"maxPointsFetch"`     // per series, read the finest resolution that fetches no more than this many points. 0 disables
+	Cheapest         bool     `json:"cheapest" form:"cheapest"`                 // read the coarsest data that still covers the requested range
+	Targets          []string `json:"target" form:"target"`
+	TargetsRails     []string `form:"target[]"` // # Rails/PHP/jQuery common practice format: ?target[]=path.1&target[]=path.2 -> like graphite, we allow this.
+	Format           string   `json:"format" form:"format" binding:"In(,json,msgp,msgpack,pickle,ndjson,rle)"`
+	NoProxy          bool     `json:"local" form:"local"` //this is set to true by graphite-web when it passes request to cluster servers
+	Meta             bool     `json:"meta" form:"meta"`   // request for meta data, which will be returned as long as the format is compatible (json) and we don't have to go via graphite
+	Process          string   `json:"process" form:"process" binding:"In(,none,stable,any);Default(stable)"`
+	Optimizations    string   `json:"optimizations" form:"optimizations"`
+	EqualizePoints   float64  `json:"equalizePoints" form:"equalizePoints"`       // coarsen the densest series until all return the same amount of points, within this relative tolerance. 0 disables
+	MaxSeries        uint32   `json:"maxSeries" form:"maxSeries"`                 // truncate the response to at most this many series, after all processing. 0 disables
+	IncludeRaw       bool     `json:"includeRaw" form:"includeRaw"`               // also return each fetched series at its archive interval, before normalization and consolidation
+	Order            string   `json:"order" form:"order" binding:"In(,asc,desc)"` // order of the points of each series in the response
+	Trace            bool     `json:"trace" form:"trace"`                         // like meta, but also include the steps applied to the data of each series
+	Align            string   `json:"align" form:"align" binding:"In(,strict)"`   // strict: return all series at a common interval, on the same timestamps
+	Coverage         bool     `json:"coverage" form:"coverage"`                   // like meta, but also include the earliest timestamp the archive read for each series has data for, and where each series can start having data
+	Grouping         bool     `json:"grouping" form:"grouping"`                   // like meta, but also include whether each series was planned as part of a PNGroup or as a single, and why it was (not) MDP-optimizable
+	Interval         string   `json:"interval" form:"interval"`                   // plan all series to this output interval, e.g. "1min". empty disables
+	IgnoreSoftLimit  bool     `json:"ignoreSoftLimit" form:"ignoreSoftLimit"`     // skip max-points-per-req-soft coarsening. only for orgs listed in ignore-soft-limit-orgs
+	ValidateOnly     bool     `json:"validateOnly" form:"validateOnly"`           // don't fetch any data, but report all series that can't be planned, and why
+	Provenance       bool     `json:"provenance" form:"provenance"`               // like meta, but also include which cluster node fetched each series
+	MaxIntervals     uint32   `json:"maxIntervals" form:"maxIntervals"`           // coarsen series until the response has at most this many distinct intervals. 0 disables
+	PlanOnly         bool     `json:"planOnly" form:"planOnly"`                   // don't fetch any data, but report the interval each series would be returned at
+	MetaOnly         bool     `json:"metaOnly" form:"metaOnly"`                   // don't fetch any data, but return each series with its metadata and without points
+	RawTimestamps    bool     `json:"rawTimestamps" form:"rawTimestamps"`         // return the raw data at the timestamps it was stored with, not aligned to its interval. only for orgs listed in raw-timestamps-orgs
+	Counters         []string `json:"counter" form:"counter"`                     // patterns of the targets of which the series are counters, so that coarsening them reads sum rollups
+	PNGroups         []string `json:"pngroup" form:"pngroup"`                     // semicolon separated patterns of targets of which the series are to be pre-normalized together, see models.Req.DeclaredPNGroup
+	Hash             bool     `json:"hash" form:"hash"`                           // like meta, but also include a hash of the datapoints of each series, see Series.DatapointsHash
+	KnownHashes      []string `json:"knownHash" form:"knownHash"`                 // like hash, but series of which the hash is listed are returned without datapoints, and marked as unchanged
+	MaxResponseBytes uint32   `json:"maxResponseBytes" form:"maxResponseBytes"`   // omit the series beyond this response size, in bytes. 0 means max-response-bytes applies
 }
 
 func (gr GraphiteRender) Validate(ctx *macaron.Context, errs binding.Errors) binding.Errors {
@@ -3,19 +3,29 @@ package models
 import (
 	"strconv"
 	"time"
+
+	"github.com/grafana/metrictank/schema"
 )
 
 // ResponseWithMeta is a graphite render response with metadata
 type ResponseWithMeta struct {
-	Meta   RenderMeta
-	Series SeriesByTarget
+	Meta     RenderMeta
+	Series   SeriesByTarget
+	Trace    bool // include the steps applied to the data of each series in their meta
+	Coverage bool // include the earliest timestamp the archive read for each series has data for in their meta, and the DataFrom of each series
+	Grouping bool // include whether each series was planned as part of a PNGroup in their meta
+	Node     bool // include which cluster node fetched each series in their meta
+	Hash     bool // include the DatapointsHash of each series
+	// DatapointsHashes the client already has the datapoints of: such series are marked as unchanged and returned without datapoints.
+	// only applies if Hash is set
+	KnownHashes map[string]struct{}
 }
 
 func (rwm ResponseWithMeta) MarshalJSONFast(b []byte) ([]byte, error) {
 	b = append(b, `{"version":"v0.1","meta":`...)
 	b, _ = rwm.Meta.MarshalJSONFast(b)
 	b = append(b, `,"series":`...)
-	b, _ = rwm.Series.MarshalJSONFastWithMeta(b)
+	b, _ = rwm.Series.marshalJSONFastWithMeta(b, seriesMetaOpts{trace: rwm.Trace, coverage: rwm.Coverage, grouping: rwm.Grouping, node: rwm.Node, hash: rwm.Hash, known: rwm.KnownHashes})
 	b = append(b, '}')
 	return b, nil
 }
@@ -24,6 +34,55 @@ func (rwm ResponseWithMeta) MarshalJSONFast(b []byte) ([]byte, error) {
 type RenderMeta struct {
 	RenderStats
 	StorageStats
+	Warnings []string
+	Degraded string // if not empty, why the response is coarser than requested. it is not part of the serialized meta
+
+	Unsatisfiable []UnsatisfiableTarget // only for validateOnly requests, see ValidateResponse. it is not part of the serialized meta
+
+	Intervals []uint32 // the distinct output intervals the series were planned to. only set for maxIntervals requests
+
+	Planned PlanResponse // only for planOnly requests. it is not part of the serialized meta
+
+	MetaOnly []MetaOnlySeries // only for metaOnly requests. it is not part of the serialized meta
+}
+
+// UnsatisfiableTarget is a series that can't be planned, because none of its archives are suitable for the request
+type UnsatisfiableTarget struct {
+	Target  string `json:"target"`
+	Pattern string `json:"pattern"`
+	Reason  string `json:"reason"`
+}
+
+// ValidateResponse is the response to a render request with validateOnly set
+type ValidateResponse struct {
+	Valid         bool                  `json:"valid"`
+	Unsatisfiable []UnsatisfiableTarget `json:"unsatisfiable"`
+}
+
+// PlannedSeries is a series as the planner would read and return it
+type PlannedSeries struct {
+	Target       string `json:"target"`
+	Pattern      string `json:"pattern"`
+	Archive      uint8  `json:"archive"`      // the archive that would be read from
+	ArchInterval uint32 `json:"archInterval"` // the interval of that archive
+	Interval     uint32 `json:"interval"`     // the interval the series would be returned at, after normalization and runtime consolidation
+}
+
+// MetaOnlySeries is a series of the response to a render request with metaOnly set: how it would be read and returned, without its points
+type MetaOnlySeries struct {
+	PlannedSeries
+	Points       uint32         `json:"points"`       // the number of points the series would return
+	CoverageFrom uint32         `json:"coverageFrom"` // the earliest timestamp the archive has data for, given its TTL
+	Datapoints   []schema.Point `json:"datapoints"`   // always empty
+}
+
+// PlanResponse is the response to a render request with planOnly set
+type PlanResponse struct {
+	Intervals     []uint32        `json:"intervals"` // the distinct intervals of the series, in ascending order
+	Series        []PlannedSeries `json:"series"`
+	Chunks        uint32          `json:"chunks"`        // the number of chunks that would be read
+	WarmChunks    uint32          `json:"warmChunks"`    // how many of them are estimated to be served from memory, see plan-warm-window
+	CacheHitRatio float64         `json:"cacheHitRatio"` // WarmChunks / Chunks
 }
 
 func (rm RenderMeta) MarshalJSONFast(b []byte) ([]byte, error) {
@@ -34,7 +93,24 @@ func (rm RenderMeta) MarshalJSONFast(b []byte) ([]byte, error) {
 	b, _ = rm.RenderStats.MarshalJSONFastRaw(b)
 	b = append(b, ',')
 	b, _ = rm.StorageStats.MarshalJSONFastRaw(b)
-	b = append(b, `}}`...)
+	b = append(b, '}')
+	if len(rm.Warnings) != 0 {
+		b = append(b, `,"warnings":[`...)
+		for _, w := range rm.Warnings {
+			b = strconv.AppendQuoteToASCII(b, w)
+			b = append(b, ',')
+		}
+		b[len(b)-1] = ']'
+	}
+	if len(rm.Intervals) != 0 {
+		b = append(b, `,"intervals":[`...)
+		for _, interval := range rm.Intervals {
+			b = strconv.AppendUint(b, uint64(interval), 10)
+			b = append(b, ',')
+		}
+		b[len(b)-1] = ']'
+	}
+	b = append(b, '}')
 	return b, nil
 }
 
@@ -46,6 +122,7 @@ type RenderStats struct {
 	SeriesFetch           uint32        `json:"executeplan.series-fetch.count"`
 	PointsFetch           uint32        `json:"executeplan.points-fetch.count"`
 	PointsReturn          uint32        `json:"executeplan.points-return.count"`
+	PNGroupsMerged        uint32        `json:"executeplan.pngroups-merged.count"`
 }
 
 func (s RenderStats) MarshalJSONFast(b []byte) ([]byte, error) {
@@ -69,5 +146,7 @@ func (s RenderStats) MarshalJSONFastRaw(b []byte) ([]byte, error) {
 	b = strconv.AppendUint(b, uint64(s.PointsFetch), 10)
 	b = append(b, `,"executeplan.points-return.count":`...)
 	b = strconv.AppendUint(b, uint64(s.PointsReturn), 10)
+	b = append(b, `,"executeplan.pngroups-merged.count":`...)
+	b = strconv.AppendUint(b, uint64(s.PNGroupsMerged), 10)
 	return b, nil
 }
@@ -2,6 +2,7 @@ package models
 
 import (
 	"encoding/json"
+	"strings"
 	"testing"
 
 	"github.com/grafana/metrictank/idx"
@@ -61,3 +62,23 @@ func TestGraphiteNames(t *testing.T) {
 		}
 	}
 }
+
+func TestRenderMetaWarnings(t *testing.T) {
+	var meta RenderMeta
+	out, _ := meta.MarshalJSONFast(nil)
+	if strings.Contains(string(out), "warnings") {
+		t.Errorf("expected no warnings in output, got %s", out)
+	}
+	if !json.Valid(out) {
+		t.Errorf("invalid json output %s", out)
+	}
+
+	meta.Warnings = []string{"foo", `"bar"`}
+	out, _ = meta.MarshalJSONFast(nil)
+	if !strings.HasSuffix(string(out), `},"warnings":["foo","\"bar\""]}`) {
+		t.Errorf("expected warnings in output, got %s", out)
+	}
+	if !json.Valid(out) {
+		t.Errorf("invalid json output %s", out)
+	}
+}
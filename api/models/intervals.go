@@ -0,0 +1,18 @@
+package models
+
+// Intervals is a request for the intervals the planner could choose for the series matching a target over a time range
+type Intervals struct {
+	FromTo
+	Target string `json:"target" form:"target" binding:"Required"`
+}
+
+type IntervalsResp struct {
+	Series []IntervalsSeries `json:"series"`
+}
+
+// IntervalsSeries describes the intervals that can be read for a series
+type IntervalsSeries struct {
+	Name      string   `json:"name"`
+	SchemaId  uint16   `json:"schemaId"`  // id of the (expanded) storage schema of the series
+	Intervals []uint32 `json:"intervals"` // the SecondsPerPoint of the archives that are ready and cover the time range, in ascending order
+}
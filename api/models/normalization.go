@@ -0,0 +1,24 @@
+package models
+
+// Normalization is a request to explain how a set of schemas and/or intervals would get normalized together,
+// as is done for requests in the same PNGroup.
+type Normalization struct {
+	SchemaIds []uint16 `json:"schemaId" form:"schemaId"` // ids of (expanded) storage schemas
+	Intervals []uint32 `json:"interval" form:"interval"` // additional intervals, in seconds, to normalize with
+	TTL       string   `json:"ttl" form:"ttl"`           // the time range that must be covered. e.g. "1d". defaults to 0
+}
+
+type NormalizationResp struct {
+	Interval uint32                `json:"interval"` // the common interval everything gets normalized to
+	Schemas  []NormalizationSchema `json:"schemas"`
+}
+
+// NormalizationSchema describes which archive of a schema would be read to deliver the common interval
+type NormalizationSchema struct {
+	Id           uint16 `json:"id"`
+	Name         string `json:"name"`
+	Retentions   string `json:"retentions"`
+	Archive      int    `json:"archive"`
+	ArchInterval uint32 `json:"archInterval"`
+	AggNum       uint32 `json:"aggNum"` // how many points of the archive get consolidated together to produce the common interval
+}
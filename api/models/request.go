@@ -1,6 +1,7 @@
 package models
 
 import (
+	"encoding/binary"
 	"fmt"
 
 	"github.com/grafana/metrictank/conf"
@@ -40,6 +41,11 @@ type Req struct {
 	Node     cluster.Node               `json:"-"`
 	SchemaId uint16                     `json:"schemaId"`
 	AggId    uint16                     `json:"aggId"`
+	// if the data gets summarize()'d, the interval of the buckets. 0 otherwise.
+	// only used to estimate the returned points
+	SummarizeInterval uint32 `json:"summarizeInterval"`
+	// why MaxPoints is (not) set, i.e. why the request was (not) classified as MDP-optimizable. only for debugging
+	MDPReason string `json:"mdpReason"`
 
 	// these fields need some more coordination and are typically set later (after request planning)
 	Archive      uint8  `json:"archive"`      // 0 means original data, 1 means first agg level, 2 means 2nd, etc.
@@ -47,6 +53,17 @@ type Req struct {
 	TTL          uint32 `json:"ttl"`          // the ttl of the archive we'll fetch
 	OutInterval  uint32 `json:"outInterval"`  // the interval of the output data, after any runtime consolidation
 	AggNum       uint32 `json:"aggNum"`       // how many points to consolidate together at runtime, after fetching from the archive (normalization)
+	CoverageFrom uint32 `json:"coverageFrom"` // the earliest timestamp the archive we'll fetch has data for, given its ttl
+	PNGrouped    bool   `json:"pnGrouped"`    // whether the request was planned as part of a PNGroup (possibly an implicit one, see auto-pngroup), rather than as a single
+	// return the raw data at the timestamps it was stored with, rather than quantized to ArchInterval. see getSeriesRaw
+	RawTimestamps bool `json:"rawTimestamps"`
+	// whether the series is a counter, so that it reads the sum rollup when it gets coarsened to honor max-points-per-req-soft. see planCounterRollup
+	Counter bool `json:"counter"`
+	// the PNGroup the client declared for the series (see the pngroup render parameter), 0 otherwise.
+	// the ReqMap plans the request as part of this group rather than the one of PNGroup, which is still used to tie the data back to the request.
+	DeclaredPNGroup PNGroup `json:"declaredPNGroup"`
+	// also return the points as read from the archive, before normalization, as an additional series. see the includeRaw render parameter
+	IncludeRaw bool `json:"includeRaw"`
 }
 
 // PNGroup is an identifier for a pre-normalization group: data that can be pre-normalized together
@@ -117,7 +134,7 @@ func (r *Req) AdjustTo(interval, from uint32, rets []conf.Retention) {
 
 	// let's see if we can deliver it via a lower-res rollup archive.
 	for i, ret := range rets[r.Archive+1:] {
-		if interval == uint32(ret.SecondsPerPoint) && ret.Ready <= from {
+		if interval == uint32(ret.SecondsPerPoint) && ret.Readable(from) {
 			// we're in luck. this will be more efficient than runtime consolidation
 			r.Plan(int(r.Archive)+1+i, ret)
 			return
@@ -136,10 +153,42 @@ func (r Req) PointsFetch() uint32 {
 	return (r.To - r.From) / r.ArchInterval
 }
 
+// ChunksFetch estimates the amount of chunks that need to be read for this request, given the chunkspan of its archive
+// best effort: assumes chunks are present for the entire time range, but not aware of chunks that are in memory or in the chunk cache
+func (r Req) ChunksFetch(chunkSpan uint32) uint32 {
+	if chunkSpan == 0 || r.To <= r.From {
+		return 0
+	}
+	first := r.From - r.From%chunkSpan
+	last := (r.To - 1) - (r.To-1)%chunkSpan
+	return (last-first)/chunkSpan + 1
+}
+
+// Chunks returns the start timestamps of the chunks that cover the time range of this request, given the chunkspan of its archive.
+// like ChunksFetch, it assumes chunks are present for the entire time range. the result is in ascending order.
+func (r Req) Chunks(chunkSpan uint32) []uint32 {
+	num := r.ChunksFetch(chunkSpan)
+	if num == 0 {
+		return nil
+	}
+	starts := make([]uint32, num)
+	t0 := r.From - r.From%chunkSpan
+	for i := range starts {
+		starts[i] = t0 + uint32(i)*chunkSpan
+	}
+	return starts
+}
+
 // PointsReturn estimates the amount of points that will be returned for this request
-// best effort: not aware of summarize(), runtime normalization. but does account for runtime consolidation
+// best effort: not aware of runtime normalization. but does account for summarize() and runtime consolidation
 func (r Req) PointsReturn(planMDP uint32) uint32 {
 	points := (r.To - r.From) / r.OutInterval
+	if i := r.SummarizeInterval; i > 0 && r.To > r.From {
+		// summarize() returns a point for each bucket that the data touches, buckets being aligned to the interval
+		first := r.From - r.From%i
+		last := (r.To - 1) - (r.To-1)%i
+		points = (last-first)/i + 1
+	}
 	if planMDP > 0 && points > planMDP {
 		// note that we don't assign to req.AggNum here, because that's only for normalization.
 		// MDP runtime consolidation doesn't look at req.AggNum
@@ -149,6 +198,33 @@ func (r Req) PointsReturn(planMDP uint32) uint32 {
 	return points
 }
 
+// ReqCacheKey is a compact binary representation of the data a planned request will read.
+// it is comparable, so it can be used directly as a map key.
+type ReqCacheKey [34]byte
+
+// CacheKey returns the key identifying the data the request will read from the store,
+// encoded as: org, key, archive, consolidator, archInterval, from, to.
+// Only the parameters that determine which chunks get read are included: two requests that differ
+// only in (pre-)normalization, MaxPoints, target name, pattern or PNGroup read the same data, so they
+// share a key. The consolidator only selects data for rollup archives and is zeroed out for the raw archive.
+// notes:
+// * the Req MUST have been Plan()'d already (and PlanNormalization()'d, if applicable)!
+// * the fetch layer should use the key to share chunk-cache lookups between requests that read the same
+//   data (e.g. the same series requested by multiple targets) and apply the per-request normalization afterwards.
+func (r Req) CacheKey() ReqCacheKey {
+	var k ReqCacheKey
+	binary.LittleEndian.PutUint32(k[0:], r.MKey.Org)
+	copy(k[4:20], r.MKey.Key[:])
+	k[20] = r.Archive
+	if r.Archive > 0 {
+		k[21] = byte(r.Consolidator)
+	}
+	binary.LittleEndian.PutUint32(k[22:], r.ArchInterval)
+	binary.LittleEndian.PutUint32(k[26:], r.From)
+	binary.LittleEndian.PutUint32(k[30:], r.To)
+	return k
+}
+
 func (r Req) String() string {
 	return fmt.Sprintf("%s %d - %d (%s - %s) span:%ds. points <= %d. %s.", r.MKey.String(), r.From, r.To, util.TS(r.From), util.TS(r.To), r.To-r.From-1, r.MaxPoints, r.Consolidator)
 }
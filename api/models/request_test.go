@@ -0,0 +1,123 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/grafana/metrictank/conf"
+	"github.com/grafana/metrictank/consolidation"
+	"github.com/grafana/metrictank/schema"
+)
+
+func TestReqCacheKey(t *testing.T) {
+	key, err := schema.MKeyFromString("1.01234567890123456789012345678901")
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := schema.MKeyFromString("2.01234567890123456789012345678901")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rets := conf.MustParseRetentions("10s:1d,60s:7d")
+
+	// planned returns a request for the given archive, planned onto the given interval
+	planned := func(key schema.MKey, target string, archive int, cons consolidation.Consolidator, interval uint32) Req {
+		r := NewReq(key, target, "a.*", 600, 1200, 800, 10, 0, cons, 0, nil, 0, 0)
+		r.Plan(archive, rets.Rets[archive])
+		if interval != r.ArchInterval {
+			r.PlanNormalization(interval)
+		}
+		return r
+	}
+
+	base := planned(key, "a.b", 0, consolidation.Avg, 10)
+
+	equal := []struct {
+		name string
+		req  Req
+	}{
+		{"identical", planned(key, "a.b", 0, consolidation.Avg, 10)},
+		{"different target", planned(key, "a.c", 0, consolidation.Avg, 10)},
+		{"different consolidator on raw archive", planned(key, "a.b", 0, consolidation.Max, 10)},
+		{"different normalization", planned(key, "a.b", 0, consolidation.Avg, 30)},
+	}
+	for _, c := range equal {
+		if base.CacheKey() != c.req.CacheKey() {
+			t.Errorf("%s: expected equal keys, got %x and %x", c.name, base.CacheKey(), c.req.CacheKey())
+		}
+	}
+
+	rollup := planned(key, "a.b", 1, consolidation.Avg, 60)
+	shifted := base
+	shifted.From, shifted.To = 610, 1210
+	distinct := []struct {
+		name string
+		req  Req
+	}{
+		{"different org", planned(otherKey, "a.b", 0, consolidation.Avg, 10)},
+		{"different archive", rollup},
+		{"different interval", func() Req { r := base; r.ArchInterval = 20; return r }()},
+		{"different time range", shifted},
+	}
+	for _, c := range distinct {
+		if base.CacheKey() == c.req.CacheKey() {
+			t.Errorf("%s: expected distinct keys, got %x for both", c.name, base.CacheKey())
+		}
+	}
+
+	// for rollups, the consolidator selects the data to read
+	if rollup.CacheKey() == planned(key, "a.b", 1, consolidation.Max, 60).CacheKey() {
+		t.Errorf("expected distinct keys for rollup reqs with different consolidators")
+	}
+}
+
+func TestReqChunksFetch(t *testing.T) {
+	cases := []struct {
+		from, to  uint32
+		chunkSpan uint32
+		exp       uint32
+	}{
+		// aligned to chunk boundaries
+		{600, 1200, 600, 1},
+		{0, 3600, 600, 6},
+		// partial chunks at either end still need to be read
+		{601, 1200, 600, 1},
+		{500, 1300, 600, 3},
+		{1199, 1201, 600, 2},
+		// a rollup with a large chunkspan covers the same range in fewer chunks
+		{500, 1300, 21600, 1},
+		{0, 0, 600, 0},
+		{600, 1200, 0, 0},
+	}
+	for _, c := range cases {
+		r := Req{From: c.from, To: c.to}
+		if got := r.ChunksFetch(c.chunkSpan); got != c.exp {
+			t.Errorf("from %d to %d chunkspan %d: expected %d chunks, got %d", c.from, c.to, c.chunkSpan, c.exp, got)
+		}
+	}
+}
+
+func TestReqChunks(t *testing.T) {
+	cases := []struct {
+		from, to  uint32
+		chunkSpan uint32
+		exp       []uint32
+	}{
+		// aligned to chunk boundaries
+		{600, 1200, 600, []uint32{600}},
+		{0, 2400, 600, []uint32{0, 600, 1200, 1800}},
+		// partial chunks at either end are included, starting at their aligned start
+		{601, 1200, 600, []uint32{600}},
+		{500, 1300, 600, []uint32{0, 600, 1200}},
+		{1199, 1201, 600, []uint32{600, 1200}},
+		{500, 1300, 21600, []uint32{0}},
+		{0, 0, 600, nil},
+		{600, 1200, 0, nil},
+	}
+	for _, c := range cases {
+		r := Req{From: c.from, To: c.to}
+		if got := r.Chunks(c.chunkSpan); !reflect.DeepEqual(got, c.exp) {
+			t.Errorf("from %d to %d chunkspan %d: expected chunks %v, got %v", c.from, c.to, c.chunkSpan, c.exp, got)
+		}
+	}
+}
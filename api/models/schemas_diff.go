@@ -0,0 +1,44 @@
+package models
+
+// SchemasDiff is a request to compare how a set of representative queries gets planned with the current storage schemas
+// and with proposed ones, e.g. to review a retention change before rolling it out.
+// Each of the targets is queried over each of the windows.
+type SchemasDiff struct {
+	Schemas       string   `json:"schemas" form:"schemas"`   // the proposed storage-schemas.conf
+	Targets       []string `json:"target" form:"target"`     // metric names, matched against the schemas like incoming metrics
+	Interval      int      `json:"interval" form:"interval"` // raw interval of the metrics, for interval-based matching. 0 means the interval of the first archive
+	Windows       []string `json:"window" form:"window"`     // query windows, ending now. e.g. "1h"
+	MaxDataPoints uint32   `json:"maxDataPoints" form:"maxDataPoints" binding:"Default(800)"`
+	All           bool     `json:"all" form:"all"` // also return the queries that get planned the same
+}
+
+// SchemasDiffQuery is a representative query: a single series, queried over a window ending now
+type SchemasDiffQuery struct {
+	Target   string `json:"target"`
+	Interval int    `json:"interval"`
+	Window   uint32 `json:"window"` // in seconds
+}
+
+// SchemasDiffPlan describes how a query gets planned with a given set of storage schemas
+type SchemasDiffPlan struct {
+	Schema        string `json:"schema"`
+	Retentions    string `json:"retentions"`
+	Archive       int    `json:"archive"`
+	ArchInterval  uint32 `json:"archInterval"`
+	Points        uint32 `json:"points"`                  // the number of points that get fetched
+	Unsatisfiable string `json:"unsatisfiable,omitempty"` // why the query can't be planned, if so. the fields above other than the schema are then not set
+}
+
+// SchemasDiffResult compares how a query gets planned with the current and with the proposed storage schemas
+type SchemasDiffResult struct {
+	SchemasDiffQuery
+	Current  SchemasDiffPlan `json:"current"`
+	Proposed SchemasDiffPlan `json:"proposed"`
+	Changed  bool            `json:"changed"` // whether the archive, interval, number of points or satisfiability changed
+}
+
+type SchemasDiffResp struct {
+	Queries int                 `json:"queries"` // the number of queries that were compared
+	Changed int                 `json:"changed"` // the number of queries of which the plan changed
+	Results []SchemasDiffResult `json:"results"` // the queries of which the plan changed, or all of them if requested
+}
@@ -2,6 +2,8 @@ package models
 
 import (
 	"bytes"
+	"encoding/binary"
+	"hash/fnv"
 	"math"
 	"sort"
 	"strconv"
@@ -46,6 +48,10 @@ type SeriesMetaProperties struct {
 	AggNumRC              uint32                     // aggNum runtime consolidation
 	ConsolidatorNormFetch consolidation.Consolidator // consolidator used for normalization and reading from store (if applicable)
 	ConsolidatorRC        consolidation.Consolidator // consolidator used for runtime consolidation to honor maxdatapoints (if applicable).
+	CoverageFrom          uint32                     // earliest timestamp the archive has data for, given its TTL, at the time of planning
+	PNGrouped             bool                       // whether the series was planned as part of a PNGroup, rather than as a single
+	MDPReason             string                     // why the series was (not) classified as MDP-optimizable
+	Node                  string                     // name of the cluster node that fetched the series
 	Count                 uint32                     // number of series corresponding to these properties
 }
 
@@ -60,12 +66,16 @@ type SeriesMetaPropertiesExport struct {
 	AggNumRC              uint32                     // aggNum runtime consolidation
 	ConsolidatorNormFetch consolidation.Consolidator // consolidator used for normalization and reading from store (if applicable)
 	ConsolidatorRC        consolidation.Consolidator // consolidator used for runtime consolidation to honor maxdatapoints (if applicable).
+	CoverageFrom          uint32                     // earliest timestamp the archive has data for, given its TTL, at the time of planning
+	PNGrouped             bool                       // whether the series was planned as part of a PNGroup, rather than as a single
+	MDPReason             string                     // why the series was (not) classified as MDP-optimizable
+	Node                  string                     // name of the cluster node that fetched the series
 	Count                 uint32                     // number of series corresponding to these properties
 }
 
 // Export returns a human-friendly version of the SeriesMetaProperties.
 func (smp SeriesMetaProperties) Export() SeriesMetaPropertiesExport {
-	schema := mdata.Schemas.Get(smp.SchemaID)
+	schema := mdata.SchemasSnapshot().Get(smp.SchemaID)
 	return SeriesMetaPropertiesExport{
 		SchemaName:            schema.Name,
 		SchemaRetentions:      schema.Retentions.Orig,
@@ -75,10 +85,33 @@ func (smp SeriesMetaProperties) Export() SeriesMetaPropertiesExport {
 		AggNumRC:              smp.AggNumRC,
 		ConsolidatorNormFetch: smp.ConsolidatorNormFetch,
 		ConsolidatorRC:        smp.ConsolidatorRC,
+		CoverageFrom:          smp.CoverageFrom,
+		PNGrouped:             smp.PNGrouped,
+		MDPReason:             smp.MDPReason,
+		Node:                  smp.Node,
 		Count:                 smp.Count,
 	}
 }
 
+// Applied returns the steps that were applied to the data, in order, in the form of graphite function calls:
+// the read from the archive, normalization and runtime consolidation. Steps that were not needed (aggNum 1) are omitted.
+// e.g. fetch(archive=1,interval=60,consolidateBy="avg") -> normalize(aggNum=2,consolidateBy="avg") -> consolidate(aggNum=3,consolidateBy="max")
+func (sme SeriesMetaPropertiesExport) Applied() []string {
+	fetch := "fetch(archive=" + strconv.Itoa(int(sme.ArchiveRead)) + ",interval=" + strconv.FormatUint(uint64(sme.ArchInterval), 10)
+	if sme.ArchiveRead > 0 {
+		// for rollups, the consolidator selects which data to read
+		fetch += `,consolidateBy="` + sme.ConsolidatorNormFetch.ConsolidateBy() + `"`
+	}
+	applied := []string{fetch + ")"}
+	if sme.AggNumNorm > 1 {
+		applied = append(applied, "normalize(aggNum="+strconv.FormatUint(uint64(sme.AggNumNorm), 10)+`,consolidateBy="`+sme.ConsolidatorNormFetch.ConsolidateBy()+`")`)
+	}
+	if sme.AggNumRC > 1 {
+		applied = append(applied, "consolidate(aggNum="+strconv.FormatUint(uint64(sme.AggNumRC), 10)+`,consolidateBy="`+sme.ConsolidatorRC.ConsolidateBy()+`")`)
+	}
+	return applied
+}
+
 // Merge merges SeriesMeta b into a and returns the modified a
 // counts for identical properties get added together
 func (a SeriesMeta) Merge(b SeriesMeta) SeriesMeta {
@@ -245,46 +278,207 @@ func (g SeriesByTarget) Swap(i, j int)      { g[i], g[j] = g[j], g[i] }
 func (g SeriesByTarget) Less(i, j int) bool { return g[i].Target < g[j].Target }
 
 // regular graphite output
+// like graphite's msgpack and pickle formats, we include the step (the interval, after any normalization and runtime consolidation)
 func (series SeriesByTarget) MarshalJSONFast(b []byte) ([]byte, error) {
 	b = append(b, '[')
 	for _, s := range series {
-		b = append(b, `{"target":`...)
-		b = strconv.AppendQuoteToASCII(b, s.Target)
-		if len(s.Tags) != 0 {
-			b = append(b, `,"tags":{`...)
-			for name, value := range s.Tags {
-				b = strconv.AppendQuoteToASCII(b, name)
-				b = append(b, ':')
-				b = strconv.AppendQuoteToASCII(b, value)
-				b = append(b, ',')
+		b, _ = s.MarshalJSONFast(b)
+		b = append(b, ',')
+	}
+	if len(series) != 0 {
+		b = b[:len(b)-1] // cut last comma
+	}
+	b = append(b, ']')
+	return b, nil
+}
+
+// MarshalJSONFastAt marshals the i'th series, like MarshalJSONFast does. This is used for the ndjson format.
+func (series SeriesByTarget) MarshalJSONFastAt(b []byte, i int) ([]byte, error) {
+	return series[i].MarshalJSONFast(b)
+}
+
+// SeriesRLE is a list of series that marshals like the regular graphite output, except that consecutive points
+// with the same value are merged into runs of [value, start, count], with the points of a run at start, start+step, etc.
+// This is the rle format. It saves a lot of bandwidth for series that rarely change, such as state metrics.
+type SeriesRLE []Series
+
+func (series SeriesRLE) MarshalJSONFast(b []byte) ([]byte, error) {
+	b = append(b, '[')
+	for _, s := range series {
+		b, _ = s.marshalJSONFastRLE(b)
+		b = append(b, ',')
+	}
+	if len(series) != 0 {
+		b = b[:len(b)-1] // cut last comma
+	}
+	b = append(b, ']')
+	return b, nil
+}
+
+// Run is a sequence of count points with the same value, with the first one at Start, and each next one a step later.
+type Run struct {
+	Val   float64
+	Start uint32
+	Count uint32
+}
+
+// Runs merges consecutive points with the same value (nulls included) into runs.
+// A point only extends a run if it is exactly one interval after (or, for descending series, before) the previous one,
+// so that the runs expand into the original points. Either way, a run starts at its earliest point.
+func (s Series) Runs() []Run {
+	var runs []Run
+	for i, p := range s.Datapoints {
+		if len(runs) != 0 && s.Interval != 0 {
+			last := &runs[len(runs)-1]
+			prev := s.Datapoints[i-1].Ts
+			sameVal := p.Val == last.Val || (math.IsNaN(p.Val) && math.IsNaN(last.Val))
+			if sameVal && prev == last.Start+(last.Count-1)*s.Interval && p.Ts == prev+s.Interval {
+				last.Count++
+				continue
 			}
-			// Replace trailing comma with a closing bracket
-			b[len(b)-1] = '}'
-		}
-		b = append(b, `,"datapoints":[`...)
-		for _, p := range s.Datapoints {
-			b = append(b, '[')
-			if math.IsNaN(p.Val) {
-				b = append(b, `null,`...)
-			} else {
-				b = strconv.AppendFloat(b, p.Val, 'f', -1, 64)
-				b = append(b, ',')
+			if sameVal && prev == last.Start && p.Ts+s.Interval == prev {
+				last.Start = p.Ts
+				last.Count++
+				continue
 			}
-			b = strconv.AppendUint(b, uint64(p.Ts), 10)
-			b = append(b, `],`...)
 		}
-		if len(s.Datapoints) != 0 {
-			b = b[:len(b)-1] // cut last comma
+		runs = append(runs, Run{Val: p.Val, Start: p.Ts, Count: 1})
+	}
+	return runs
+}
+
+func (s Series) marshalJSONFastRLE(b []byte) ([]byte, error) {
+	b = append(b, `{"target":`...)
+	b = strconv.AppendQuoteToASCII(b, s.Target)
+	if len(s.Tags) != 0 {
+		b = append(b, `,"tags":{`...)
+		for name, value := range s.Tags {
+			b = strconv.AppendQuoteToASCII(b, name)
+			b = append(b, ':')
+			b = strconv.AppendQuoteToASCII(b, value)
+			b = append(b, ',')
+		}
+		// Replace trailing comma with a closing bracket
+		b[len(b)-1] = '}'
+	}
+	b = append(b, `,"step":`...)
+	b = strconv.AppendUint(b, uint64(s.Interval), 10)
+	b = append(b, `,"runs":[`...)
+	runs := s.Runs()
+	for _, r := range runs {
+		b = append(b, '[')
+		if math.IsNaN(r.Val) {
+			b = append(b, `null,`...)
+		} else {
+			b = strconv.AppendFloat(b, r.Val, 'f', -1, 64)
+			b = append(b, ',')
 		}
-		b = append(b, `]},`...)
+		b = strconv.AppendUint(b, uint64(r.Start), 10)
+		b = append(b, ',')
+		b = strconv.AppendUint(b, uint64(r.Count), 10)
+		b = append(b, `],`...)
 	}
-	if len(series) != 0 {
+	if len(runs) != 0 {
 		b = b[:len(b)-1] // cut last comma
 	}
-	b = append(b, ']')
+	b = append(b, `]}`...)
+	return b, nil
+}
+
+// MarshalJSONFast marshals the series as a single object of the regular graphite output (see SeriesByTarget.MarshalJSONFast)
+func (s Series) MarshalJSONFast(b []byte) ([]byte, error) {
+	b = append(b, `{"target":`...)
+	b = strconv.AppendQuoteToASCII(b, s.Target)
+	if len(s.Tags) != 0 {
+		b = append(b, `,"tags":{`...)
+		for name, value := range s.Tags {
+			b = strconv.AppendQuoteToASCII(b, name)
+			b = append(b, ':')
+			b = strconv.AppendQuoteToASCII(b, value)
+			b = append(b, ',')
+		}
+		// Replace trailing comma with a closing bracket
+		b[len(b)-1] = '}'
+	}
+	b = append(b, `,"step":`...)
+	b = strconv.AppendUint(b, uint64(s.Interval), 10)
+	b = append(b, `,"datapoints":[`...)
+	for _, p := range s.Datapoints {
+		b = append(b, '[')
+		if math.IsNaN(p.Val) {
+			b = append(b, `null,`...)
+		} else {
+			b = strconv.AppendFloat(b, p.Val, 'f', -1, 64)
+			b = append(b, ',')
+		}
+		b = strconv.AppendUint(b, uint64(p.Ts), 10)
+		b = append(b, `],`...)
+	}
+	if len(s.Datapoints) != 0 {
+		b = b[:len(b)-1] // cut last comma
+	}
+	b = append(b, `]}`...)
 	return b, nil
 }
 func (series SeriesByTarget) MarshalJSONFastWithMeta(b []byte) ([]byte, error) {
+	return series.marshalJSONFastWithMeta(b, seriesMetaOpts{})
+}
+
+// MarshalJSONFastWithTrace is like MarshalJSONFastWithMeta, but the meta of each series also includes the steps
+// that were applied to its data (see SeriesMetaPropertiesExport.Applied)
+func (series SeriesByTarget) MarshalJSONFastWithTrace(b []byte) ([]byte, error) {
+	return series.marshalJSONFastWithMeta(b, seriesMetaOpts{trace: true})
+}
+
+// DataFrom returns the earliest timestamp the series can have data for: the query from, or, if the query reaches beyond the retention
+// of the archives that were read, the earliest CoverageFrom of its lineages. Clients can trim their axes to it.
+func (s Series) DataFrom() uint32 {
+	if len(s.Meta) == 0 {
+		return s.QueryFrom
+	}
+	from := s.Meta[0].CoverageFrom
+	for _, props := range s.Meta[1:] {
+		if props.CoverageFrom < from {
+			from = props.CoverageFrom
+		}
+	}
+	if from < s.QueryFrom {
+		return s.QueryFrom
+	}
+	return from
+}
+
+// DatapointsHash returns a hash of the timestamps and values of the datapoints of the series, as a hex string.
+// series with the same datapoints have the same hash, so clients can use it to detect whether data has changed since they last fetched it.
+// all nulls hash the same, regardless of the NaN they are represented by.
+func (s Series) DatapointsHash() string {
+	h := fnv.New64a()
+	var buf [12]byte
+	for _, p := range s.Datapoints {
+		bits := math.Float64bits(p.Val)
+		if math.IsNaN(p.Val) {
+			bits = math.Float64bits(math.NaN())
+		}
+		binary.LittleEndian.PutUint32(buf[0:], p.Ts)
+		binary.LittleEndian.PutUint64(buf[4:], bits)
+		h.Write(buf[:])
+	}
+	return strconv.FormatUint(h.Sum64(), 16)
+}
+
+// seriesMetaOpts controls which optional fields are included in the meta of each series
+type seriesMetaOpts struct {
+	trace    bool // the steps applied to the data
+	coverage bool // the earliest timestamp the archive that was read has data for, and the DataFrom of the series
+	grouping bool // whether the series was planned as part of a PNGroup, and why it was (not) classified as MDP-optimizable
+	node     bool // which cluster node fetched the series
+	hash     bool // the DatapointsHash of the series, next to its step
+	// DatapointsHashes that the client already has the datapoints of. series with one of these are marked as unchanged,
+	// and returned without their datapoints. only applies if hash is set.
+	known map[string]struct{}
+}
+
+func (series SeriesByTarget) marshalJSONFastWithMeta(b []byte, opts seriesMetaOpts) ([]byte, error) {
 	b = append(b, '[')
 	for _, s := range series {
 		b = append(b, `{"target":`...)
@@ -300,23 +494,41 @@ func (series SeriesByTarget) MarshalJSONFastWithMeta(b []byte) ([]byte, error) {
 			// Replace trailing comma with a closing bracket
 			b[len(b)-1] = '}'
 		}
-		b = append(b, `,"datapoints":[`...)
-		for _, p := range s.Datapoints {
-			b = append(b, '[')
-			if math.IsNaN(p.Val) {
-				b = append(b, `null,`...)
-			} else {
-				b = strconv.AppendFloat(b, p.Val, 'f', -1, 64)
-				b = append(b, ',')
+		b = append(b, `,"step":`...)
+		b = strconv.AppendUint(b, uint64(s.Interval), 10)
+		if opts.coverage {
+			b = append(b, `,"dataFrom":`...)
+			b = strconv.AppendUint(b, uint64(s.DataFrom()), 10)
+		}
+		var unchanged bool
+		if opts.hash {
+			hash := s.DatapointsHash()
+			b = append(b, `,"hash":"`...)
+			b = append(b, hash...)
+			b = append(b, '"')
+			if _, unchanged = opts.known[hash]; unchanged {
+				b = append(b, `,"unchanged":true`...)
 			}
-			b = strconv.AppendUint(b, uint64(p.Ts), 10)
-			b = append(b, `],`...)
 		}
-		if len(s.Datapoints) != 0 {
-			b = b[:len(b)-1] // cut last comma
+		b = append(b, `,"datapoints":[`...)
+		if !unchanged {
+			for _, p := range s.Datapoints {
+				b = append(b, '[')
+				if math.IsNaN(p.Val) {
+					b = append(b, `null,`...)
+				} else {
+					b = strconv.AppendFloat(b, p.Val, 'f', -1, 64)
+					b = append(b, ',')
+				}
+				b = strconv.AppendUint(b, uint64(p.Ts), 10)
+				b = append(b, `],`...)
+			}
+			if len(s.Datapoints) != 0 {
+				b = b[:len(b)-1] // cut last comma
+			}
 		}
 		b = append(b, `],"meta":`...)
-		b, _ = s.Meta.MarshalJSONFast(b)
+		b, _ = s.Meta.marshalJSONFast(b, opts)
 		b = append(b, `},`...)
 	}
 	if len(series) != 0 {
@@ -327,6 +539,10 @@ func (series SeriesByTarget) MarshalJSONFastWithMeta(b []byte) ([]byte, error) {
 }
 
 func (meta SeriesMeta) MarshalJSONFast(b []byte) ([]byte, error) {
+	return meta.marshalJSONFast(b, seriesMetaOpts{})
+}
+
+func (meta SeriesMeta) marshalJSONFast(b []byte, opts seriesMetaOpts) ([]byte, error) {
 	b = append(b, '[')
 	for _, props := range meta {
 		exp := props.Export()
@@ -348,6 +564,28 @@ func (meta SeriesMeta) MarshalJSONFast(b []byte) ([]byte, error) {
 		b = append(b, exp.ConsolidatorRC.String()...)
 		b = append(b, `","count":`...)
 		b = strconv.AppendUint(b, uint64(exp.Count), 10)
+		if opts.coverage {
+			b = append(b, `,"coverage-from":`...)
+			b = strconv.AppendUint(b, uint64(exp.CoverageFrom), 10)
+		}
+		if opts.grouping {
+			b = append(b, `,"pngrouped":`...)
+			b = strconv.AppendBool(b, exp.PNGrouped)
+			b = append(b, `,"mdp-reason":`...)
+			b = strconv.AppendQuoteToASCII(b, exp.MDPReason)
+		}
+		if opts.node {
+			b = append(b, `,"node":`...)
+			b = strconv.AppendQuoteToASCII(b, exp.Node)
+		}
+		if opts.trace {
+			b = append(b, `,"applied":[`...)
+			for _, step := range exp.Applied() {
+				b = strconv.AppendQuoteToASCII(b, step)
+				b = append(b, ',')
+			}
+			b[len(b)-1] = ']'
+		}
 		b = append(b, `},`...)
 	}
 	if len(meta) != 0 {
@@ -1148,6 +1148,30 @@ func (z *SeriesMetaProperties) DecodeMsg(dc *msgp.Reader) (err error) {
 				err = msgp.WrapError(err, "ConsolidatorRC")
 				return
 			}
+		case "CoverageFrom":
+			z.CoverageFrom, err = dc.ReadUint32()
+			if err != nil {
+				err = msgp.WrapError(err, "CoverageFrom")
+				return
+			}
+		case "PNGrouped":
+			z.PNGrouped, err = dc.ReadBool()
+			if err != nil {
+				err = msgp.WrapError(err, "PNGrouped")
+				return
+			}
+		case "MDPReason":
+			z.MDPReason, err = dc.ReadString()
+			if err != nil {
+				err = msgp.WrapError(err, "MDPReason")
+				return
+			}
+		case "Node":
+			z.Node, err = dc.ReadString()
+			if err != nil {
+				err = msgp.WrapError(err, "Node")
+				return
+			}
 		case "Count":
 			z.Count, err = dc.ReadUint32()
 			if err != nil {
@@ -1167,9 +1191,9 @@ func (z *SeriesMetaProperties) DecodeMsg(dc *msgp.Reader) (err error) {
 
 // EncodeMsg implements msgp.Encodable
 func (z *SeriesMetaProperties) EncodeMsg(en *msgp.Writer) (err error) {
-	// map header, size 8
+	// map header, size 12
 	// write "SchemaID"
-	err = en.Append(0x88, 0xa8, 0x53, 0x63, 0x68, 0x65, 0x6d, 0x61, 0x49, 0x44)
+	err = en.Append(0x8c, 0xa8, 0x53, 0x63, 0x68, 0x65, 0x6d, 0x61, 0x49, 0x44)
 	if err != nil {
 		return
 	}
@@ -1238,6 +1262,46 @@ func (z *SeriesMetaProperties) EncodeMsg(en *msgp.Writer) (err error) {
 		err = msgp.WrapError(err, "ConsolidatorRC")
 		return
 	}
+	// write "CoverageFrom"
+	err = en.Append(0xac, 0x43, 0x6f, 0x76, 0x65, 0x72, 0x61, 0x67, 0x65, 0x46, 0x72, 0x6f, 0x6d)
+	if err != nil {
+		return
+	}
+	err = en.WriteUint32(z.CoverageFrom)
+	if err != nil {
+		err = msgp.WrapError(err, "CoverageFrom")
+		return
+	}
+	// write "PNGrouped"
+	err = en.Append(0xa9, 0x50, 0x4e, 0x47, 0x72, 0x6f, 0x75, 0x70, 0x65, 0x64)
+	if err != nil {
+		return
+	}
+	err = en.WriteBool(z.PNGrouped)
+	if err != nil {
+		err = msgp.WrapError(err, "PNGrouped")
+		return
+	}
+	// write "MDPReason"
+	err = en.Append(0xa9, 0x4d, 0x44, 0x50, 0x52, 0x65, 0x61, 0x73, 0x6f, 0x6e)
+	if err != nil {
+		return
+	}
+	err = en.WriteString(z.MDPReason)
+	if err != nil {
+		err = msgp.WrapError(err, "MDPReason")
+		return
+	}
+	// write "Node"
+	err = en.Append(0xa4, 0x4e, 0x6f, 0x64, 0x65)
+	if err != nil {
+		return
+	}
+	err = en.WriteString(z.Node)
+	if err != nil {
+		err = msgp.WrapError(err, "Node")
+		return
+	}
 	// write "Count"
 	err = en.Append(0xa5, 0x43, 0x6f, 0x75, 0x6e, 0x74)
 	if err != nil {
@@ -1254,9 +1318,9 @@ func (z *SeriesMetaProperties) EncodeMsg(en *msgp.Writer) (err error) {
 // MarshalMsg implements msgp.Marshaler
 func (z *SeriesMetaProperties) MarshalMsg(b []byte) (o []byte, err error) {
 	o = msgp.Require(b, z.Msgsize())
-	// map header, size 8
+	// map header, size 12
 	// string "SchemaID"
-	o = append(o, 0x88, 0xa8, 0x53, 0x63, 0x68, 0x65, 0x6d, 0x61, 0x49, 0x44)
+	o = append(o, 0x8c, 0xa8, 0x53, 0x63, 0x68, 0x65, 0x6d, 0x61, 0x49, 0x44)
 	o = msgp.AppendUint16(o, z.SchemaID)
 	// string "Archive"
 	o = append(o, 0xa7, 0x41, 0x72, 0x63, 0x68, 0x69, 0x76, 0x65)
@@ -1284,6 +1348,18 @@ func (z *SeriesMetaProperties) MarshalMsg(b []byte) (o []byte, err error) {
 		err = msgp.WrapError(err, "ConsolidatorRC")
 		return
 	}
+	// string "CoverageFrom"
+	o = append(o, 0xac, 0x43, 0x6f, 0x76, 0x65, 0x72, 0x61, 0x67, 0x65, 0x46, 0x72, 0x6f, 0x6d)
+	o = msgp.AppendUint32(o, z.CoverageFrom)
+	// string "PNGrouped"
+	o = append(o, 0xa9, 0x50, 0x4e, 0x47, 0x72, 0x6f, 0x75, 0x70, 0x65, 0x64)
+	o = msgp.AppendBool(o, z.PNGrouped)
+	// string "MDPReason"
+	o = append(o, 0xa9, 0x4d, 0x44, 0x50, 0x52, 0x65, 0x61, 0x73, 0x6f, 0x6e)
+	o = msgp.AppendString(o, z.MDPReason)
+	// string "Node"
+	o = append(o, 0xa4, 0x4e, 0x6f, 0x64, 0x65)
+	o = msgp.AppendString(o, z.Node)
 	// string "Count"
 	o = append(o, 0xa5, 0x43, 0x6f, 0x75, 0x6e, 0x74)
 	o = msgp.AppendUint32(o, z.Count)
@@ -1350,6 +1426,30 @@ func (z *SeriesMetaProperties) UnmarshalMsg(bts []byte) (o []byte, err error) {
 				err = msgp.WrapError(err, "ConsolidatorRC")
 				return
 			}
+		case "CoverageFrom":
+			z.CoverageFrom, bts, err = msgp.ReadUint32Bytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "CoverageFrom")
+				return
+			}
+		case "PNGrouped":
+			z.PNGrouped, bts, err = msgp.ReadBoolBytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "PNGrouped")
+				return
+			}
+		case "MDPReason":
+			z.MDPReason, bts, err = msgp.ReadStringBytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "MDPReason")
+				return
+			}
+		case "Node":
+			z.Node, bts, err = msgp.ReadStringBytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "Node")
+				return
+			}
 		case "Count":
 			z.Count, bts, err = msgp.ReadUint32Bytes(bts)
 			if err != nil {
@@ -1370,6 +1470,6 @@ func (z *SeriesMetaProperties) UnmarshalMsg(bts []byte) (o []byte, err error) {
 
 // Msgsize returns an upper bound estimate of the number of bytes occupied by the serialized message
 func (z *SeriesMetaProperties) Msgsize() (s int) {
-	s = 1 + 9 + msgp.Uint16Size + 8 + msgp.Uint8Size + 13 + msgp.Uint32Size + 11 + msgp.Uint32Size + 9 + msgp.Uint32Size + 22 + z.ConsolidatorNormFetch.Msgsize() + 15 + z.ConsolidatorRC.Msgsize() + 6 + msgp.Uint32Size
+	s = 1 + 9 + msgp.Uint16Size + 8 + msgp.Uint8Size + 13 + msgp.Uint32Size + 11 + msgp.Uint32Size + 9 + msgp.Uint32Size + 22 + z.ConsolidatorNormFetch.Msgsize() + 15 + z.ConsolidatorRC.Msgsize() + 13 + msgp.Uint32Size + 10 + msgp.BoolSize + 10 + msgp.StringPrefixSize + len(z.MDPReason) + 5 + msgp.StringPrefixSize + len(z.Node) + 6 + msgp.Uint32Size
 	return
 }
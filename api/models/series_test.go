@@ -2,10 +2,15 @@ package models
 
 import (
 	"encoding/json"
+	"math"
 	"math/rand"
 	"reflect"
+	"regexp"
 	"testing"
 
+	"github.com/grafana/metrictank/conf"
+	"github.com/grafana/metrictank/consolidation"
+	"github.com/grafana/metrictank/mdata"
 	"github.com/grafana/metrictank/schema"
 )
 
@@ -26,7 +31,7 @@ func TestJsonMarshal(t *testing.T) {
 					Interval:   60,
 				},
 			},
-			out: `[{"target":"a","datapoints":[]}]`,
+			out: `[{"target":"a","step":60,"datapoints":[]}]`,
 		},
 		{
 			in: []Series{
@@ -36,7 +41,7 @@ func TestJsonMarshal(t *testing.T) {
 					Interval:   60,
 				},
 			},
-			out: `[{"target":"a\\b","datapoints":[]}]`,
+			out: `[{"target":"a\\b","step":60,"datapoints":[]}]`,
 		},
 		{
 			in: []Series{
@@ -51,7 +56,7 @@ func TestJsonMarshal(t *testing.T) {
 					Interval: 60,
 				},
 			},
-			out: `[{"target":"a","datapoints":[[123,60],[10000,120],[0,180],[1,240]]}]`,
+			out: `[{"target":"a","step":60,"datapoints":[[123,60],[10000,120],[0,180],[1,240]]}]`,
 		},
 		{
 			in: []Series{
@@ -77,7 +82,7 @@ func TestJsonMarshal(t *testing.T) {
 					Interval: 10,
 				},
 			},
-			out: `[{"target":"a","datapoints":[[123,60],[10000,120],[0,180],[1,240]]},{"target":"foo(bar)","datapoints":[[123.456,10],[123.7,20],[124.1001,30],[125,40],[126,50]]}]`,
+			out: `[{"target":"a","step":60,"datapoints":[[123,60],[10000,120],[0,180],[1,240]]},{"target":"foo(bar)","step":10,"datapoints":[[123.456,10],[123.7,20],[124.1001,30],[125,40],[126,50]]}]`,
 		},
 	}
 
@@ -93,6 +98,279 @@ func TestJsonMarshal(t *testing.T) {
 	}
 }
 
+// TestSeriesRLE verifies that the runs of the rle format expand back into the original series
+func TestSeriesRLE(t *testing.T) {
+	nan := math.NaN()
+	in := []Series{
+		{
+			Target:     "empty",
+			Interval:   10,
+			Datapoints: []schema.Point{},
+		},
+		{
+			Target:   "state",
+			Tags:     map[string]string{"name": "state"},
+			Interval: 10,
+			Datapoints: []schema.Point{
+				{Val: 0, Ts: 10}, {Val: 0, Ts: 20}, {Val: 0, Ts: 30}, {Val: 1, Ts: 40}, {Val: 1, Ts: 50},
+				{Val: nan, Ts: 60}, {Val: nan, Ts: 70}, {Val: 1, Ts: 80}, {Val: 0, Ts: 90}, {Val: 0.5, Ts: 100},
+			},
+		},
+		{
+			// the gap must not be absorbed into the run
+			Target:     "gap",
+			Interval:   60,
+			Datapoints: []schema.Point{{Val: 1, Ts: 60}, {Val: 1, Ts: 120}, {Val: 1, Ts: 300}, {Val: 1, Ts: 360}},
+		},
+	}
+	expRuns := []int{0, 6, 2}
+
+	buf, err := SeriesRLE(in).MarshalJSONFast(nil)
+	if err != nil {
+		t.Fatalf("failed to marshal: %s", err)
+	}
+	var out []struct {
+		Target string
+		Tags   map[string]string
+		Step   uint32
+		Runs   [][3]*float64
+	}
+	if err := json.Unmarshal(buf, &out); err != nil {
+		t.Fatalf("output is not valid json: %s. output: %s", err, buf)
+	}
+	if len(out) != len(in) {
+		t.Fatalf("expected %d series, got %d. output: %s", len(in), len(out), buf)
+	}
+	for i, o := range out {
+		if o.Target != in[i].Target || o.Step != in[i].Interval || !reflect.DeepEqual(o.Tags, in[i].Tags) {
+			t.Fatalf("series %d: expected target %q, step %d and tags %v, got %q, %d and %v", i, in[i].Target, in[i].Interval, in[i].Tags, o.Target, o.Step, o.Tags)
+		}
+		if len(o.Runs) != expRuns[i] {
+			t.Errorf("series %d: expected %d runs, got %d. output: %s", i, expRuns[i], len(o.Runs), buf)
+		}
+		points := []schema.Point{}
+		for _, r := range o.Runs {
+			val := nan
+			if r[0] != nil {
+				val = *r[0]
+			}
+			for j := uint32(0); j < uint32(*r[2]); j++ {
+				points = append(points, schema.Point{Val: val, Ts: uint32(*r[1]) + j*o.Step})
+			}
+		}
+		if len(points) != len(in[i].Datapoints) {
+			t.Fatalf("series %d: expected %d points after expanding, got %d", i, len(in[i].Datapoints), len(points))
+		}
+		for j, p := range points {
+			exp := in[i].Datapoints[j]
+			if p.Ts != exp.Ts || (p.Val != exp.Val && !(math.IsNaN(p.Val) && math.IsNaN(exp.Val))) {
+				t.Errorf("series %d point %d: expected %v, got %v", i, j, exp, p)
+			}
+		}
+	}
+}
+
+// TestSeriesRunsDesc verifies that the points of descending series (order=desc) get merged into runs as well
+func TestSeriesRunsDesc(t *testing.T) {
+	nan := math.NaN()
+	s := Series{
+		Interval: 10,
+		Datapoints: []schema.Point{
+			{Val: 0.5, Ts: 100}, {Val: 0, Ts: 90}, {Val: 1, Ts: 80}, {Val: nan, Ts: 70}, {Val: nan, Ts: 60},
+			{Val: 1, Ts: 50}, {Val: 1, Ts: 40}, {Val: 0, Ts: 30}, {Val: 0, Ts: 20}, {Val: 0, Ts: 10},
+		},
+	}
+	exp := []Run{{0.5, 100, 1}, {0, 90, 1}, {1, 80, 1}, {nan, 60, 2}, {1, 40, 2}, {0, 10, 3}}
+	got := s.Runs()
+	if len(got) != len(exp) {
+		t.Fatalf("expected runs %v, got %v", exp, got)
+	}
+	for i, r := range got {
+		if r.Start != exp[i].Start || r.Count != exp[i].Count || (r.Val != exp[i].Val && !(math.IsNaN(r.Val) && math.IsNaN(exp[i].Val))) {
+			t.Fatalf("expected runs %v, got %v", exp, got)
+		}
+	}
+}
+
+func TestSeriesMetaTrace(t *testing.T) {
+	mdata.Schemas = conf.NewSchemas([]conf.Schema{
+		{
+			Name:       "default",
+			Pattern:    regexp.MustCompile(".*"),
+			Retentions: conf.MustParseRetentions("10s:1d,60s:30d"),
+		},
+	})
+	// e.g. sum(a.*) where one input was read raw and another from a rollup,
+	// normalized to a common interval and runtime consolidated to honor maxDataPoints
+	in := SeriesByTarget{
+		{
+			Target:     "sumSeries(a.*)",
+			Interval:   360,
+			Datapoints: []schema.Point{{Val: 1, Ts: 360}},
+			Meta: SeriesMeta{
+				{SchemaID: 0, Archive: 0, ArchInterval: 10, AggNumNorm: 6, AggNumRC: 6, ConsolidatorNormFetch: consolidation.Avg, ConsolidatorRC: consolidation.Max, Count: 1},
+				{SchemaID: 1, Archive: 1, ArchInterval: 60, AggNumNorm: 1, AggNumRC: 6, ConsolidatorNormFetch: consolidation.Avg, ConsolidatorRC: consolidation.Max, Count: 2},
+			},
+		},
+	}
+	expApplied := [][]string{
+		{`fetch(archive=0,interval=10)`, `normalize(aggNum=6,consolidateBy="avg")`, `consolidate(aggNum=6,consolidateBy="max")`},
+		{`fetch(archive=1,interval=60,consolidateBy="avg")`, `consolidate(aggNum=6,consolidateBy="max")`},
+	}
+	for i, props := range in[0].Meta {
+		if got := props.Export().Applied(); !reflect.DeepEqual(got, expApplied[i]) {
+			t.Errorf("lineage %d: expected applied steps %v, got %v", i, expApplied[i], got)
+		}
+	}
+
+	var withMeta, withTrace []struct {
+		Meta []map[string]interface{} `json:"meta"`
+	}
+	buf, _ := in.MarshalJSONFastWithMeta(nil)
+	if err := json.Unmarshal(buf, &withMeta); err != nil {
+		t.Fatalf("failed to unmarshal %s: %s", buf, err)
+	}
+	buf, _ = in.MarshalJSONFastWithTrace(nil)
+	if err := json.Unmarshal(buf, &withTrace); err != nil {
+		t.Fatalf("failed to unmarshal %s: %s", buf, err)
+	}
+	for i := range expApplied {
+		if _, ok := withMeta[0].Meta[i]["applied"]; ok {
+			t.Errorf("lineage %d: expected no applied steps without trace, got %v", i, withMeta[0].Meta[i])
+		}
+		var got []string
+		for _, step := range withTrace[0].Meta[i]["applied"].([]interface{}) {
+			got = append(got, step.(string))
+		}
+		if !reflect.DeepEqual(got, expApplied[i]) {
+			t.Errorf("lineage %d: expected applied steps %v in trace, got %v", i, expApplied[i], got)
+		}
+		delete(withTrace[0].Meta[i], "applied")
+		if !reflect.DeepEqual(withMeta[0].Meta[i], withTrace[0].Meta[i]) {
+			t.Errorf("lineage %d: expected the trace to extend the meta %v, got %v", i, withMeta[0].Meta[i], withTrace[0].Meta[i])
+		}
+	}
+}
+
+func TestSeriesMetaCoverage(t *testing.T) {
+	mdata.Schemas = conf.NewSchemas([]conf.Schema{
+		{
+			Name:       "default",
+			Pattern:    regexp.MustCompile(".*"),
+			Retentions: conf.MustParseRetentions("10s:1d,60s:30d"),
+		},
+	})
+	in := SeriesByTarget{
+		{
+			Target:     "a",
+			Interval:   60,
+			Datapoints: []schema.Point{{Val: 1, Ts: 360}},
+			Meta: SeriesMeta{
+				{SchemaID: 1, Archive: 1, ArchInterval: 60, AggNumNorm: 1, ConsolidatorNormFetch: consolidation.Avg, CoverageFrom: 1000, Count: 1},
+			},
+		},
+	}
+	var out struct {
+		Series []struct {
+			DataFrom *uint32                  `json:"dataFrom"`
+			Meta     []map[string]interface{} `json:"meta"`
+		} `json:"series"`
+	}
+	for _, coverage := range []bool{false, true} {
+		out.Series = nil
+		buf, _ := ResponseWithMeta{Series: in, Coverage: coverage}.MarshalJSONFast(nil)
+		if err := json.Unmarshal(buf, &out); err != nil {
+			t.Fatalf("failed to unmarshal %s: %s", buf, err)
+		}
+		got, ok := out.Series[0].Meta[0]["coverage-from"]
+		if ok != coverage || (coverage && got != float64(1000)) {
+			t.Errorf("coverage %t: expected coverage-from 1000 to be included: %t, got %v", coverage, coverage, out.Series[0].Meta[0])
+		}
+		if dataFrom := out.Series[0].DataFrom; (dataFrom != nil) != coverage || (coverage && *dataFrom != 1000) {
+			t.Errorf("coverage %t: expected dataFrom 1000 to be included: %t, got %s", coverage, coverage, buf)
+		}
+	}
+}
+
+// TestSeriesDataFrom verifies the earliest timestamp series can have data for, when their window exceeds the retention
+// of (some of) the archives that were read
+func TestSeriesDataFrom(t *testing.T) {
+	cases := []struct {
+		name      string
+		queryFrom uint32
+		coverage  []uint32 // CoverageFrom of each lineage
+		exp       uint32
+	}{
+		{"NoMeta", 500, nil, 500},
+		{"WithinRetention", 1500, []uint32{1000}, 1500},
+		{"BeyondRetention", 500, []uint32{1000}, 1000},
+		{"EarliestLineage", 500, []uint32{1000, 800, 2000}, 800},
+		{"SomeLineageWithinRetention", 500, []uint32{1000, 0}, 500},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := Series{QueryFrom: c.queryFrom}
+			for _, from := range c.coverage {
+				s.Meta = append(s.Meta, SeriesMetaProperties{CoverageFrom: from, Count: 1})
+			}
+			if got := s.DataFrom(); got != c.exp {
+				t.Errorf("expected %d, got %d", c.exp, got)
+			}
+		})
+	}
+}
+
+func TestSeriesMetaGrouping(t *testing.T) {
+	mdata.Schemas = conf.NewSchemas([]conf.Schema{
+		{
+			Name:       "default",
+			Pattern:    regexp.MustCompile(".*"),
+			Retentions: conf.MustParseRetentions("10s:1d,60s:30d"),
+		},
+	})
+	in := SeriesByTarget{
+		{
+			Target:     "sumSeries(a.*)",
+			Interval:   60,
+			Datapoints: []schema.Point{{Val: 1, Ts: 360}},
+			Meta: SeriesMeta{
+				{SchemaID: 1, Archive: 1, ArchInterval: 60, AggNumNorm: 1, ConsolidatorNormFetch: consolidation.Avg, PNGrouped: true, MDPReason: "optimizable", Count: 2},
+			},
+		},
+		{
+			Target:     "b",
+			Interval:   10,
+			Datapoints: []schema.Point{{Val: 1, Ts: 360}},
+			Meta: SeriesMeta{
+				{SchemaID: 1, Archive: 0, ArchInterval: 10, AggNumNorm: 1, ConsolidatorNormFetch: consolidation.None, MDPReason: "graphite-origin request", Count: 1},
+			},
+		},
+	}
+	var out struct {
+		Series []struct {
+			Meta []map[string]interface{} `json:"meta"`
+		} `json:"series"`
+	}
+	for _, grouping := range []bool{false, true} {
+		buf, _ := ResponseWithMeta{Series: in, Grouping: grouping}.MarshalJSONFast(nil)
+		if err := json.Unmarshal(buf, &out); err != nil {
+			t.Fatalf("failed to unmarshal %s: %s", buf, err)
+		}
+		for i, exp := range []bool{true, false} {
+			got, ok := out.Series[i].Meta[0]["pngrouped"]
+			if ok != grouping || (grouping && got != exp) {
+				t.Errorf("grouping %t: expected pngrouped %t to be included: %t, got %v", grouping, exp, grouping, out.Series[i].Meta[0])
+			}
+		}
+		for i, exp := range []string{"optimizable", "graphite-origin request"} {
+			got, ok := out.Series[i].Meta[0]["mdp-reason"]
+			if ok != grouping || (grouping && got != exp) {
+				t.Errorf("grouping %t: expected mdp-reason %q to be included: %t, got %v", grouping, exp, grouping, out.Series[i].Meta[0])
+			}
+		}
+	}
+}
+
 func TestSetTags(t *testing.T) {
 	cases := []struct {
 		in  Series
@@ -195,3 +473,61 @@ func randString(n int) string {
 	}
 	return string(b)
 }
+
+func TestDatapointsHash(t *testing.T) {
+	points := func() []schema.Point {
+		return []schema.Point{{Val: 1, Ts: 60}, {Val: math.NaN(), Ts: 120}, {Val: 3, Ts: 180}}
+	}
+	base := Series{Target: "a", Datapoints: points()}.DatapointsHash()
+
+	same := Series{Target: "b", Datapoints: points()}
+	same.Datapoints[1].Val = math.Float64frombits(0x7ff8000000000002) // a null represented by another NaN
+	if hash := same.DatapointsHash(); hash != base {
+		t.Errorf("expected identical datapoints to have the same hash %s, got %s", base, hash)
+	}
+
+	changes := map[string]func(p []schema.Point){
+		"value":     func(p []schema.Point) { p[2].Val = 4 },
+		"null":      func(p []schema.Point) { p[1].Val = 0 },
+		"timestamp": func(p []schema.Point) { p[2].Ts = 240 },
+	}
+	for name, change := range changes {
+		changed := points()
+		change(changed)
+		if hash := (Series{Datapoints: changed}).DatapointsHash(); hash == base {
+			t.Errorf("%s: expected the hash to change, got %s", name, hash)
+		}
+	}
+	if hash := (Series{Datapoints: points()[:2]}).DatapointsHash(); hash == base {
+		t.Errorf("expected the hash to change when a point is removed, got %s", hash)
+	}
+}
+
+func TestSeriesHashKnown(t *testing.T) {
+	in := SeriesByTarget{
+		{Target: "a", Interval: 60, Datapoints: []schema.Point{{Val: 1, Ts: 60}}},
+		{Target: "b", Interval: 60, Datapoints: []schema.Point{{Val: 2, Ts: 60}}},
+	}
+	known := map[string]struct{}{in[0].DatapointsHash(): {}}
+	var out struct {
+		Series []struct {
+			Target     string
+			Hash       string
+			Unchanged  bool
+			Datapoints [][2]float64
+		} `json:"series"`
+	}
+	buf, _ := ResponseWithMeta{Series: in, Hash: true, KnownHashes: known}.MarshalJSONFast(nil)
+	if err := json.Unmarshal(buf, &out); err != nil {
+		t.Fatalf("failed to unmarshal %s: %s", buf, err)
+	}
+	for i, exp := range []bool{true, false} {
+		s := out.Series[i]
+		if s.Hash != in[i].DatapointsHash() {
+			t.Errorf("series %s: expected hash %s, got %s", s.Target, in[i].DatapointsHash(), s.Hash)
+		}
+		if s.Unchanged != exp || (len(s.Datapoints) == 0) != exp {
+			t.Errorf("series %s: expected unchanged %t, and datapoints to be omitted: %t, got %s", s.Target, exp, exp, buf)
+		}
+	}
+}
@@ -0,0 +1,8 @@
+package models
+
+// Tail is a request to stream the points of the series matching a target as they arrive
+type Tail struct {
+	Target        string `json:"target" form:"target" binding:"Required"`
+	Interval      string `json:"interval" form:"interval"`           // stream the points at this interval, e.g. "1min", rounded up to a multiple of the native interval. empty means the native interval
+	ConsolidateBy string `json:"consolidateBy" form:"consolidateBy"` // consolidation function to bring the points to the interval. empty means the primary aggregation method of the series
+}
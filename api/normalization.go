@@ -0,0 +1,91 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/grafana/metrictank/api/middleware"
+	"github.com/grafana/metrictank/api/models"
+	"github.com/grafana/metrictank/api/response"
+	"github.com/grafana/metrictank/mdata"
+	"github.com/grafana/metrictank/util"
+	"github.com/raintank/dur"
+)
+
+// normalization explains which common interval the given schemas and intervals would get normalized to,
+// and which archive would be read for each of the schemas.
+func (s *Server) normalization(ctx *middleware.Context, req models.Normalization) {
+	resp, err := explainNormalization(uint32(time.Now().Unix()), req)
+	if err != nil {
+		response.Write(ctx, response.WrapError(err))
+		return
+	}
+	response.Write(ctx, response.NewJson(200, resp, ""))
+}
+
+// explainNormalization mirrors how planHighestResMulti normalizes the requests of a PNGroup:
+// each schema contributes the interval of its highest resolution archive that covers the TTL,
+// the common interval is the LCM of those and the given intervals, and each schema then reads
+// from its coarsest (or finest, see normalization-pref) archive that can deliver the common interval.
+func explainNormalization(now uint32, req models.Normalization) (models.NormalizationResp, error) {
+	var resp models.NormalizationResp
+	if len(req.SchemaIds) == 0 && len(req.Intervals) == 0 {
+		return resp, response.NewError(http.StatusBadRequest, "at least one schemaId or interval is required")
+	}
+	var ttl uint32
+	if req.TTL != "" {
+		var err error
+		ttl, err = dur.ParseDuration(req.TTL)
+		if err != nil {
+			return resp, response.NewError(http.StatusBadRequest, fmt.Sprintf("could not parse ttl %q: %s", req.TTL, err.Error()))
+		}
+	}
+	var from uint32
+	if ttl < now {
+		from = now - ttl
+	}
+
+	schemas := mdata.SchemasSnapshot()
+	intervals := make([]uint32, 0, len(req.SchemaIds)+len(req.Intervals))
+	for _, id := range req.SchemaIds {
+		if int(id) >= schemas.Len() {
+			return resp, response.NewError(http.StatusBadRequest, fmt.Sprintf("unknown schemaId %d", id))
+		}
+		rets := schemas.Get(id).Retentions.Rets
+		_, ret, ok := findHighestResRet(rets, from, ttl)
+		if !ok || !ret.Valid(readyFrom(from), ttl) {
+			return resp, response.NewError(http.StatusBadRequest, fmt.Sprintf("schemaId %d has no ready archive covering the ttl", id))
+		}
+		intervals = append(intervals, uint32(ret.SecondsPerPoint))
+	}
+	for _, interval := range req.Intervals {
+		if interval == 0 {
+			return resp, response.NewError(http.StatusBadRequest, "intervals must be > 0")
+		}
+		intervals = append(intervals, interval)
+	}
+
+	resp.Interval = util.Lcm(intervals)
+	if resp.Interval == 0 {
+		return resp, response.NewError(http.StatusBadRequest, "no common interval: the LCM of the intervals does not fit in a uint32")
+	}
+
+	for _, id := range req.SchemaIds {
+		schema := schemas.Get(id)
+		archive, ret, ok := findValidResForInterval(schema.Retentions.Rets, from, ttl, resp.Interval)
+		if !ok {
+			// this should never happen: the schema contributed its own interval to the LCM
+			return resp, response.NewError(http.StatusInternalServerError, fmt.Sprintf("schemaId %d can't deliver interval %d", id, resp.Interval))
+		}
+		resp.Schemas = append(resp.Schemas, models.NormalizationSchema{
+			Id:           id,
+			Name:         schema.Name,
+			Retentions:   schema.Retentions.Orig,
+			Archive:      archive,
+			ArchInterval: uint32(ret.SecondsPerPoint),
+			AggNum:       resp.Interval / uint32(ret.SecondsPerPoint),
+		})
+	}
+	return resp, nil
+}
@@ -0,0 +1,94 @@
+package api
+
+import (
+	"net/http"
+	"reflect"
+	"regexp"
+	"testing"
+
+	"github.com/grafana/metrictank/api/models"
+	"github.com/grafana/metrictank/api/response"
+	"github.com/grafana/metrictank/conf"
+	"github.com/grafana/metrictank/mdata"
+)
+
+func TestExplainNormalization(t *testing.T) {
+	// expanded schema ids: a is 0,1,2 and b is 3,4
+	mdata.Schemas = conf.NewSchemas([]conf.Schema{
+		{
+			Name:       "a",
+			Pattern:    regexp.MustCompile("^a"),
+			Retentions: conf.MustParseRetentions("10s:1d,60s:7d,300s:30d"),
+		},
+		{
+			Name:       "b",
+			Pattern:    regexp.MustCompile("^b"),
+			Retentions: conf.MustParseRetentions("15s:1d,120s:7d"),
+		},
+	})
+	now := uint32(100 * 24 * 3600)
+	a := func(archive int, archInterval, aggNum uint32) models.NormalizationSchema {
+		return models.NormalizationSchema{Id: 0, Name: "a", Retentions: "10s:1d,60s:7d,300s:30d", Archive: archive, ArchInterval: archInterval, AggNum: aggNum}
+	}
+	b := func(archive int, archInterval, aggNum uint32) models.NormalizationSchema {
+		return models.NormalizationSchema{Id: 3, Name: "b", Retentions: "15s:1d,120s:7d", Archive: archive, ArchInterval: archInterval, AggNum: aggNum}
+	}
+
+	cases := []struct {
+		name    string
+		req     models.Normalization
+		expResp models.NormalizationResp
+		expCode int
+	}{
+		{
+			"RawIntervals",
+			models.Normalization{SchemaIds: []uint16{0, 3}},
+			models.NormalizationResp{Interval: 30, Schemas: []models.NormalizationSchema{a(0, 10, 3), b(0, 15, 2)}},
+			0,
+		},
+		{
+			// the raw archives don't cover the ttl, so we normalize the first rollups
+			"Rollups",
+			models.Normalization{SchemaIds: []uint16{0, 3}, TTL: "3d"},
+			models.NormalizationResp{Interval: 120, Schemas: []models.NormalizationSchema{a(1, 60, 2), b(1, 120, 1)}},
+			0,
+		},
+		{
+			"SchemaAndInterval",
+			models.Normalization{SchemaIds: []uint16{0}, Intervals: []uint32{45}},
+			models.NormalizationResp{Interval: 90, Schemas: []models.NormalizationSchema{a(0, 10, 9)}},
+			0,
+		},
+		{
+			"IntervalsOnly",
+			models.Normalization{Intervals: []uint32{4, 6}},
+			models.NormalizationResp{Interval: 12},
+			0,
+		},
+		{"Empty", models.Normalization{}, models.NormalizationResp{}, http.StatusBadRequest},
+		{"UnknownSchema", models.Normalization{SchemaIds: []uint16{100}}, models.NormalizationResp{}, http.StatusBadRequest},
+		{"TTLNotMet", models.Normalization{SchemaIds: []uint16{3}, TTL: "30d"}, models.NormalizationResp{}, http.StatusBadRequest},
+		{"BadTTL", models.Normalization{SchemaIds: []uint16{0}, TTL: "foo"}, models.NormalizationResp{}, http.StatusBadRequest},
+		{"ZeroInterval", models.Normalization{Intervals: []uint32{0}}, models.NormalizationResp{}, http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			resp, err := explainNormalization(now, c.req)
+			if c.expCode != 0 {
+				if err == nil {
+					t.Fatalf("expected error with code %d, got none", c.expCode)
+				}
+				if code := response.WrapError(err).HTTPStatusCode(); code != c.expCode {
+					t.Fatalf("expected error with code %d, got %d: %s", c.expCode, code, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected no error, got %s", err)
+			}
+			if !reflect.DeepEqual(resp, c.expResp) {
+				t.Errorf("expected %+v, got %+v", c.expResp, resp)
+			}
+		})
+	}
+}
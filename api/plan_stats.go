@@ -0,0 +1,48 @@
+package api
+
+// PlanStats is a snapshot of the planner metrics of a single render request.
+// The aggregate meters (e.g. api.request.render.points_fetched) of concurrent requests are interleaved,
+// whereas a PlanStats allows to correlate them, e.g. the points fetched with the archives that were chosen.
+type PlanStats struct {
+	From           uint32           `json:"from"`
+	To             uint32           `json:"to"`
+	MaxDataPoints  uint32           `json:"maxDataPoints"`  // the maxDataPoints used for planning, if any
+	Series         uint32           `json:"series"`         // the number of series planned
+	PNGroups       uint32           `json:"pngroups"`       // the number of pre-normalization groups
+	PointsFetch    uint32           `json:"pointsFetch"`    // see api.request.render.points_fetched
+	PointsReturn   uint32           `json:"pointsReturn"`   // see api.request.render.points_returned
+	ChosenArchives map[uint8]uint32 `json:"chosenArchives"` // the number of series read from each archive (0 means raw data, 1 means first agg level, etc)
+}
+
+// PlanStatsSink receives the PlanStats of planned render requests, e.g. to emit them as structured events.
+// PlanStats is invoked synchronously at the end of planning, once per request, so implementations must be cheap and must not block.
+type PlanStatsSink interface {
+	PlanStats(stats PlanStats)
+}
+
+// planStatsSink is the sink that the stats of each plan are reported to. nil disables it.
+var planStatsSink PlanStatsSink
+
+// SetPlanStatsSink registers the sink that the stats of each planned render request are reported to.
+// it must be called before the api starts serving requests. nil disables it.
+func SetPlanStatsSink(s PlanStatsSink) {
+	planStatsSink = s
+}
+
+// newPlanStats takes a snapshot of the planner metrics of the plan
+func newPlanStats(from, to, planMDP uint32, rp ReqsPlan) PlanStats {
+	stats := PlanStats{
+		From:           from,
+		To:             to,
+		MaxDataPoints:  planMDP,
+		PNGroups:       uint32(len(rp.pngroups)),
+		PointsFetch:    rp.PointsFetch(),
+		PointsReturn:   rp.PointsReturn(planMDP),
+		ChosenArchives: make(map[uint8]uint32),
+	}
+	for _, req := range rp.List() {
+		stats.Series++
+		stats.ChosenArchives[req.Archive]++
+	}
+	return stats
+}
@@ -0,0 +1,147 @@
+package api
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/grafana/metrictank/conf"
+	"github.com/grafana/metrictank/mdata"
+)
+
+// retTables caches the retTable of each set of retentions. nil disables plan tables.
+var retTables *retTableCache
+
+// retTable is a lookup table of the retention that findHighestResRet picks amongst a set of retentions, for any from and ttl.
+// Which retentions are valid only changes when from crosses the Ready timestamp of a retention, or ttl crosses the max retention
+// of one. So the table has a cell for each combination of those ranges, which is computed once by scanning the retentions.
+// Note that the cells also depend on ready-lead, archive-fanout-costs and archive-fanout-tolerance, which don't change at runtime.
+type retTable struct {
+	readies []uint32         // the distinct Ready timestamps of the retentions, ascending, starting with 0. each starts a range of readyFrom(from)
+	ttls    []uint32         // the distinct max retentions of the retentions, ascending. each ends a range of ttl
+	cells   [][]retTableCell // for each range of readyFrom(from), for each range of ttl (and one for a ttl beyond all max retentions)
+}
+
+type retTableCell struct {
+	archive   int
+	ok        bool
+	preferred bool // whether a coarser retention was preferred due to archive-fanout-costs
+}
+
+func newRetTable(rets []conf.Retention) *retTable {
+	t := &retTable{
+		readies: []uint32{0},
+	}
+	for _, ret := range rets {
+		t.readies = appendUnique(t.readies, ret.Ready)
+		t.ttls = appendUnique(t.ttls, uint32(ret.MaxRetention()))
+	}
+	sort.Slice(t.readies, func(i, j int) bool { return t.readies[i] < t.readies[j] })
+	sort.Slice(t.ttls, func(i, j int) bool { return t.ttls[i] < t.ttls[j] })
+
+	t.cells = make([][]retTableCell, len(t.readies))
+	for i, ready := range t.readies {
+		t.cells[i] = make([]retTableCell, len(t.ttls)+1)
+		for j := range t.cells[i] {
+			// any ttl within the range has the same outcome, so we use the highest one
+			ttl := t.ttls[len(t.ttls)-1] + 1
+			if j < len(t.ttls) {
+				ttl = t.ttls[j]
+			}
+			archive, ok, preferred := scanHighestResRet(rets, ready, ttl)
+			t.cells[i][j] = retTableCell{archive, ok, preferred}
+		}
+	}
+	return t
+}
+
+func appendUnique(s []uint32, v uint32) []uint32 {
+	for _, e := range s {
+		if e == v {
+			return s
+		}
+	}
+	return append(s, v)
+}
+
+// lookup returns the same as scanHighestResRet would for the retentions of the table.
+// there are only a few ranges, so a linear search is fastest.
+func (t *retTable) lookup(ready, ttl uint32) (int, bool, bool) {
+	i := len(t.readies) - 1
+	for i > 0 && t.readies[i] > ready {
+		i--
+	}
+	j := 0
+	for j < len(t.ttls) && t.ttls[j] < ttl {
+		j++
+	}
+	cell := t.cells[i][j]
+	return cell.archive, cell.ok, cell.preferred
+}
+
+// retTableCache builds the retTable of each set of retentions on first use,
+// and drops them all when the schemas get replaced (see mdata.SetSchemas), or once there are maxRetTables of them.
+// lookups are lock-free: the tables are replaced as a whole whenever one is added.
+type retTableCache struct {
+	sync.Mutex
+	tables atomic.Value // retTableSet
+}
+
+// maxRetTables bounds the number of tables. there is one for each distinct set of retentions that gets planned against,
+// which normally is a few per schema, but e.g. each min-fetch-interval or /schemas/diff request may add some.
+const maxRetTables = 1000
+
+// retTableSet holds the retTable of each set of retentions of a given generation of the schemas
+type retTableSet struct {
+	generation uint32
+	tables     map[string]*retTable
+}
+
+// appendRetTableKey appends the key that identifies the given retentions to b: the properties of each retention that the table depends on.
+// schemas get copied when they are derived (e.g. see conf.Schemas.WithMinInterval), so we can't identify retentions by their location.
+func appendRetTableKey(b []byte, rets []conf.Retention) []byte {
+	for _, ret := range rets {
+		var disabled uint32
+		if ret.Disabled {
+			disabled = 1
+		}
+		for _, v := range [...]uint32{uint32(ret.SecondsPerPoint), uint32(ret.MaxRetention()), ret.Ready, disabled} {
+			b = append(b, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+		}
+	}
+	return b
+}
+
+func newRetTableCache() *retTableCache {
+	c := &retTableCache{}
+	c.tables.Store(retTableSet{
+		generation: mdata.SchemasGeneration(),
+		tables:     make(map[string]*retTable),
+	})
+	return c
+}
+
+// get returns the retTable of the given (non-empty) retentions
+func (c *retTableCache) get(rets []conf.Retention) *retTable {
+	var buf [128]byte
+	key := appendRetTableKey(buf[:0], rets)
+	generation := mdata.SchemasGeneration()
+	set := c.tables.Load().(retTableSet)
+	if t, ok := set.tables[string(key)]; ok && set.generation == generation {
+		return t
+	}
+
+	t := newRetTable(rets)
+	c.Lock()
+	set = c.tables.Load().(retTableSet)
+	tables := make(map[string]*retTable, len(set.tables)+1)
+	if set.generation == generation && len(set.tables) < maxRetTables {
+		for k, v := range set.tables {
+			tables[k] = v
+		}
+	}
+	tables[string(key)] = t
+	c.tables.Store(retTableSet{generation, tables})
+	c.Unlock()
+	return t
+}
@@ -6,13 +6,22 @@ import (
 	"net/http"
 	"reflect"
 	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/grafana/metrictank/api/models"
 	"github.com/grafana/metrictank/api/response"
 	"github.com/grafana/metrictank/conf"
+	"github.com/grafana/metrictank/consolidation"
+	"github.com/grafana/metrictank/expr"
 	"github.com/grafana/metrictank/mdata"
+	"github.com/grafana/metrictank/schema"
 	"github.com/grafana/metrictank/stats"
 	"github.com/grafana/metrictank/util"
+	"github.com/grafana/metrictank/util/align"
+	log "github.com/sirupsen/logrus"
 )
 
 var (
@@ -22,11 +31,192 @@ var (
 	// metric api.request.render.points_fetched is the number of points that need to be fetched for a /render request.
 	reqRenderPointsFetched = stats.NewMeter32("api.request.render.points_fetched", false)
 	// metric api.request.render.points_returned is the number of points the request will return
-	// best effort: not aware of summarize(), aggregation functions, runtime normalization. but does account for runtime consolidation
+	// best effort: not aware of aggregation functions, runtime normalization. but does account for summarize() and runtime consolidation
 	reqRenderPointsReturned = stats.NewMeter32("api.request.render.points_returned", false)
+	// metric api.request.render.mdp_fill_ratio is the average amount of points per series that the planned intervals yield, before runtime consolidation,
+	// as a percentage of maxDataPoints. 50-100 means MDP-optimization tracks the requested density well, up to 200 means we over-deliver (see the mdp/2 floor),
+	// and below 50 means we coarsened beyond what maxDataPoints asked for (e.g. to honor max-points-per-req-soft). only for requests with maxDataPoints
+	reqRenderMDPFillRatio = stats.NewMeter32("api.request.render.mdp_fill_ratio", false)
+	// metric api.request.render.unsatisfiable.no_ready_archive is the number of requests that could not be satisfied because a schema has no enabled archive that is ready
+	reqRenderUnsatisfiableNoReadyArchive = stats.NewCounter32("api.request.render.unsatisfiable.no_ready_archive")
+	// metric api.request.render.unsatisfiable.ttl_not_met is the number of requests that could not be satisfied because a schema has no ready archive with a long enough TTL
+	reqRenderUnsatisfiableTTLNotMet = stats.NewCounter32("api.request.render.unsatisfiable.ttl_not_met")
+	// metric api.request.render.unsatisfiable.no_valid_interval is the number of requests that could not be satisfied because no common interval could be found amongst the schemas of a PNGroup
+	reqRenderUnsatisfiableNoValidInterval = stats.NewCounter32("api.request.render.unsatisfiable.no_valid_interval")
+	// metric api.request.render.unsatisfiable.no_retentions is the number of requests that could not be satisfied because a schema has no retentions at all
+	reqRenderUnsatisfiableNoRetentions = stats.NewCounter32("api.request.render.unsatisfiable.no_retentions")
+	// metric api.request.render.unsatisfiable.mdp_too_high is the number of requests rejected due to mdp-strict, because the MDP-optimizable series
+	// of a PNGroup could not be normalized to an interval that yields at least maxDataPoints/2 points
+	reqRenderUnsatisfiableMDPTooHigh = stats.NewCounter32("api.request.render.unsatisfiable.mdp_too_high")
+	// metric api.request.render.pngroups is the number of pre-normalization groups (PNGroups) a /render request plans
+	reqRenderPNGroups = stats.NewMeter32("api.request.render.pngroups", false)
+	// metric api.request.render.soft_limit.passes is the number of reduction passes needed to honor max-points-per-req-soft, for requests that exceeded it
+	reqRenderSoftLimitPasses = stats.NewMeter32("api.request.render.soft_limit.passes", false)
+	// metric api.request.render.soft_limit.points_over is how many points requests still fetch above max-points-per-req-soft after reduction, for requests that could not meet it
+	reqRenderSoftLimitPointsOver = stats.NewMeter32("api.request.render.soft_limit.points_over", false)
+	// metric api.request.render.soft_limit.points_under is how many points requests fetch below max-points-per-req-soft after reduction, for requests that met it
+	reqRenderSoftLimitPointsUnder = stats.NewMeter32("api.request.render.soft_limit.points_under", false)
+	// metric api.request.render.soft_limit.stalled is the number of requests that could not meet max-points-per-req-soft because their resolution could not be reduced any further
+	reqRenderSoftLimitStalled = stats.NewCounter32("api.request.render.soft_limit.stalled")
+	// metric api.request.render.soft_limit.capped is the number of requests that could not meet max-points-per-req-soft within max-points-per-req-soft-passes reduction passes
+	reqRenderSoftLimitCapped = stats.NewCounter32("api.request.render.soft_limit.capped")
+	// metric api.request.render.soft_limit.ignored is the number of requests that skipped max-points-per-req-soft because they set ignoreSoftLimit
+	reqRenderSoftLimitIgnored = stats.NewCounter32("api.request.render.soft_limit.ignored")
+	// metric api.request.render.soft_limit.counter_sum is the number of counter series that read the sum rollup, rather than their default one, after being coarsened to honor max-points-per-req-soft
+	reqRenderSoftLimitCounterSum = stats.NewCounter32("api.request.render.soft_limit.counter_sum")
+	// metric api.request.render.hard_limit_headroom is the number of requests of which max-points-per-req-hard was reduced by max-points-per-req-hard-headroom, because they have lookback functions
+	reqRenderHardLimitHeadroom = stats.NewCounter32("api.request.render.hard_limit_headroom")
+	// metric api.request.render.clamped_to is the number of requests of which the to was in the future, and that were planned as if it were now, due to plan-clamp-to
+	reqRenderClampedTo = stats.NewCounter32("api.request.render.clamped_to")
+	// metric api.request.render.plan.prefer_warm is the number of pre-normalization groups and schemas of singles of which the MDP-optimizable requests were planned at the highest resolution, because their window lies within plan-warm-window (see plan-prefer-warm)
+	reqRenderPlanPreferWarm = stats.NewCounter32("api.request.render.plan.prefer_warm")
+	// metric api.request.render.plan.archives_inspected is the number of retention archives that the planners inspected. Divided by the rate of
+	// render requests, this tells how much of the planning cost is due to schemas with many archives
+	reqRenderPlanArchivesInspected = stats.NewCounter64("api.request.render.plan.archives_inspected")
+	// metric api.request.render.plan.fanout_preferred is the number of times the planner read a coarser archive than the highest resolution one,
+	// because it has a comparable point count and a lower archive-fanout-costs
+	reqRenderFanoutPreferred = stats.NewCounter32("api.request.render.plan.fanout_preferred")
+	// metric api.request.render.plan.chunks_preferred is the number of times a pre-normalization group was coarsened beyond the next common interval,
+	// because a coarser one reads fewer chunks, see reduce-res-candidates
+	reqRenderChunksPreferred = stats.NewCounter32("api.request.render.plan.chunks_preferred")
+	// metric api.request.render.plan.loss_budget_applied is the number of MDP-optimizable pre-normalization groups that were planned
+	// to a finer common interval than they would have been otherwise, due to mdp-max-loss-factor
+	reqRenderLossBudgetApplied = stats.NewCounter32("api.request.render.plan.loss_budget_applied")
+	// metric api.request.render.plan.budget_exceeded is the number of interval searches for pre-normalization groups that were abandoned because they exceeded plan-time-budget
+	reqRenderPlanBudgetExceeded = stats.NewCounter32("api.request.render.plan.budget_exceeded")
+	// metric api.request.render.plan.combinations is the number of interval combinations that need to be evaluated to plan a pre-normalization group
+	reqRenderPlanCombinations = stats.NewMeter32("api.request.render.plan.combinations", false)
 
-	errUnSatisfiable   = response.NewError(http.StatusNotFound, "request cannot be satisfied due to lack of available retentions")
-	errMaxPointsPerReq = response.NewError(http.StatusRequestEntityTooLarge, "request exceeds max-points-per-req-hard limit. Reduce the time range or number of targets or ask your admin to increase the limit.")
+	// metric api.request.render.rollup_guard.raw is the number of series that were moved to their raw archive because their rollup does not store the requested consolidation
+	reqRenderRollupGuardRaw = stats.NewCounter32("api.request.render.rollup_guard.raw")
+	// metric api.request.render.rollup_guard.unmet is the number of series that read a rollup which does not store the requested consolidation, because their raw archive could not be used
+	reqRenderRollupGuardUnmet = stats.NewCounter32("api.request.render.rollup_guard.unmet")
+
+	// metric api.request.render.singles_incompatible is the number of schemas of which the MDP-optimizable and non-MDP-optimizable singles of a request
+	// were planned to intervals that are not multiples of one another
+	reqRenderSinglesIncompatible = stats.NewCounter32("api.request.render.singles_incompatible")
+
+	// metric api.request.render.normalization_ratio is the ratio of the output interval to the archive interval of series that get
+	// pre-normalized, tagged by the name of their storage-schemas rule (e.g. `api.request.render.normalization_ratio;schema=default`)
+	reqRenderNormalizationRatio = normalizationRatios{meters: make(map[string]*stats.Meter32)}
+
+	errUnSatisfiable             = response.NewError(http.StatusNotFound, "request cannot be satisfied due to lack of available retentions")
+	errNoRetentions              = response.NewError(http.StatusInternalServerError, "request cannot be satisfied because the storage schema of some of the series has no retentions. this is a misconfiguration")
+	errMaxPointsPerReq           = response.NewError(http.StatusRequestEntityTooLarge, "request exceeds max-points-per-req-hard limit. Reduce the time range or number of targets or ask your admin to increase the limit.")
+	errAlignStrictInterval       = response.NewError(http.StatusUnprocessableEntity, "align=strict: the series can't be normalized to a common interval")
+	errMDPStrict                 = response.NewError(http.StatusBadRequest, "the time range is too short for the requested maxDataPoints: the series can't be normalized to a common interval that yields at least maxDataPoints/2 points. Increase the time range or reduce maxDataPoints.")
+	errMaxPointsPerReqSoftPasses = response.NewError(http.StatusRequestEntityTooLarge, "request exceeds max-points-per-req-soft limit after max-points-per-req-soft-passes reduction passes. Reduce the time range or number of targets or ask your admin to increase the limits.")
+)
+
+// normalizationRatios tracks the normalization ratios per schema.
+// meters are only created for schemas that have been normalized, so the cardinality is bounded by the amount of schemas.
+type normalizationRatios struct {
+	sync.Mutex
+	meters map[string]*stats.Meter32
+}
+
+func (n *normalizationRatios) get(schema string) *stats.Meter32 {
+	n.Lock()
+	meter, ok := n.meters[schema]
+	if !ok {
+		tag := strings.NewReplacer(";", "_", "~", "_", " ", "_").Replace(schema)
+		meter = stats.NewMeter32WithTags("api.request.render.normalization_ratio", ";schema="+tag, false)
+		n.meters[schema] = meter
+	}
+	n.Unlock()
+	return meter
+}
+
+// observe reports the normalization ratio (OutInterval/ArchInterval) of all requests of the plan that get pre-normalized.
+// normalization only applies to PNGroups
+func (n *normalizationRatios) observe(schemas *conf.Schemas, rp ReqsPlan) {
+	type key struct {
+		schema string
+		ratio  uint32
+	}
+	counts := make(map[key]uint32)
+	for _, data := range rp.pngroups {
+		for _, rbr := range []ReqsByRet{data.mdpyes, data.mdpno} {
+			for schemaID, reqs := range rbr {
+				for _, req := range reqs {
+					if req.ArchInterval == 0 || req.OutInterval == req.ArchInterval {
+						continue
+					}
+					counts[key{schemas.Get(uint16(schemaID)).Name, req.OutInterval / req.ArchInterval}]++
+				}
+			}
+		}
+	}
+	for k, cnt := range counts {
+		n.get(k.schema).ValuesUint32(k.ratio, cnt)
+	}
+}
+
+// mayIgnoreSoftLimit returns whether the given org may skip max-points-per-req-soft, as per ignore-soft-limit-orgs
+func mayIgnoreSoftLimit(orgId uint32) bool {
+	_, ok := ignoreSoftLimitOrgs[orgId]
+	return ok
+}
+
+// mayRequestRawTimestamps returns whether the given org may request the raw data at its stored timestamps, as per raw-timestamps-orgs
+func mayRequestRawTimestamps(orgId uint32) bool {
+	_, ok := rawTimestampsOrgs[orgId]
+	return ok
+}
+
+// getMinFetchInterval returns the finest interval the given org may read, see min-fetch-interval and min-fetch-interval-orgs
+func getMinFetchInterval(orgId uint32) uint32 {
+	if interval, ok := minFetchIntOrgs[orgId]; ok {
+		return interval
+	}
+	return minFetchInterval
+}
+
+// softLimit returns the max-points-per-req-soft limit to plan a request with. if the request ignores it, planning skips step 2 (see planRequests)
+func softLimit(ignore bool) int {
+	if ignore {
+		reqRenderSoftLimitIgnored.Inc()
+		return 0
+	}
+	return maxPointsPerReqSoft
+}
+
+// hardLimit returns the max-points-per-req-hard limit to plan a request with. if the request has functions that read data
+// before its from (see hasLookback), max-points-per-req-hard-headroom of it is reserved for that extra data.
+func hardLimit(lookback bool) int {
+	if !lookback || maxPointsPerReqHardHeadroom == 0 || maxPointsPerReqHard == 0 {
+		return maxPointsPerReqHard
+	}
+	reqRenderHardLimitHeadroom.Inc()
+	return int(float64(maxPointsPerReqHard) * (1 - maxPointsPerReqHardHeadroom))
+}
+
+// hasLookback returns whether any of the given requests reads data before from, due to functions such as movingAverage
+func hasLookback(reqs []expr.Req, from uint32) bool {
+	for _, r := range reqs {
+		if r.From < from {
+			return true
+		}
+	}
+	return false
+}
+
+// granularities at which the Ready timestamp of archives is compared to the from of requests, see ready-granularity
+const (
+	readyGranularitySecond   = "second"
+	readyGranularityInterval = "interval"
+)
+
+// strategies to reduce resolutions to honor max-points-per-req-soft
+const (
+	softStrategySequential   = "sequential"
+	softStrategyProportional = "proportional"
+)
+
+// preferences for the archive to normalize from, see findValidResForInterval
+const (
+	normalizationPrefMinFetch    = "min-fetch"
+	normalizationPrefMaxAccuracy = "max-accuracy"
 )
 
 // planRequests updates the requests with all details for fetching.
@@ -52,6 +242,7 @@ var (
 //    * requests in the same PNGroup but not MDP-optimizable: reduce conservatively: to shortest common interval that still meets TTL
 //    * MDP optimizable singles     : longest interval such that points >= MDP/2
 //    * non-MDP-optimizable singles : shortest interval that still meets TTL
+//    If cheapest is set, MDP-optimizability doesn't matter: all requests get the longest (common, for PNGroups) interval that still meets TTL
 //
 // 2) apply max-points-per-req-soft (meaning: pick coarser data as needed)
 //    The optimizations in the previous step should increase the odds of meeting this limit.
@@ -59,6 +250,9 @@ var (
 //    a) reduce the already MDP-optimized ones further but that would definitely result in loss of accuracy
 //    b) reduce non-MDP-optimizable series.
 //    For "fairness" across series, and because we used to simply reduce any series without regard for how it would be used, we pick the latter. better would be both
+//    We stop when the limit is met, when no further reduction is possible, or after max-points-per-req-soft-passes passes (if set).
+//    In the latter case, max-points-per-req-soft-reject determines whether we reject the request or move on to the next step.
+//    If all requests are non-MDP-optimizable singles of one schema, we compute the needed reduction in one shot.
 // 3) subject to max-points-per-req-hard: reject the query if it can't be met
 //
 // note: it is assumed that all requests have the same from & to.
@@ -66,47 +260,64 @@ var (
 
 // TODO: MDP-yes and max-points-per-req-soft code paths may not take into account that archive 0 may have a different raw interval.
 // see https://github.com/grafana/metrictank/issues/1679 (for MDP-no it does do the right thing)
-func planRequests(now, from, to uint32, reqs *ReqMap, planMDP uint32, mpprSoft, mpprHard int) (*ReqsPlan, error) {
+func planRequests(now, from, to uint32, reqs *ReqMap, planMDP uint32, mdpTarget bool, maxPointsFetch uint32, cheapest bool, mpprSoft, mpprHard int, minFetchInterval uint32) (*ReqsPlan, error) {
 
-	ok, rp := false, NewReqsPlan(*reqs)
+	// all planning is done against a single snapshot of the schemas, so that it is consistent
+	// even if they get replaced while we're planning
+	schemas := planSchemas(minFetchInterval)
+	rp := NewReqsPlan(schemas, *reqs)
+
+	// the cost of planning, and of honoring max-points-per-req-soft in particular, grows with the amount of PNGroups
+	reqRenderPNGroups.ValueUint32(uint32(len(rp.pngroups)))
+	if maxPNGroupsPerReq > 0 && len(rp.pngroups) > maxPNGroupsPerReq {
+		return nil, response.NewError(http.StatusRequestEntityTooLarge, fmt.Sprintf("request has %d pre-normalization groups, which exceeds the max-pngroups-per-req limit (%d). Reduce the number of aggregated targets or ask your admin to increase the limit.", len(rp.pngroups), maxPNGroupsPerReq))
+	}
+
+	// if requested, plan as if a to in the future were now: there can't be any data beyond now,
+	// so counting the points up to the requested to only makes us pick coarser data than needed.
+	// the requested to is restored once we're done, so that the response still covers the requested window.
+	reqTo := to
+	if planClampTo && to > now && from < now {
+		reqRenderClampedTo.Inc()
+		to = now
+		setTo(rp, to)
+	}
 
 	// 1) Initial parameters
-	for group, split := range rp.pngroups {
-		if split.mdpyes.HasData() {
-			ok = planLowestResForMDPMulti(now, from, to, planMDP, split.mdpyes)
-			if !ok {
-				return nil, errUnSatisfiable
+	if _, err := planInitial(schemas, now, from, to, &rp, planMDP, mdpTarget, cheapest, false); err != nil {
+		return nil, err
+	}
+
+	// if requested, use the finest resolution that fetches no more than maxPointsFetch points per series.
+	// we start from the planned resolution and pick coarser data until all requests of each PNGroup
+	// and schema of singles fit the budget (or we can't go any coarser)
+	if maxPointsFetch > 0 {
+		for _, data := range rp.pngroups {
+			for _, rbr := range []ReqsByRet{data.mdpyes, data.mdpno} {
+				for rbr.HasData() && rbr.HighestPointsFetch() > maxPointsFetch {
+					if !reduceResMulti(schemas, now, from, to, rbr) {
+						break
+					}
+				}
 			}
-			rp.pngroups[group] = split
 		}
-		if split.mdpno.HasData() {
-			ok = planHighestResMulti(now, from, to, split.mdpno)
-			if !ok {
-				return nil, errUnSatisfiable
+		for _, rbr := range []ReqsByRet{rp.single.mdpyes, rp.single.mdpno} {
+			for schemaID, reqs := range rbr {
+				for len(reqs) > 0 && highestPointsFetch(reqs) > maxPointsFetch {
+					if !reduceResSingles(schemas, now, from, to, uint16(schemaID), reqs) {
+						break
+					}
+				}
 			}
 		}
 	}
-	for schemaID, reqs := range rp.single.mdpyes {
-		if len(reqs) == 0 {
-			continue
-		}
-		ok = planLowestResForMDPSingles(now, from, to, planMDP, uint16(schemaID), reqs)
-		if !ok {
-			return nil, errUnSatisfiable
-		}
-	}
-	for schemaID, reqs := range rp.single.mdpno {
-		if len(reqs) == 0 {
-			continue
-		}
-		ok = planHighestResSingles(now, from, to, uint16(schemaID), reqs)
-		if !ok {
-			return nil, errUnSatisfiable
-		}
-	}
 
 	// 2) pick coarser data if needed to honor max-points-per-req-soft
+	var passes int
+	var capped bool
+	var pointsBefore uint32
 	if mpprSoft > 0 {
+		pointsBefore = rp.PointsFetch()
 		// at this point, MDP-optimizable series have already seen a decent resolution reduction
 		// so to meet this constraint, we will try to reduce the resolution of non-MDP-optimizable series
 		// in the future we can make this even more aggressive and also try to reduce MDP-optimized series even more
@@ -130,20 +341,90 @@ func planRequests(now, from, to uint32, reqs *ReqMap, planMDP uint32, mpprSoft,
 		// * In particular, our logic to do PNGroups in ascending size order, then singles in schemaID order, is made up.
 		// * Because PNGroups may be comprised of multiple schemas, we typically don't have to adjust all of the comprising requests
 		//   to achieve an overall point reduction for the entire group. This means that singles may reduce faster than PNGroups
+		//   (see the proportional strategy, which addresses this)
 		progress := true
 
+		// a common case is a request for many non-MDP-optimizable series of one schema, e.g. a wildcard. there is only one candidate
+		// to reduce, so both strategies come down to reducing it until we meet the limit, which we can compute in one shot.
+		if schemaID, ok := rp.single.mdpno.soleSchemaID(); ok && len(rp.pngroups) == 0 && !rp.single.mdpyes.HasData() {
+			var honored bool
+			passes, honored = reduceResSinglesForSoftLimit(schemas, now, from, to, schemaID, rp.single.mdpno[schemaID], uint32(mpprSoft), maxPointsPerReqSoftPasses)
+			if !honored {
+				if maxPointsPerReqSoftPasses > 0 && passes == maxPointsPerReqSoftPasses {
+					capped = true
+				} else if maxPointsPerReqSoftStrat != softStrategyProportional {
+					// the sequential strategy also counts the pass that found it could not reduce any further
+					passes++
+				}
+			}
+			goto HonoredSoft
+		}
+
 		pngroupsByLen := make([]models.PNGroup, 0, len(rp.pngroups))
 		for group := range rp.pngroups {
 			pngroupsByLen = append(pngroupsByLen, group)
 		}
 		sort.Slice(pngroupsByLen, func(i, j int) bool { return rp.pngroups[pngroupsByLen[i]].Len() < rp.pngroups[pngroupsByLen[j]].Len() })
 
+		if maxPointsPerReqSoftStrat == softStrategyProportional {
+			// rather than reducing all PNGroups and then all singles, each pass reduces whichever PNGroup, or schema of singles,
+			// currently fetches the most points. This spreads the reductions according to their contribution, and avoids needlessly
+			// reducing the resolution of small PNGroups. Note that here, each pass is a single reduction.
+			type softCandidate struct {
+				points func() uint32
+				reduce func() bool
+			}
+			var candidates []softCandidate
+			for _, groupID := range pngroupsByLen {
+				rbr := rp.pngroups[groupID].mdpno
+				if rbr.HasData() {
+					candidates = append(candidates, softCandidate{
+						points: rbr.PointsFetch,
+						reduce: func() bool { return reduceResMulti(schemas, now, from, to, rbr) },
+					})
+				}
+			}
+			for schemaID, reqs := range rp.single.mdpno {
+				if len(reqs) > 0 {
+					schemaID, reqs := uint16(schemaID), reqs
+					candidates = append(candidates, softCandidate{
+						points: func() uint32 { return pointsFetch(reqs) },
+						reduce: func() bool { return reduceResSingles(schemas, now, from, to, schemaID, reqs) },
+					})
+				}
+			}
+			for rp.PointsFetch() > uint32(mpprSoft) && len(candidates) > 0 {
+				if maxPointsPerReqSoftPasses > 0 && passes == maxPointsPerReqSoftPasses {
+					capped = true
+					break
+				}
+				biggest := 0
+				for i := range candidates {
+					if candidates[i].points() > candidates[biggest].points() {
+						biggest = i
+					}
+				}
+				if !candidates[biggest].reduce() {
+					// can't be reduced any further
+					candidates = append(candidates[:biggest], candidates[biggest+1:]...)
+					continue
+				}
+				passes++
+			}
+			goto HonoredSoft
+		}
+
 		for rp.PointsFetch() > uint32(mpprSoft) && progress {
+			if maxPointsPerReqSoftPasses > 0 && passes == maxPointsPerReqSoftPasses {
+				capped = true
+				break
+			}
+			passes++
 			progress = false
 			for _, groupID := range pngroupsByLen {
 				data := rp.pngroups[groupID]
 				if len(data.mdpno) > 0 {
-					ok := reduceResMulti(now, from, to, data.mdpno)
+					ok := reduceResMulti(schemas, now, from, to, data.mdpno)
 					if ok {
 						progress = true
 						if rp.PointsFetch() <= uint32(mpprSoft) {
@@ -154,7 +435,7 @@ func planRequests(now, from, to uint32, reqs *ReqMap, planMDP uint32, mpprSoft,
 			}
 			for schemaID, reqs := range rp.single.mdpno {
 				if len(reqs) > 0 {
-					ok := reduceResSingles(now, from, to, uint16(schemaID), reqs)
+					ok := reduceResSingles(schemas, now, from, to, uint16(schemaID), reqs)
 					if ok {
 						progress = true
 						if rp.PointsFetch() <= uint32(mpprSoft) {
@@ -166,6 +447,47 @@ func planRequests(now, from, to uint32, reqs *ReqMap, planMDP uint32, mpprSoft,
 		}
 	}
 HonoredSoft:
+	if passes > 0 {
+		reqRenderSoftLimitPasses.Value(passes)
+		if points := rp.PointsFetch(); points > uint32(mpprSoft) {
+			reqRenderSoftLimitPointsOver.ValueUint32(points - uint32(mpprSoft))
+			if capped {
+				reqRenderSoftLimitCapped.Inc()
+				if maxPointsPerReqSoftReject {
+					return nil, errMaxPointsPerReqSoftPasses
+				}
+			} else {
+				reqRenderSoftLimitStalled.Inc()
+			}
+		} else {
+			reqRenderSoftLimitPointsUnder.ValueUint32(uint32(mpprSoft) - points)
+		}
+		if rp.PointsFetch() < pointsBefore {
+			rp.degraded = "resolution was reduced to honor max-points-per-req-soft"
+		}
+	}
+
+	// requests must not silently read a rollup that was stored with another function than the one requested.
+	// this may fetch more points, so it must happen before we enforce max-points-per-req-hard
+	rp.warnings = guardRollups(schemas, mdata.Aggregations, now, from, rp, mpprSoft)
+	if planMDP > 0 && !cheapest && maxPointsFetch == 0 {
+		rp.warnings = append(rp.warnings, mdpLossWarnings(schemas, now, from, planMDP, mdpTarget, rp)...)
+	}
+
+	// singles of the same schema are planned independently depending on whether they are MDP-optimizable,
+	// so make sure they don't end up at intervals that are not multiples of one another
+	for schemaID := range rp.single.mdpyes {
+		if !compatibleIntervals(rp.single.mdpyes[schemaID], rp.single.mdpno[schemaID]) {
+			reqRenderSinglesIncompatible.Inc()
+			if reconcileSingles {
+				reconcileIntervals(rp.single.mdpyes[schemaID], rp.single.mdpno[schemaID])
+			}
+		}
+	}
+
+	if rp.degraded == "" && belowMDP(schemas, now, from, rp) {
+		rp.degraded = "fewer than maxDataPoints/2 points are returned, although higher resolution data is available"
+	}
 
 	// 3) honor max-points-per-req-hard
 	if mpprHard > 0 && int(rp.PointsFetch()) > mpprHard {
@@ -173,6 +495,12 @@ HonoredSoft:
 
 	}
 
+	if to != reqTo {
+		setTo(rp, reqTo)
+	}
+	setCoverage(now, rp)
+	setPNGrouped(rp)
+
 	// 4) send out some metrics and we're done!
 	for _, reqs := range rp.single.mdpyes {
 		if len(reqs) != 0 {
@@ -198,148 +526,781 @@ HonoredSoft:
 	}
 	reqRenderPointsFetched.ValueUint32(rp.PointsFetch())
 	reqRenderPointsReturned.ValueUint32(rp.PointsReturn(planMDP))
+	if planMDP > 0 && rp.cnt > 0 {
+		reqRenderMDPFillRatio.ValueUint32(mdpFillRatio(rp, planMDP))
+	}
+	reqRenderNormalizationRatio.observe(schemas, rp)
+	if planStatsSink != nil {
+		planStatsSink.PlanStats(newPlanStats(from, to, planMDP, rp))
+	}
+	if mergePNGroups {
+		rp.mergePNGroups()
+	}
 
 	return &rp, nil
 }
 
-// planHighestResSingles plans all requests of the given retention to their most precise resolution (which may be different for different retentions)
-func planHighestResSingles(now, from, to uint32, schemaID uint16, reqs []models.Req) bool {
-	rets := mdata.Schemas.Get(uint16(schemaID)).Retentions.Rets
-	minTTL := now - from
-	archive, ret, ok := findHighestResRet(rets, from, minTTL)
-	if ok {
-		for i := range reqs {
-			req := &reqs[i]
-			req.Plan(archive, ret)
+// belowMDP returns whether any MDP-optimizable request returns fewer than MaxPoints/2 points, while it could return more
+// if it were planned to the highest resolution available. for PNGroups, this is the highest common resolution.
+func belowMDP(schemas *conf.Schemas, now, from uint32, rp ReqsPlan) bool {
+	minTTL := getMinTTL(now, from)
+	// highest returns the highest resolution interval available to the request
+	highest := func(req models.Req) uint32 {
+		archive, ret, ok := findHighestResRet(schemas.Get(req.SchemaId).Retentions.Rets, from, minTTL)
+		if !ok {
+			return req.OutInterval
+		}
+		if archive == 0 {
+			return req.RawInterval
 		}
+		return uint32(ret.SecondsPerPoint)
 	}
-	return ok
-}
-
-// planLowestResForMDPSingles plans all requests of the given retention to an interval such that requests still return >=mdp/2 points (interval may be different for different retentions)
-func planLowestResForMDPSingles(now, from, to, mdp uint32, schemaID uint16, reqs []models.Req) bool {
-	if len(reqs) == 0 {
-		return true
+	below := func(req models.Req, interval uint32) bool {
+		return req.OutInterval > interval && (req.To-req.From)/req.OutInterval < req.MaxPoints/2
 	}
-	rets := mdata.Schemas.Get(uint16(schemaID)).Retentions.Rets
-	var archive int
-	var ret conf.Retention
-	var ok bool
-	for i := len(rets) - 1; i >= 0; i-- {
-		// skip non-ready option.
-		if rets[i].Ready > from {
+	for _, reqs := range rp.single.mdpyes {
+		for _, req := range reqs {
+			if below(req, highest(req)) {
+				return true
+			}
+		}
+	}
+	for _, data := range rp.pngroups {
+		var intervals []uint32
+		for _, reqs := range data.mdpyes {
+			for _, req := range reqs {
+				intervals = append(intervals, highest(req))
+			}
+		}
+		if len(intervals) == 0 {
 			continue
 		}
-		archive, ret, ok = i, rets[i], true
-		(&reqs[0]).Plan(i, rets[i])
-		if reqs[0].PointsFetch() >= mdp/2 {
-			break
+		interval := util.Lcm(intervals)
+		for _, reqs := range data.mdpyes {
+			for _, req := range reqs {
+				if interval != 0 && below(req, interval) {
+					return true
+				}
+			}
 		}
 	}
-	if !ok {
-		return false
+	return false
+}
+
+// setCoverage sets the earliest timestamp that the chosen archive of each request has data for, given its TTL.
+// queries that go further back than that (e.g. because the archive that covers the range isn't ready yet) only get data from then on.
+func setCoverage(now uint32, rp ReqsPlan) {
+	rbrs := []ReqsByRet{rp.single.mdpyes, rp.single.mdpno}
+	for _, data := range rp.pngroups {
+		rbrs = append(rbrs, data.mdpyes, data.mdpno)
 	}
-	for i := range reqs {
-		req := &reqs[i]
-		req.Plan(archive, ret)
+	for _, rbr := range rbrs {
+		for _, reqs := range rbr {
+			for i := range reqs {
+				req := &reqs[i]
+				req.CoverageFrom = 0
+				if req.TTL < now {
+					req.CoverageFrom = now - req.TTL
+				}
+			}
+		}
 	}
-	return true
 }
 
-// planHighestResMulti plans all requests of all retentions to the most precise, common, resolution.
-func planHighestResMulti(now, from, to uint32, rbr ReqsByRet) bool {
-	minTTL := now - from
-
-	var listIntervals []uint32
-	var seenIntervals = make(map[uint32]struct{})
+// mdpFillRatio returns the average amount of points per series that the planned intervals yield, before runtime consolidation,
+// as a percentage of planMDP (which must not be 0)
+func mdpFillRatio(rp ReqsPlan, planMDP uint32) uint32 {
+	return uint32(uint64(rp.PointsReturn(0)) * 100 / (uint64(planMDP) * uint64(rp.cnt)))
+}
 
-	for schemaID, reqs := range rbr {
-		if len(reqs) == 0 {
-			continue
-		}
-		rets := mdata.Schemas.Get(uint16(schemaID)).Retentions.Rets
-		archive, ret, ok := findHighestResRet(rets, from, minTTL)
-		if !ok {
-			return false
+// setTo sets the to of all requests of the plan
+// note: it is assumed that all requests have the same to
+func setTo(rp ReqsPlan, to uint32) {
+	rbrs := []ReqsByRet{rp.single.mdpyes, rp.single.mdpno}
+	for _, data := range rp.pngroups {
+		rbrs = append(rbrs, data.mdpyes, data.mdpno)
+	}
+	for _, rbr := range rbrs {
+		for _, reqs := range rbr {
+			for i := range reqs {
+				reqs[i].To = to
+			}
 		}
-		for i := range reqs {
-			req := &reqs[i]
-			req.Plan(archive, ret)
+	}
+}
 
-			// note: requests with the same schemaID may still have a different ArchInterval if archive=0 (raw data)
-			// because we allow series to have different native intervals than what the schema specifies.
-			if _, exists := seenIntervals[req.ArchInterval]; !exists {
-				listIntervals = append(listIntervals, req.ArchInterval)
-				seenIntervals[req.ArchInterval] = struct{}{}
+// setPNGrouped marks the requests that were planned as part of a PNGroup, as opposed to those planned as singles.
+// note that with auto-pngroup, requests without a PNGroup of their own may still end up in one.
+func setPNGrouped(rp ReqsPlan) {
+	mark := func(rbr ReqsByRet, grouped bool) {
+		for _, reqs := range rbr {
+			for i := range reqs {
+				reqs[i].PNGrouped = grouped
 			}
 		}
 	}
-	interval := util.Lcm(listIntervals)
+	mark(rp.single.mdpyes, false)
+	mark(rp.single.mdpno, false)
+	for _, data := range rp.pngroups {
+		mark(data.mdpyes, true)
+		mark(data.mdpno, true)
+	}
+}
 
-	// plan all our requests so that they result in the common output interval.
-	for schemaID, reqs := range rbr {
-		rets := mdata.Schemas.Get(uint16(schemaID)).Retentions.Rets
-		for i := range reqs {
-			req := &reqs[i]
-			req.AdjustTo(interval, from, rets)
+// compatibleIntervals returns whether the output intervals of the MDP-optimizable requests and those of the
+// non-MDP-optimizable requests are multiples of one another, so they can be combined without normalizing to a coarser interval
+func compatibleIntervals(mdpyes, mdpno []models.Req) bool {
+	for _, y := range mdpyes {
+		for _, n := range mdpno {
+			if y.OutInterval%n.OutInterval != 0 && n.OutInterval%y.OutInterval != 0 {
+				return false
+			}
 		}
 	}
-
 	return true
 }
 
-// planLowestResForMDPMulti plans all requests of all retentions to the same common interval such that they still return >=mdp/2 points
-// note: we can assume all reqs have the same MDP.
-func planLowestResForMDPMulti(now, from, to, mdp uint32, rbr ReqsByRet) bool {
-	minTTL := now - from
+// reconcileIntervals normalizes the MDP-optimizable requests to the LCM of their interval and those of the non-MDP-optimizable requests.
+// the latter are left alone, as they may need their resolution. requests for which the LCM overflows are left alone as well.
+func reconcileIntervals(mdpyes, mdpno []models.Req) {
+	intervals := make([]uint32, 0, len(mdpno)+1)
+	seen := make(map[uint32]struct{})
+	for _, n := range mdpno {
+		if _, ok := seen[n.OutInterval]; !ok {
+			seen[n.OutInterval] = struct{}{}
+			intervals = append(intervals, n.OutInterval)
+		}
+	}
+	for i := range mdpyes {
+		req := &mdpyes[i]
+		interval := util.Lcm(append(intervals, req.OutInterval))
+		if interval != 0 && interval != req.OutInterval {
+			req.PlanNormalization(interval)
+		}
+	}
+}
 
-	// if we were to set each req to their coarsest interval that results in >= MDP/2 points,
-	// we'd still have to align them to their LCM interval, which may push them in to
-	// "too coarse" territory.
-	// instead, we pick the coarsest allowable artificial interval...
-	maxInterval := (2 * (to - from)) / mdp
-	// ...and then we look for the combination of intervals that scores highest.
-	// the bigger the interval the better (load less points), adjusted for number of reqs that
-	// have that interval. but their combined LCM may not exceed maxInterval.
+// mdpLossWarnings returns warnings for the schemas of which the MDP-optimizable series of a PNGroup got normalized to a coarser interval
+// than they would have been MDP-optimized to by themselves, because they need a common interval with the other series
+// that they get aggregated with. See note [2] of planRequests.
+func mdpLossWarnings(schemas *conf.Schemas, now, from, mdp uint32, mdpTarget bool, rp ReqsPlan) []string {
+	minTTL := getMinTTL(now, from)
+	var warnings []string
+	seen := make(map[string]struct{})
+	for _, data := range rp.pngroups {
+		interval := data.mdpyes.OutInterval()
+		for schemaID, reqs := range data.mdpyes {
+			if len(reqs) == 0 {
+				continue
+			}
+			schema := schemas.Get(uint16(schemaID))
+			req := reqs[0]
+			archive, ret, ok := findLowestResForMDP(schema.Retentions.Rets, from, minTTL, mdp, mdpTarget, &req)
+			if !ok {
+				continue
+			}
+			req.Plan(archive, ret)
+			if interval <= req.ArchInterval {
+				continue
+			}
+			warning := fmt.Sprintf("series of schema %s are aggregated with other series, and need to be normalized to a common interval of %ds rather than %ds for maxDataPoints, which may reduce their accuracy", schema.Name, interval, req.ArchInterval)
+			if _, ok := seen[warning]; !ok {
+				seen[warning] = struct{}{}
+				warnings = append(warnings, warning)
+			}
+		}
+	}
+	return warnings
+}
 
-	// first, extract the set of valid intervals from each retention
-	validIntervalsSet, ok := getValidIntervalsSet(rbr, from, minTTL)
-	if !ok {
-		return false
+// guardRollups makes sure that requests read an archive that stores the consolidation they requested.
+// when no rollup stores it, the request has fallen back to another function (see closestAggMethod).
+// such requests are moved to the raw archive, normalized to the same interval with the requested function,
+// as long as the raw archive is valid for the request, and reading it doesn't exceed mpprSoft (if set), as that would undo
+// the coarsening done to honor it. otherwise they keep reading the rollup, and a warning is returned.
+func guardRollups(schemas *conf.Schemas, aggs conf.Aggregations, now, from uint32, rp ReqsPlan, mpprSoft int) []string {
+	minTTL := getMinTTL(now, from)
+	var warnings []string
+	seen := make(map[string]struct{})
+	points := rp.PointsFetch()
+	warn := func(warning string) {
+		reqRenderRollupGuardUnmet.Inc()
+		if _, ok := seen[warning]; !ok {
+			seen[warning] = struct{}{}
+			warnings = append(warnings, warning)
+		}
+	}
+	guard := func(rbr ReqsByRet) {
+		for _, reqs := range rbr {
+			for i := range reqs {
+				req := &reqs[i]
+				if req.ConsReq == 0 || req.ConsReq == req.Consolidator {
+					continue
+				}
+				if aggs.Get(req.AggId).Stores(int(req.Archive), conf.Method(req.ConsReq)) {
+					// the archive has data for the requested function, so we can use it for fetching and normalization
+					req.Consolidator = req.ConsReq
+					continue
+				}
+				schema := schemas.Get(req.SchemaId)
+				raw := schema.Retentions.Rets[0]
+				if !raw.Valid(readyFrom(from), minTTL) || req.OutInterval%req.RawInterval != 0 {
+					warn(fmt.Sprintf("consolidateBy(%s) can't be honored for series of schema %s: no %s rollup is stored and the raw data does not cover the time range. using %s rollup instead", req.ConsReq.ConsolidateBy(), schema.Name, req.ConsReq.ConsolidateBy(), req.Consolidator.ConsolidateBy()))
+					continue
+				}
+				guarded := *req
+				interval := guarded.OutInterval
+				guarded.Plan(0, raw)
+				if interval != guarded.ArchInterval {
+					guarded.PlanNormalization(interval)
+				}
+				if mpprSoft > 0 && points-req.PointsFetch()+guarded.PointsFetch() > uint32(mpprSoft) {
+					warn(fmt.Sprintf("consolidateBy(%s) can't be honored for series of schema %s: no %s rollup is stored and reading the raw data would exceed max-points-per-req-soft. using %s rollup instead", req.ConsReq.ConsolidateBy(), schema.Name, req.ConsReq.ConsolidateBy(), req.Consolidator.ConsolidateBy()))
+					continue
+				}
+				points = points - req.PointsFetch() + guarded.PointsFetch()
+				*req = guarded
+				req.Consolidator = req.ConsReq
+				reqRenderRollupGuardRaw.Inc()
+			}
+		}
+	}
+	guard(rp.single.mdpyes)
+	guard(rp.single.mdpno)
+	for _, data := range rp.pngroups {
+		guard(data.mdpyes)
+		guard(data.mdpno)
 	}
+	return warnings
+}
 
-	// now find the lowest resolution (highest) LCM interval that is not bigger than maxInterval
-	interval := getLowestResFromSetMatching(rbr, from, minTTL, 0, maxInterval, validIntervalsSet)
+// planSchemas returns the snapshot of the schemas to plan against, in which the archives finer than minFetchInterval (if any) are disabled
+// and, if ready-granularity is interval, the Ready timestamps are rounded up to the interval of the archives
+func planSchemas(minFetchInterval uint32) *conf.Schemas {
+	schemas := mdata.SchemasSnapshot()
+	if readyGranularity == readyGranularityInterval {
+		schemas = withIntervalReady(schemas)
+	}
+	if minFetchInterval == 0 {
+		return schemas
+	}
+	restricted := schemas.WithMinInterval(minFetchInterval)
+	return &restricted
+}
 
-	// now we finally found our optimal interval that we want to use.
-	// plan all our requests so that they result in the common output interval.
-	planToMulti(now, from, to, interval, rbr)
+// intervalReadySchemas holds the schemas last derived by withIntervalReady
+var intervalReadySchemas atomic.Value // intervalReady
 
-	return true
+type intervalReady struct {
+	src     *conf.Retention // the first retention of the default schema of the schemas they were derived from
+	schemas *conf.Schemas
 }
 
-// reduceResSingles reduces the resolution of all requests of the given retention
-// to the next more coarse, common, interval (which may be different for different retentions)
-// we already assume that each request is setup to request as little as data as possible to yield
-// the desired output interval. Thus the only way to fetch fewer points is to increase the output
-// interval
-// returns whether we were able to reduce
-func reduceResSingles(now, from, to uint32, schemaID uint16, reqs []models.Req) bool {
-	if len(reqs) == 0 {
-		return true
+// withIntervalReady returns the schemas with the Ready timestamps of their retentions rounded up to their interval, see ready-granularity.
+// they are only derived once for each set of schemas, rather than for every request.
+func withIntervalReady(schemas *conf.Schemas) *conf.Schemas {
+	rets := schemas.DefaultSchema.Retentions.Rets
+	if len(rets) == 0 {
+		derived := schemas.WithIntervalReady()
+		return &derived
 	}
+	if cached, ok := intervalReadySchemas.Load().(intervalReady); ok && cached.src == &rets[0] {
+		return cached.schemas
+	}
+	derived := schemas.WithIntervalReady()
+	intervalReadySchemas.Store(intervalReady{&rets[0], &derived})
+	return &derived
+}
 
-	curOut := reqs[0].OutInterval
-	minTTL := now - from
+// reasons why requests can't be planned, as reported by validateRequests
+const (
+	unsatisfiableNoReadyArchive  = "no ready archive"  // a schema has no enabled archive that is ready
+	unsatisfiableTTLNotMet       = "ttl not met"       // a schema has no ready archive with a long enough TTL
+	unsatisfiableNoValidInterval = "no valid interval" // no common interval could be found amongst the schemas of a PNGroup
+	unsatisfiableMDPTooHigh      = "mdp too high"      // see mdp-strict
+	unsatisfiableNoRetentions    = "no retentions"     // a schema has no retentions at all, which is a misconfiguration
+)
 
-	var ok bool
+// unsatisfiableErr returns the error to fail the request with, for requests that can't be planned for the given reason
+func unsatisfiableErr(reason string) error {
+	if reason == unsatisfiableNoRetentions {
+		return errNoRetentions
+	}
+	return errUnSatisfiable
+}
 
-	var archive int
+// missingRetentions returns whether the schema of any of the requests has no retentions.
+// schemas always have retentions when loaded from the config, but we don't want the planners to assume so.
+func missingRetentions(schemas *conf.Schemas, rbr ReqsByRet) bool {
+	for schemaID, reqs := range rbr {
+		if len(reqs) > 0 && len(schemas.Get(uint16(schemaID)).Retentions.Rets) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// planInitial does the initial planning of all PNGroups and singles of the plan, see planRequests.
+// If collect is false, it stops at the first PNGroup or schema of singles that can't be satisfied, and returns the corresponding error.
+// Otherwise, it plans all of them and returns the requests that can't be satisfied, with the reason why.
+func planInitial(schemas *conf.Schemas, now, from, to uint32, rp *ReqsPlan, planMDP uint32, mdpTarget, cheapest, collect bool) ([]models.UnsatisfiableTarget, error) {
+	var unsatisfiable []models.UnsatisfiableTarget
+	fail := func(reason string, err error, rbrs ...ReqsByRet) error {
+		if !collect {
+			return err
+		}
+		for _, rbr := range rbrs {
+			for _, reqs := range rbr {
+				for _, req := range reqs {
+					unsatisfiable = append(unsatisfiable, models.UnsatisfiableTarget{Target: req.Target, Pattern: req.Pattern, Reason: reason})
+				}
+			}
+		}
+		return nil
+	}
+	minTTL := getMinTTL(now, from)
+	warm := !cheapest && preferWarm(now, from)
+
+	var ok bool
+	for group, split := range rp.pngroups {
+		if split.mdpyes.HasData() {
+			if cheapest {
+				ok = planLowestResCoveringTTLMulti(schemas, now, from, to, split.mdpyes)
+			} else if warm {
+				reqRenderPlanPreferWarm.Inc()
+				ok = planHighestResMulti(schemas, now, from, to, split.mdpyes)
+			} else {
+				ok = planLowestResForMDPMulti(schemas, now, from, to, planMDP, mdpTarget, split.mdpyes)
+			}
+			if !ok {
+				reason := unsatisfiableReason(schemas, split.mdpyes, from, minTTL, !cheapest)
+				if err := fail(reason, unsatisfiableErr(reason), split.mdpyes); err != nil {
+					return nil, err
+				}
+			} else if mdpStrict && !cheapest && !mdpTarget && planMDP > 0 && split.mdpyes.OutInterval() > getMaxIntervalForMDP(to-from, planMDP) {
+				// if no valid interval fits within the budget, planLowestResForMDPMulti falls back to the lowest common interval.
+				// in strict mode, we reject the request instead.
+				reqRenderUnsatisfiableMDPTooHigh.Inc()
+				if err := fail(unsatisfiableMDPTooHigh, errMDPStrict, split.mdpyes); err != nil {
+					return nil, err
+				}
+			}
+			rp.pngroups[group] = split
+		}
+		if split.mdpno.HasData() {
+			if cheapest {
+				ok = planLowestResCoveringTTLMulti(schemas, now, from, to, split.mdpno)
+			} else {
+				ok = planHighestResMulti(schemas, now, from, to, split.mdpno)
+			}
+			if !ok {
+				reason := unsatisfiableReason(schemas, split.mdpno, from, minTTL, false)
+				if err := fail(reason, unsatisfiableErr(reason), split.mdpno); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	for schemaID, reqs := range rp.single.mdpyes {
+		if len(reqs) == 0 {
+			continue
+		}
+		if cheapest {
+			ok = planLowestResCoveringTTLSingles(schemas, now, from, to, uint16(schemaID), reqs)
+		} else if warm {
+			reqRenderPlanPreferWarm.Inc()
+			ok = planHighestResSingles(schemas, now, from, to, uint16(schemaID), reqs)
+		} else {
+			ok = planLowestResForMDPSingles(schemas, now, from, to, planMDP, mdpTarget, uint16(schemaID), reqs)
+		}
+		// singles fall back to the highest resolution archive, so they can only fail due to not having any ready archive (or retentions)
+		if !ok {
+			reason := unsatisfiableSinglesReason(schemas, uint16(schemaID))
+			if err := fail(reason, unsatisfiableErr(reason), ReqsByRet{reqs}); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for schemaID, reqs := range rp.single.mdpno {
+		if len(reqs) == 0 {
+			continue
+		}
+		if cheapest {
+			ok = planLowestResCoveringTTLSingles(schemas, now, from, to, uint16(schemaID), reqs)
+		} else {
+			ok = planHighestResSingles(schemas, now, from, to, uint16(schemaID), reqs)
+		}
+		if !ok {
+			reason := unsatisfiableSinglesReason(schemas, uint16(schemaID))
+			if err := fail(reason, unsatisfiableErr(reason), ReqsByRet{reqs}); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return unsatisfiable, nil
+}
+
+// unsatisfiableReason returns why the requests of a PNGroup could not be planned.
+// ttl denotes whether the planning function that failed requires archives with a long enough TTL (planLowestResForMDPMulti)
+// rather than falling back to archives that are too short.
+func unsatisfiableReason(schemas *conf.Schemas, rbr ReqsByRet, from, minTTL uint32, ttl bool) string {
+	if missingRetentions(schemas, rbr) {
+		return unsatisfiableNoRetentions
+	}
+	if !readable(schemas, rbr, from) {
+		return unsatisfiableNoReadyArchive
+	}
+	if _, ok := getValidIntervalsSet(schemas, rbr, from, minTTL); ttl && !ok {
+		return unsatisfiableTTLNotMet
+	}
+	return unsatisfiableNoValidInterval
+}
+
+// unsatisfiableSinglesReason returns why the single requests of the given schema could not be planned
+func unsatisfiableSinglesReason(schemas *conf.Schemas, schemaID uint16) string {
+	if len(schemas.Get(schemaID).Retentions.Rets) == 0 {
+		return unsatisfiableNoRetentions
+	}
+	return unsatisfiableNoReadyArchive
+}
+
+// validateRequests plans the given requests like planRequests does initially, but rather than failing on the first
+// PNGroup or schema of singles that can't be satisfied, it returns all requests that can't be satisfied, sorted by pattern and target,
+// with the reason why. The plan itself is discarded: this is meant to diagnose requests without fetching any data.
+func validateRequests(now, from, to uint32, reqs *ReqMap, planMDP uint32, mdpTarget, cheapest bool, minFetchInterval uint32) []models.UnsatisfiableTarget {
+	schemas := planSchemas(minFetchInterval)
+	rp := NewReqsPlan(schemas, *reqs)
+	unsatisfiable, _ := planInitial(schemas, now, from, to, &rp, planMDP, mdpTarget, cheapest, true)
+	sort.Slice(unsatisfiable, func(i, j int) bool {
+		if unsatisfiable[i].Pattern != unsatisfiable[j].Pattern {
+			return unsatisfiable[i].Pattern < unsatisfiable[j].Pattern
+		}
+		return unsatisfiable[i].Target < unsatisfiable[j].Target
+	})
+	return unsatisfiable
+}
+
+// preferWarm returns whether MDP-optimizable requests with the given from should be planned at the highest resolution,
+// because their window lies within plan-warm-window, and is thus likely served from memory. see plan-prefer-warm
+func preferWarm(now, from uint32) bool {
+	return planPreferWarm && (now <= planWarmWindow || from >= now-planWarmWindow)
+}
+
+// planHighestResSingles plans all requests of the given retention to their most precise resolution (which may be different for different retentions)
+func planHighestResSingles(schemas *conf.Schemas, now, from, to uint32, schemaID uint16, reqs []models.Req) bool {
+	rets := schemas.Get(uint16(schemaID)).Retentions.Rets
+	if len(rets) == 0 {
+		reqRenderUnsatisfiableNoRetentions.Inc()
+		return false
+	}
+	minTTL := getMinTTL(now, from)
+	archive, ret, ok := findHighestResRet(rets, from, minTTL)
+	if !ok {
+		reqRenderUnsatisfiableNoReadyArchive.Inc()
+		return false
+	}
+	for i := range reqs {
+		req := &reqs[i]
+		req.Plan(archive, ret)
+	}
+	return true
+}
+
+// planLowestResForMDPSingles plans all requests of the given retention to an interval such that requests still return >=mdp/2 points (interval may be different for different retentions)
+// or, if mdpTarget is set, to the interval that yields the amount of points closest to mdp.
+// only archives that have a long enough TTL are considered. If there are none, we fall back to the
+// highest resolution archive, just like planHighestResSingles does.
+// If archive-hysteresis-size is set, the archive remembered from a previous request with a similar window is preferred.
+func planLowestResForMDPSingles(schemas *conf.Schemas, now, from, to, mdp uint32, mdpTarget bool, schemaID uint16, reqs []models.Req) bool {
+	if len(reqs) == 0 {
+		return true
+	}
+	rets := schemas.Get(uint16(schemaID)).Retentions.Rets
+	if len(rets) == 0 {
+		reqRenderUnsatisfiableNoRetentions.Inc()
+		return false
+	}
+	minTTL := getMinTTL(now, from)
+	archive, ret, ok := findLowestResForMDP(rets, from, minTTL, mdp, mdpTarget, &reqs[0])
+	if !ok {
+		archive, ret, ok = findHighestResRet(rets, from, minTTL)
+	}
+	if !ok {
+		reqRenderUnsatisfiableNoReadyArchive.Inc()
+		return false
+	}
+	// prefer the archive that was chosen for a similar window before, as long as it is still valid
+	if archiveHysteresis != nil {
+		key := archiveHysteresis.key(schemaID, reqs, to-from)
+		remembered, found := archiveHysteresis.get(key)
+		if found && remembered != archive && remembered < len(rets) && rets[remembered].Valid(readyFrom(from), minTTL) {
+			archive, ret = remembered, rets[remembered]
+			reqRenderArchiveHysteresisKept.Inc()
+		}
+		archiveHysteresis.add(key, archive)
+	}
+	for i := range reqs {
+		req := &reqs[i]
+		req.Plan(archive, ret)
+	}
+	return true
+}
+
+// findLowestResForMDP finds the coarsest valid retention for which the request still returns >=mdp/2 points,
+// or, if mdpTarget is set, the one that yields the amount of points closest to mdp.
+// if none of them yield >=mdp/2 points, the finest valid retention is returned.
+// note that the request gets planned along the way, so the caller must plan it again.
+func findLowestResForMDP(rets []conf.Retention, from, minTTL, mdp uint32, mdpTarget bool, req *models.Req) (int, conf.Retention, bool) {
+	var archive int
+	var ret conf.Retention
+	var ok bool
+	var bestPoints uint32
+	for i := len(rets) - 1; i >= 0; i-- {
+		reqRenderPlanArchivesInspected.Inc()
+		// skip non-ready or disabled options, and those that don't cover the range.
+		// coarser retentions always have a longer TTL (see conf.Retentions.Validate), so we never trade coverage for fewer points.
+		if !rets[i].Valid(readyFrom(from), minTTL) {
+			continue
+		}
+		if mdpTarget {
+			// we iterate from coarse to fine, so the finest archive wins ties
+			req.Plan(i, rets[i])
+			if !ok || distance(req.PointsFetch(), mdp) <= distance(bestPoints, mdp) {
+				archive, ret, ok = i, rets[i], true
+				bestPoints = req.PointsFetch()
+			}
+			continue
+		}
+		archive, ret, ok = i, rets[i], true
+		req.Plan(i, rets[i])
+		if req.PointsFetch() >= mdp/2 {
+			break
+		}
+	}
+	return archive, ret, ok
+}
+
+// planLowestResCoveringTTLSingles plans all requests of the given retention to the coarsest archive that is ready and meets the TTL,
+// to minimize the amount of points to fetch (interval may be different for different retentions).
+// If there is none, we fall back to planHighestResSingles.
+func planLowestResCoveringTTLSingles(schemas *conf.Schemas, now, from, to uint32, schemaID uint16, reqs []models.Req) bool {
+	rets := schemas.Get(uint16(schemaID)).Retentions.Rets
+	if len(rets) == 0 {
+		reqRenderUnsatisfiableNoRetentions.Inc()
+		return false
+	}
+	minTTL := getMinTTL(now, from)
+	for i := len(rets) - 1; i >= 0; i-- {
+		reqRenderPlanArchivesInspected.Inc()
+		if !rets[i].Valid(readyFrom(from), minTTL) {
+			continue
+		}
+		for j := range reqs {
+			req := &reqs[j]
+			req.Plan(i, rets[i])
+		}
+		return true
+	}
+	return planHighestResSingles(schemas, now, from, to, schemaID, reqs)
+}
+
+// planLowestResCoveringTTLMulti plans all requests of all retentions to the coarsest common interval of which all
+// retentions meet the TTL, to minimize the amount of points to fetch.
+// If any of the retentions has no archive that meets the TTL, we fall back to planHighestResMulti.
+func planLowestResCoveringTTLMulti(schemas *conf.Schemas, now, from, to uint32, rbr ReqsByRet) bool {
+	if missingRetentions(schemas, rbr) {
+		reqRenderUnsatisfiableNoRetentions.Inc()
+		return false
+	}
+	minTTL := getMinTTL(now, from)
+	validIntervalsSet, ok := getValidIntervalsSet(schemas, rbr, from, minTTL)
+	if !ok {
+		return planHighestResMulti(schemas, now, from, to, rbr)
+	}
+	observeCombinations(schemas, "planLowestResCoveringTTLMulti", rbr, validIntervalsSet)
+
+	var interval uint32
+	if intervals, ok := singleIntervals(validIntervalsSet); ok {
+		interval = util.Lcm(intervals)
+	} else {
+		interval = getLowestResFromSetMatching(schemas, rbr, from, minTTL, 0, math.MaxUint32, validIntervalsSet)
+	}
+	if interval == 0 {
+		reqRenderUnsatisfiableNoValidInterval.Inc()
+		return false
+	}
+	planToMulti(schemas, now, from, to, interval, rbr)
+	return true
+}
+
+// planHighestResMulti plans all requests of all retentions to the most precise, common, resolution.
+func planHighestResMulti(schemas *conf.Schemas, now, from, to uint32, rbr ReqsByRet) bool {
+	if missingRetentions(schemas, rbr) {
+		reqRenderUnsatisfiableNoRetentions.Inc()
+		return false
+	}
+	minTTL := getMinTTL(now, from)
+
+	var listIntervals []uint32
+	var seenIntervals = make(map[uint32]struct{})
+
+	for schemaID, reqs := range rbr {
+		if len(reqs) == 0 {
+			continue
+		}
+		rets := schemas.Get(uint16(schemaID)).Retentions.Rets
+		archive, ret, ok := findHighestResRet(rets, from, minTTL)
+		if !ok {
+			reqRenderUnsatisfiableNoReadyArchive.Inc()
+			return false
+		}
+		for i := range reqs {
+			req := &reqs[i]
+			req.Plan(archive, ret)
+
+			// note: requests with the same schemaID may still have a different ArchInterval if archive=0 (raw data)
+			// because we allow series to have different native intervals than what the schema specifies.
+			if _, exists := seenIntervals[req.ArchInterval]; !exists {
+				listIntervals = append(listIntervals, req.ArchInterval)
+				seenIntervals[req.ArchInterval] = struct{}{}
+			}
+		}
+	}
+	interval := util.Lcm(listIntervals)
+	if interval == 0 {
+		reqRenderUnsatisfiableNoValidInterval.Inc()
+		return false
+	}
+
+	// plan all our requests so that they result in the common output interval.
+	for schemaID, reqs := range rbr {
+		rets := schemas.Get(uint16(schemaID)).Retentions.Rets
+		for i := range reqs {
+			req := &reqs[i]
+			req.AdjustTo(interval, readyFrom(from), rets)
+		}
+	}
+
+	return true
+}
+
+// planLowestResForMDPMulti plans all requests of all retentions to the same common interval such that they still return >=mdp/2 points
+// or, if mdpTarget is set, to the common interval that yields the amount of points closest to mdp.
+// if no common interval yields >=mdp/2 points, the lowest common interval is used (see mdp-strict).
+// if mdp-max-loss-factor is set, the common interval is also bounded by it, see mdpLossBudget.
+// note: we can assume all reqs have the same MDP.
+func planLowestResForMDPMulti(schemas *conf.Schemas, now, from, to, mdp uint32, mdpTarget bool, rbr ReqsByRet) bool {
+	if missingRetentions(schemas, rbr) {
+		reqRenderUnsatisfiableNoRetentions.Inc()
+		return false
+	}
+	minTTL := getMinTTL(now, from)
+
+	// if we were to set each req to their coarsest interval that results in >= MDP/2 points,
+	// we'd still have to align them to their LCM interval, which may push them in to
+	// "too coarse" territory.
+	// instead, we pick the coarsest allowable artificial interval...
+	maxInterval := getMaxIntervalForMDP(to-from, mdp)
+	// ...and then we look for the combination of intervals that scores highest.
+	// the bigger the interval the better (load less points), adjusted for number of reqs that
+	// have that interval. but their combined LCM may not exceed maxInterval.
+
+	// first, extract the set of valid intervals from each retention
+	validIntervalsSet, ok := getValidIntervalsSet(schemas, rbr, from, minTTL)
+	if !ok {
+		if readable(schemas, rbr, from) {
+			reqRenderUnsatisfiableTTLNotMet.Inc()
+		} else {
+			reqRenderUnsatisfiableNoReadyArchive.Inc()
+		}
+		return false
+	}
+	observeCombinations(schemas, "planLowestResForMDPMulti", rbr, validIntervalsSet)
+
+	// now find the lowest resolution (highest) LCM interval that is not bigger than maxInterval
+	// if each retention has only one valid interval, there is only one combination to consider,
+	// so we can simply take its LCM and skip the search.
+	var interval uint32
+	if intervals, ok := singleIntervals(validIntervalsSet); ok {
+		interval = util.Lcm(intervals)
+	} else if mdpTarget {
+		interval = getClosestResFromSetMatching(to-from, mdp, validIntervalsSet)
+	} else {
+		interval = getLowestResFromSetMatching(schemas, rbr, from, minTTL, 0, maxInterval, validIntervalsSet)
+	}
+	if interval == 0 {
+		reqRenderUnsatisfiableNoValidInterval.Inc()
+		return false
+	}
+	if mdpMaxLossFactor > 0 {
+		if budget := mdpLossBudget(schemas, from, minTTL, mdp, mdpTarget, rbr); interval > budget {
+			// if no interval meets the budget, this returns the lowest one
+			limit := budget
+			if !mdpTarget && maxInterval < limit {
+				limit = maxInterval
+			}
+			if finer := getLowestResFromSetMatching(schemas, rbr, from, minTTL, 0, limit, validIntervalsSet); finer < interval {
+				interval = finer
+				reqRenderLossBudgetApplied.Inc()
+			}
+		}
+	}
+
+	// now we finally found our optimal interval that we want to use.
+	// plan all our requests so that they result in the common output interval.
+	planToMulti(schemas, now, from, to, interval, rbr)
+
+	return true
+}
+
+// mdpLossBudget returns the coarsest common interval that the MDP-optimizable requests may be planned to, as per mdp-max-loss-factor:
+// a multiple of the finest interval that any of them would be MDP-optimized to by itself (see note [2] of planRequests).
+func mdpLossBudget(schemas *conf.Schemas, from, minTTL, mdp uint32, mdpTarget bool, rbr ReqsByRet) uint32 {
+	var finest uint32
+	for schemaID, reqs := range rbr {
+		if len(reqs) == 0 {
+			continue
+		}
+		req := reqs[0]
+		archive, ret, ok := findLowestResForMDP(schemas.Get(uint16(schemaID)).Retentions.Rets, from, minTTL, mdp, mdpTarget, &req)
+		if !ok {
+			continue
+		}
+		req.Plan(archive, ret)
+		if finest == 0 || req.ArchInterval < finest {
+			finest = req.ArchInterval
+		}
+	}
+	budget := mdpMaxLossFactor * float64(finest)
+	if finest == 0 || budget > math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return uint32(budget)
+}
+
+// reduceResSingles reduces the resolution of all requests of the given retention
+// to the next more coarse, common, interval (which may be different for different retentions)
+// we already assume that each request is setup to request as little as data as possible to yield
+// the desired output interval. Thus the only way to fetch fewer points is to increase the output
+// interval
+// returns whether we were able to reduce
+func reduceResSingles(schemas *conf.Schemas, now, from, to uint32, schemaID uint16, reqs []models.Req) bool {
+	if len(reqs) == 0 {
+		return true
+	}
+
+	curOut := reqs[0].OutInterval
+	minTTL := getMinTTL(now, from)
+
+	var ok bool
+
+	var archive int
 	var ret conf.Retention
 
-	rets := mdata.Schemas.Get(schemaID).Retentions.Rets
+	rets := schemas.Get(schemaID).Retentions.Rets
 	for i, retMaybe := range rets {
-		if retMaybe.Valid(from, minTTL) && uint32(retMaybe.SecondsPerPoint) > curOut {
+		reqRenderPlanArchivesInspected.Inc()
+		if retMaybe.Valid(readyFrom(from), minTTL) && uint32(retMaybe.SecondsPerPoint) > curOut {
 			ok = true
 			archive = i
 			ret = retMaybe
@@ -354,35 +1315,129 @@ func reduceResSingles(now, from, to uint32, schemaID uint16, reqs []models.Req)
 	for i := range reqs {
 		req := &reqs[i]
 		req.Plan(archive, ret)
+		planCounterRollup(req)
 	}
 
 	return true
 
 }
 
+// planCounterRollup makes a counter that got coarsened to a rollup archive read the sum rollup, if the aggregation rules
+// of the series have one. Otherwise, its points (typically averages) would understate the totals of the raw data.
+// series of which the consolidator was requested via consolidateBy() are left alone.
+func planCounterRollup(req *models.Req) {
+	if !req.Counter || req.ConsReq != 0 || req.Archive == 0 || req.Consolidator == consolidation.Sum {
+		return
+	}
+	for _, method := range mdata.Aggregations.Get(req.AggId).AggregationMethod {
+		if consolidation.Consolidator(method) == consolidation.Sum {
+			req.Consolidator = consolidation.Sum
+			reqRenderSoftLimitCounterSum.Inc()
+			return
+		}
+	}
+}
+
+// reduceResSinglesForSoftLimit reduces the resolution of all requests of the given retention to the first interval at which they, together,
+// fetch no more than mpprSoft points. It is equivalent to calling reduceResSingles until the limit is met, but rather than re-planning
+// and recounting the points of all requests after each reduction, it estimates the interval needed from the overshoot ratio and plans once.
+// if maxPasses > 0, it stops after that many reductions.
+// returns the number of reductions, and whether the limit is met
+func reduceResSinglesForSoftLimit(schemas *conf.Schemas, now, from, to uint32, schemaID uint16, reqs []models.Req, mpprSoft uint32, maxPasses int) (int, bool) {
+	points := pointsFetch(reqs)
+	if len(reqs) == 0 || points <= mpprSoft {
+		return 0, true
+	}
+
+	// the successive archives that reduceResSingles would pick, and the interval they result in
+	type step struct {
+		archive  int
+		ret      conf.Retention
+		interval uint32
+	}
+	var steps []step
+	curOut := reqs[0].OutInterval
+	minTTL := getMinTTL(now, from)
+	for i, ret := range schemas.Get(schemaID).Retentions.Rets {
+		reqRenderPlanArchivesInspected.Inc()
+		if ret.Valid(readyFrom(from), minTTL) && uint32(ret.SecondsPerPoint) > curOut {
+			curOut = uint32(ret.SecondsPerPoint)
+			if i == 0 {
+				curOut = reqs[0].RawInterval
+			}
+			steps = append(steps, step{i, ret, curOut})
+		}
+	}
+
+	fits := func(interval uint32) bool {
+		var cnt uint32
+		for _, req := range reqs {
+			cnt += (req.To - req.From) / interval
+		}
+		return cnt <= mpprSoft
+	}
+	// the amount of points is inversely proportional to the interval, so we can skip to the first interval that is at least
+	// as coarse as the overshoot ratio requires. because of rounding, we may have to correct by a step.
+	needed := uint64(reqs[0].OutInterval) * uint64(points) / uint64(mpprSoft)
+	k := sort.Search(len(steps), func(i int) bool { return uint64(steps[i].interval) >= needed })
+	for k > 0 && fits(steps[k-1].interval) {
+		k--
+	}
+	for k < len(steps) && !fits(steps[k].interval) {
+		k++
+	}
+
+	honored := k < len(steps)
+	reductions := k + 1
+	if !honored {
+		reductions = len(steps)
+	}
+	if maxPasses > 0 && reductions > maxPasses {
+		reductions, honored = maxPasses, false
+	}
+	if reductions == 0 {
+		return 0, false
+	}
+	target := steps[reductions-1]
+	for i := range reqs {
+		reqs[i].Plan(target.archive, target.ret)
+		planCounterRollup(&reqs[i])
+	}
+	return reductions, honored
+}
+
 // reduceResMulti reduces the resolution of all requests to the next more coarse, common, interval
 // we already assume that each request is setup to request as little as data as possible to yield
 // the desired output interval. Thus the only way to fetch fewer points is to increase the output
 // interval
+// if reduce-res-candidates > 1, a few more coarser intervals are considered, and the one that reads the fewest chunks is used.
 // returns whether we were able to reduce
-func reduceResMulti(now, from, to uint32, rbr ReqsByRet) bool {
+func reduceResMulti(schemas *conf.Schemas, now, from, to uint32, rbr ReqsByRet) bool {
 	curOut := rbr.OutInterval()
-	minTTL := now - from
+	minTTL := getMinTTL(now, from)
 
-	validIntervalss, ok := getValidIntervalsSet(rbr, from, minTTL)
+	validIntervalss, ok := getValidIntervalsSet(schemas, rbr, from, minTTL)
 	if !ok {
 		return false
 	}
+	observeCombinations(schemas, "reduceResMulti", rbr, validIntervalss)
 
 	// now find the highest resolution (lowest) LCM interval that is bigger than our current interval
 	interval := getHighestResFromSetMatching(from, minTTL, curOut+1, math.MaxUint32, validIntervalss)
 	if interval == 0 {
 		return false
 	}
+	if reduceResCandidates > 1 {
+		candidates := getHighestRessFromSetMatching(curOut+1, math.MaxUint32, validIntervalss, reduceResCandidates)
+		interval = getCheapestInterval(schemas, from, minTTL, candidates, rbr)
+		if interval != candidates[0] {
+			reqRenderChunksPreferred.Inc()
+		}
+	}
 
 	// now we finally found our optimal interval that we want to use.
 	// plan all our requests so that they result in the common output interval.
-	planToMulti(now, from, to, interval, rbr)
+	planToMulti(schemas, now, from, to, interval, rbr)
 
 	return true
 
@@ -391,14 +1446,14 @@ func reduceResMulti(now, from, to uint32, rbr ReqsByRet) bool {
 // getValidIntervalsSet returns a list of valid interval lists; one for each used retention
 // (used retention means a retention that has >0 requests associated to it)
 // if any used retention has no valid intervals, we return false
-func getValidIntervalsSet(rbr ReqsByRet, from, ttl uint32) ([][]uint32, bool) {
+func getValidIntervalsSet(schemas *conf.Schemas, rbr ReqsByRet, from, ttl uint32) ([][]uint32, bool) {
 	var validIntervalsSet [][]uint32
 
 	for schemaID, reqs := range rbr {
 		if len(reqs) == 0 {
 			continue
 		}
-		validIntervals, ok := getValidIntervals(uint16(schemaID), from, ttl)
+		validIntervals, ok := getValidIntervals(schemas, uint16(schemaID), from, ttl)
 		if !ok {
 			return nil, false
 		}
@@ -417,15 +1472,90 @@ func getValidIntervalsSet(rbr ReqsByRet, from, ttl uint32) ([][]uint32, bool) {
 	return validIntervalsSet, true
 }
 
+// observeCombinations records how many interval combinations need to be evaluated for the given
+// intervalsSet, and logs the requests involved if this exceeds plan-combinations-log-threshold.
+func observeCombinations(schemas *conf.Schemas, fn string, rbr ReqsByRet, intervalsSet [][]uint32) {
+	combos := uint64(1)
+	for _, intervals := range intervalsSet {
+		combos *= uint64(len(intervals))
+		if combos > math.MaxUint32 {
+			combos = math.MaxUint32
+		}
+	}
+	reqRenderPlanCombinations.ValueUint32(uint32(combos))
+
+	if planCombinationsLogThreshold == 0 || combos <= uint64(planCombinationsLogThreshold) {
+		return
+	}
+	var names []string
+	for schemaID, reqs := range rbr {
+		if len(reqs) == 0 {
+			continue
+		}
+		names = append(names, fmt.Sprintf("%d:%s", schemaID, schemas.Get(uint16(schemaID)).Name))
+	}
+	log.Warnf("%s: %d targets across schemas %s require evaluating %d interval combinations", fn, rbr.Len(), strings.Join(names, ","), combos)
+}
+
+// getMinTTL returns the TTL needed to serve a request starting at from.
+// a from in the future (e.g. due to clock skew) requires no TTL at all.
+func getMinTTL(now, from uint32) uint32 {
+	if from > now {
+		return 0
+	}
+	return now - from
+}
+
+// readyFrom returns the time by which archives must have become ready, for them to be used
+// for a request starting at from. This takes into account the ready-lead
+func readyFrom(from uint32) uint32 {
+	if from < readyLead {
+		return 0
+	}
+	return from - readyLead
+}
+
+// snapFrom snaps from down to a multiple of plan-from-snap, if enabled.
+// As dashboards auto-refresh, from advances by a few seconds each time. Planning with a snapped from
+// means they only cross the Ready and TTL boundaries of archives (and thus flip to another archive)
+// once per grid step, rather than on any refresh.
+func snapFrom(from uint32) uint32 {
+	if planFromSnap == 0 {
+		return from
+	}
+	return from - from%planFromSnap
+}
+
+// readable returns whether each used retention has at least one archive that is readable wrt from (irrespective of TTL)
+func readable(schemas *conf.Schemas, rbr ReqsByRet, from uint32) bool {
+	for schemaID, reqs := range rbr {
+		if len(reqs) == 0 {
+			continue
+		}
+		var ok bool
+		for _, ret := range schemas.Get(uint16(schemaID)).Retentions.Rets {
+			if ret.Readable(readyFrom(from)) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
 // getValidIntervals returns the list of valid intervals for the given set of retentions
-func getValidIntervals(schemaID uint16, from, ttl uint32) ([]uint32, bool) {
+func getValidIntervals(schemas *conf.Schemas, schemaID uint16, from, ttl uint32) ([]uint32, bool) {
 
 	var ok bool
 	var validIntervals []uint32
 
-	rets := mdata.Schemas.Get(schemaID).Retentions.Rets
+	rets := schemas.Get(schemaID).Retentions.Rets
 	for _, ret := range rets {
-		if ret.Valid(from, ttl) {
+		reqRenderPlanArchivesInspected.Inc()
+		if ret.Valid(readyFrom(from), ttl) {
 			ok = true
 			validIntervals = append(validIntervals, uint32(ret.SecondsPerPoint))
 		}
@@ -433,20 +1563,44 @@ func getValidIntervals(schemaID uint16, from, ttl uint32) ([]uint32, bool) {
 	return validIntervals, ok
 }
 
+// singleIntervals returns the interval of each list of the intervalsSet, if each of them has exactly one interval.
+func singleIntervals(intervalsSet [][]uint32) ([]uint32, bool) {
+	intervals := make([]uint32, 0, len(intervalsSet))
+	for _, v := range intervalsSet {
+		if len(v) != 1 {
+			return nil, false
+		}
+		intervals = append(intervals, v[0])
+	}
+	return intervals, true
+}
+
 // getLowestResFromSetMatching computes the LCM for each possible combination of the intervalsSet
 // returns the LCM interval such that minInterval <= LCM interval <= maxInterval that requires the least points to be fetched.
 // If the proper LCM interval is not found, returns the lowest interval
+// If there are no combinations at all (or none of which the LCM fits in a uint32), returns 0
 // Caller must make sure all requests support these intervals, otherwise we panic
-func getLowestResFromSetMatching(rbr ReqsByRet, from, ttl, minInterval, maxInterval uint32, intervalsSet [][]uint32) uint32 {
+// If the search exceeds plan-time-budget, it is abandoned and we use the best interval found so far (or the lowest one seen).
+func getLowestResFromSetMatching(schemas *conf.Schemas, rbr ReqsByRet, from, ttl, minInterval, maxInterval uint32, intervalsSet [][]uint32) uint32 {
+	start := time.Now()
 	combos := util.AllCombinationsUint32(intervalsSet)
 
 	var maxScore int
 
-	lowestInterval := uint32(math.MaxUint32)
+	var lowestInterval uint32
 	var returnInterval uint32
-	for _, combo := range combos {
+	for i, combo := range combos {
+		// checking the time for every combination would be too expensive
+		if planTimeBudget > 0 && i%1024 == 1023 && time.Since(start) > planTimeBudget {
+			reqRenderPlanBudgetExceeded.Inc()
+			log.Warnf("HTTP Render: abandoning search for the interval of a pre-normalization group after evaluating %d of %d combinations, as it exceeded plan-time-budget %s", i, len(combos), planTimeBudget)
+			break
+		}
 		candidateInterval := util.Lcm(combo)
-		if candidateInterval < lowestInterval {
+		if candidateInterval == 0 {
+			continue // overflow
+		}
+		if lowestInterval == 0 || candidateInterval < lowestInterval {
 			lowestInterval = candidateInterval
 		}
 		if candidateInterval < minInterval || candidateInterval > maxInterval {
@@ -457,7 +1611,7 @@ func getLowestResFromSetMatching(rbr ReqsByRet, from, ttl, minInterval, maxInter
 			if len(reqs) == 0 {
 				continue
 			}
-			rets := mdata.Schemas.Get(uint16(schemaID)).Retentions.Rets
+			rets := schemas.Get(uint16(schemaID)).Retentions.Rets
 			_, ret, ok := findLowestValidResForInterval(rets, from, ttl, candidateInterval)
 			if !ok {
 				panic(fmt.Sprintf("getLowestResFromSetMatching: could not findLowestValidResForInterval for interval %d", candidateInterval))
@@ -476,6 +1630,50 @@ func getLowestResFromSetMatching(rbr ReqsByRet, from, ttl, minInterval, maxInter
 	return returnInterval
 }
 
+// getMaxIntervalForMDP returns the coarsest interval that still yields >= mdp/2 points for the given window.
+// it is computed in 64 bit, lest large windows overflow and result in a needlessly fine interval. mdp 0 yields 0.
+func getMaxIntervalForMDP(window, mdp uint32) uint32 {
+	if mdp == 0 {
+		return 0
+	}
+	maxInterval := 2 * uint64(window) / uint64(mdp)
+	if maxInterval > math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return uint32(maxInterval)
+}
+
+// getClosestResFromSetMatching computes the LCM for each possible combination of the intervalsSet
+// returns the LCM interval that, for the given window, yields the amount of points closest to mdp (above or below).
+// in case of a tie, the highest resolution wins.
+// If there are no combinations at all (or none of which the LCM fits in a uint32), returns 0
+func getClosestResFromSetMatching(window, mdp uint32, intervalsSet [][]uint32) uint32 {
+	combos := util.AllCombinationsUint32(intervalsSet)
+
+	var interval uint32
+	var dist uint32
+	for _, combo := range combos {
+		candidateInterval := util.Lcm(combo)
+		if candidateInterval == 0 {
+			continue // overflow
+		}
+		candidateDist := distance(window/candidateInterval, mdp)
+		if interval == 0 || candidateDist < dist || (candidateDist == dist && candidateInterval < interval) {
+			interval = candidateInterval
+			dist = candidateDist
+		}
+	}
+	return interval
+}
+
+// distance returns the absolute difference between a and b
+func distance(a, b uint32) uint32 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
+
 // getHighestResFromSetMatching computes the LCM for each possible combination of the intervalsSet
 // returns the lowest LCM interval such that minInterval <= LCM interval <= maxInterval.
 // if the proper LCM interval is not found, returns 0
@@ -485,7 +1683,7 @@ func getHighestResFromSetMatching(from, ttl, minInterval, maxInterval uint32, in
 	var interval uint32 // lowest matching interval we find
 	for _, combo := range combos {
 		candidateInterval := util.Lcm(combo)
-		if candidateInterval < minInterval || candidateInterval > maxInterval {
+		if candidateInterval == 0 || candidateInterval < minInterval || candidateInterval > maxInterval {
 			continue
 		}
 		if interval == 0 || candidateInterval < interval {
@@ -495,51 +1693,511 @@ func getHighestResFromSetMatching(from, ttl, minInterval, maxInterval uint32, in
 	return interval
 }
 
+// getHighestRessFromSetMatching is like getHighestResFromSetMatching, but returns up to n of the lowest LCM intervals, in ascending order.
+func getHighestRessFromSetMatching(minInterval, maxInterval uint32, intervalsSet [][]uint32, n int) []uint32 {
+	var intervals []uint32
+	for _, combo := range util.AllCombinationsUint32(intervalsSet) {
+		candidateInterval := util.Lcm(combo)
+		if candidateInterval == 0 || candidateInterval < minInterval || candidateInterval > maxInterval {
+			continue
+		}
+		i := sort.Search(len(intervals), func(i int) bool { return intervals[i] >= candidateInterval })
+		if i == n || (i < len(intervals) && intervals[i] == candidateInterval) {
+			continue
+		}
+		intervals = append(intervals, 0)
+		copy(intervals[i+1:], intervals[i:])
+		intervals[i] = candidateInterval
+		if len(intervals) > n {
+			intervals = intervals[:n]
+		}
+	}
+	return intervals
+}
+
+// getCheapestInterval returns the interval, out of the given ascending candidates, for which planToMulti would read the fewest chunks.
+// in case of a tie, the lowest interval is returned.
+func getCheapestInterval(schemas *conf.Schemas, from, ttl uint32, candidates []uint32, rbr ReqsByRet) uint32 {
+	var interval, cheapest uint32
+	for _, candidate := range candidates {
+		var chunks uint32
+		for schemaID, reqs := range rbr {
+			if len(reqs) == 0 {
+				continue
+			}
+			_, ret, _ := findValidResForInterval(schemas.Get(uint16(schemaID)).Retentions.Rets, from, ttl, candidate)
+			for _, req := range reqs {
+				chunks += req.ChunksFetch(ret.ChunkSpan)
+			}
+		}
+		if interval == 0 || chunks < cheapest {
+			interval, cheapest = candidate, chunks
+		}
+	}
+	return interval
+}
+
 // planToMulti plans all requests of all retentions to the same given interval.
 // caller must have assured that the requests support this interval, otherwise we will panic
-func planToMulti(now, from, to, interval uint32, rbr ReqsByRet) {
-	minTTL := now - from
+func planToMulti(schemas *conf.Schemas, now, from, to, interval uint32, rbr ReqsByRet) {
+	minTTL := getMinTTL(now, from)
 	for schemaID, reqs := range rbr {
 		if len(reqs) == 0 {
 			continue
 		}
-		rets := mdata.Schemas.Get(uint16(schemaID)).Retentions.Rets
-		archive, ret, ok := findLowestValidResForInterval(rets, from, minTTL, interval)
+		rets := schemas.Get(uint16(schemaID)).Retentions.Rets
+		archive, ret, ok := findValidResForInterval(rets, from, minTTL, interval)
 		if !ok {
-			panic(fmt.Sprintf("planToMulti: could not findLowestResForInterval for desired interval %d", interval))
+			panic(fmt.Sprintf("planToMulti: could not findValidResForInterval for desired interval %d", interval))
+		}
+		for i := range reqs {
+			req := &reqs[i]
+			req.Plan(archive, ret)
+			if interval != req.ArchInterval {
+				req.PlanNormalization(interval)
+			}
+		}
+	}
+}
+
+// equalizePoints coarsens the densest requests so that the amount of points that each series returns is within the given relative
+// tolerance of one another, if their valid retentions allow, so that targets of different schemas line up (see the equalizePoints render parameter).
+// PNGroups, and singles per schema, are coarsened as a whole. unlike align=strict, their intervals may remain different.
+// For each of them, we simulate the successive reductions of their resolution to find which amounts of points they can return. We then pick the
+// amount of points that all of them can get closest to (by ratio of the densest to the sparsest), preferring more points over less.
+func equalizePoints(now, from, to, planMDP uint32, tolerance float64, rp *ReqsPlan) {
+	type unit struct {
+		rbr     ReqsByRet
+		reduce  func() bool
+		options []uint32 // the amount of points returned after 0, 1, 2, ... reductions
+	}
+	var units []unit
+	for _, data := range rp.pngroups {
+		for _, rbr := range []ReqsByRet{data.mdpyes, data.mdpno} {
+			if rbr.HasData() {
+				rbr := rbr
+				units = append(units, unit{
+					rbr:    rbr,
+					reduce: func() bool { return reduceResMulti(rp.schemas, now, from, to, rbr) },
+				})
+			}
+		}
+	}
+	for _, rbr := range []ReqsByRet{rp.single.mdpyes, rp.single.mdpno} {
+		for schemaID, reqs := range rbr {
+			if len(reqs) > 0 {
+				schemaID, reqs := uint16(schemaID), reqs
+				units = append(units, unit{
+					rbr:    ReqsByRet{reqs},
+					reduce: func() bool { return reduceResSingles(rp.schemas, now, from, to, schemaID, reqs) },
+				})
+			}
+		}
+	}
+	if len(units) < 2 {
+		return
+	}
+
+	pointsReturn := func(rbr ReqsByRet) uint32 {
+		var highest uint32
+		for _, reqs := range rbr {
+			for _, req := range reqs {
+				highest = util.Max(highest, req.PointsReturn(planMDP))
+			}
+		}
+		return highest
+	}
+	// snapshot returns a function that restores the requests to their current plan
+	snapshot := func(rbr ReqsByRet) func() {
+		saved := make([][]models.Req, len(rbr))
+		for i, reqs := range rbr {
+			saved[i] = append([]models.Req(nil), reqs...)
+		}
+		return func() {
+			for i := range rbr {
+				copy(rbr[i], saved[i])
+			}
+		}
+	}
+	for i := range units {
+		u := &units[i]
+		restore := snapshot(u.rbr)
+		u.options = append(u.options, pointsReturn(u.rbr))
+		for u.reduce() {
+			points := pointsReturn(u.rbr)
+			if points >= u.options[len(u.options)-1] {
+				break
+			}
+			u.options = append(u.options, points)
+		}
+		restore()
+	}
+
+	// pick returns, for each unit, how many times to reduce it so that it returns no more than limit points, if possible.
+	pick := func(limit float64) []int {
+		steps := make([]int, len(units))
+		for i, u := range units {
+			for steps[i] < len(u.options)-1 && float64(u.options[steps[i]]) > limit {
+				steps[i]++
+			}
+		}
+		return steps
+	}
+	spread := func(steps []int) (float64, uint32) {
+		densest, sparsest := uint32(0), uint32(math.MaxUint32)
+		for i, u := range units {
+			densest = util.Max(densest, u.options[steps[i]])
+			sparsest = util.Min(sparsest, u.options[steps[i]])
+		}
+		if sparsest == 0 {
+			return math.Inf(1), 0
+		}
+		return float64(densest) / float64(sparsest), sparsest
+	}
+	// any combination within tolerance is preferable over any that isn't. amongst those within tolerance, we prefer the most points.
+	// amongst those that aren't, the smallest spread.
+	better := func(s float64, sparsest uint32, bestSpread float64, bestSparsest uint32) bool {
+		within, bestWithin := s <= 1+tolerance, bestSpread <= 1+tolerance
+		if within != bestWithin {
+			return within
+		}
+		if within || s == bestSpread {
+			return sparsest > bestSparsest
+		}
+		return s < bestSpread
+	}
+	best := make([]int, len(units))
+	bestSpread, bestSparsest := spread(best)
+	if bestSpread <= 1+tolerance {
+		return
+	}
+	for _, u := range units {
+		for _, points := range u.options {
+			steps := pick(float64(points) * (1 + tolerance))
+			if s, sparsest := spread(steps); better(s, sparsest, bestSpread, bestSparsest) {
+				best, bestSpread, bestSparsest = steps, s, sparsest
+			}
+		}
+	}
+	for i, u := range units {
+		for j := 0; j < best[i]; j++ {
+			u.reduce()
+		}
+	}
+}
+
+// limitIntervals coarsens requests so that the plan has at most max distinct output intervals, if their valid retentions allow
+// (see the maxIntervals render parameter). It repeatedly snaps all requests at one interval to a coarser interval that is already in use,
+// trying the nearest pairs (by ratio) first. PNGroups (their mdpyes and mdpno requests separately) move as a whole, so they remain pre-normalizable.
+// It returns the resulting intervals, in ascending order, and adds a warning to the plan if they couldn't be reduced to max.
+func limitIntervals(now, from uint32, max int, rp *ReqsPlan) []uint32 {
+	var units [][]*models.Req
+	for _, data := range rp.pngroups {
+		for _, rbr := range []ReqsByRet{data.mdpyes, data.mdpno} {
+			var unit []*models.Req
+			for _, reqs := range rbr {
+				for i := range reqs {
+					unit = append(unit, &reqs[i])
+				}
+			}
+			if len(unit) > 0 {
+				units = append(units, unit)
+			}
+		}
+	}
+	for _, rbr := range []ReqsByRet{rp.single.mdpyes, rp.single.mdpno} {
+		for _, reqs := range rbr {
+			for i := range reqs {
+				units = append(units, []*models.Req{&reqs[i]})
+			}
 		}
+	}
+	intervals := func() []uint32 {
+		seen := make(map[uint32]struct{})
+		var out []uint32
+		for _, unit := range units {
+			for _, req := range unit {
+				if _, ok := seen[req.OutInterval]; !ok {
+					seen[req.OutInterval] = struct{}{}
+					out = append(out, req.OutInterval)
+				}
+			}
+		}
+		sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
+		return out
+	}
+
+	minTTL := getMinTTL(now, from)
+	// snap plans the requests to the given interval. it returns false if that's not possible for any of them.
+	snap := func(reqs []models.Req, interval uint32) bool {
 		for i := range reqs {
 			req := &reqs[i]
+			archive, ret, ok := findValidResForInterval(rp.schemas.Get(req.SchemaId).Retentions.Rets, from, minTTL, interval)
+			// the raw archive of a series may have a different interval than its schema says.
+			// see https://github.com/grafana/metrictank/issues/1679
+			if !ok || (archive == 0 && (req.RawInterval == 0 || interval%req.RawInterval != 0)) {
+				return false
+			}
 			req.Plan(archive, ret)
 			if interval != req.ArchInterval {
 				req.PlanNormalization(interval)
 			}
 		}
+		return true
+	}
+	// move snaps all units that have requests at interval from to interval to, if all of them can be.
+	// otherwise, the plan is left unchanged.
+	move := func(from, to uint32) bool {
+		var moving [][]*models.Req
+		var planned [][]models.Req
+		for _, unit := range units {
+			for _, req := range unit {
+				if req.OutInterval == from {
+					reqs := make([]models.Req, len(unit))
+					for i, req := range unit {
+						reqs[i] = *req
+					}
+					if !snap(reqs, to) {
+						return false
+					}
+					moving = append(moving, unit)
+					planned = append(planned, reqs)
+					break
+				}
+			}
+		}
+		for i, unit := range moving {
+			for j, req := range unit {
+				*req = planned[i][j]
+			}
+		}
+		return true
 	}
+
+	current := intervals()
+	for len(current) > max {
+		type pair struct{ from, to uint32 }
+		var pairs []pair
+		for i := range current {
+			for j := i + 1; j < len(current); j++ {
+				pairs = append(pairs, pair{current[i], current[j]})
+			}
+		}
+		// nearest first
+		sort.SliceStable(pairs, func(i, j int) bool {
+			return uint64(pairs[i].to)*uint64(pairs[j].from) < uint64(pairs[j].to)*uint64(pairs[i].from)
+		})
+		moved := false
+		for _, p := range pairs {
+			if move(p.from, p.to) {
+				moved = true
+				break
+			}
+		}
+		if !moved {
+			rp.warnings = append(rp.warnings, fmt.Sprintf("maxIntervals: could only reduce the number of distinct intervals to %d rather than %d, as the retentions of the series don't allow coarser shared intervals", len(current), max))
+			break
+		}
+		current = intervals()
+	}
+	setCoverage(now, *rp)
+	return current
+}
+
+// planResponse describes how the given planned requests would be read and returned (see the planOnly render parameter).
+func planResponse(reqs []models.Req, planMDP uint32, mdpTarget bool) models.PlanResponse {
+	resp := models.PlanResponse{
+		Intervals: make([]uint32, 0),
+		Series:    make([]models.PlannedSeries, 0, len(reqs)),
+	}
+	seen := make(map[uint32]struct{})
+	for _, req := range reqs {
+		interval := returnInterval(req, planMDP, mdpTarget)
+		if _, ok := seen[interval]; !ok {
+			seen[interval] = struct{}{}
+			resp.Intervals = append(resp.Intervals, interval)
+		}
+		resp.Series = append(resp.Series, models.PlannedSeries{
+			Target:       req.Target,
+			Pattern:      req.Pattern,
+			Archive:      req.Archive,
+			ArchInterval: req.ArchInterval,
+			Interval:     interval,
+		})
+	}
+	sort.Slice(resp.Intervals, func(i, j int) bool { return resp.Intervals[i] < resp.Intervals[j] })
+	sort.Slice(resp.Series, func(i, j int) bool {
+		if resp.Series[i].Target == resp.Series[j].Target {
+			return resp.Series[i].Pattern < resp.Series[j].Pattern
+		}
+		return resp.Series[i].Target < resp.Series[j].Target
+	})
+	return resp
+}
+
+// metaOnlyResponse describes how each of the given planned requests would be read and returned, without any points (see the metaOnly render parameter).
+func metaOnlyResponse(reqs []models.Req, planMDP uint32, mdpTarget bool) []models.MetaOnlySeries {
+	out := make([]models.MetaOnlySeries, 0, len(reqs))
+	for _, req := range reqs {
+		out = append(out, models.MetaOnlySeries{
+			PlannedSeries: models.PlannedSeries{
+				Target:       req.Target,
+				Pattern:      req.Pattern,
+				Archive:      req.Archive,
+				ArchInterval: req.ArchInterval,
+				Interval:     returnInterval(req, planMDP, mdpTarget),
+			},
+			Points:       req.PointsReturn(planMDP),
+			CoverageFrom: req.CoverageFrom,
+			Datapoints:   make([]schema.Point, 0),
+		})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Target == out[j].Target {
+			return out[i].Pattern < out[j].Pattern
+		}
+		return out[i].Target < out[j].Target
+	})
+	return out
+}
+
+// returnInterval returns the interval the series of the planned request is returned at: its output interval, unless
+// it gets consolidated at runtime to honor planMDP, the same way expr.Plan.Run does. (functions such as summarize() may still change it)
+func returnInterval(req models.Req, planMDP uint32, mdpTarget bool) uint32 {
+	interval := req.OutInterval
+	if planMDP == 0 {
+		return interval
+	}
+	first := align.ForwardIfNotAligned(req.From, interval)
+	last := align.Backward(req.To, interval)
+	if last < first {
+		return interval
+	}
+	points := (last-first)/interval + 1
+	if points <= planMDP {
+		return interval
+	}
+	if mdpTarget {
+		return interval * consolidation.AggClosest(points, planMDP)
+	}
+	return interval * consolidation.AggEvery(points, planMDP)
+}
+
+// planToInterval plans all requests of the plan, across PNGroups and singles, to the given output interval (see the interval render parameter).
+// each request reads from the coarsest valid archive of which the interval is a multiple, and gets normalized as needed.
+// it returns an error if the interval can't be achieved for any of the requests, or if the plan then exceeds max-points-per-req-hard.
+func planToInterval(now, from, interval uint32, rp *ReqsPlan, mpprHard int) error {
+	minTTL := getMinTTL(now, from)
+	rbrs := []ReqsByRet{rp.single.mdpyes, rp.single.mdpno}
+	for _, data := range rp.pngroups {
+		rbrs = append(rbrs, data.mdpyes, data.mdpno)
+	}
+	for _, rbr := range rbrs {
+		for schemaID, reqs := range rbr {
+			if len(reqs) == 0 {
+				continue
+			}
+			schema := rp.schemas.Get(uint16(schemaID))
+			archive, ret, ok := findValidResForInterval(schema.Retentions.Rets, from, minTTL, interval)
+			for i := range reqs {
+				req := &reqs[i]
+				// the raw archive of a series may have a different interval than its schema says.
+				// see https://github.com/grafana/metrictank/issues/1679
+				if !ok || (archive == 0 && (req.RawInterval == 0 || interval%req.RawInterval != 0)) {
+					return response.NewError(http.StatusUnprocessableEntity, fmt.Sprintf("interval %d can't be achieved for %s: none of the archives of its storage schema %q (%s) that cover the requested range has an interval that divides it", interval, req.Target, schema.Name, schema.Retentions.Orig))
+				}
+				req.Plan(archive, ret)
+				if interval != req.ArchInterval {
+					req.PlanNormalization(interval)
+				}
+			}
+		}
+	}
+	// the resolution is now exactly what was asked for
+	rp.degraded = ""
+	if mpprHard > 0 && int(rp.PointsFetch()) > mpprHard {
+		return errMaxPointsPerReq
+	}
+	return nil
 }
 
 // findHighestResRet finds the most precise (lowest interval) retention that:
-// * is ready for long enough to accommodate `from`
+// * is enabled and ready for long enough to accommodate `from`
 // * has a long enough TTL, or otherwise the longest TTL
+// if archive-fanout-costs is set, a coarser retention with a lower fan-out cost and a comparable point count is preferred, see preferLowerFanout.
+// if plan-tables is enabled, the retention is looked up in the retTable of the retentions, rather than found by scanning them.
 func findHighestResRet(rets []conf.Retention, from, ttl uint32) (int, conf.Retention, bool) {
+	var archive int
+	var ok, preferred bool
+	if retTables != nil && len(rets) > 0 {
+		archive, ok, preferred = retTables.get(rets).lookup(readyFrom(from), ttl)
+	} else {
+		archive, ok, preferred = scanHighestResRet(rets, readyFrom(from), ttl)
+	}
+	if preferred {
+		reqRenderFanoutPreferred.Inc()
+	}
+	if !ok {
+		return 0, conf.Retention{}, false
+	}
+	return archive, rets[archive], true
+}
+
+// scanHighestResRet implements findHighestResRet by scanning the retentions, given the time by which they must have become ready (see readyFrom).
+// it also returns whether a coarser retention was preferred due to archive-fanout-costs.
+func scanHighestResRet(rets []conf.Retention, ready, ttl uint32) (int, bool, bool) {
 
 	var archive int
-	var ret conf.Retention
-	var ok bool
+	var ok, preferred bool
 
 	for i, retMaybe := range rets {
-		// skip non-ready option.
-		if retMaybe.Ready > from {
+		reqRenderPlanArchivesInspected.Inc()
+		// skip non-ready or disabled option.
+		if !retMaybe.Readable(ready) {
 			continue
 		}
-		archive, ret, ok = i, retMaybe, true
+		archive, ok = i, true
 
 		if uint32(retMaybe.MaxRetention()) >= ttl {
+			if len(fanoutCosts) > 0 {
+				best := preferLowerFanout(rets, ready, ttl, archive)
+				archive, preferred = best, best != archive
+			}
 			break
 		}
 	}
 
-	return archive, ret, ok
+	return archive, ok, preferred
+}
+
+// fanoutCost returns the estimated cost of the fan-out needed to read the given archive, as configured via archive-fanout-costs
+func fanoutCost(archive int) uint32 {
+	if len(fanoutCosts) == 0 {
+		return 0
+	}
+	if archive >= len(fanoutCosts) {
+		return fanoutCosts[len(fanoutCosts)-1]
+	}
+	return fanoutCosts[archive]
+}
+
+// preferLowerFanout returns, amongst the given valid retention and the coarser valid retentions of which the point count
+// is within archive-fanout-tolerance of it, the one with the lowest fan-out cost. the finest one wins ties.
+// point counts are compared via the intervals, as they are inversely proportional for a given time range.
+// ready is the time by which the retentions must have become ready, see readyFrom.
+func preferLowerFanout(rets []conf.Retention, ready, ttl uint32, archive int) int {
+	best := archive
+	maxInterval := float64(rets[archive].SecondsPerPoint) / (1 - fanoutTolerance)
+	for i := archive + 1; i < len(rets); i++ {
+		reqRenderPlanArchivesInspected.Inc()
+		if float64(rets[i].SecondsPerPoint) > maxInterval {
+			break
+		}
+		if rets[i].Valid(ready, ttl) && fanoutCost(i) < fanoutCost(best) {
+			best = i
+		}
+	}
+	return best
 }
 
 // findLowestValidResForInterval finds the coarsest valid retention that has an interval that either:
@@ -548,10 +2206,71 @@ func findHighestResRet(rets []conf.Retention, from, ttl uint32) (int, conf.Reten
 // note that because we iterate in descending order we always return an exact match when possible.
 func findLowestValidResForInterval(rets []conf.Retention, from, ttl, interval uint32) (int, conf.Retention, bool) {
 	for i := len(rets) - 1; i >= 0; i-- {
+		reqRenderPlanArchivesInspected.Inc()
 		ret := rets[i]
-		if ret.Valid(from, ttl) && interval%uint32(ret.SecondsPerPoint) == 0 {
+		if ret.Valid(readyFrom(from), ttl) && interval%uint32(ret.SecondsPerPoint) == 0 {
 			return i, ret, true
 		}
 	}
 	return 0, conf.Retention{}, false
 }
+
+// findHighestValidResForInterval finds the finest valid retention that has an interval that is a fraction of (or matches) the desired interval.
+// compared to findLowestValidResForInterval, this fetches more data and requires more normalization, but the normalization
+// consolidates raw data rather than rollups, so less information is lost.
+func findHighestValidResForInterval(rets []conf.Retention, from, ttl, interval uint32) (int, conf.Retention, bool) {
+	for i, ret := range rets {
+		reqRenderPlanArchivesInspected.Inc()
+		if ret.Valid(readyFrom(from), ttl) && interval%uint32(ret.SecondsPerPoint) == 0 {
+			return i, ret, true
+		}
+	}
+	return 0, conf.Retention{}, false
+}
+
+// findValidResForInterval finds the retention to read from to deliver the desired interval, according to normalization-pref
+func findValidResForInterval(rets []conf.Retention, from, ttl, interval uint32) (int, conf.Retention, bool) {
+	if normalizationPref == normalizationPrefMaxAccuracy {
+		return findHighestValidResForInterval(rets, from, ttl, interval)
+	}
+	return findLowestValidResForInterval(rets, from, ttl, interval)
+}
+
+// PlanSweepResult describes how a single series would be planned for a given query window
+type PlanSweepResult struct {
+	Window       uint32 // size of the query window in seconds
+	Satisfiable  bool   // whether any archive could be planned at all. if false, the fields below are not set
+	Archive      uint8  // the archive that would be read from
+	ArchInterval uint32 // the interval of the archive
+	TTL          uint32 // the TTL of the archive
+	Points       uint32 // the number of points that would be fetched
+}
+
+// PlanSweep runs the highest-res planner for a single series of the given schema and raw interval, for each of the given
+// window sizes (all ending at now), so you can see how the chosen archive changes as the query window grows.
+// It does not change any state other than the planner stats that findHighestResRet reports (e.g. archives inspected),
+// and it relies on mdata.Schemas being set.
+func PlanSweep(schemaID uint16, rawInterval, now uint32, windows []uint32) []PlanSweepResult {
+	rets := mdata.SchemasSnapshot().Get(schemaID).Retentions.Rets
+	out := make([]PlanSweepResult, 0, len(windows))
+	for _, window := range windows {
+		from := uint32(0)
+		if window < now {
+			from = now - window
+		}
+		res := PlanSweepResult{Window: window}
+		// same as planHighestResSingles, minus the unsatisfiable stats
+		archive, ret, ok := findHighestResRet(rets, from, getMinTTL(now, from))
+		if ok {
+			req := models.NewReq(schema.MKey{}, "", "", from, now, 0, rawInterval, 0, 0, 0, nil, schemaID, 0)
+			req.Plan(archive, ret)
+			res.Satisfiable = true
+			res.Archive = req.Archive
+			res.ArchInterval = req.ArchInterval
+			res.TTL = req.TTL
+			res.Points = req.PointsFetch()
+		}
+		out = append(out, res)
+	}
+	return out
+}
@@ -1,15 +1,26 @@
 package api
 
 import (
+	"math"
+	"math/rand"
+	"net/http"
+	"reflect"
 	"regexp"
 	"sort"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/grafana/metrictank/api/models"
+	"github.com/grafana/metrictank/api/response"
 	"github.com/grafana/metrictank/conf"
 	"github.com/grafana/metrictank/consolidation"
+	"github.com/grafana/metrictank/expr"
 	"github.com/grafana/metrictank/mdata"
+	"github.com/grafana/metrictank/stats"
 	"github.com/grafana/metrictank/test"
+	"github.com/grafana/metrictank/util"
 )
 
 func getReqMap(reqs []models.Req) *ReqMap {
@@ -49,7 +60,7 @@ func testPlan(reqs []models.Req, retentions []conf.Retentions, outReqs []models.
 	// thus SchemasID must accommodate for this!
 	mdata.Schemas = conf.NewSchemas(schemas)
 	//spew.Dump(mdata.Schemas)
-	out, err := planRequests(now, reqs[0].From, reqs[0].To, getReqMap(reqs), 0, maxPointsPerReqSoft, maxPointsPerReqHard)
+	out, err := planRequests(now, reqs[0].From, reqs[0].To, getReqMap(reqs), 0, false, 0, false, maxPointsPerReqSoft, maxPointsPerReqHard, 0)
 	if err != outErr {
 		t.Errorf("different err value expected: %v, got: %v", outErr, err)
 	}
@@ -640,7 +651,3457 @@ func BenchmarkPlanRequestsSamePNGroupNoLimits(b *testing.B) {
 	})
 
 	for n := 0; n < b.N; n++ {
-		res, _ = planRequests(14*24*3600, 0, 3600*24*7, reqs, 0, 0, 0)
+		res, _ = planRequests(14*24*3600, 0, 3600*24*7, reqs, 0, false, 0, false, 0, 0, 0)
 	}
 	result = res
 }
+
+// benchmarkPlanRequestsWildcard plans a wildcard that expanded into 10k series of the same schema
+func benchmarkPlanRequestsWildcard(b *testing.B, mdp uint32, auto bool) {
+	mdata.Schemas = conf.NewSchemas([]conf.Schema{
+		{
+			Pattern:    regexp.MustCompile(".*"),
+			Retentions: conf.MustParseRetentions("10s:1d,60s:7d,300s:30d,3600s:1y"),
+		},
+	})
+	autoPNGroup = auto
+	defer func() { autoPNGroup = false }()
+	reqs := NewReqMap()
+	for i := 0; i < 10000; i++ {
+		reqs.Add(reqRaw(test.GetMKey(i), 0, 3600*24*3, mdp, 10, consolidation.Avg, 0, 0))
+	}
+	var res *ReqsPlan
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		res, _ = planRequests(14*24*3600, 0, 3600*24*3, reqs, mdp, false, 0, false, 0, 0, 0)
+	}
+	result = res
+}
+
+func BenchmarkPlanRequestsWildcard10kSingles(b *testing.B) {
+	benchmarkPlanRequestsWildcard(b, 0, false)
+}
+
+func BenchmarkPlanRequestsWildcard10kMDPSingles(b *testing.B) {
+	benchmarkPlanRequestsWildcard(b, 800, false)
+}
+
+func BenchmarkPlanRequestsWildcard10kAutoPNGroup(b *testing.B) {
+	benchmarkPlanRequestsWildcard(b, 0, true)
+}
+
+// benchmarkReduceSingleSchemaSoftLimit plans 5000 non-MDP-optimizable series of the same schema, that fetch 27 times more points
+// than max-points-per-req-soft allows at their raw resolution
+func benchmarkReduceSingleSchemaSoftLimit(b *testing.B, reduce func(reqs []models.Req)) {
+	mdata.Schemas = conf.NewSchemas([]conf.Schema{
+		{
+			Pattern:    regexp.MustCompile(".*"),
+			Retentions: conf.MustParseRetentions("10s:1d,30s:2d,60s:7d,300s:14d,900s:30d,3600s:1y"),
+		},
+	})
+	reqs := make([]models.Req, 5000)
+	for i := range reqs {
+		reqs[i] = reqRaw(test.GetMKey(i), 0, 3600*6, 0, 10, consolidation.Avg, 0, 0)
+		reqs[i].Plan(0, mdata.Schemas.Get(0).Retentions.Rets[0])
+	}
+	planned := make([]models.Req, len(reqs))
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		copy(planned, reqs)
+		reduce(planned)
+	}
+	if pointsFetch(planned) > 400000 {
+		b.Fatalf("expected the requests to honor the soft limit, got %d points", pointsFetch(planned))
+	}
+}
+
+func BenchmarkReduceSingleSchemaSoftLimitStepped(b *testing.B) {
+	benchmarkReduceSingleSchemaSoftLimit(b, func(reqs []models.Req) {
+		for pointsFetch(reqs) > 400000 && reduceResSingles(&mdata.Schemas, 14*24*3600, 0, 3600*6, 0, reqs) {
+		}
+	})
+}
+
+func BenchmarkReduceSingleSchemaSoftLimitOneShot(b *testing.B) {
+	benchmarkReduceSingleSchemaSoftLimit(b, func(reqs []models.Req) {
+		reduceResSinglesForSoftLimit(&mdata.Schemas, 14*24*3600, 0, 3600*6, 0, reqs, 400000, 0)
+	})
+}
+
+func BenchmarkPlanRequestsSoftLimit5kSingles(b *testing.B) {
+	mdata.Schemas = conf.NewSchemas([]conf.Schema{
+		{
+			Pattern:    regexp.MustCompile(".*"),
+			Retentions: conf.MustParseRetentions("10s:1d,30s:2d,60s:7d,300s:14d,900s:30d,3600s:1y"),
+		},
+	})
+	reqs := NewReqMap()
+	for i := 0; i < 5000; i++ {
+		reqs.Add(reqRaw(test.GetMKey(i), 0, 3600*6, 0, 10, consolidation.Avg, 0, 0))
+	}
+	var res *ReqsPlan
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		res, _ = planRequests(14*24*3600, 0, 3600*6, reqs, 0, false, 0, false, 400000, 0, 0)
+	}
+	result = res
+}
+
+// TestPlanRequestsDisabledArchive verifies that a disabled archive is never selected, in any of the planning paths
+func TestPlanRequestsDisabledArchive(t *testing.T) {
+	mdata.Schemas = conf.NewSchemas([]conf.Schema{
+		{
+			Pattern:    regexp.MustCompile(".*"),
+			Retentions: conf.MustParseRetentions("10s:1h,60s:2h:2h:2:true:true,300s:7d"),
+		},
+	})
+	cases := []struct {
+		name        string
+		now         uint32
+		mdp         uint32
+		pngroup     models.PNGroup
+		mpprSoft    int
+		archive     uint8
+		outInterval uint32
+	}{
+		// without the disabled archive, all of these would have chosen archive 1
+		{"HighestResSingles", 5000, 0, 0, 0, 2, 300},
+		{"LowestResForMDPSingles", 1200, 10, 0, 0, 0, 10},
+		{"HighestResMulti", 5000, 0, 123, 0, 2, 300},
+		{"LowestResForMDPMulti", 1200, 10, 123, 0, 0, 10},
+		{"ReduceResSingles", 1200, 0, 0, 150, 2, 300},
+		{"ReduceResMulti", 1200, 0, 123, 150, 2, 300},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			reqs := NewReqMap()
+			for i := 0; i < 2; i++ {
+				r := reqRaw(test.GetMKey(i), 0, 1000, c.mdp, 10, consolidation.Avg, 0, 0)
+				r.PNGroup = c.pngroup
+				reqs.Add(r)
+			}
+			plan, err := planRequests(c.now, 0, 1000, reqs, c.mdp, false, 0, false, c.mpprSoft, 0, 0)
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			for _, r := range plan.List() {
+				if r.Archive != c.archive || r.OutInterval != c.outInterval {
+					t.Errorf("expected archive %d and outInterval %d, got archive %d and outInterval %d", c.archive, c.outInterval, r.Archive, r.OutInterval)
+				}
+			}
+		})
+	}
+}
+
+// lcm64 is a reference implementation of the LCM that doesn't overflow for the values we feed it
+func lcm64(vals []uint32) uint64 {
+	out := uint64(1)
+	for _, v := range vals {
+		a, b := out, uint64(v)
+		for b != 0 {
+			a, b = b, a%b
+		}
+		out = out / a * uint64(v)
+	}
+	return out
+}
+
+// achievable returns whether interval can be delivered by a read from each of the lists of intervals
+func achievable(interval uint32, intervalsSet [][]uint32) bool {
+	for _, intervals := range intervalsSet {
+		var ok bool
+		for _, v := range intervals {
+			if interval%v == 0 {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// TestGetResFromSetMatchingRandom feeds random schemas - including large coprime intervals and
+// non-ready archives - into the interval-combination search and validates that it never panics,
+// only returns intervals achievable by all participating schemas, and respects the min/max bounds.
+// the same invariants can be checked with go-fuzz, see fuzz.go
+func TestGetResFromSetMatchingRandom(t *testing.T) {
+	pool := []uint32{1, 2, 3, 5, 7, 10, 15, 60, 120, 600, 3600, 86400, 65521, 65537, 4294967291}
+	r := rand.New(rand.NewSource(42))
+	for i := 0; i < 5000; i++ {
+		var schemas []conf.Schema
+		var schemaIDs []int
+		var numRets int
+		for s := 0; s < 1+r.Intn(4); s++ {
+			var rets []conf.Retention
+			var interval uint32
+			for _, p := range r.Perm(len(pool))[:1+r.Intn(4)] {
+				interval = pool[p]
+				ready := uint32(0)
+				if r.Intn(4) == 0 {
+					ready = math.MaxUint32
+				}
+				rets = append(rets, conf.NewRetentionMT(int(interval), interval, 0, 0, ready))
+			}
+			sort.Slice(rets, func(i, j int) bool { return rets[i].SecondsPerPoint < rets[j].SecondsPerPoint })
+			schemas = append(schemas, conf.Schema{
+				Pattern:    regexp.MustCompile(".*"),
+				Retentions: conf.BuildFromRetentions(rets...),
+			})
+			// note: schemas are expanded, one entry per retention
+			schemaIDs = append(schemaIDs, numRets)
+			numRets += len(rets)
+		}
+		mdata.Schemas = conf.NewSchemas(schemas)
+
+		rbr := make(ReqsByRet, numRets)
+		for j, id := range schemaIDs {
+			rbr[id] = []models.Req{reqRaw(test.GetMKey(j), 0, 1000, 0, 10, consolidation.Avg, uint16(id), 0)}
+		}
+
+		intervalsSet, ok := getValidIntervalsSet(&mdata.Schemas, rbr, 0, 1)
+		if !ok {
+			continue
+		}
+		minInterval := pool[r.Intn(len(pool))]
+		maxInterval := minInterval * uint32(1+r.Intn(100))
+		if maxInterval < minInterval {
+			maxInterval = math.MaxUint32
+		}
+
+		// the reference result: whether any combination has an LCM within bounds
+		var inBounds, fits bool
+		for _, combo := range util.AllCombinationsUint32(intervalsSet) {
+			lcm := lcm64(combo)
+			fits = fits || lcm <= math.MaxUint32
+			inBounds = inBounds || (lcm >= uint64(minInterval) && lcm <= uint64(maxInterval))
+		}
+
+		highest := getHighestResFromSetMatching(0, 1, minInterval, maxInterval, intervalsSet)
+		if inBounds != (highest != 0) {
+			t.Fatalf("case %d: set %v, bounds %d-%d: getHighestResFromSetMatching returned %d", i, intervalsSet, minInterval, maxInterval, highest)
+		}
+		if highest != 0 && (highest < minInterval || highest > maxInterval || !achievable(highest, intervalsSet)) {
+			t.Fatalf("case %d: set %v, bounds %d-%d: getHighestResFromSetMatching returned invalid interval %d", i, intervalsSet, minInterval, maxInterval, highest)
+		}
+
+		lowest := getLowestResFromSetMatching(&mdata.Schemas, rbr, 0, 1, minInterval, maxInterval, intervalsSet)
+		if fits != (lowest != 0) {
+			t.Fatalf("case %d: set %v, bounds %d-%d: getLowestResFromSetMatching returned %d", i, intervalsSet, minInterval, maxInterval, lowest)
+		}
+		if lowest != 0 && !achievable(lowest, intervalsSet) {
+			t.Fatalf("case %d: set %v, bounds %d-%d: getLowestResFromSetMatching returned unachievable interval %d", i, intervalsSet, minInterval, maxInterval, lowest)
+		}
+		if inBounds && (lowest < minInterval || lowest > maxInterval) {
+			t.Fatalf("case %d: set %v, bounds %d-%d: getLowestResFromSetMatching returned out of bounds interval %d", i, intervalsSet, minInterval, maxInterval, lowest)
+		}
+	}
+
+	// degenerate sets, which don't require any schemas
+	for _, set := range [][][]uint32{nil, {}, {{}}, {{10, 60}, {}}, {{4294967291}, {4294967279}}} {
+		if got := getHighestResFromSetMatching(0, 1, 0, math.MaxUint32, set); got != 0 {
+			t.Errorf("set %v: expected getHighestResFromSetMatching to return 0, got %d", set, got)
+		}
+		if got := getLowestResFromSetMatching(&mdata.Schemas, nil, 0, 1, 0, math.MaxUint32, set); got != 0 {
+			t.Errorf("set %v: expected getLowestResFromSetMatching to return 0, got %d", set, got)
+		}
+	}
+}
+
+// TestPlanRequestsUnsatisfiableCauses verifies that each cause of an unsatisfiable request increments the right counter
+func TestPlanRequestsUnsatisfiableCauses(t *testing.T) {
+	noReady, ttlNotMet, noValidInterval := reqRenderUnsatisfiableNoReadyArchive, reqRenderUnsatisfiableTTLNotMet, reqRenderUnsatisfiableNoValidInterval
+	cases := []struct {
+		name     string
+		rets     []conf.Retentions
+		raw      []uint32 // raw interval of each request. request i uses schema i
+		now      uint32
+		mdp      uint32
+		pngroup  models.PNGroup
+		expCount *stats.Counter32
+	}{
+		{"NoReadyArchiveSingles", []conf.Retentions{conf.MustParseRetentions("10s:1d:1h:2:5000")}, []uint32{10}, 1200, 0, 0, noReady},
+		{"NoReadyArchiveMDPSingles", []conf.Retentions{conf.MustParseRetentions("10s:1d:1h:2:5000")}, []uint32{10}, 1200, 800, 0, noReady},
+		{"NoReadyArchiveMulti", []conf.Retentions{conf.MustParseRetentions("10s:1d:1h:2:5000")}, []uint32{10}, 1200, 0, 123, noReady},
+		{"NoReadyArchiveMDPMulti", []conf.Retentions{conf.MustParseRetentions("10s:1d:1h:2:5000")}, []uint32{10}, 1200, 800, 123, noReady},
+		{"TTLNotMetMDPMulti", []conf.Retentions{conf.MustParseRetentions("10s:1h")}, []uint32{10}, 100000, 800, 123, ttlNotMet},
+		{
+			"NoValidIntervalMulti",
+			[]conf.Retentions{
+				conf.BuildFromRetentions(conf.NewRetentionMT(4294967291, math.MaxUint32, 0, 0, 0)),
+				conf.BuildFromRetentions(conf.NewRetentionMT(4294967279, math.MaxUint32, 0, 0, 0)),
+			},
+			[]uint32{4294967291, 4294967279}, 1200, 0, 123, noValidInterval,
+		},
+		{
+			"NoValidIntervalMDPMulti",
+			[]conf.Retentions{
+				conf.BuildFromRetentions(conf.NewRetentionMT(4294967291, math.MaxUint32, 0, 0, 0)),
+				conf.BuildFromRetentions(conf.NewRetentionMT(4294967279, math.MaxUint32, 0, 0, 0)),
+			},
+			[]uint32{4294967291, 4294967279}, 1200, 800, 123, noValidInterval,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var schemas []conf.Schema
+			for _, ret := range c.rets {
+				schemas = append(schemas, conf.Schema{
+					Pattern:    regexp.MustCompile(".*"),
+					Retentions: ret,
+				})
+			}
+			mdata.Schemas = conf.NewSchemas(schemas)
+			reqs := NewReqMap()
+			for i, raw := range c.raw {
+				// each schema has a single retention, so the schemaID matches the index
+				r := reqRaw(test.GetMKey(i), 0, 1000, c.mdp, raw, consolidation.Avg, uint16(i), 0)
+				r.PNGroup = c.pngroup
+				reqs.Add(r)
+			}
+			counters := map[string]*stats.Counter32{
+				"no_ready_archive":  noReady,
+				"ttl_not_met":       ttlNotMet,
+				"no_valid_interval": noValidInterval,
+			}
+			before := make(map[string]uint32)
+			for name, counter := range counters {
+				before[name] = counter.Peek()
+			}
+			_, err := planRequests(c.now, 0, 1000, reqs, c.mdp, false, 0, false, 0, 0, 0)
+			if err != errUnSatisfiable {
+				t.Fatalf("expected error %v, got %v", errUnSatisfiable, err)
+			}
+			for name, counter := range counters {
+				exp := before[name]
+				if counter == c.expCount {
+					exp++
+				}
+				if counter.Peek() != exp {
+					t.Errorf("expected counter %s to be %d, got %d", name, exp, counter.Peek())
+				}
+			}
+		})
+	}
+}
+
+// TestValidateRequests verifies that validateRequests reports all unsatisfiable requests with their reason, rather than only the first
+func TestValidateRequests(t *testing.T) {
+	mdata.Schemas = conf.NewSchemas([]conf.Schema{
+		{Pattern: regexp.MustCompile(".*"), Retentions: conf.MustParseRetentions("10s:1d:1h:2:5000")},
+		{Pattern: regexp.MustCompile(".*"), Retentions: conf.MustParseRetentions("10s:1h")},
+		{Pattern: regexp.MustCompile(".*"), Retentions: conf.BuildFromRetentions(conf.NewRetentionMT(4294967291, math.MaxUint32, 0, 0, 0))},
+		{Pattern: regexp.MustCompile(".*"), Retentions: conf.BuildFromRetentions(conf.NewRetentionMT(4294967279, math.MaxUint32, 0, 0, 0))},
+		{Pattern: regexp.MustCompile(".*"), Retentions: conf.MustParseRetentions("10s:1d")},
+	})
+	// expanded schema ids: 0, 1, 2, 3, 4
+
+	reqs := NewReqMap()
+	add := func(i int, target, pattern string, mdp, raw uint32, pngroup models.PNGroup) {
+		r := reqRaw(test.GetMKey(i), 0, 1000, mdp, raw, consolidation.Avg, uint16(i), 0)
+		r.Target, r.Pattern, r.PNGroup = target, pattern, pngroup
+		reqs.Add(r)
+	}
+	add(0, "a.notready", "a.*", 0, 10, 0)             // single without a ready archive
+	add(1, "b.short", "sum(b.*)", 800, 10, 123)       // MDP-optimizable PNGroup without an archive covering the TTL
+	add(2, "c.huge1", "sum(c.*)", 0, 4294967291, 456) // PNGroup without a common interval
+	add(3, "c.huge2", "sum(c.*)", 0, 4294967279, 456) // PNGroup without a common interval
+	add(4, "d.fine", "d.*", 0, 10, 0)                 // satisfiable
+
+	exp := []models.UnsatisfiableTarget{
+		{Target: "a.notready", Pattern: "a.*", Reason: unsatisfiableNoReadyArchive},
+		{Target: "b.short", Pattern: "sum(b.*)", Reason: unsatisfiableTTLNotMet},
+		{Target: "c.huge1", Pattern: "sum(c.*)", Reason: unsatisfiableNoValidInterval},
+		{Target: "c.huge2", Pattern: "sum(c.*)", Reason: unsatisfiableNoValidInterval},
+	}
+	got := validateRequests(100000, 0, 1000, reqs, 800, false, false, 0)
+	if !reflect.DeepEqual(exp, got) {
+		t.Errorf("expected unsatisfiable targets:\n%+v\ngot:\n%+v", exp, got)
+	}
+
+	// regular planning still fails on the first
+	if _, err := planRequests(100000, 0, 1000, reqs, 800, false, 0, false, 0, 0, 0); err != errUnSatisfiable {
+		t.Errorf("expected planRequests to return error %v, got %v", errUnSatisfiable, err)
+	}
+}
+
+// TestPlanRequestsNoRetentions verifies that requests for a schema without any retentions are reported as unsatisfiable, rather than crashing the planners
+func TestPlanRequestsNoRetentions(t *testing.T) {
+	schemas := conf.NewSchemas(nil)
+	schemas.DefaultSchema = conf.Schema{Name: "default", Pattern: regexp.MustCompile(".*")}
+	schemas.BuildIndex()
+	mdata.Schemas = schemas
+	// the index is empty, so schemaID 0 resolves to the default schema, which has no retentions
+
+	cases := []struct {
+		name     string
+		mdp      uint32
+		pngroup  models.PNGroup
+		cheapest bool
+	}{
+		{"Singles", 0, 0, false},
+		{"MDPSingles", 800, 0, false},
+		{"CheapestSingles", 0, 0, true},
+		{"Multi", 0, 123, false},
+		{"MDPMulti", 800, 123, false},
+		{"CheapestMulti", 0, 123, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			reqs := NewReqMap()
+			r := reqRaw(test.GetMKey(0), 0, 1000, c.mdp, 10, consolidation.Avg, 0, 0)
+			r.Target, r.Pattern, r.PNGroup = "a.b", "a.*", c.pngroup
+			reqs.Add(r)
+
+			before := reqRenderUnsatisfiableNoRetentions.Peek()
+			if _, err := planRequests(1200, 0, 1000, reqs, c.mdp, false, 0, c.cheapest, 0, 0, 0); err != errNoRetentions {
+				t.Fatalf("expected error %v, got %v", errNoRetentions, err)
+			}
+			if got := reqRenderUnsatisfiableNoRetentions.Peek(); got != before+1 {
+				t.Errorf("expected counter no_retentions to be %d, got %d", before+1, got)
+			}
+
+			exp := []models.UnsatisfiableTarget{{Target: "a.b", Pattern: "a.*", Reason: unsatisfiableNoRetentions}}
+			if got := validateRequests(1200, 0, 1000, reqs, c.mdp, false, c.cheapest, 0); !reflect.DeepEqual(exp, got) {
+				t.Errorf("expected unsatisfiable targets:\n%+v\ngot:\n%+v", exp, got)
+			}
+		})
+	}
+}
+
+// TestPlanRequestsFanoutCost verifies that a coarser archive with a lower fan-out cost is preferred over the highest resolution one,
+// but only if their point counts are comparable
+func TestPlanRequestsFanoutCost(t *testing.T) {
+	mdata.Schemas = conf.NewSchemas([]conf.Schema{
+		{
+			Pattern:    regexp.MustCompile(".*"),
+			Retentions: conf.MustParseRetentions("15s:1d,30s:2d,60s:7d"),
+		},
+	})
+	defer func() { fanoutCosts, fanoutTolerance = nil, 0 }()
+
+	cases := []struct {
+		name       string
+		costs      []uint32
+		tolerance  float64
+		window     uint32
+		expArchive uint8
+	}{
+		{"Disabled", nil, 0.5, 3600, 0},
+		{"Comparable", []uint32{4, 1}, 0.5, 3600, 1},
+		{"NotComparable", []uint32{4, 1}, 0.25, 3600, 0},
+		{"SameCost", []uint32{1}, 0.5, 3600, 0},
+		{"LowestCostWins", []uint32{4, 2, 1}, 0.9, 3600, 2},
+		{"FinestOfLowestCostWins", []uint32{4, 1}, 0.9, 3600, 1},
+		{"RawDoesNotCoverTTL", []uint32{4, 4, 1}, 0.25, 36 * 3600, 1}, // 60s isn't comparable to 30s
+	}
+	now := uint32(10 * 24 * 3600)
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			fanoutCosts, fanoutTolerance = c.costs, c.tolerance
+			from := now - c.window
+			reqs := NewReqMap()
+			reqs.Add(reqRaw(test.GetMKey(0), from, now, 0, 15, consolidation.Avg, 0, 0))
+			pre := reqRenderFanoutPreferred.Peek()
+			rp, err := planRequests(now, from, now, reqs, 0, false, 0, false, 0, 0, 0)
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if got := rp.List()[0].Archive; got != c.expArchive {
+				t.Errorf("expected archive %d, got %d", c.expArchive, got)
+			}
+			// the finest archive covering the TTL is 0, unless the window exceeds its TTL
+			finest := uint8(0)
+			if c.window > 24*3600 {
+				finest = 1
+			}
+			exp := pre
+			if c.expArchive != finest {
+				exp++
+			}
+			if reqRenderFanoutPreferred.Peek() != exp {
+				t.Errorf("expected fanout_preferred to be %d, got %d", exp, reqRenderFanoutPreferred.Peek())
+			}
+		})
+	}
+}
+
+// TestReduceResMultiCandidates verifies that with reduce-res-candidates, coarsening a pre-normalization group can skip the next
+// common interval if it requires reading an archive with small chunks, in favor of a slightly coarser one that reads far fewer chunks.
+func TestReduceResMultiCandidates(t *testing.T) {
+	schemas := conf.NewSchemas([]conf.Schema{
+		{
+			Pattern:    regexp.MustCompile("a"),
+			Retentions: conf.MustParseRetentions("5s:1d:5min:2,30s:2d:6h:2"),
+		},
+		{
+			Pattern:    regexp.MustCompile("b"),
+			Retentions: conf.MustParseRetentions("10s:1d:5min:2,60s:2d:6h:2"),
+		},
+	})
+	defer func() { reduceResCandidates = 1 }()
+
+	now := uint32(10 * 24 * 3600)
+	from := now - 12*3600
+	// the group can be coarsened from 10 to 30, but that requires reading the raw data of b, with its 5min chunks,
+	// whereas 60 reads the rollups of both, with their 6h chunks.
+	cases := []struct {
+		candidates   int
+		expInterval  uint32
+		expPreferred uint32
+	}{
+		{1, 30, 0},
+		{2, 60, 1},
+		{3, 60, 1},
+	}
+	for _, c := range cases {
+		reduceResCandidates = c.candidates
+		// schema ids are assigned per archive: a is 0 and b is 2
+		rbr := make(ReqsByRet, 3)
+		rbr[0] = []models.Req{reqRaw(test.GetMKey(0), from, now, 0, 5, consolidation.Avg, 0, 0)}
+		rbr[2] = []models.Req{reqRaw(test.GetMKey(1), from, now, 0, 10, consolidation.Avg, 2, 0)}
+		planToMulti(&schemas, now, from, now, 10, rbr)
+
+		preferred := reqRenderChunksPreferred.Peek()
+		if !reduceResMulti(&schemas, now, from, now, rbr) {
+			t.Fatalf("candidates %d: expected to be able to reduce", c.candidates)
+		}
+		if got := rbr.OutInterval(); got != c.expInterval {
+			t.Errorf("candidates %d: expected interval %d, got %d", c.candidates, c.expInterval, got)
+		}
+		if got := reqRenderChunksPreferred.Peek() - preferred; got != c.expPreferred {
+			t.Errorf("candidates %d: expected chunks_preferred to be incremented by %d, got %d", c.candidates, c.expPreferred, got)
+		}
+	}
+}
+
+// TestRetTable verifies that the retTable of various retentions picks the same retention as scanning them, across a range of windows
+func TestRetTable(t *testing.T) {
+	defer func() { fanoutCosts, fanoutTolerance = nil, 0 }()
+	cases := []struct {
+		rets      string
+		costs     []uint32
+		tolerance float64
+	}{
+		{"1s:1d,1min:30d,10min:1y", nil, 0},
+		{"10s:1h:10min:10:true,60s:1d:1h:2:1000", nil, 0},
+		{"10s:1d,60s:7d:6h:2:true:true,600s:30d:6h:2:500,1h:1y:1d:2:20000", nil, 0},
+		{"10s:1d,30s:7d:6h:2:3000,60s:30d:6h:2:true", []uint32{4, 2, 1}, 0.9},
+	}
+	now := uint32(400 * 24 * 3600)
+	for _, c := range cases {
+		fanoutCosts, fanoutTolerance = c.costs, c.tolerance
+		rets := conf.MustParseRetentions(c.rets).Rets
+		table := newRetTable(rets)
+		var ttls []uint32
+		for _, ret := range rets {
+			ttl := uint32(ret.MaxRetention())
+			ttls = append(ttls, ttl-1, ttl, ttl+1)
+		}
+		for window := uint32(60); window < now; window = window*3/2 + 1 {
+			ttls = append(ttls, window)
+		}
+		for ready := uint32(0); ready <= 25000; ready += 250 {
+			for _, ttl := range ttls {
+				expArchive, expOk, expPreferred := scanHighestResRet(rets, ready, ttl)
+				archive, ok, preferred := table.lookup(ready, ttl)
+				if archive != expArchive || ok != expOk || preferred != expPreferred {
+					t.Fatalf("rets %s, ready %d, ttl %d: expected %d, %t, %t, got %d, %t, %t", c.rets, ready, ttl, expArchive, expOk, expPreferred, archive, ok, preferred)
+				}
+			}
+		}
+	}
+}
+
+// TestRetTableCache verifies that the retTables are built once for each distinct set of retentions, and rebuilt once the schemas get replaced
+func TestRetTableCache(t *testing.T) {
+	rets := conf.MustParseRetentions("10s:1d,60s:7d").Rets
+	cache := newRetTableCache()
+	table := cache.get(rets)
+	if cache.get(rets) != table {
+		t.Fatalf("expected the table to be reused")
+	}
+	if cache.get(conf.MustParseRetentions("10s:1d,60s:7d").Rets) != table {
+		t.Fatalf("expected a copy of the retentions to reuse the table")
+	}
+	if cache.get(conf.MustParseRetentions("10s:1d,60s:30d").Rets) == table {
+		t.Fatalf("expected other retentions to get their own table")
+	}
+	mdata.SetSchemas(mdata.Schemas)
+	if cache.get(rets) == table {
+		t.Fatalf("expected the table to be rebuilt once the schemas were replaced")
+	}
+	if tables := cache.tables.Load().(retTableSet).tables; len(tables) != 1 {
+		t.Fatalf("expected the tables of the previous schemas to be dropped, got %d tables", len(tables))
+	}
+}
+
+// TestRetTableCacheMinFetchInterval verifies that the schemas derived for min-fetch-interval, which are copied for each request,
+// don't add a table for each request
+func TestRetTableCacheMinFetchInterval(t *testing.T) {
+	mdata.Schemas = conf.NewSchemas([]conf.Schema{
+		{
+			Pattern:    regexp.MustCompile(".*"),
+			Retentions: conf.MustParseRetentions("10s:1d,60s:7d"),
+		},
+	})
+	retTables = newRetTableCache()
+	defer func() { retTables = nil }()
+
+	plan := func() {
+		reqs := NewReqMap()
+		reqs.Add(reqRaw(test.GetMKey(0), 0, 3600, 0, 10, consolidation.Avg, 0, 0))
+		if _, err := planRequests(86400, 0, 3600, reqs, 0, false, 0, false, 0, 0, 60); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+	plan()
+	tables := len(retTables.tables.Load().(retTableSet).tables)
+	if tables == 0 {
+		t.Fatalf("expected the planning to use a table")
+	}
+	plan()
+	if got := len(retTables.tables.Load().(retTableSet).tables); got != tables {
+		t.Fatalf("expected %d tables after planning again, got %d", tables, got)
+	}
+}
+
+func benchmarkFindHighestResRet(b *testing.B, tables bool) {
+	rets := conf.MustParseRetentions("1s:1d,10s:7d,1min:30d,10min:1y,1h:5y").Rets
+	if tables {
+		retTables = newRetTableCache()
+		defer func() { retTables = nil }()
+	}
+	now := uint32(5 * 365 * 24 * 3600)
+	windows := []uint32{3600, 6 * 3600, 24 * 3600, 7 * 24 * 3600, 30 * 24 * 3600}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		from := now - windows[i%len(windows)]
+		findHighestResRet(rets, from, now-from)
+	}
+}
+
+func BenchmarkFindHighestResRetScan(b *testing.B) {
+	benchmarkFindHighestResRet(b, false)
+}
+
+func BenchmarkFindHighestResRetTable(b *testing.B) {
+	benchmarkFindHighestResRet(b, true)
+}
+
+// TestPlanRequestsReadyLead verifies that archives that became ready within ready-lead of the request's from are skipped
+func TestPlanRequestsReadyLead(t *testing.T) {
+	mdata.Schemas = conf.NewSchemas([]conf.Schema{
+		{
+			Pattern:    regexp.MustCompile(".*"),
+			Retentions: conf.MustParseRetentions("10s:1h:10min:10:true,60s:1d:1h:2:1000"),
+		},
+	})
+	defer func() { readyLead = 0 }()
+	cases := []struct {
+		name        string
+		now         uint32
+		readyLead   uint32
+		mdp         uint32
+		pngroup     models.PNGroup
+		archive     uint8
+		outInterval uint32
+	}{
+		// archive 1 became ready 100s before from.
+		// with now=5000, the TTL of archive 0 does not suffice, so we use archive 1 if possible.
+		// the MDP-multi path requires the TTL to be met, and picks archive 1 if possible anyway.
+		{"HighestResSinglesNoLead", 5000, 0, 0, 0, 1, 60},
+		{"HighestResSinglesLeadMet", 5000, 100, 0, 0, 1, 60},
+		{"HighestResSinglesLeadNotMet", 5000, 101, 0, 0, 0, 10},
+		{"HighestResMultiLeadMet", 5000, 100, 0, 123, 1, 60},
+		{"HighestResMultiLeadNotMet", 5000, 101, 0, 123, 0, 10},
+		{"LowestResForMDPSinglesLeadMet", 5000, 100, 10, 0, 1, 60},
+		{"LowestResForMDPSinglesLeadNotMet", 5000, 101, 10, 0, 0, 10},
+		{"LowestResForMDPMultiLeadMet", 3000, 100, 10, 123, 1, 60},
+		{"LowestResForMDPMultiLeadNotMet", 3000, 101, 10, 123, 0, 10},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			readyLead = c.readyLead
+			reqs := NewReqMap()
+			for i := 0; i < 2; i++ {
+				r := reqRaw(test.GetMKey(i), 1100, 2000, c.mdp, 10, consolidation.Avg, 0, 0)
+				r.PNGroup = c.pngroup
+				reqs.Add(r)
+			}
+			plan, err := planRequests(c.now, 1100, 2000, reqs, c.mdp, false, 0, false, 0, 0, 0)
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			for _, r := range plan.List() {
+				if r.Archive != c.archive || r.OutInterval != c.outInterval {
+					t.Errorf("expected archive %d and outInterval %d, got archive %d and outInterval %d", c.archive, c.outInterval, r.Archive, r.OutInterval)
+				}
+			}
+		})
+	}
+}
+
+// TestPlanRequestsMinFetchInterval verifies that an org restricted by min-fetch-interval-orgs reads a coarser archive than an unrestricted one
+func TestPlanRequestsMinFetchInterval(t *testing.T) {
+	mdata.Schemas = conf.NewSchemas([]conf.Schema{
+		{
+			Pattern:    regexp.MustCompile(".*"),
+			Retentions: conf.MustParseRetentions("1s:1d,1min:30d,10min:1y"),
+		},
+	})
+	defer func() { minFetchIntOrgs = nil }()
+	minFetchIntOrgs = map[uint32]uint32{2: 60}
+
+	now := uint32(100000)
+	from := now - 3600
+	cases := []struct {
+		name    string
+		mdp     uint32
+		pngroup models.PNGroup
+	}{
+		{"HighestResSingles", 0, 0},
+		{"HighestResMulti", 0, 123},
+		{"LowestResForMDPSingles", 3600, 0},
+		{"LowestResForMDPMulti", 3600, 123},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			for _, org := range []struct {
+				id          uint32
+				archive     uint8
+				outInterval uint32
+			}{
+				{1, 0, 1},
+				{2, 1, 60},
+			} {
+				reqs := NewReqMap()
+				for i := 0; i < 2; i++ {
+					r := reqRaw(test.GetMKey(i), from, now, c.mdp, 1, consolidation.Avg, 0, 0)
+					r.PNGroup = c.pngroup
+					reqs.Add(r)
+				}
+				plan, err := planRequests(now, from, now, reqs, c.mdp, false, 0, false, 0, 0, getMinFetchInterval(org.id))
+				if err != nil {
+					t.Fatalf("org %d: expected no error, got %v", org.id, err)
+				}
+				for _, r := range plan.List() {
+					if r.Archive != org.archive || r.OutInterval != org.outInterval {
+						t.Errorf("org %d: expected archive %d and outInterval %d, got archive %d and outInterval %d", org.id, org.archive, org.outInterval, r.Archive, r.OutInterval)
+					}
+				}
+			}
+		})
+	}
+}
+
+// TestPlanSweep verifies the chosen archive for a sweep of windows against a known retention chain
+func TestPlanSweep(t *testing.T) {
+	mdata.Schemas = conf.NewSchemas([]conf.Schema{
+		{
+			Pattern:    regexp.MustCompile(".*"),
+			Retentions: conf.MustParseRetentions("10s:1d:1h:2:true,1m:7d:6h:2:true,1h:365d:1d:2:true,1d:5y:1d:2:2000000000"),
+		},
+	})
+	now := uint32(1600000000)
+	windows := []uint32{3600, 6 * 3600, 86400, 2 * 86400, 30 * 86400, 3 * 365 * 86400}
+	exp := []PlanSweepResult{
+		{3600, true, 0, 10, 86400, 360},
+		{6 * 3600, true, 0, 10, 86400, 2160},
+		{86400, true, 0, 10, 86400, 8640},
+		{2 * 86400, true, 1, 60, 7 * 86400, 2880},
+		{30 * 86400, true, 2, 3600, 365 * 86400, 720},
+		// the 1d archive is not ready yet, so we fall back to the one with the longest TTL
+		{3 * 365 * 86400, true, 2, 3600, 365 * 86400, 3 * 365 * 24},
+	}
+	got := PlanSweep(0, 10, now, windows)
+	if !reflect.DeepEqual(exp, got) {
+		t.Errorf("PlanSweep mismatch:\nexp: %+v\ngot: %+v", exp, got)
+	}
+
+	// a schema of which no archive is ready yet
+	mdata.Schemas = conf.NewSchemas([]conf.Schema{
+		{
+			Pattern:    regexp.MustCompile(".*"),
+			Retentions: conf.MustParseRetentions("10s:1d:1h:2:2000000000"),
+		},
+	})
+	exp = []PlanSweepResult{{Window: 3600}}
+	got = PlanSweep(0, 10, now, []uint32{3600})
+	if !reflect.DeepEqual(exp, got) {
+		t.Errorf("PlanSweep mismatch:\nexp: %+v\ngot: %+v", exp, got)
+	}
+}
+
+// singleRetentionSchemas sets up a schema with a single retention for each interval, and returns a ReqsByRet with a request for each of them
+func singleRetentionSchemas(intervals []uint32) ReqsByRet {
+	var schemas []conf.Schema
+	rbr := make(ReqsByRet, len(intervals))
+	for i, interval := range intervals {
+		schemas = append(schemas, conf.Schema{
+			Pattern:    regexp.MustCompile(".*"),
+			Retentions: conf.BuildFromRetentions(conf.NewRetentionMT(int(interval), 35*24*3600, 0, 0, 0)),
+		})
+		rbr[i] = []models.Req{reqRaw(test.GetMKey(i), 0, 3600*24, 800, interval, consolidation.Avg, uint16(i), 0)}
+	}
+	mdata.Schemas = conf.NewSchemas(schemas)
+	return rbr
+}
+
+// TestPlanLowestResForMDPMultiSingleRetentions verifies that the fast path for schemas that each have a single
+// valid interval yields the same interval as the combination search
+func TestPlanLowestResForMDPMultiSingleRetentions(t *testing.T) {
+	cases := [][]uint32{
+		{10},
+		{10, 10},
+		{10, 60},
+		{10, 15, 60},
+		{7, 11, 13},
+		{3600, 60, 1},
+	}
+	for i, intervals := range cases {
+		rbr := singleRetentionSchemas(intervals)
+		maxInterval := uint32((2 * 3600 * 24) / 800)
+		validIntervalsSet, ok := getValidIntervalsSet(&mdata.Schemas, rbr, 0, 14*24*3600)
+		if !ok {
+			t.Fatalf("case %d: expected valid intervals", i)
+		}
+		single, ok := singleIntervals(validIntervalsSet)
+		if !ok {
+			t.Fatalf("case %d: expected single intervals, got %v", i, validIntervalsSet)
+		}
+		exp := getLowestResFromSetMatching(&mdata.Schemas, rbr, 0, 14*24*3600, 0, maxInterval, validIntervalsSet)
+		if got := util.Lcm(single); got != exp {
+			t.Errorf("case %d: intervals %v: fast path yields %d, search yields %d", i, intervals, got, exp)
+		}
+		if !planLowestResForMDPMulti(&mdata.Schemas, 14*24*3600, 0, 3600*24, 800, false, rbr) {
+			t.Fatalf("case %d: expected planLowestResForMDPMulti to succeed", i)
+		}
+		for _, reqs := range rbr {
+			for _, req := range reqs {
+				if req.OutInterval != exp {
+					t.Errorf("case %d: intervals %v: expected OutInterval %d, got %d", i, intervals, exp, req.OutInterval)
+				}
+			}
+		}
+	}
+	if _, ok := singleIntervals([][]uint32{{10}, {10, 60}}); ok {
+		t.Errorf("expected singleIntervals to reject a list with multiple intervals")
+	}
+}
+
+func BenchmarkLowestResSingleRetentionsSearch(b *testing.B) {
+	rbr := singleRetentionSchemas([]uint32{10, 15, 30, 60, 120})
+	validIntervalsSet, _ := getValidIntervalsSet(&mdata.Schemas, rbr, 0, 14*24*3600)
+	var res uint32
+	for n := 0; n < b.N; n++ {
+		res = getLowestResFromSetMatching(&mdata.Schemas, rbr, 0, 14*24*3600, 0, 216, validIntervalsSet)
+	}
+	benchInterval = res
+}
+
+func BenchmarkLowestResSingleRetentionsFastPath(b *testing.B) {
+	rbr := singleRetentionSchemas([]uint32{10, 15, 30, 60, 120})
+	validIntervalsSet, _ := getValidIntervalsSet(&mdata.Schemas, rbr, 0, 14*24*3600)
+	var res uint32
+	for n := 0; n < b.N; n++ {
+		intervals, _ := singleIntervals(validIntervalsSet)
+		res = util.Lcm(intervals)
+	}
+	benchInterval = res
+}
+
+var benchInterval uint32
+
+// TestPlanRequestsTargetDataPoints compares the intervals chosen for MDP-optimizable requests under ceiling vs target semantics
+func TestPlanRequestsTargetDataPoints(t *testing.T) {
+	mdata.Schemas = conf.NewSchemas([]conf.Schema{
+		{
+			Pattern:    regexp.MustCompile("a"),
+			Retentions: conf.MustParseRetentions("10s:1d,60s:7d,300s:30d"),
+		},
+		{
+			Pattern:    regexp.MustCompile(".*"),
+			Retentions: conf.MustParseRetentions("15s:1d,120s:7d,600s:30d"),
+		},
+	})
+	// a 6h window
+	from, to, now := uint32(0), uint32(6*3600), uint32(6*3600)
+	cases := []struct {
+		name        string
+		schemaIDs   []uint16 // with the expanded schemas, schema a is id 0 and the other is id 3
+		pngroup     models.PNGroup
+		mdp         uint32
+		mdpTarget   bool
+		outInterval uint32
+	}{
+		// singles of schema a: 2160, 360 or 72 points.
+		// the ceiling semantics picks the coarsest with >=mdp/2 points, the target semantics the closest to mdp
+		{"SinglesCeiling", []uint16{0}, 0, 200, false, 60},
+		{"SinglesTarget", []uint16{0}, 0, 200, true, 300},
+		{"SinglesCeilingFine", []uint16{0}, 0, 600, false, 60},
+		{"SinglesTargetFine", []uint16{0}, 0, 600, true, 60},
+		// multi: the LCM combinations are 30s (720 points), 60s (360 points), 120s (180 points), 300s (72 points) and 600s (36 points).
+		// ceiling semantics: highest LCM interval <= 2*21600/mdp, target semantics: closest to mdp
+		{"MultiCeiling", []uint16{0, 3}, 123, 200, false, 120},
+		{"MultiTarget", []uint16{0, 3}, 123, 200, true, 120},
+		{"MultiCeilingMDP300", []uint16{0, 3}, 123, 300, false, 120},
+		{"MultiTargetMDP300", []uint16{0, 3}, 123, 300, true, 60},
+		{"MultiCeilingMDP130", []uint16{0, 3}, 123, 130, false, 300},
+		{"MultiTargetMDP130", []uint16{0, 3}, 123, 130, true, 120},
+		{"MultiCeilingCoarse", []uint16{0, 3}, 123, 40, false, 600},
+		{"MultiTargetCoarse", []uint16{0, 3}, 123, 40, true, 600},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			reqs := NewReqMap()
+			for i, schemaID := range c.schemaIDs {
+				raw := uint32(mdata.Schemas.Get(schemaID).Retentions.Rets[0].SecondsPerPoint)
+				r := reqRaw(test.GetMKey(i), from, to, c.mdp, raw, consolidation.Avg, schemaID, 0)
+				r.PNGroup = c.pngroup
+				reqs.Add(r)
+			}
+			plan, err := planRequests(now, from, to, reqs, c.mdp, c.mdpTarget, 0, false, 0, 0, 0)
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			for _, r := range plan.List() {
+				if r.OutInterval != c.outInterval {
+					t.Errorf("expected outInterval %d, got %d", c.outInterval, r.OutInterval)
+				}
+			}
+		})
+	}
+}
+
+// TestPlanRequestsFromInFuture verifies that a from after now (e.g. due to clock skew) does not result in a wrapped TTL,
+// which would select the archive with the longest TTL, or deem MDP-optimizable PNGroups unsatisfiable.
+func TestPlanRequestsFromInFuture(t *testing.T) {
+	mdata.Schemas = conf.NewSchemas([]conf.Schema{
+		{
+			Pattern:    regexp.MustCompile(".*"),
+			Retentions: conf.MustParseRetentions("10s:1h,60s:1d"),
+		},
+	})
+	cases := []struct {
+		name    string
+		mdp     uint32
+		pngroup models.PNGroup
+	}{
+		{"HighestResSingles", 0, 0},
+		{"HighestResMulti", 0, 123},
+		{"LowestResForMDPSingles", 100, 0},
+		{"LowestResForMDPMulti", 100, 123},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			reqs := NewReqMap()
+			for i := 0; i < 2; i++ {
+				r := reqRaw(test.GetMKey(i), 2000, 3000, c.mdp, 10, consolidation.Avg, 0, 0)
+				r.PNGroup = c.pngroup
+				reqs.Add(r)
+			}
+			plan, err := planRequests(1000, 2000, 3000, reqs, c.mdp, false, 0, false, 0, 0, 0)
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			for _, r := range plan.List() {
+				if r.Archive != 0 || r.OutInterval != 10 {
+					t.Errorf("expected archive 0 and outInterval 10, got archive %d and outInterval %d", r.Archive, r.OutInterval)
+				}
+			}
+		})
+	}
+}
+
+// TestPlanLowestResForMDPSinglesTTL verifies that MDP-optimization only picks archives that cover the requested range,
+// and otherwise falls back to the same archive as planHighestResSingles.
+func TestPlanLowestResForMDPSinglesTTL(t *testing.T) {
+	now := uint32(1000000)
+	from := now - 5*24*3600
+	cases := []struct {
+		name       string
+		rets       conf.Retentions
+		mdpTarget  bool
+		expArchive uint8
+	}{
+		{
+			// the coarse archive would yield enough points, but doesn't cover the range
+			"CoarseShortTTL",
+			conf.BuildFromRetentions(conf.NewRetentionMT(10, 7*24*3600, 0, 0, 0), conf.NewRetentionMT(1800, 2*24*3600, 0, 0, 0)),
+			false,
+			0,
+		},
+		{
+			"CoarseShortTTLTarget",
+			conf.BuildFromRetentions(conf.NewRetentionMT(10, 7*24*3600, 0, 0, 0), conf.NewRetentionMT(1800, 2*24*3600, 0, 0, 0)),
+			true,
+			0,
+		},
+		{
+			// no archive covers the range: the longest TTL wins
+			"NoneCoverTTL",
+			conf.BuildFromRetentions(conf.NewRetentionMT(10, 24*3600, 0, 0, 0), conf.NewRetentionMT(1800, 2*24*3600, 0, 0, 0)),
+			false,
+			1,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			mdata.Schemas = conf.NewSchemas([]conf.Schema{
+				{
+					Pattern:    regexp.MustCompile(".*"),
+					Retentions: c.rets,
+				},
+			})
+			reqs := []models.Req{reqRaw(test.GetMKey(0), from, now, 200, 10, consolidation.Avg, 0, 0)}
+			if !planLowestResForMDPSingles(&mdata.Schemas, now, from, now, 200, c.mdpTarget, 0, reqs) {
+				t.Fatalf("expected request to be satisfiable")
+			}
+			if reqs[0].Archive != c.expArchive {
+				t.Errorf("expected archive %d, got %d", c.expArchive, reqs[0].Archive)
+			}
+		})
+	}
+}
+
+// TestPlanRequestsMaxPointsPerReqSoftPasses verifies the soft limit reduction loop stops when it can't make further
+// progress, and honors max-points-per-req-soft-passes and max-points-per-req-soft-reject.
+// the request fetches 360 points at 10s, 60 at 60s and 12 at 300s.
+func TestPlanRequestsMaxPointsPerReqSoftPasses(t *testing.T) {
+	mdata.Schemas = conf.NewSchemas([]conf.Schema{
+		{
+			Pattern:    regexp.MustCompile(".*"),
+			Retentions: conf.MustParseRetentions("10s:1d,60s:2d,300s:7d"),
+		},
+	})
+	defer func() {
+		maxPointsPerReqSoftPasses = 0
+		maxPointsPerReqSoftReject = false
+	}()
+	cases := []struct {
+		name       string
+		soft       int
+		passes     int
+		reject     bool
+		expErr     error
+		expPoints  uint32
+		expStalled uint32
+		expCapped  uint32
+	}{
+		{"Met", 100, 0, false, nil, 60, 0, 0},
+		{"Stalled", 10, 0, false, nil, 12, 1, 0},
+		{"StalledReject", 10, 0, true, nil, 12, 1, 0}, // reject only applies when we're capped
+		{"CappedAccept", 50, 1, false, nil, 60, 0, 1},
+		{"CappedReject", 50, 1, true, errMaxPointsPerReqSoftPasses, 0, 0, 1},
+		{"CapNotReached", 50, 2, true, nil, 12, 0, 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			maxPointsPerReqSoftPasses = c.passes
+			maxPointsPerReqSoftReject = c.reject
+			stalled, capped := reqRenderSoftLimitStalled.Peek(), reqRenderSoftLimitCapped.Peek()
+
+			reqs := NewReqMap()
+			reqs.Add(reqRaw(test.GetMKey(0), 0, 3600, 0, 10, consolidation.Avg, 0, 0))
+			plan, err := planRequests(3600, 0, 3600, reqs, 0, false, 0, false, c.soft, 0, 0)
+			if err != c.expErr {
+				t.Fatalf("expected error %v, got %v", c.expErr, err)
+			}
+			if err == nil && plan.PointsFetch() != c.expPoints {
+				t.Errorf("expected %d points fetched, got %d", c.expPoints, plan.PointsFetch())
+			}
+			if got := reqRenderSoftLimitStalled.Peek() - stalled; got != c.expStalled {
+				t.Errorf("expected stalled counter to increase by %d, got %d", c.expStalled, got)
+			}
+			if got := reqRenderSoftLimitCapped.Peek() - capped; got != c.expCapped {
+				t.Errorf("expected capped counter to increase by %d, got %d", c.expCapped, got)
+			}
+		})
+	}
+}
+
+// TestPlanRequestsIgnoreSoftLimit verifies that requests that ignore max-points-per-req-soft skip its reductions,
+// while max-points-per-req-hard still applies, and that only allowed orgs may ignore it.
+func TestPlanRequestsIgnoreSoftLimit(t *testing.T) {
+	mdata.Schemas = conf.NewSchemas([]conf.Schema{
+		{
+			Pattern:    regexp.MustCompile(".*"),
+			Retentions: conf.MustParseRetentions("10s:1d,60s:2d,300s:7d"),
+		},
+	})
+	defer func(soft int) {
+		maxPointsPerReqSoft = soft
+		ignoreSoftLimitOrgs = nil
+	}(maxPointsPerReqSoft)
+	maxPointsPerReqSoft = 100
+	ignoreSoftLimitOrgs = map[uint32]struct{}{2: {}}
+
+	if mayIgnoreSoftLimit(1) || !mayIgnoreSoftLimit(2) {
+		t.Errorf("expected only org 2 to be allowed to ignore the soft limit")
+	}
+
+	cases := []struct {
+		name       string
+		ignore     bool
+		hard       int
+		expErr     error
+		expPoints  uint32
+		expIgnored uint32
+	}{
+		{"Honored", false, 0, nil, 60, 0},
+		{"Ignored", true, 0, nil, 360, 1},
+		{"IgnoredHardMet", true, 360, nil, 360, 1},
+		{"IgnoredHardBreached", true, 359, errMaxPointsPerReq, 0, 1},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ignored := reqRenderSoftLimitIgnored.Peek()
+			reqs := NewReqMap()
+			reqs.Add(reqRaw(test.GetMKey(0), 0, 3600, 0, 10, consolidation.Avg, 0, 0))
+			plan, err := planRequests(3600, 0, 3600, reqs, 0, false, 0, false, softLimit(c.ignore), c.hard, 0)
+			if err != c.expErr {
+				t.Fatalf("expected error %v, got %v", c.expErr, err)
+			}
+			if err == nil && plan.PointsFetch() != c.expPoints {
+				t.Errorf("expected %d points fetched, got %d", c.expPoints, plan.PointsFetch())
+			}
+			if got := reqRenderSoftLimitIgnored.Peek() - ignored; got != c.expIgnored {
+				t.Errorf("expected ignored counter to increase by %d, got %d", c.expIgnored, got)
+			}
+		})
+	}
+}
+
+// TestPlanRequestsHardLimitHeadroom verifies that requests with lookback functions are planned with a max-points-per-req-hard
+// that is reduced by max-points-per-req-hard-headroom, to leave room for the data they read before their from.
+func TestPlanRequestsHardLimitHeadroom(t *testing.T) {
+	mdata.Schemas = conf.NewSchemas([]conf.Schema{
+		{
+			Pattern:    regexp.MustCompile(".*"),
+			Retentions: conf.MustParseRetentions("10s:1d"),
+		},
+	})
+	defer func(hard int, headroom float64) {
+		maxPointsPerReqHard = hard
+		maxPointsPerReqHardHeadroom = headroom
+	}(maxPointsPerReqHard, maxPointsPerReqHardHeadroom)
+	maxPointsPerReqHard = 400
+
+	cases := []struct {
+		name        string
+		target      string
+		headroom    float64
+		expLookback bool
+		expErr      error
+	}{
+		{"NoLookback", "a.b", 0.2, false, nil},                                         // 300 points, within 400
+		{"LookbackNoHeadroom", "movingAverage(a.b, 600)", 0, true, nil},                // 360 points, within 400
+		{"LookbackHeadroom", "movingAverage(a.b, 600)", 0.2, true, errMaxPointsPerReq}, // 360 points, over 320
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			maxPointsPerReqHardHeadroom = c.headroom
+			exprs, err := expr.ParseMany([]string{c.target})
+			if err != nil {
+				t.Fatalf("failed to parse target: %s", err)
+			}
+			plan, err := expr.NewPlan(exprs, 600, 3600, 0, false, expr.Optimizations{})
+			if err != nil {
+				t.Fatalf("failed to create plan: %s", err)
+			}
+			lookback := hasLookback(plan.Reqs, plan.From)
+			if lookback != c.expLookback {
+				t.Fatalf("expected lookback %t, got %t", c.expLookback, lookback)
+			}
+			headroomApplied := reqRenderHardLimitHeadroom.Peek()
+			reqs := NewReqMap()
+			reqs.Add(reqRaw(test.GetMKey(0), plan.Reqs[0].From, plan.Reqs[0].To, 0, 10, consolidation.Avg, 0, 0))
+			_, err = planRequests(3600, plan.Reqs[0].From, plan.Reqs[0].To, reqs, 0, false, 0, false, 0, hardLimit(lookback), 0)
+			if err != c.expErr {
+				t.Fatalf("expected error %v, got %v", c.expErr, err)
+			}
+			var expApplied uint32
+			if lookback && c.headroom > 0 {
+				expApplied = 1
+			}
+			if got := reqRenderHardLimitHeadroom.Peek() - headroomApplied; got != expApplied {
+				t.Errorf("expected headroom counter to increase by %d, got %d", expApplied, got)
+			}
+		})
+	}
+}
+
+// TestPlanRequestsCounterSoftLimit verifies that counters that get coarsened to honor max-points-per-req-soft read the sum rollup,
+// if their aggregation stores one, so that their points keep adding up to the totals of the raw data.
+func TestPlanRequestsCounterSoftLimit(t *testing.T) {
+	mdata.Schemas = conf.NewSchemas([]conf.Schema{
+		{
+			Pattern:    regexp.MustCompile(".*"),
+			Retentions: conf.MustParseRetentions("10s:1d,60s:2d"),
+		},
+	})
+	// aggId 0 stores avg and sum rollups, aggId 1 only stores avg rollups
+	mdata.Aggregations = conf.Aggregations{
+		Data: []conf.Aggregation{
+			{Name: "sum", Pattern: regexp.MustCompile("^sum"), AggregationMethod: []conf.Method{conf.Avg, conf.Sum}},
+			{Name: "avg", Pattern: regexp.MustCompile("^avg"), AggregationMethod: []conf.Method{conf.Avg}},
+		},
+		DefaultAggregation: conf.NewAggregations().DefaultAggregation,
+	}
+	defer func() { mdata.Aggregations = conf.NewAggregations() }()
+
+	cases := []struct {
+		name       string
+		counter    bool
+		aggId      uint16
+		consReq    consolidation.Consolidator
+		soft       int
+		expArchive uint8
+		expCons    consolidation.Consolidator
+	}{
+		{"CounterNotCoarsened", true, 0, 0, 0, 0, consolidation.Avg},
+		{"Counter", true, 0, 0, 100, 1, consolidation.Sum},
+		{"CounterWithoutSumRollup", true, 1, 0, 100, 1, consolidation.Avg},
+		{"CounterConsolidateBy", true, 0, consolidation.Avg, 100, 1, consolidation.Avg},
+		{"Gauge", false, 0, 0, 100, 1, consolidation.Avg},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			counterSum := reqRenderSoftLimitCounterSum.Peek()
+			r := reqRaw(test.GetMKey(0), 0, 3600, 0, 10, consolidation.Avg, 0, c.aggId)
+			r.ConsReq = c.consReq
+			r.Counter = c.counter
+			reqs := NewReqMap()
+			reqs.Add(r)
+			rp, err := planRequests(3600, 0, 3600, reqs, 0, false, 0, false, c.soft, 0, 0)
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			out := rp.List()[0]
+			if out.Archive != c.expArchive || out.Consolidator != c.expCons {
+				t.Errorf("expected archive %d and consolidator %s, got %s", c.expArchive, c.expCons, out.DebugString())
+			}
+			var expCounterSum uint32
+			if c.expCons == consolidation.Sum {
+				expCounterSum = 1
+			}
+			if got := reqRenderSoftLimitCounterSum.Peek() - counterSum; got != expCounterSum {
+				t.Errorf("expected counter_sum to increase by %d, got %d", expCounterSum, got)
+			}
+		})
+	}
+}
+
+// TestPlanRequestsClampTo verifies that with plan-clamp-to, requests of which the to is in the future are planned as if it were now,
+// while they still cover the requested window
+func TestPlanRequestsClampTo(t *testing.T) {
+	mdata.Schemas = conf.NewSchemas([]conf.Schema{
+		{
+			Pattern:    regexp.MustCompile(".*"),
+			Retentions: conf.MustParseRetentions("10s:1d,60s:2d"),
+		},
+	})
+	defer func() { planClampTo = false }()
+
+	// now is 3600, and the soft limit allows 300 points of the 10s archive, i.e. 3000s
+	cases := []struct {
+		name       string
+		clamp      bool
+		to         uint32
+		expArchive uint8
+		expClamped uint32
+	}{
+		{"Past", true, 3600, 0, 0},
+		{"Future", false, 5400, 1, 0},
+		{"FutureClamped", true, 5400, 0, 1},
+		{"FutureClampedBeyondSoft", true, 9000, 0, 1},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			planClampTo = c.clamp
+			clamped := reqRenderClampedTo.Peek()
+			reqs := NewReqMap()
+			reqs.Add(reqRaw(test.GetMKey(0), 1800, c.to, 0, 10, consolidation.Avg, 0, 0))
+			rp, err := planRequests(3600, 1800, c.to, reqs, 0, false, 0, false, 300, 0, 0)
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			out := rp.List()[0]
+			if out.Archive != c.expArchive {
+				t.Errorf("expected archive %d, got %s", c.expArchive, out.DebugString())
+			}
+			if out.To != c.to {
+				t.Errorf("expected the requested to %d to be preserved, got %d", c.to, out.To)
+			}
+			if got := reqRenderClampedTo.Peek() - clamped; got != c.expClamped {
+				t.Errorf("expected clamped_to to increase by %d, got %d", c.expClamped, got)
+			}
+		})
+	}
+}
+
+// TestPlanRequestsPreferWarm verifies that with plan-prefer-warm, MDP-optimizable requests of which the window lies within plan-warm-window
+// are planned at the highest resolution rather than at the rollup that satisfies maxDataPoints
+func TestPlanRequestsPreferWarm(t *testing.T) {
+	mdata.Schemas = conf.NewSchemas([]conf.Schema{
+		{
+			Pattern:    regexp.MustCompile(".*"),
+			Retentions: conf.MustParseRetentions("10s:1d,60s:2d"),
+		},
+	})
+	warmWindow := planWarmWindow
+	planWarmWindow = 3600
+	defer func() {
+		planPreferWarm = false
+		planWarmWindow = warmWindow
+	}()
+
+	// with an mdp of 100, the 60s archive is the lowest resolution that still returns at least mdp/2 points for windows of 50 minutes or more
+	now := uint32(86400)
+	cases := []struct {
+		name       string
+		preferWarm bool
+		from       uint32
+		pngroup    models.PNGroup
+		expArchive uint8
+		expWarm    uint32
+	}{
+		{"Disabled", false, now - 3600, 0, 1, 0},
+		{"Recent", true, now - 3600, 0, 0, 1},
+		{"RecentPNGroup", true, now - 3600, 1, 0, 1},
+		{"BeyondWarmWindow", true, now - 7200, 0, 1, 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			planPreferWarm = c.preferWarm
+			warm := reqRenderPlanPreferWarm.Peek()
+			reqs := NewReqMap()
+			for i := 0; i < 2; i++ {
+				r := reqRaw(test.GetMKey(i), c.from, now, 100, 10, consolidation.Avg, 0, 0)
+				r.PNGroup = c.pngroup
+				reqs.Add(r)
+			}
+			rp, err := planRequests(now, c.from, now, reqs, 100, false, 0, false, 0, 0, 0)
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			for _, out := range rp.List() {
+				if out.Archive != c.expArchive {
+					t.Errorf("expected archive %d, got %s", c.expArchive, out.DebugString())
+				}
+			}
+			if got := reqRenderPlanPreferWarm.Peek() - warm; got != c.expWarm {
+				t.Errorf("expected prefer_warm to increase by %d, got %d", c.expWarm, got)
+			}
+		})
+	}
+}
+
+// TestPlanRequestsDeclaredPNGroup verifies that requests with a DeclaredPNGroup are planned to a common interval,
+// while keeping their own PNGroup to tie the data back to the request
+func TestPlanRequestsDeclaredPNGroup(t *testing.T) {
+	mdata.Schemas = conf.NewSchemas([]conf.Schema{
+		{
+			Pattern:    regexp.MustCompile("^a"),
+			Retentions: conf.MustParseRetentions("10s:1d"),
+		},
+		{
+			Pattern:    regexp.MustCompile("^b"),
+			Retentions: conf.MustParseRetentions("30s:1d"),
+		},
+	})
+
+	cases := []struct {
+		name         string
+		declared     models.PNGroup
+		expIntervals []uint32
+	}{
+		{"Singles", 0, []uint32{10, 30}},
+		{"Declared", models.PNGroup(math.MaxUint64 / 2), []uint32{30, 30}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			reqs := NewReqMap()
+			for i, interval := range []uint32{10, 30} {
+				r := reqRaw(test.GetMKey(i), 0, 3600, 0, interval, consolidation.Avg, uint16(i), 0)
+				r.DeclaredPNGroup = c.declared
+				reqs.Add(r)
+			}
+			rp, err := planRequests(3600, 0, 3600, reqs, 0, false, 0, false, 0, 0, 0)
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			out := rp.List()
+			sort.Slice(out, func(i, j int) bool { return test.KeyToInt(out[i].MKey) < test.KeyToInt(out[j].MKey) })
+			for i, req := range out {
+				if req.OutInterval != c.expIntervals[i] || req.PNGroup != 0 {
+					t.Errorf("request %d: expected interval %d and PNGroup 0, got %s", i, c.expIntervals[i], req.DebugString())
+				}
+			}
+		})
+	}
+}
+
+func TestMDPFillRatio(t *testing.T) {
+	mdata.Schemas = conf.NewSchemas([]conf.Schema{
+		{
+			Pattern:    regexp.MustCompile(".*"),
+			Retentions: conf.MustParseRetentions("10s:1d,60s:2d"),
+		},
+	})
+
+	// over an hour, the 60s archive yields 60 points and the raw archive 360
+	cases := []struct {
+		name      string
+		maxPoints uint32 // 0 makes the requests not MDP-optimizable, so they read raw data
+		soft      int
+		exp       uint32
+	}{
+		{"Optimized", 100, 0, 60},
+		{"NotOptimized", 0, 0, 360},
+		{"Coarsened", 0, 100, 60},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			reqs := NewReqMap()
+			for i := 0; i < 2; i++ {
+				reqs.Add(reqRaw(test.GetMKey(i), 0, 3600, c.maxPoints, 10, consolidation.Avg, 0, 0))
+			}
+			rp, err := planRequests(3600, 0, 3600, reqs, 100, false, 0, false, c.soft, 0, 0)
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if ratio := mdpFillRatio(*rp, 100); ratio != c.exp {
+				t.Errorf("expected a fill ratio of %d, got %d", c.exp, ratio)
+			}
+		})
+	}
+}
+
+// TestPlanRequestsReadyGranularity verifies that with ready-granularity=interval, a rollup that became ready mid-bucket
+// is not read for windows that start within that bucket
+func TestPlanRequestsReadyGranularity(t *testing.T) {
+	// the 1min archive became ready at 3630, within the bucket that spans 3600-3660
+	mdata.Schemas = conf.NewSchemas([]conf.Schema{
+		{
+			Pattern:    regexp.MustCompile(".*"),
+			Retentions: conf.MustParseRetentions("10s:1d,1min:2d:2h:2:3630"),
+		},
+	})
+	defer func() { readyGranularity = readyGranularitySecond }()
+
+	// with an mdp of 50, the 1min archive yields enough points for the hour of data
+	cases := []struct {
+		granularity string
+		from        uint32
+		expArchive  uint8
+	}{
+		{readyGranularitySecond, 3620, 0},
+		{readyGranularitySecond, 3640, 1},
+		{readyGranularityInterval, 3640, 0},
+		{readyGranularityInterval, 3660, 0},
+		{readyGranularityInterval, 3661, 1},
+	}
+	for _, c := range cases {
+		readyGranularity = c.granularity
+		reqs := NewReqMap()
+		reqs.Add(reqRaw(test.GetMKey(0), c.from, c.from+3600, 50, 10, consolidation.Avg, 0, 0))
+		rp, err := planRequests(c.from+3600, c.from, c.from+3600, reqs, 50, false, 0, false, 0, 0, 0)
+		if err != nil {
+			t.Fatalf("%s, from %d: expected no error, got %v", c.granularity, c.from, err)
+		}
+		if out := rp.List()[0]; out.Archive != c.expArchive {
+			t.Errorf("%s, from %d: expected archive %d, got %s", c.granularity, c.from, c.expArchive, out.DebugString())
+		}
+	}
+
+	// the derived schemas are reused across requests, so that plan-tables can cache them
+	if withIntervalReady(mdata.SchemasSnapshot()) != withIntervalReady(mdata.SchemasSnapshot()) {
+		t.Errorf("expected the schemas with interval-granular Ready timestamps to be derived once")
+	}
+}
+
+// TestPlanRequestsArchivesInspected verifies that the planners report how many retention archives they inspect
+func TestPlanRequestsArchivesInspected(t *testing.T) {
+	mdata.Schemas = conf.NewSchemas([]conf.Schema{
+		{
+			Pattern:    regexp.MustCompile(".*"),
+			Retentions: conf.MustParseRetentions("10s:1d,60s:2d,300s:7d"),
+		},
+	})
+	now := uint32(7 * 24 * 3600)
+	cases := []struct {
+		name   string
+		window uint32
+		mdp    uint32
+		exp    uint64
+	}{
+		{"HighestResRaw", 3600, 0, 1},             // the raw archive covers the range
+		{"HighestResRollup", 3 * 24 * 3600, 0, 3}, // only the last rollup covers the range
+		// for MDP-optimizable series, we also look up the highest resolution archive, to tell whether they are degraded
+		{"MDPCoarsest", 3600, 10, 2}, // the coarsest archive already yields enough points
+		{"MDPRaw", 3600, 800, 4},     // we have to go all the way to the raw archive
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			pre := reqRenderPlanArchivesInspected.Peek()
+			reqs := NewReqMap()
+			reqs.Add(reqRaw(test.GetMKey(0), now-c.window, now, c.mdp, 10, consolidation.Avg, 0, 0))
+			if _, err := planRequests(now, now-c.window, now, reqs, c.mdp, false, 0, false, 0, 0, 0); err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if got := reqRenderPlanArchivesInspected.Peek() - pre; got != c.exp {
+				t.Errorf("expected %d archives to be inspected, got %d", c.exp, got)
+			}
+		})
+	}
+}
+
+// TestPlanRequestsMaxPNGroupsPerReq verifies that requests with too many PNGroups are rejected before any of them get planned
+func TestPlanRequestsMaxPNGroupsPerReq(t *testing.T) {
+	mdata.Schemas = conf.NewSchemas([]conf.Schema{
+		{
+			Pattern:    regexp.MustCompile(".*"),
+			Retentions: conf.MustParseRetentions("10s:1d,60s:2d,300s:7d"),
+		},
+	})
+	defer func() { maxPNGroupsPerReq = 0 }()
+	maxPNGroupsPerReq = 3
+	cases := []struct {
+		name     string
+		pngroups int
+		expCode  int
+	}{
+		{"Below", 2, 0},
+		{"AtLimit", 3, 0},
+		{"Exceeded", 4, http.StatusRequestEntityTooLarge},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			reqs := NewReqMap()
+			// each PNGroup has 2 series, and there's a single that doesn't count towards the limit
+			for i := 0; i < 2*c.pngroups; i++ {
+				r := reqRaw(test.GetMKey(i), 0, 3600, 0, 10, consolidation.Avg, 0, 0)
+				r.PNGroup = models.PNGroup(i/2 + 1)
+				reqs.Add(r)
+			}
+			reqs.Add(reqRaw(test.GetMKey(2*c.pngroups), 0, 3600, 0, 10, consolidation.Avg, 0, 0))
+
+			inspected := reqRenderPlanArchivesInspected.Peek()
+			rp, err := planRequests(3600, 0, 3600, reqs, 0, false, 0, false, 0, 0, 0)
+			if c.expCode == 0 {
+				if err != nil {
+					t.Fatalf("expected no error, got %v", err)
+				}
+				if len(rp.List()) != 2*c.pngroups+1 {
+					t.Errorf("expected %d planned requests, got %d", 2*c.pngroups+1, len(rp.List()))
+				}
+				return
+			}
+			if err == nil || response.WrapError(err).HTTPStatusCode() != c.expCode {
+				t.Fatalf("expected error with status %d, got %v", c.expCode, err)
+			}
+			// the request got rejected before the planners spent any effort on it
+			if got := reqRenderPlanArchivesInspected.Peek() - inspected; got != 0 {
+				t.Errorf("expected no archives to be inspected, got %d", got)
+			}
+		})
+	}
+}
+
+// TestPlanRequestsMDPStrict verifies that with mdp-strict, requests are rejected when the MDP-optimizable series of a PNGroup
+// can't be normalized to an interval that yields at least mdp/2 points, rather than being returned at their lowest common interval
+func TestPlanRequestsMDPStrict(t *testing.T) {
+	mdata.Schemas = conf.NewSchemas([]conf.Schema{
+		{
+			Pattern:    regexp.MustCompile("^a"),
+			Retentions: conf.MustParseRetentions("10s:1d,60s:7d"),
+		},
+		{
+			Pattern:    regexp.MustCompile(".*"),
+			Retentions: conf.MustParseRetentions("15s:1d,120s:7d"),
+		},
+	})
+	defer func() { mdpStrict = false }()
+	cases := []struct {
+		name        string
+		mdp         uint32
+		strict      bool
+		expErr      error
+		expInterval uint32
+		expRejected uint32
+	}{
+		// a 1h window with mdp 800 requires an interval of at most 9s, but the lowest common interval is 30s
+		{"TooShortLenient", 800, false, nil, 30, 0},
+		{"TooShortStrict", 800, true, errMDPStrict, 0, 1},
+		// with mdp 100, intervals up to 72s fit
+		{"FitsLenient", 100, false, nil, 60, 0},
+		{"FitsStrict", 100, true, nil, 60, 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			mdpStrict = c.strict
+			rejected := reqRenderUnsatisfiableMDPTooHigh.Peek()
+
+			reqs := NewReqMap()
+			// expanded schema ids: a is 0,1 and b is 2,3
+			for i, s := range []struct {
+				schemaID    uint16
+				rawInterval uint32
+			}{{0, 10}, {2, 15}} {
+				r := reqRaw(test.GetMKey(i), 0, 3600, c.mdp, s.rawInterval, consolidation.Avg, s.schemaID, 0)
+				r.PNGroup = 1
+				reqs.Add(r)
+			}
+			plan, err := planRequests(3600, 0, 3600, reqs, c.mdp, false, 0, false, 0, 0, 0)
+			if err != c.expErr {
+				t.Fatalf("expected error %v, got %v", c.expErr, err)
+			}
+			if err == nil {
+				for _, req := range plan.List() {
+					if req.OutInterval != c.expInterval {
+						t.Errorf("expected OutInterval %d, got %s", c.expInterval, req.DebugString())
+					}
+				}
+			}
+			if got := reqRenderUnsatisfiableMDPTooHigh.Peek() - rejected; got != c.expRejected {
+				t.Errorf("expected rejected counter to increase by %d, got %d", c.expRejected, got)
+			}
+		})
+	}
+}
+
+// TestPlanToInterval verifies that an interval hint plans all series, singles and PNGroups alike, to exactly that output interval
+func TestPlanToInterval(t *testing.T) {
+	// expanded schema ids: a is 0,1 and b is 2,3
+	mdata.Schemas = conf.NewSchemas([]conf.Schema{
+		{
+			Pattern:    regexp.MustCompile("^a"),
+			Retentions: conf.MustParseRetentions("10s:1d,60s:7d"),
+		},
+		{
+			Pattern:    regexp.MustCompile("^b"),
+			Retentions: conf.MustParseRetentions("15s:1d,120s:7d"),
+		},
+	})
+	type exp struct {
+		archive uint8
+		aggNum  uint32
+	}
+	cases := []struct {
+		name     string
+		interval uint32
+		rawB     uint32 // native interval of the series of b
+		expReqs  []exp  // for the single of a, the single of b, and the PNGroup members a and b
+		expCode  int
+	}{
+		{"Exact", 60, 15, []exp{{1, 1}, {0, 4}, {1, 1}, {0, 4}}, 0},
+		{"Normalized", 30, 15, []exp{{0, 3}, {0, 2}, {0, 3}, {0, 2}}, 0},
+		{"Rollups", 120, 15, []exp{{1, 2}, {1, 1}, {1, 2}, {1, 1}}, 0},
+		{"Unachievable", 25, 15, nil, http.StatusUnprocessableEntity},
+		// b has a native interval of 20s, which 30 is not a multiple of, even though its schema says 15s
+		{"UnachievableRaw", 30, 20, nil, http.StatusUnprocessableEntity},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			reqs := NewReqMap()
+			for i, s := range []struct {
+				schemaID    uint16
+				rawInterval uint32
+				pngroup     models.PNGroup
+			}{{0, 10, 0}, {2, c.rawB, 0}, {0, 10, 1}, {2, c.rawB, 1}} {
+				r := reqRaw(test.GetMKey(i), 0, 3600, 0, s.rawInterval, consolidation.Avg, s.schemaID, 0)
+				r.Target = strconv.Itoa(i)
+				r.PNGroup = s.pngroup
+				reqs.Add(r)
+			}
+			rp, err := planRequests(3600, 0, 3600, reqs, 0, false, 0, false, 0, 0, 0)
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			err = planToInterval(3600, 0, c.interval, rp, 0)
+			if c.expCode != 0 {
+				if err == nil || response.WrapError(err).HTTPStatusCode() != c.expCode {
+					t.Fatalf("expected error with status %d, got %v", c.expCode, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			out := rp.List()
+			sort.Slice(out, func(i, j int) bool { return out[i].Target < out[j].Target })
+			for i, req := range out {
+				if req.OutInterval != c.interval || req.Archive != c.expReqs[i].archive || req.AggNum != c.expReqs[i].aggNum {
+					t.Errorf("req %d: expected archive %d, aggNum %d and OutInterval %d, got %s", i, c.expReqs[i].archive, c.expReqs[i].aggNum, c.interval, req.DebugString())
+				}
+			}
+		})
+	}
+}
+
+// TestPlanRequestsNormalizeAll verifies that align=strict normalizes singles and PNGroups alike to their common interval
+func TestPlanRequestsNormalizeAll(t *testing.T) {
+	// expanded schema ids: a is 0, b is 1 and c is 2
+	mdata.Schemas = conf.NewSchemas([]conf.Schema{
+		{
+			Pattern:    regexp.MustCompile("^a"),
+			Retentions: conf.MustParseRetentions("10s:1d"),
+		},
+		{
+			Pattern:    regexp.MustCompile("^b"),
+			Retentions: conf.MustParseRetentions("15s:1d"),
+		},
+		{
+			Pattern:    regexp.MustCompile("^c"),
+			Retentions: conf.MustParseRetentions("20s:1d"),
+		},
+	})
+
+	now := uint32(24 * 3600)
+	from := now - 3600
+	reqs := NewReqMap()
+	reqs.Add(reqRaw(test.GetMKey(0), from, now, 0, 10, consolidation.Avg, 0, 0))
+	reqs.Add(reqRaw(test.GetMKey(1), from, now, 0, 15, consolidation.Avg, 1, 0))
+	for _, r := range []models.Req{
+		reqRaw(test.GetMKey(2), from, now, 0, 15, consolidation.Avg, 1, 0),
+		reqRaw(test.GetMKey(3), from, now, 0, 20, consolidation.Avg, 2, 0),
+	} {
+		r.PNGroup = 123
+		reqs.Add(r)
+	}
+	rp, err := planRequests(now, from, now, reqs, 0, false, 0, false, 0, 0, 0)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !rp.NormalizeAll() {
+		t.Fatalf("expected to be able to normalize all requests")
+	}
+	// the singles are at 10s and 15s, the PNGroup at 60s, the LCM of 15s and 20s
+	for _, r := range rp.List() {
+		if r.OutInterval != 60 || r.AggNum != 60/r.ArchInterval {
+			t.Errorf("expected req to be normalized to 60s, got %s", r.DebugString())
+		}
+	}
+}
+
+// TestPlanRequestsReconcileSingles verifies the handling of singles of the same schema that are split across
+// MDP-optimizability, and thus get planned independently. e.g. series a and b combined by a function
+// without pre-normalization, of which only the series of a are MDP-optimizable.
+func TestPlanRequestsReconcileSingles(t *testing.T) {
+	mdata.Schemas = conf.NewSchemas([]conf.Schema{
+		{
+			Pattern:    regexp.MustCompile(".*"),
+			Retentions: conf.MustParseRetentions("10s:1d,60s:30d"),
+		},
+	})
+	defer func() { reconcileSingles = false }()
+
+	now := uint32(30 * 24 * 3600)
+	from := now - 12*3600
+	plan := func(reconcile bool) (models.Req, models.Req) {
+		reconcileSingles = reconcile
+		reqs := NewReqMap()
+		// with an mdp this high, the MDP-optimizable series a stays at its raw 10s.
+		// the series of b have a native interval of 15s, which the schema allows.
+		reqs.Add(reqRaw(test.GetMKey(0), from, now, 10000, 10, consolidation.Avg, 0, 0))
+		reqs.Add(reqRaw(test.GetMKey(1), from, now, 0, 15, consolidation.Avg, 0, 0))
+		rp, err := planRequests(now, from, now, reqs, 10000, false, 0, false, 0, 0, 0)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		out := rp.List()
+		sort.Slice(out, func(i, j int) bool { return out[i].MaxPoints > out[j].MaxPoints })
+		return out[0], out[1]
+	}
+
+	pre := reqRenderSinglesIncompatible.Peek()
+	a, b := plan(false)
+	if a.OutInterval != 10 || b.OutInterval != 15 {
+		t.Errorf("expected intervals 10 and 15, got %d and %d", a.OutInterval, b.OutInterval)
+	}
+	if got := reqRenderSinglesIncompatible.Peek() - pre; got != 1 {
+		t.Errorf("expected incompatible intervals to be detected once, got %d", got)
+	}
+
+	// with reconciliation, a is normalized to 30s, which b can be normalized to as well
+	a, b = plan(true)
+	if a.Archive != 0 || a.OutInterval != 30 || a.AggNum != 3 {
+		t.Errorf("expected a to be normalized to 30s, got %s", a.DebugString())
+	}
+	if b.Archive != 0 || b.OutInterval != 15 || b.AggNum != 1 {
+		t.Errorf("expected b to remain at 15s, got %s", b.DebugString())
+	}
+}
+
+// TestPlanRequestsDegraded verifies that plans are marked as degraded when the soft limit reduces their resolution,
+// or when MDP-optimizable series are normalized below maxDataPoints/2 points to reach a common interval.
+func TestPlanRequestsDegraded(t *testing.T) {
+	// expanded schema ids: a is 0,1 and b is 2,3
+	mdata.Schemas = conf.NewSchemas([]conf.Schema{
+		{
+			Pattern:    regexp.MustCompile("^a"),
+			Retentions: conf.MustParseRetentions("10s:1d,60s:30d"),
+		},
+		{
+			Pattern:    regexp.MustCompile("^b"),
+			Retentions: conf.MustParseRetentions("15s:1d,3600s:30d"),
+		},
+	})
+
+	now := uint32(30 * 24 * 3600)
+	from := now - 12*3600
+	plan := func(mdp uint32, pngroup models.PNGroup, mpprSoft int) string {
+		reqs := NewReqMap()
+		a := reqRaw(test.GetMKey(0), from, now, mdp, 10, consolidation.Avg, 0, 0)
+		b := reqRaw(test.GetMKey(1), from, now, mdp, 15, consolidation.Avg, 2, 0)
+		a.PNGroup, b.PNGroup = pngroup, pngroup
+		reqs.Add(a)
+		reqs.Add(b)
+		rp, err := planRequests(now, from, now, reqs, mdp, false, 0, false, mpprSoft, 0, 0)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		return rp.Degraded()
+	}
+
+	// 10s and 15s raw data make for 4320+2880 points
+	if reason := plan(0, 0, 0); reason != "" {
+		t.Errorf("expected plan without soft limit not to be degraded, got %q", reason)
+	}
+	if reason := plan(0, 0, 10000); reason != "" {
+		t.Errorf("expected plan within the soft limit not to be degraded, got %q", reason)
+	}
+	if reason := plan(0, 0, 5000); !strings.Contains(reason, "max-points-per-req-soft") {
+		t.Errorf("expected plan reduced by the soft limit to be degraded, got %q", reason)
+	}
+
+	// 800 points need a 54s interval at most. as singles, a gets the 10s and b the 15s raw data
+	if reason := plan(800, 0, 0); reason != "" {
+		t.Errorf("expected singles not to be degraded, got %q", reason)
+	}
+	// pre-normalized together, the closest common interval is 30s
+	if reason := plan(800, 123, 0); reason != "" {
+		t.Errorf("expected PNGroup at 30s not to be degraded, got %q", reason)
+	}
+	// 20000 points need higher resolution raw data than available, which is not a degradation
+	if reason := plan(20000, 123, 0); reason != "" {
+		t.Errorf("expected PNGroup at the highest resolution not to be degraded, got %q", reason)
+	}
+}
+
+// TestPlanRequestsCoverage verifies that requests report the earliest timestamp their archive has data for,
+// so that a query exceeding the TTL of all archives can be told apart from one for which there is no data.
+func TestPlanRequestsCoverage(t *testing.T) {
+	mdata.Schemas = conf.NewSchemas([]conf.Schema{
+		{
+			Pattern:    regexp.MustCompile(".*"),
+			Retentions: conf.MustParseRetentions("10s:1d,60s:7d"),
+		},
+	})
+
+	now := uint32(90 * 24 * 3600)
+	cases := []struct {
+		from         uint32
+		expArchive   uint8
+		expCoverFrom uint32
+	}{
+		// within the TTL of the raw archive
+		{now - 12*3600, 0, now - 24*3600},
+		// beyond the TTL of the raw archive, within that of the rollup
+		{now - 3*24*3600, 1, now - 7*24*3600},
+		// a 90 day query exceeds the TTL of all archives, so only the last 7 days are covered
+		{0, 1, now - 7*24*3600},
+	}
+	for _, c := range cases {
+		reqs := NewReqMap()
+		reqs.Add(reqRaw(test.GetMKey(0), c.from, now, 0, 10, consolidation.Avg, 0, 0))
+		rp, err := planRequests(now, c.from, now, reqs, 0, false, 0, false, 0, 0, 0)
+		if err != nil {
+			t.Fatalf("from %d: expected no error, got %v", c.from, err)
+		}
+		r := rp.List()[0]
+		if r.Archive != c.expArchive || r.CoverageFrom != c.expCoverFrom {
+			t.Errorf("from %d: expected archive %d covering from %d, got archive %d covering from %d", c.from, c.expArchive, c.expCoverFrom, r.Archive, r.CoverageFrom)
+		}
+	}
+}
+
+// TestPlanRequestsPNGrouped verifies that requests are marked according to whether they were planned as part of a PNGroup
+func TestPlanRequestsPNGrouped(t *testing.T) {
+	mdata.Schemas = conf.NewSchemas([]conf.Schema{
+		{
+			Pattern:    regexp.MustCompile(".*"),
+			Retentions: conf.MustParseRetentions("10s:1d,60s:7d"),
+		},
+	})
+	defer func() { autoPNGroup = false }()
+
+	now := uint32(10 * 24 * 3600)
+	from := now - 6*3600
+	for _, auto := range []bool{false, true} {
+		autoPNGroup = auto
+		reqs := NewReqMap()
+		// 2 grouped requests, one of which is MDP-optimizable, and 2 singles, one of which is MDP-optimizable
+		for i, mdp := range []uint32{800, 0, 800, 0} {
+			r := reqRaw(test.GetMKey(i), from, now, mdp, 10, consolidation.Avg, 0, 0)
+			if i < 2 {
+				r.PNGroup = 1
+			}
+			reqs.Add(r)
+		}
+		rp, err := planRequests(now, from, now, reqs, 800, false, 0, false, 0, 0, 0)
+		if err != nil {
+			t.Fatalf("auto-pngroup %t: expected no error, got %v", auto, err)
+		}
+		for _, r := range rp.List() {
+			// with auto-pngroup, the singles get bundled into an implicit PNGroup
+			exp := r.PNGroup != 0 || auto
+			if r.PNGrouped != exp {
+				t.Errorf("auto-pngroup %t: expected PNGrouped %t, got %s", auto, exp, r.DebugString())
+			}
+		}
+	}
+}
+
+// TestPlanRequestsRollupGuard verifies that series don't read a rollup which doesn't store the requested consolidation,
+// if their raw data can be normalized with the right function instead.
+func TestPlanRequestsRollupGuard(t *testing.T) {
+	mdata.Schemas = conf.NewSchemas([]conf.Schema{
+		{
+			Name:       "a",
+			Pattern:    regexp.MustCompile(".*"),
+			Retentions: conf.MustParseRetentions("10s:1d,60s:30d"),
+		},
+	})
+	// aggId 0 only stores avg rollups, aggId 1 stores avg and max rollups
+	mdata.Aggregations = conf.Aggregations{
+		Data: []conf.Aggregation{
+			{Name: "avg", Pattern: regexp.MustCompile("^avg"), AggregationMethod: []conf.Method{conf.Avg}},
+			{Name: "max", Pattern: regexp.MustCompile("^max"), AggregationMethod: []conf.Method{conf.Avg, conf.Max}},
+		},
+		DefaultAggregation: conf.NewAggregations().DefaultAggregation,
+	}
+	defer func() { mdata.Aggregations = conf.NewAggregations() }()
+
+	now := uint32(30 * 24 * 3600)
+	// req returns a request for max, which falls back to avg if its aggregation doesn't store max rollups (see closestAggMethod)
+	req := func(from, maxPoints uint32, aggId uint16) models.Req {
+		cons := consolidation.Max
+		if aggId == 0 {
+			cons = consolidation.Avg
+		}
+		r := reqRaw(test.GetMKey(int(aggId)), from, now, maxPoints, 10, cons, 0, aggId)
+		r.ConsReq = consolidation.Max
+		return r
+	}
+
+	// the raw data covers 12 hours, but with mdp 100 the 60s rollup is chosen
+	from := now - 12*3600
+	reqs := NewReqMap()
+	reqs.Add(req(from, 100, 0))
+	reqs.Add(req(from, 100, 1))
+	rp, err := planRequests(now, from, now, reqs, 100, false, 0, false, 0, 0, 0)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	out := rp.List()
+	sort.Slice(out, func(i, j int) bool { return out[i].AggId < out[j].AggId })
+	// without a max rollup, the raw data is normalized to the same interval using max
+	if r := out[0]; r.Archive != 0 || r.OutInterval != 60 || r.AggNum != 6 || r.Consolidator != consolidation.Max {
+		t.Errorf("expected req without max rollup to read raw data normalized to 60s using max, got %s", r.DebugString())
+	}
+	// the max rollup can be used as is
+	if r := out[1]; r.Archive != 1 || r.OutInterval != 60 || r.Consolidator != consolidation.Max {
+		t.Errorf("expected req with max rollup to read it, got %s", r.DebugString())
+	}
+	if len(rp.Warnings()) != 0 {
+		t.Errorf("expected no warnings, got %v", rp.Warnings())
+	}
+
+	// the raw data doesn't cover 3 days, so the avg rollup has to be used, with a warning
+	from = now - 3*24*3600
+	reqs = NewReqMap()
+	reqs.Add(req(from, 0, 0))
+	reqs.Add(req(from, 0, 0))
+	rp, err = planRequests(now, from, now, reqs, 0, false, 0, false, 0, 0, 0)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	for _, r := range rp.List() {
+		if r.Archive != 1 || r.Consolidator != consolidation.Avg {
+			t.Errorf("expected req to read the avg rollup, got %s", r.DebugString())
+		}
+	}
+	if len(rp.Warnings()) != 1 || !strings.Contains(rp.Warnings()[0], "schema a") {
+		t.Errorf("expected 1 warning about schema a, got %v", rp.Warnings())
+	}
+
+	// with a soft limit, the raw data covers 12 hours, but reading it would undo the coarsening that honors the limit,
+	// so the avg rollup is used as well, with a warning
+	from = now - 12*3600
+	reqs = NewReqMap()
+	reqs.Add(req(from, 0, 0))
+	rp, err = planRequests(now, from, now, reqs, 0, false, 0, false, 1000, 0, 0)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if r := rp.List()[0]; r.Archive != 1 || r.Consolidator != consolidation.Avg {
+		t.Errorf("expected req to read the avg rollup to honor the soft limit, got %s", r.DebugString())
+	}
+	if len(rp.Warnings()) != 1 || !strings.Contains(rp.Warnings()[0], "consolidateBy(max)") || !strings.Contains(rp.Warnings()[0], "max-points-per-req-soft") {
+		t.Errorf("expected 1 warning about max-points-per-req-soft, got %v", rp.Warnings())
+	}
+}
+
+func TestEqualizePoints(t *testing.T) {
+	// expanded schema ids: a is 0,1,2, b is 3,4 and c is 5,6
+	mdata.Schemas = conf.NewSchemas([]conf.Schema{
+		{
+			Name:       "a",
+			Pattern:    regexp.MustCompile("^a"),
+			Retentions: conf.MustParseRetentions("10s:1d,1min:7d,5min:30d"),
+		},
+		{
+			Name:       "b",
+			Pattern:    regexp.MustCompile("^b"),
+			Retentions: conf.MustParseRetentions("15s:1d,1min:7d"),
+		},
+		{
+			Name:       "c",
+			Pattern:    regexp.MustCompile("^c"),
+			Retentions: conf.MustParseRetentions("15s:1d,2min:7d"),
+		},
+	})
+	now := uint32(30 * 24 * 3600)
+	from := now - 6*3600
+	plan := func(tolerance float64, schemaIDs ...uint16) []models.Req {
+		reqs := NewReqMap()
+		for i, schemaID := range schemaIDs {
+			rawInterval := uint32(mdata.Schemas.Get(schemaID).Retentions.Rets[0].SecondsPerPoint)
+			reqs.Add(reqRaw(test.GetMKey(i), from, now, 0, rawInterval, consolidation.Avg, schemaID, 0))
+		}
+		rp, err := planRequests(now, from, now, reqs, 0, false, 0, false, 0, 0, 0)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		equalizePoints(now, from, now, 0, tolerance, rp)
+		return rp.List()
+	}
+	pointsReturn := func(reqs []models.Req) map[uint32]uint32 {
+		points := make(map[uint32]uint32)
+		for _, req := range reqs {
+			points[req.OutInterval] = req.PointsReturn(0)
+		}
+		return points
+	}
+
+	// by themselves, a returns 2160 points at 10s and b 1440 at 15s. they both can return 360 points at 1min
+	points := pointsReturn(plan(0.1, 0, 3))
+	if len(points) != 1 || points[60] != 360 {
+		t.Errorf("expected a and b to be equalized to 360 points at 1min, got %v", points)
+	}
+
+	// a tolerance of 50% allows a to stay at 10s
+	points = pointsReturn(plan(0.5, 0, 3))
+	if len(points) != 2 || points[10] != 2160 || points[15] != 1440 {
+		t.Errorf("expected a and b to stay at 2160 and 1440 points, got %v", points)
+	}
+
+	// c can only return 1440 or 180 points, a can't get any closer than 2160 to them
+	points = pointsReturn(plan(0.1, 0, 5))
+	if len(points) != 2 || points[10] != 2160 || points[15] != 1440 {
+		t.Errorf("expected a and c to stay at 2160 and 1440 points, got %v", points)
+	}
+}
+
+func TestLimitIntervals(t *testing.T) {
+	// expanded schema ids: a is 0,1,2, b is 3,4, c is 5,6 and d is 7
+	mdata.Schemas = conf.NewSchemas([]conf.Schema{
+		{
+			Name:       "a",
+			Pattern:    regexp.MustCompile("^a"),
+			Retentions: conf.MustParseRetentions("10s:1d,1min:7d,5min:30d"),
+		},
+		{
+			Name:       "b",
+			Pattern:    regexp.MustCompile("^b"),
+			Retentions: conf.MustParseRetentions("15s:1d,1min:7d"),
+		},
+		{
+			Name:       "c",
+			Pattern:    regexp.MustCompile("^c"),
+			Retentions: conf.MustParseRetentions("30s:1d,5min:7d"),
+		},
+		{
+			Name:       "d",
+			Pattern:    regexp.MustCompile("^d"),
+			Retentions: conf.MustParseRetentions("7s:1d"),
+		},
+	})
+	now := uint32(30 * 24 * 3600)
+	from := now - 6*3600
+	plan := func(max int, schemaIDs ...uint16) (*ReqsPlan, []uint32) {
+		reqs := NewReqMap()
+		for i, schemaID := range schemaIDs {
+			rawInterval := uint32(mdata.Schemas.Get(schemaID).Retentions.Rets[0].SecondsPerPoint)
+			reqs.Add(reqRaw(test.GetMKey(i), from, now, 0, rawInterval, consolidation.Avg, schemaID, 0))
+		}
+		rp, err := planRequests(now, from, now, reqs, 0, false, 0, false, 0, 0, 0)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		return rp, limitIntervals(now, from, max, rp)
+	}
+	outIntervals := func(rp *ReqsPlan) map[uint16]uint32 {
+		out := make(map[uint16]uint32)
+		for _, req := range rp.List() {
+			out[req.SchemaId] = req.OutInterval
+		}
+		return out
+	}
+
+	// by themselves, a is read at 10s, b at 15s and c at 30s. 10s can't be snapped to 15s, but 15s to 30s can
+	rp, intervals := plan(3, 0, 3, 5)
+	if !reflect.DeepEqual(intervals, []uint32{10, 15, 30}) {
+		t.Errorf("expected intervals to stay 10, 15 and 30, got %v", intervals)
+	}
+	rp, intervals = plan(2, 0, 3, 5)
+	if !reflect.DeepEqual(intervals, []uint32{10, 30}) {
+		t.Errorf("expected intervals 10 and 30, got %v", intervals)
+	}
+	if exp := map[uint16]uint32{0: 10, 3: 30, 5: 30}; !reflect.DeepEqual(outIntervals(rp), exp) {
+		t.Errorf("expected out intervals %v, got %v", exp, outIntervals(rp))
+	}
+	rp, intervals = plan(1, 0, 3, 5)
+	if !reflect.DeepEqual(intervals, []uint32{30}) {
+		t.Errorf("expected interval 30, got %v", intervals)
+	}
+	for _, req := range rp.List() {
+		if req.Archive != 0 || req.OutInterval != 30 || req.AggNum != 30/req.ArchInterval {
+			t.Errorf("expected all series to be normalized from their raw archive to 30s, got %s", req.DebugString())
+		}
+	}
+	if len(rp.Warnings()) != 0 {
+		t.Errorf("expected no warnings, got %v", rp.Warnings())
+	}
+
+	// d only has its 7s raw archive, which no coarser interval in use is a multiple of
+	rp, intervals = plan(1, 3, 7)
+	if !reflect.DeepEqual(intervals, []uint32{7, 15}) {
+		t.Errorf("expected intervals to stay 7 and 15, got %v", intervals)
+	}
+	if len(rp.Warnings()) != 1 || !strings.Contains(rp.Warnings()[0], "to 2 rather than 1") {
+		t.Errorf("expected 1 warning about the intervals, got %v", rp.Warnings())
+	}
+}
+
+// TestPlanRequestsMDPLossWarnings verifies the scenario of note [2] of planRequests: MDP-optimizable series that get
+// aggregated together may have to be normalized to a coarser interval than they would have been MDP-optimized to by themselves.
+// (4min, as used in the note, is not a valid rollup span, so we use 2min)
+func TestPlanRequestsMDPLossWarnings(t *testing.T) {
+	// expanded schema ids: a is 0,1 and b is 2,3
+	mdata.Schemas = conf.NewSchemas([]conf.Schema{
+		{
+			Name:       "a",
+			Pattern:    regexp.MustCompile("^a"),
+			Retentions: conf.MustParseRetentions("10s:7d,5min:70d"),
+		},
+		{
+			Name:       "b",
+			Pattern:    regexp.MustCompile("^b"),
+			Retentions: conf.MustParseRetentions("10s:7d,2min:30d"),
+		},
+	})
+	now := uint32(70 * 24 * 3600)
+	from := now - 2*24*3600
+	plan := func(schemaIDs ...uint16) *ReqsPlan {
+		reqs := NewReqMap()
+		for i, schemaID := range schemaIDs {
+			r := reqRaw(test.GetMKey(i), from, now, 800, 10, consolidation.Avg, schemaID, 0)
+			r.PNGroup = 1
+			reqs.Add(r)
+		}
+		rp, err := planRequests(now, from, now, reqs, 800, false, 0, false, 0, 0, 0)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		return rp
+	}
+
+	// by themselves, a would be MDP-optimized to 5min (576 points) and b to 2min (1440 points)
+	if rp := plan(0, 0); len(rp.Warnings()) != 0 {
+		t.Errorf("expected no warnings for series of the same schema, got %v", rp.Warnings())
+	}
+	if rp := plan(2, 2); len(rp.Warnings()) != 0 {
+		t.Errorf("expected no warnings for series of the same schema, got %v", rp.Warnings())
+	}
+
+	// aggregated together, they get normalized to 5min, which is coarser than b would have been
+	rp := plan(0, 2)
+	for _, req := range rp.List() {
+		if req.OutInterval != 300 {
+			t.Errorf("expected OutInterval 300, got %s", req.DebugString())
+		}
+	}
+	if len(rp.Warnings()) != 1 || !strings.Contains(rp.Warnings()[0], "schema b") || !strings.Contains(rp.Warnings()[0], "300s rather than 120s") {
+		t.Errorf("expected 1 warning about schema b, got %v", rp.Warnings())
+	}
+}
+
+// TestPlanRequestsMDPMaxLossFactor verifies that mdp-max-loss-factor bounds how much coarser than the finest MDP-optimized interval
+// of its series a PNGroup gets normalized to, using the example of note [2] of planRequests.
+func TestPlanRequestsMDPMaxLossFactor(t *testing.T) {
+	// expanded schema ids: a is 0,1 and b is 2,3
+	mdata.Schemas = conf.NewSchemas([]conf.Schema{
+		{
+			Pattern:    regexp.MustCompile("^a"),
+			Retentions: conf.MustParseRetentions("10s:7d,5min:70d"),
+		},
+		{
+			Pattern:    regexp.MustCompile("^b"),
+			Retentions: conf.MustParseRetentions("10s:7d,2min:30d"),
+		},
+	})
+	defer func() { mdpMaxLossFactor = 0 }()
+	now := uint32(70 * 24 * 3600)
+
+	// by themselves, a would be MDP-optimized to 5min and b to 2min
+	cases := []struct {
+		factor      float64
+		window      uint32
+		expInterval uint32
+		expApplied  uint32
+	}{
+		{0, 2 * 24 * 3600, 300, 0},
+		{2.5, 2 * 24 * 3600, 300, 0},
+		// 2min is used, even though that reads the raw data of a
+		{1, 2 * 24 * 3600, 120, 1},
+		{2, 2 * 24 * 3600, 120, 1},
+		// beyond the raw TTL, the only common interval is 10min, which is used even though it exceeds the budget
+		{1, 20 * 24 * 3600, 600, 0},
+	}
+	for i, c := range cases {
+		mdpMaxLossFactor = c.factor
+		from := now - c.window
+		reqs := NewReqMap()
+		for j, schemaID := range []uint16{0, 2} {
+			r := reqRaw(test.GetMKey(j), from, now, 800, 10, consolidation.Avg, schemaID, 0)
+			r.PNGroup = 1
+			reqs.Add(r)
+		}
+		applied := reqRenderLossBudgetApplied.Peek()
+		rp, err := planRequests(now, from, now, reqs, 800, false, 0, false, 0, 0, 0)
+		if err != nil {
+			t.Fatalf("case %d: expected no error, got %v", i, err)
+		}
+		for _, req := range rp.List() {
+			if req.OutInterval != c.expInterval {
+				t.Errorf("case %d: expected OutInterval %d, got %s", i, c.expInterval, req.DebugString())
+			}
+		}
+		if got := reqRenderLossBudgetApplied.Peek() - applied; got != c.expApplied {
+			t.Errorf("case %d: expected loss_budget_applied to be incremented by %d, got %d", i, c.expApplied, got)
+		}
+	}
+}
+
+// TestPlanRequestsMergePNGroups verifies that PNGroups that resolve to the same interval and use disjoint schemas
+// get their fetches scheduled together, without affecting how they are planned.
+func TestPlanRequestsMergePNGroups(t *testing.T) {
+	// expanded schema ids: a is 0,1 and b is 2,3
+	mdata.Schemas = conf.NewSchemas([]conf.Schema{
+		{
+			Pattern:    regexp.MustCompile("^a"),
+			Retentions: conf.MustParseRetentions("10s:1d,60s:30d"),
+		},
+		{
+			Pattern:    regexp.MustCompile("^b"),
+			Retentions: conf.MustParseRetentions("10s:1d,60s:30d"),
+		},
+	})
+	defer func() { mergePNGroups = false }()
+
+	now := uint32(30 * 24 * 3600)
+	from := now - 3*24*3600
+	plan := func(merge bool) *ReqsPlan {
+		mergePNGroups = merge
+		reqs := NewReqMap()
+		// all groups need the 60s rollup. 123 and 124 use different schemas, 125 uses the same schema as 123
+		for i, group := range []models.PNGroup{123, 124, 125} {
+			schemaID := uint16(0)
+			if group == 124 {
+				schemaID = 2
+			}
+			for j := 0; j < 2; j++ {
+				r := reqRaw(test.GetMKey(i*2+j), from, now, 0, 10, consolidation.Avg, schemaID, 0)
+				r.PNGroup = group
+				reqs.Add(r)
+			}
+		}
+		rp, err := planRequests(now, from, now, reqs, 0, false, 0, false, 0, 0, 0)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		for _, r := range rp.List() {
+			if r.Archive != 1 || r.OutInterval != 60 {
+				t.Fatalf("merge %t: expected all reqs to use archive 1 at interval 60, got %s", merge, r.DebugString())
+			}
+		}
+		return rp
+	}
+
+	if merged := plan(false).MergedPNGroups(); merged != 0 {
+		t.Errorf("expected no merged PNGroups when disabled, got %d", merged)
+	}
+
+	rp := plan(true)
+	if merged := rp.MergedPNGroups(); merged != 1 {
+		t.Fatalf("expected 1 merged PNGroup, got %d", merged)
+	}
+	if leader, ok := rp.fetchWith[124]; !ok || leader != 123 {
+		t.Errorf("expected PNGroup 124 to be fetched with 123, got %d (merged: %t)", leader, ok)
+	}
+	if _, ok := rp.fetchWith[125]; ok {
+		t.Errorf("expected PNGroup 125 not to be merged, as it shares a schema with 123")
+	}
+
+	// the requests of merged groups are listed next to each other
+	var groups []models.PNGroup
+	for _, r := range rp.List() {
+		if len(groups) == 0 || groups[len(groups)-1] != r.PNGroup {
+			groups = append(groups, r.PNGroup)
+		}
+	}
+	if exp := []models.PNGroup{123, 124, 125}; !reflect.DeepEqual(groups, exp) {
+		t.Errorf("expected reqs listed by group in order %v, got %v", exp, groups)
+	}
+}
+
+// TestPlanRequestsAutoPNGroup verifies that with auto-pngroup, singles with the same intervals get planned together,
+// which allows the series that could be read at high resolution to use the rollup the other series needs anyway.
+func TestPlanRequestsAutoPNGroup(t *testing.T) {
+	// expanded schema ids: a is 0,1, b is 2,3 and c is 4,5
+	mdata.Schemas = conf.NewSchemas([]conf.Schema{
+		{
+			Pattern:    regexp.MustCompile("^a"),
+			Retentions: conf.MustParseRetentions("10s:1d,60s:30d"),
+		},
+		{
+			Pattern:    regexp.MustCompile("^b"),
+			Retentions: conf.MustParseRetentions("10s:7d,60s:30d"),
+		},
+		{
+			Pattern:    regexp.MustCompile("^c"),
+			Retentions: conf.MustParseRetentions("15s:7d,60s:30d"),
+		},
+	})
+	defer func() { autoPNGroup = false }()
+
+	now := uint32(30 * 24 * 3600)
+	from := now - 3*24*3600
+	plan := func(auto bool, mdp uint32) []models.Req {
+		autoPNGroup = auto
+		reqs := NewReqMap()
+		reqs.Add(reqRaw(test.GetMKey(0), from, now, mdp, 10, consolidation.Avg, 0, 0))
+		reqs.Add(reqRaw(test.GetMKey(1), from, now, mdp, 10, consolidation.Avg, 2, 0))
+		reqs.Add(reqRaw(test.GetMKey(2), from, now, mdp, 15, consolidation.Avg, 4, 0))
+		rp, err := planRequests(now, from, now, reqs, mdp, false, 0, false, 0, 0, 0)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		out := rp.List()
+		sort.Slice(out, func(i, j int) bool { return out[i].SchemaId < out[j].SchemaId })
+		for _, r := range out {
+			if r.PNGroup != 0 {
+				t.Fatalf("expected PNGroup of requests to remain unset, got %d", r.PNGroup)
+			}
+		}
+		return out
+	}
+	pointsFetch := func(reqs []models.Req) uint32 {
+		var points uint32
+		for _, r := range reqs {
+			points += r.PointsFetch()
+		}
+		return points
+	}
+
+	// a needs its rollup to cover the TTL, b and c can use their raw data
+	singles := plan(false, 0)
+	expArchives := []uint8{1, 0, 0}
+	for i, r := range singles {
+		if r.Archive != expArchives[i] {
+			t.Errorf("singles: expected req %d to use archive %d, got %d", i, expArchives[i], r.Archive)
+		}
+	}
+
+	// a and b have the same intervals, so b goes along with a. c has a different raw interval so remains by itself.
+	grouped := plan(true, 0)
+	expArchives = []uint8{1, 1, 0}
+	for i, r := range grouped {
+		if r.Archive != expArchives[i] {
+			t.Errorf("auto-pngroup: expected req %d to use archive %d, got %d", i, expArchives[i], r.Archive)
+		}
+	}
+	if pointsFetch(grouped) >= pointsFetch(singles) {
+		t.Errorf("expected auto-pngroup to fetch fewer points than %d, got %d", pointsFetch(singles), pointsFetch(grouped))
+	}
+
+	// MDP-optimizable requests are grouped and planned separately from non-MDP-optimizable ones
+	autoPNGroup = true
+	reqs := NewReqMap()
+	reqs.Add(reqRaw(test.GetMKey(0), from, now, 800, 10, consolidation.Avg, 0, 0))
+	reqs.Add(reqRaw(test.GetMKey(1), from, now, 0, 10, consolidation.Avg, 2, 0))
+	rp := NewReqsPlan(&mdata.Schemas, *reqs)
+	if len(rp.pngroups) != 1 || rp.single.Len() != 0 {
+		t.Fatalf("expected all requests to go into 1 implicit PNGroup, got %d groups and %d singles", len(rp.pngroups), rp.single.Len())
+	}
+	for _, data := range rp.pngroups {
+		if data.mdpyes.Len() != 1 || data.mdpno.Len() != 1 {
+			t.Errorf("expected 1 MDP-optimizable and 1 non-MDP-optimizable request, got %d and %d", data.mdpyes.Len(), data.mdpno.Len())
+		}
+	}
+}
+
+type mockAccounting map[uint32]accountingCost
+
+func (m mockAccounting) Account(org, pointsReturn, pointsFetch uint32) {
+	m[org] = accountingCost{pointsReturn, pointsFetch}
+}
+
+func TestChargePlanAccounting(t *testing.T) {
+	mdata.Schemas = conf.NewSchemas([]conf.Schema{
+		{
+			Pattern:    regexp.MustCompile(".*"),
+			Retentions: conf.MustParseRetentions("10s:1d,60s:30d"),
+		},
+	})
+	defer func() { accounting, accountingPointsRounding = nil, 0 }()
+
+	now := uint32(30 * 24 * 3600)
+	from := now - 3600
+	keyOrg2 := test.GetMKey(2)
+	keyOrg2.Org = 2
+	plan := func(rounding uint) mockAccounting {
+		sink := make(mockAccounting)
+		SetAccounting(sink)
+		accountingPointsRounding = rounding
+		reqs := NewReqMap()
+		key0, key1 := test.GetMKey(0), test.GetMKey(1)
+		key0.Org, key1.Org = 1, 1
+		reqs.Add(reqRaw(key0, from, now, 0, 10, consolidation.Avg, 0, 0))
+		reqs.Add(reqRaw(key1, from, now, 0, 10, consolidation.Avg, 0, 0))
+		reqs.Add(reqRaw(keyOrg2, from, now, 0, 10, consolidation.Avg, 0, 0))
+		// each request fetches 360 raw points, which get consolidated down to 90 to honor MDP
+		rp, err := planRequests(now, from, now, reqs, 100, false, 0, false, 0, 0, 0)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if err := chargePlan(*rp, 100); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		return sink
+	}
+
+	cases := []struct {
+		rounding uint
+		exp      mockAccounting
+	}{
+		{0, mockAccounting{1: {180, 720}, 2: {90, 360}}},
+		{1, mockAccounting{1: {180, 720}, 2: {90, 360}}},
+		{100, mockAccounting{1: {200, 800}, 2: {100, 400}}},
+	}
+	for _, c := range cases {
+		got := plan(c.rounding)
+		if !reflect.DeepEqual(got, c.exp) {
+			t.Errorf("rounding %d: expected accounted costs %v, got %v", c.rounding, c.exp, got)
+		}
+	}
+
+	// without a sink, planning works as usual
+	SetAccounting(nil)
+	reqs := NewReqMap()
+	reqs.Add(reqRaw(keyOrg2, from, now, 0, 10, consolidation.Avg, 0, 0))
+	rp, err := planRequests(now, from, now, reqs, 100, false, 0, false, 0, 0, 0)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := chargePlan(*rp, 100); err != nil {
+		t.Fatalf("expected no error without accounting sink, got %v", err)
+	}
+}
+
+type mockPlanStatsSink []PlanStats
+
+func (m *mockPlanStatsSink) PlanStats(stats PlanStats) {
+	*m = append(*m, stats)
+}
+
+func TestPlanRequestsPlanStats(t *testing.T) {
+	mdata.Schemas = conf.NewSchemas([]conf.Schema{
+		{
+			Pattern:    regexp.MustCompile("a"),
+			Retentions: conf.MustParseRetentions("10s:1d,60s:30d"),
+		},
+		{
+			Pattern:    regexp.MustCompile("b"),
+			Retentions: conf.MustParseRetentions("60s:30d"),
+		},
+	})
+	sink := &mockPlanStatsSink{}
+	SetPlanStatsSink(sink)
+	defer SetPlanStatsSink(nil)
+
+	now := uint32(30 * 24 * 3600)
+	from := now - 2*24*3600
+	reqs := NewReqMap()
+	// a PNGroup of 2 series of schema a, which have to read its rollup because the raw data doesn't go back far enough
+	for i := 0; i < 2; i++ {
+		req := reqRaw(test.GetMKey(i), from, now, 100, 10, consolidation.Avg, 0, 0)
+		req.PNGroup = 1
+		reqs.Add(req)
+	}
+	// and a single of schema b
+	reqs.Add(reqRaw(test.GetMKey(2), from, now, 100, 60, consolidation.Avg, 2, 0))
+	if _, err := planRequests(now, from, now, reqs, 100, false, 0, false, 0, 0, 0); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	// each series fetches 2880 points, which get consolidated 29 at a time to honor MDP
+	exp := PlanStats{
+		From:           from,
+		To:             now,
+		MaxDataPoints:  100,
+		Series:         3,
+		PNGroups:       1,
+		PointsFetch:    3 * 2880,
+		PointsReturn:   3 * 99,
+		ChosenArchives: map[uint8]uint32{0: 1, 1: 2},
+	}
+	if len(*sink) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(*sink))
+	}
+	if !reflect.DeepEqual((*sink)[0], exp) {
+		t.Errorf("expected stats %+v, got %+v", exp, (*sink)[0])
+	}
+}
+
+// mockQuota is a quota backend that allows each org to fetch a fixed number of points, tracking their usage via accounting
+type mockQuota struct {
+	limit uint32
+	used  map[uint32]uint32
+}
+
+func (m *mockQuota) Exhausted(org, pointsFetch uint32) bool {
+	return m.used[org]+pointsFetch > m.limit
+}
+
+func (m *mockQuota) Account(org, pointsReturn, pointsFetch uint32) {
+	m.used[org] += pointsFetch
+}
+
+func TestChargePlanQuota(t *testing.T) {
+	mdata.Schemas = conf.NewSchemas([]conf.Schema{
+		{
+			Pattern:    regexp.MustCompile(".*"),
+			Retentions: conf.MustParseRetentions("10s:1d,60s:30d"),
+		},
+	})
+	// each org may fetch enough points for 2 requests
+	q := &mockQuota{limit: 800, used: make(map[uint32]uint32)}
+	SetQuota(q)
+	SetAccounting(q)
+	defer func() { quota, accounting = nil, nil }()
+
+	now := uint32(30 * 24 * 3600)
+	from := now - 3600
+	plan := func(org uint32) error {
+		key := test.GetMKey(int(org))
+		key.Org = org
+		reqs := NewReqMap()
+		// fetches 360 raw points
+		reqs.Add(reqRaw(key, from, now, 0, 10, consolidation.Avg, 0, 0))
+		rp, err := planRequests(now, from, now, reqs, 100, false, 0, false, 0, 0, 0)
+		if err != nil {
+			return err
+		}
+		return chargePlan(*rp, 100)
+	}
+
+	cases := []struct {
+		org    uint32
+		expErr error
+	}{
+		{1, nil},
+		{1, nil},
+		{1, errQuotaExceeded},
+		{2, nil}, // quotas are per org
+		{1, errQuotaExceeded},
+	}
+	for i, c := range cases {
+		if err := plan(c.org); err != c.expErr {
+			t.Errorf("case %d: expected error %v, got %v", i, c.expErr, err)
+		}
+	}
+	// rejected requests are not accounted
+	exp := map[uint32]uint32{1: 720, 2: 360}
+	if !reflect.DeepEqual(q.used, exp) {
+		t.Errorf("expected usage %v, got %v", exp, q.used)
+	}
+}
+
+// TestPlanRequestsSnapFrom verifies that with plan-from-snap, the chosen archive remains stable as from advances
+// across the moment a rollup became ready, until from crosses into the next step of the grid.
+func TestPlanRequestsSnapFrom(t *testing.T) {
+	ready := uint32(100*3600 + 1800)
+	mdata.Schemas = conf.NewSchemas([]conf.Schema{
+		{
+			Pattern:    regexp.MustCompile(".*"),
+			Retentions: conf.BuildFromRetentions(conf.NewRetentionMT(10, 30*24*3600, 0, 0, 0), conf.NewRetentionMT(60, 30*24*3600, 0, 0, ready)),
+		},
+	})
+	defer func() { planFromSnap = 0 }()
+
+	now := ready + 10*24*3600
+	// a range of a day yields plenty of points for the MDP at 60s, so the rollup is chosen whenever it is ready
+	plan := func(from uint32) uint8 {
+		to := from + 24*3600
+		reqs := NewReqMap()
+		reqs.Add(reqRaw(test.GetMKey(0), from, to, 1000, 10, consolidation.Avg, 0, 0))
+		rp, err := planRequests(now, snapFrom(from), to, reqs, 1000, false, 0, false, 0, 0, 0)
+		if err != nil {
+			t.Fatalf("from %d: expected no error, got %v", from, err)
+		}
+		return rp.List()[0].Archive
+	}
+
+	froms := []uint32{100*3600 + 1000, 100*3600 + 1790, 100*3600 + 1810, 100*3600 + 3590}
+
+	// without snapping, the archive flips as soon as from passes ready
+	expArchives := []uint8{0, 0, 1, 1}
+	for i, from := range froms {
+		if archive := plan(from); archive != expArchives[i] {
+			t.Errorf("no snap: from %d: expected archive %d, got %d", from, expArchives[i], archive)
+		}
+	}
+
+	// with snapping, all froms within the same hour get the same archive
+	planFromSnap = 3600
+	for _, from := range froms {
+		if archive := plan(from); archive != 0 {
+			t.Errorf("snap: from %d: expected archive 0, got %d", from, archive)
+		}
+	}
+	if archive := plan(101 * 3600); archive != 1 {
+		t.Errorf("snap: from %d: expected archive 1 in the next grid step, got %d", 101*3600, archive)
+	}
+}
+
+// TestPlanRequestsChunksFetch verifies the chunk estimates over a day of data, for a raw archive with 10min chunks
+// and a rollup with 6h chunks.
+func TestPlanRequestsChunksFetch(t *testing.T) {
+	mdata.Schemas = conf.NewSchemas([]conf.Schema{
+		{
+			Pattern:    regexp.MustCompile(".*"),
+			Retentions: conf.BuildFromRetentions(conf.NewRetentionMT(10, 30*24*3600, 600, 0, 0), conf.NewRetentionMT(300, 90*24*3600, 6*3600, 0, 0)),
+		},
+	})
+
+	now := uint32(30 * 24 * 3600)
+	from := uint32(3600)
+	to := from + 24*3600
+	reqs := NewReqMap()
+	// the non-MDP-optimizable request reads raw data, the MDP-optimizable one gets enough points from the rollup
+	reqs.Add(reqRaw(test.GetMKey(0), from, to, 0, 10, consolidation.Avg, 0, 0))
+	reqs.Add(reqRaw(test.GetMKey(1), from, to, 100, 10, consolidation.Avg, 0, 0))
+	reqs.Add(reqRaw(test.GetMKey(2), from, to, 100, 10, consolidation.Avg, 0, 0))
+	rp, err := planRequests(now, from, to, reqs, 100, false, 0, false, 0, 0, 0)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	// raw: 144 chunks of 10min. rollup: the day starts at 1h, so it spans 5 chunks of 6h, for each request
+	exp := map[uint8]uint32{0: 144, 1: 10}
+	if got := rp.ChunksFetch(); !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected chunks per archive %v, got %v", exp, got)
+	}
+
+	// the rollup chunks start at 0h, 6h, 12h, 18h and 24h
+	rollupStarts := []uint32{0, 6 * 3600, 12 * 3600, 18 * 3600, 24 * 3600}
+	for _, rc := range rp.Chunks() {
+		if rc.MKey == test.GetMKey(0) {
+			if rc.Archive != 0 || rc.ChunkSpan != 600 || len(rc.Starts) != 144 || rc.Starts[0] != from || rc.Starts[143] != to-600 {
+				t.Errorf("raw req: unexpected chunks %d %d %v", rc.Archive, rc.ChunkSpan, rc.Starts)
+			}
+			continue
+		}
+		if rc.Archive != 1 || rc.ChunkSpan != 6*3600 || !reflect.DeepEqual(rc.Starts, rollupStarts) {
+			t.Errorf("rollup req %s: expected archive 1 with chunks %v, got archive %d with %v", rc.MKey, rollupStarts, rc.Archive, rc.Starts)
+		}
+	}
+}
+
+// TestPlanRequestsWarmChunks verifies the estimate of how many of the chunks to read are served from memory,
+// for queries within the warm window, spanning cold data and entirely cold.
+func TestPlanRequestsWarmChunks(t *testing.T) {
+	mdata.Schemas = conf.NewSchemas([]conf.Schema{
+		{
+			Pattern:    regexp.MustCompile(".*"),
+			Retentions: conf.BuildFromRetentions(conf.NewRetentionMT(10, 30*24*3600, 600, 0, 0), conf.NewRetentionMT(300, 90*24*3600, 6*3600, 0, 0)),
+		},
+	})
+	now := uint32(30 * 24 * 3600)
+	warmWindow := uint32(3600)
+
+	cases := []struct {
+		name     string
+		from, to uint32
+		mdp      uint32
+		expWarm  uint32
+		expTotal uint32
+	}{
+		{"WithinWarmWindow", now - 1800, now, 0, 3, 3},
+		{"SpanningColdData", now - 12*3600, now, 0, 6, 72},            // the last hour of 10min chunks is warm
+		{"Cold", now - 3*24*3600, now - 2*24*3600, 0, 0, 144},         // ends long before the warm window
+		{"SpanningColdDataRollup", now - 10*24*3600, now, 100, 1, 40}, // only the last 6h chunk ends within the warm window
+		{"ChunkEndsInWarmWindow", now - 6*3600, now - 3000, 0, 1, 31}, // the chunk starting at now-3600 ends within the warm window, though it starts before it
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			reqs := NewReqMap()
+			reqs.Add(reqRaw(test.GetMKey(0), c.from, c.to, c.mdp, 10, consolidation.Avg, 0, 0))
+			rp, err := planRequests(now, c.from, c.to, reqs, c.mdp, false, 0, false, 0, 0, 0)
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			warm, total := rp.WarmChunks(now, warmWindow)
+			if warm != c.expWarm || total != c.expTotal {
+				t.Errorf("expected %d of %d chunks to be warm, got %d of %d", c.expWarm, c.expTotal, warm, total)
+			}
+		})
+	}
+}
+
+func TestPlanRequestsEffectiveQuery(t *testing.T) {
+	mdata.Schemas = conf.NewSchemas([]conf.Schema{
+		{
+			Pattern:    regexp.MustCompile(".*"),
+			Retentions: conf.MustParseRetentions("10s:1d,60s:30d"),
+		},
+	})
+
+	now := uint32(30 * 24 * 3600)
+	from := now - 2*24*3600
+	// req returns a request for series i, as resolved from the given pattern
+	req := func(i int, pattern string, pngroup models.PNGroup) models.Req {
+		r := reqRaw(test.GetMKey(i), from, now, 0, 10, consolidation.Avg, 0, 0)
+		r.Target, r.Pattern, r.PNGroup = "a.b"+strconv.Itoa(i), pattern, pngroup
+		return r
+	}
+	plan := func(planMDP uint32, reqs ...models.Req) string {
+		rm := NewReqMap()
+		for _, r := range reqs {
+			rm.Add(r)
+		}
+		rp, err := planRequests(now, from, now, rm, planMDP, false, 0, false, 0, 0, 0)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		return rp.EffectiveQuery(planMDP)
+	}
+
+	base := plan(800, req(0, "a.*", 0), req(1, "a.*", 0))
+	equivalent := []struct {
+		name  string
+		query string
+	}{
+		{"reverse order", plan(800, req(1, "a.*", 0), req(0, "a.*", 0))},
+		{"different patterns", plan(800, req(0, "a.b0", 0), req(1, "a.{b1,b2}", 0))},
+		{"pre-normalized together", plan(800, req(0, "a.*", 1), req(1, "a.*", 1))},
+	}
+	for _, c := range equivalent {
+		if c.query != base {
+			t.Errorf("%s: expected effective query %q, got %q", c.name, base, c.query)
+		}
+	}
+
+	distinct := []struct {
+		name  string
+		query string
+	}{
+		{"different series", plan(800, req(0, "a.*", 0), req(2, "a.*", 0))},
+		{"different mdp", plan(400, req(0, "a.*", 0), req(1, "a.*", 0))},
+		{"fewer series", plan(800, req(0, "a.*", 0))},
+	}
+	for _, c := range distinct {
+		if c.query == base {
+			t.Errorf("%s: expected effective query to differ from %q", c.name, base)
+		}
+	}
+}
+
+// TestPlanRequestsMaxPointsPerReqSoftStrategy compares the soft limit reduction strategies for a PNGroup with 1 request
+// and 3 singles. Each request fetches 360 points at 10s, 60 at 60s and 12 at 300s.
+// The sequential strategy always reduces the PNGroup first, whereas the proportional strategy first reduces the singles,
+// which contribute most of the points.
+func TestPlanRequestsMaxPointsPerReqSoftStrategy(t *testing.T) {
+	mdata.Schemas = conf.NewSchemas([]conf.Schema{
+		{
+			Pattern:    regexp.MustCompile(".*"),
+			Retentions: conf.MustParseRetentions("10s:1d,60s:2d,300s:7d"),
+		},
+	})
+	defer func() { maxPointsPerReqSoftStrat = softStrategySequential }()
+
+	cases := []struct {
+		strategy           string
+		soft               int
+		expPNGroupInterval uint32
+		expSinglesInterval uint32
+		expPoints          uint32
+	}{
+		{softStrategySequential, 800, 60, 60, 240},
+		{softStrategyProportional, 800, 10, 60, 540},
+		{softStrategySequential, 300, 60, 60, 240},
+		{softStrategyProportional, 300, 60, 60, 240},
+		{softStrategySequential, 100, 300, 300, 48},
+		{softStrategyProportional, 100, 60, 300, 96},
+	}
+	for _, c := range cases {
+		maxPointsPerReqSoftStrat = c.strategy
+		reqs := NewReqMap()
+		grouped := reqRaw(test.GetMKey(0), 0, 3600, 0, 10, consolidation.Avg, 0, 0)
+		grouped.PNGroup = 1
+		reqs.Add(grouped)
+		for i := 1; i <= 3; i++ {
+			reqs.Add(reqRaw(test.GetMKey(i), 0, 3600, 0, 10, consolidation.Avg, 0, 0))
+		}
+		plan, err := planRequests(3600, 0, 3600, reqs, 0, false, 0, false, c.soft, 0, 0)
+		if err != nil {
+			t.Fatalf("%s soft %d: expected no error, got %v", c.strategy, c.soft, err)
+		}
+		for _, r := range plan.List() {
+			exp := c.expSinglesInterval
+			if r.PNGroup != 0 {
+				exp = c.expPNGroupInterval
+			}
+			if r.ArchInterval != exp {
+				t.Errorf("%s soft %d: expected req %s (pngroup %d) to be read at interval %d, got %d", c.strategy, c.soft, r.MKey, r.PNGroup, exp, r.ArchInterval)
+			}
+		}
+		if plan.PointsFetch() != c.expPoints {
+			t.Errorf("%s soft %d: expected %d points fetched, got %d", c.strategy, c.soft, c.expPoints, plan.PointsFetch())
+		}
+	}
+}
+
+// TestPlanRequestsNormalizationPref verifies that normalization-pref determines which archive MDP-optimizable series are normalized from
+func TestPlanRequestsNormalizationPref(t *testing.T) {
+	// expanded schema ids: a is 0,1 and b is 2,3
+	mdata.Schemas = conf.NewSchemas([]conf.Schema{
+		{
+			Name:       "a",
+			Pattern:    regexp.MustCompile("^a"),
+			Retentions: conf.MustParseRetentions("10s:1d,30s:7d"),
+		},
+		{
+			Name:       "b",
+			Pattern:    regexp.MustCompile("^b"),
+			Retentions: conf.MustParseRetentions("15s:1d,60s:7d"),
+		},
+	})
+	defer func() { normalizationPref = normalizationPrefMinFetch }()
+
+	now := uint32(10 * 24 * 3600)
+	from := now - 6*3600
+	cases := []struct {
+		pref       string
+		expArchive uint8 // the archive of a
+		expAggNum  uint32
+	}{
+		// for 800 points over 6h, the coarsest common interval is 30s. for a, this is either its 30s rollup, or its raw data
+		{normalizationPrefMinFetch, 1, 1},
+		{normalizationPrefMaxAccuracy, 0, 3},
+	}
+	for _, c := range cases {
+		normalizationPref = c.pref
+		reqs := NewReqMap()
+		a := reqRaw(test.GetMKey(0), from, now, 800, 10, consolidation.Avg, 0, 0)
+		a.PNGroup = 1
+		reqs.Add(a)
+		b := reqRaw(test.GetMKey(1), from, now, 800, 15, consolidation.Avg, 2, 0)
+		b.PNGroup = 1
+		reqs.Add(b)
+		rp, err := planRequests(now, from, now, reqs, 800, false, 0, false, 0, 0, 0)
+		if err != nil {
+			t.Fatalf("%s: expected no error, got %v", c.pref, err)
+		}
+		for _, req := range rp.List() {
+			if req.OutInterval != 30 {
+				t.Errorf("%s: expected OutInterval 30, got %s", c.pref, req.DebugString())
+			}
+			if req.SchemaId == 0 && (req.Archive != c.expArchive || req.AggNum != c.expAggNum) {
+				t.Errorf("%s: expected a to be read from archive %d with aggNum %d, got %s", c.pref, c.expArchive, c.expAggNum, req.DebugString())
+			}
+			if req.SchemaId == 2 && (req.Archive != 0 || req.AggNum != 2) {
+				t.Errorf("%s: expected b to be read from archive 0 with aggNum 2, got %s", c.pref, req.DebugString())
+			}
+		}
+	}
+}
+
+// TestReduceResSinglesForSoftLimit verifies that reducing singles in one shot yields the same result as reducing them
+// one retention at a time, like the generic max-points-per-req-soft loop does
+func TestReduceResSinglesForSoftLimit(t *testing.T) {
+	mdata.Schemas = conf.NewSchemas([]conf.Schema{
+		{
+			Pattern:    regexp.MustCompile(".*"),
+			Retentions: conf.MustParseRetentions("10s:1d,60s:2d,300s:7d,3600s:30d"),
+		},
+	})
+	newReqs := func() []models.Req {
+		reqs := make([]models.Req, 100)
+		for i := range reqs {
+			reqs[i] = reqRaw(test.GetMKey(i), 0, 3600, 0, 10, consolidation.Avg, 0, 0)
+			reqs[i].Plan(0, mdata.Schemas.Get(0).Retentions.Rets[0])
+		}
+		return reqs
+	}
+	cases := []struct {
+		soft          uint32
+		maxPasses     int
+		expReductions int
+		expHonored    bool
+	}{
+		{50000, 0, 0, true},
+		{36000, 0, 0, true},
+		{20000, 0, 1, true},
+		{6000, 0, 1, true},
+		{5999, 0, 2, true},
+		{100, 0, 3, true},
+		{99, 0, 3, false},
+		{100, 2, 2, false},
+		{99, 3, 3, false},
+	}
+	for _, c := range cases {
+		reqs := newReqs()
+		reductions, honored := reduceResSinglesForSoftLimit(&mdata.Schemas, 3600, 0, 3600, 0, reqs, c.soft, c.maxPasses)
+		if reductions != c.expReductions || honored != c.expHonored {
+			t.Errorf("soft %d, max passes %d: expected %d reductions and honored %t, got %d and %t", c.soft, c.maxPasses, c.expReductions, c.expHonored, reductions, honored)
+		}
+
+		stepped := newReqs()
+		for i := 0; pointsFetch(stepped) > c.soft && (c.maxPasses == 0 || i < c.maxPasses); i++ {
+			if !reduceResSingles(&mdata.Schemas, 3600, 0, 3600, 0, stepped) {
+				break
+			}
+		}
+		for i := range reqs {
+			if reqs[i].Archive != stepped[i].Archive || reqs[i].ArchInterval != stepped[i].ArchInterval || reqs[i].OutInterval != stepped[i].OutInterval || reqs[i].TTL != stepped[i].TTL {
+				t.Fatalf("soft %d, max passes %d: expected the same plan as when reducing one retention at a time. got %s, expected %s", c.soft, c.maxPasses, reqs[i].DebugString(), stepped[i].DebugString())
+			}
+		}
+	}
+}
+
+// TestGetLowestResFromSetMatchingTimeBudget verifies that a search through a large amount of combinations
+// is abandoned once it exceeds plan-time-budget, and still yields an interval that all schemas can deliver.
+func TestGetLowestResFromSetMatchingTimeBudget(t *testing.T) {
+	// 8 schemas with 5 intervals each yield 5^8=390625 combinations
+	var schemas []conf.Schema
+	var rbr ReqsByRet
+	for i := 0; i < 8; i++ {
+		var rets []conf.Retention
+		for j, interval := range []int{1, 2, 4, 8, 16} {
+			rets = append(rets, conf.NewRetentionMT(interval*(i+1), uint32((j+1)*24*3600), 0, 0, 0))
+		}
+		schemas = append(schemas, conf.Schema{
+			Pattern:    regexp.MustCompile(".*"),
+			Retentions: conf.BuildFromRetentions(rets...),
+		})
+		// note: schemas are expanded, one entry per retention
+		id := len(rbr)
+		rbr = append(rbr, make(ReqsByRet, len(rets))...)
+		rbr[id] = []models.Req{reqRaw(test.GetMKey(i), 0, 3600, 0, uint32(i+1), consolidation.Avg, uint16(id), 0)}
+	}
+	mdata.Schemas = conf.NewSchemas(schemas)
+	validIntervalsSet, ok := getValidIntervalsSet(&mdata.Schemas, rbr, 0, 1)
+	if !ok {
+		t.Fatalf("expected valid intervals")
+	}
+	defer func() { planTimeBudget = 0 }()
+
+	pre := time.Now()
+	full := getLowestResFromSetMatching(&mdata.Schemas, rbr, 0, 1, 0, math.MaxUint32, validIntervalsSet)
+	fullDuration := time.Since(pre)
+
+	planTimeBudget = time.Nanosecond
+	exceeded := reqRenderPlanBudgetExceeded.Peek()
+	pre = time.Now()
+	budgeted := getLowestResFromSetMatching(&mdata.Schemas, rbr, 0, 1, 0, math.MaxUint32, validIntervalsSet)
+	budgetedDuration := time.Since(pre)
+
+	if reqRenderPlanBudgetExceeded.Peek() != exceeded+1 {
+		t.Errorf("expected budget exceeded stat to be incremented")
+	}
+	if budgeted == 0 || !achievable(budgeted, validIntervalsSet) {
+		t.Errorf("expected an achievable interval, got %d", budgeted)
+	}
+	if full == 0 || !achievable(full, validIntervalsSet) {
+		t.Errorf("expected the full search to return an achievable interval, got %d", full)
+	}
+	if budgetedDuration >= fullDuration {
+		t.Errorf("expected the budgeted search to take less time than the full search (%s), got %s", fullDuration, budgetedDuration)
+	}
+}
+
+// TestPlanRequestsMaxPointsFetch verifies that with maxPointsFetch, the finest resolution that fetches no more than
+// the given amount of points is chosen, across windows.
+func TestPlanRequestsMaxPointsFetch(t *testing.T) {
+	mdata.Schemas = conf.NewSchemas([]conf.Schema{
+		{
+			Pattern:    regexp.MustCompile(".*"),
+			Retentions: conf.MustParseRetentions("10s:1d,60s:7d,300s:30d,3600s:1y"),
+		},
+	})
+	now := uint32(400 * 24 * 3600)
+	cases := []struct {
+		window         uint32
+		maxPointsFetch uint32
+		expInterval    uint32
+	}{
+		{3600, 0, 10},
+		{24 * 3600, 0, 10},
+		{3600, 1000, 10},            // 360 points at 10s
+		{6 * 3600, 1000, 60},        // 2160 points at 10s, 360 at 60s
+		{24 * 3600, 1000, 300},      // 1440 points at 60s, 288 at 300s
+		{3 * 24 * 3600, 1000, 300},  // raw doesn't cover the window. 4320 points at 60s, 864 at 300s
+		{7 * 24 * 3600, 1000, 3600}, // 2016 points at 300s, 168 at 3600s
+		{30 * 24 * 3600, 1000, 3600},
+		{365 * 24 * 3600, 10, 3600}, // can't meet the budget, so we use the coarsest archive
+	}
+	for _, c := range cases {
+		from := now - c.window
+		for _, pngroup := range []models.PNGroup{0, 1} {
+			reqs := NewReqMap()
+			for i := 0; i < 2; i++ {
+				r := reqRaw(test.GetMKey(i), from, now, 0, 10, consolidation.Avg, 0, 0)
+				r.PNGroup = pngroup
+				reqs.Add(r)
+			}
+			plan, err := planRequests(now, from, now, reqs, 0, false, c.maxPointsFetch, false, 0, 0, 0)
+			if err != nil {
+				t.Fatalf("window %d budget %d pngroup %d: expected no error, got %v", c.window, c.maxPointsFetch, pngroup, err)
+			}
+			for _, r := range plan.List() {
+				if r.ArchInterval != c.expInterval {
+					t.Errorf("window %d budget %d pngroup %d: expected interval %d, got %d", c.window, c.maxPointsFetch, pngroup, c.expInterval, r.ArchInterval)
+				}
+			}
+		}
+	}
+}
+
+// TestPlanRequestsSchemasSnapshot verifies that when the schemas get replaced while requests are being planned,
+// each plan is made against one version of the schemas, and never against a mix of both.
+func TestPlanRequestsSchemasSnapshot(t *testing.T) {
+	schemasFor := func(rets string) conf.Schemas {
+		return conf.NewSchemas([]conf.Schema{
+			{
+				Pattern:    regexp.MustCompile("^a"),
+				Retentions: conf.MustParseRetentions(rets),
+			},
+			{
+				Pattern:    regexp.MustCompile(".*"),
+				Retentions: conf.MustParseRetentions(rets),
+			},
+		})
+	}
+	// for a window of 2 days, the former can only be served by its rollup, the latter by its raw archive
+	short := schemasFor("10s:1d,60s:30d")
+	long := schemasFor("10s:30d,60s:60d")
+	orig := mdata.Schemas
+	defer mdata.SetSchemas(orig)
+	mdata.SetSchemas(short)
+
+	now := uint32(100 * 24 * 3600)
+	from := now - 2*24*3600
+
+	done := make(chan struct{})
+	swapped := make(chan struct{})
+	stop := func() {
+		close(done)
+		<-swapped
+	}
+	go func() {
+		defer close(swapped)
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if i%2 == 0 {
+				mdata.SetSchemas(long)
+			} else {
+				mdata.SetSchemas(short)
+			}
+		}
+	}()
+
+	for i := 0; i < 1000; i++ {
+		reqs := NewReqMap()
+		for j := 0; j < 8; j++ {
+			// schemas are expanded, one entry per retention
+			r := reqRaw(test.GetMKey(j), from, now, 0, 10, consolidation.Avg, uint16(2*(j%2)), 0)
+			if j >= 4 {
+				r.PNGroup = 1
+			}
+			reqs.Add(r)
+		}
+		plan, err := planRequests(now, from, now, reqs, 0, false, 0, false, 0, 0, 0)
+		if err != nil {
+			stop()
+			t.Fatalf("iteration %d: expected no error, got %v", i, err)
+		}
+		list := plan.List()
+		for _, r := range list {
+			if r.ArchInterval != list[0].ArchInterval {
+				stop()
+				t.Fatalf("iteration %d: expected all requests to be planned against the same schemas, got intervals %d and %d", i, list[0].ArchInterval, r.ArchInterval)
+			}
+		}
+	}
+	stop()
+}
+
+// TestPlanRequestsSchemaReload verifies that there are no lingering planning decisions:
+// as soon as the schemas are replaced, the next plan reflects the new schemas.
+func TestPlanRequestsSchemaReload(t *testing.T) {
+	schemasFor := func(rets string) conf.Schemas {
+		return conf.NewSchemas([]conf.Schema{
+			{
+				Pattern:    regexp.MustCompile(".*"),
+				Retentions: conf.MustParseRetentions(rets),
+			},
+		})
+	}
+	orig := mdata.Schemas
+	defer mdata.SetSchemas(orig)
+
+	now := uint32(100 * 24 * 3600)
+	from := now - 3600
+	plan := func() uint32 {
+		reqs := NewReqMap()
+		reqs.Add(reqRaw(test.GetMKey(0), from, now, 30, 10, consolidation.Avg, 0, 0))
+		rp, err := planRequests(now, from, now, reqs, 30, false, 0, false, 0, 0, 0)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		return rp.List()[0].ArchInterval
+	}
+
+	steps := []struct {
+		rets        string
+		expInterval uint32
+	}{
+		{"10s:1d,60s:30d:2h:2:false", 10}, // the rollup is not ready yet, so we have to use raw data
+		{"10s:1d,60s:30d:2h:2:true", 60},  // once it is, we use it to honor MDP
+		{"10s:1d,60s:30d:2h:2:false", 10}, // or not, once it's marked as not ready again
+		{"10s:1d,60s:30d:2h:2:true:true", 10},  // nor once it is disabled
+	}
+	for i, s := range steps {
+		mdata.SetSchemas(schemasFor(s.rets))
+		if got := plan(); got != s.expInterval {
+			t.Errorf("step %d (%s): expected interval %d, got %d", i, s.rets, s.expInterval, got)
+		}
+	}
+}
+
+// TestPlanRequestsExtremeMDP verifies that MDP-optimized planning remains sane for extreme maxDataPoints values and time ranges
+func TestPlanRequestsExtremeMDP(t *testing.T) {
+	mdata.Schemas = conf.NewSchemas([]conf.Schema{
+		{
+			Pattern:    regexp.MustCompile(".*"),
+			Retentions: conf.MustParseRetentions("10s:80y,60s:90y,3600s:100y"),
+		},
+	})
+	now := uint32(3000000000)
+	day := uint32(24 * 3600)
+	cases := []struct {
+		window      uint32
+		mdp         uint32
+		expInterval uint32
+	}{
+		{day, 0, 10},              // no runtime consolidation: highest resolution
+		{day, 1, 3600},            // the coarsest archive still returns plenty of points
+		{day, 800, 60},            // 1440 points
+		{day, math.MaxUint32, 10}, // can't honor it, so use the highest resolution
+		// a window for which 2*window overflows a uint32. it should not be mistaken for a very short one
+		{1<<31 + 1000, 100, 3600},
+		{1<<31 + 1000, math.MaxUint32, 10},
+	}
+	for _, c := range cases {
+		from := now - c.window
+		for _, pngroup := range []models.PNGroup{0, 1} {
+			reqs := NewReqMap()
+			for i := 0; i < 2; i++ {
+				r := reqRaw(test.GetMKey(i), from, now, c.mdp, 10, consolidation.Avg, 0, 0)
+				r.PNGroup = pngroup
+				reqs.Add(r)
+			}
+			plan, err := planRequests(now, from, now, reqs, c.mdp, false, 0, false, 0, 0, 0)
+			if err != nil {
+				t.Fatalf("window %d mdp %d pngroup %d: expected no error, got %v", c.window, c.mdp, pngroup, err)
+			}
+			for _, r := range plan.List() {
+				if r.ArchInterval != c.expInterval {
+					t.Errorf("window %d mdp %d pngroup %d: expected interval %d, got %d", c.window, c.mdp, pngroup, c.expInterval, r.ArchInterval)
+				}
+			}
+		}
+	}
+}
+
+// TestPlanRequestsCheapest verifies that with cheapest, the coarsest archive that covers the TTL is chosen, regardless of MDP
+func TestPlanRequestsCheapest(t *testing.T) {
+	mdata.Schemas = conf.NewSchemas([]conf.Schema{
+		{
+			Pattern:    regexp.MustCompile("^a"),
+			Retentions: conf.MustParseRetentions("10s:1d,60s:7d,300s:30d,3600s:1y"),
+		},
+		{
+			Pattern:    regexp.MustCompile("^b"),
+			Retentions: conf.MustParseRetentions("10s:1d,60s:7d,300s:30d,3600s:1y:6h:2:false"),
+		},
+		{
+			Pattern:    regexp.MustCompile("^c"),
+			Retentions: conf.MustParseRetentions("10s:1d,60s:3d"),
+		},
+		{
+			Pattern:    regexp.MustCompile("^d"),
+			Retentions: conf.MustParseRetentions("15s:1d,120s:60d"),
+		},
+		{
+			Pattern:    regexp.MustCompile(".*"),
+			Retentions: conf.MustParseRetentions("10s:1d,60s:7d,300s:30d"),
+		},
+	})
+	// note: schemas are expanded, one entry per retention
+	const (
+		schemaA = 0
+		schemaB = 4
+		schemaC = 8
+		schemaD = 10
+		schemaE = 12
+	)
+	now := uint32(400 * 24 * 3600)
+	hour := uint32(3600)
+	day := 24 * hour
+	type series struct {
+		schemaID    uint16
+		rawInterval uint32
+		expInterval uint32
+	}
+	cases := []struct {
+		name    string
+		window  uint32
+		pngroup models.PNGroup
+		series  []series
+	}{
+		{"all archives cover the range", 2 * hour, 0, []series{{schemaA, 10, 3600}}},
+		{"even if raw doesn't", 10 * day, 0, []series{{schemaA, 10, 3600}}},
+		{"nor any archive but the coarsest", 40 * day, 0, []series{{schemaA, 10, 3600}}},
+		{"coarsest ready archive that covers the range", 10 * day, 0, []series{{schemaB, 10, 300}}},
+		{"no ready archive covers the range: longest retention", 40 * day, 0, []series{{schemaB, 10, 300}}},
+		{"coarsest archive is not ready", 2 * hour, 0, []series{{schemaB, 10, 300}}},
+		{"no archive covers the range: longest retention", 5 * day, 0, []series{{schemaC, 10, 60}}},
+		{"singles each get their own coarsest archive", 2 * day, 0, []series{{schemaE, 10, 300}, {schemaD, 15, 120}}},
+		{"pngroups get the coarsest common interval", 2 * day, 1, []series{{schemaE, 10, 600}, {schemaD, 15, 600}}},
+		{"a pngroup member without archive that covers the range", 5 * day, 1, []series{{schemaE, 10, 60}, {schemaC, 10, 60}}},
+	}
+	for _, c := range cases {
+		from := now - c.window
+		for _, mdp := range []uint32{0, 800} {
+			reqs := NewReqMap()
+			for i, s := range c.series {
+				r := reqRaw(test.GetMKey(i), from, now, mdp, s.rawInterval, consolidation.Avg, s.schemaID, 0)
+				r.PNGroup = c.pngroup
+				reqs.Add(r)
+			}
+			plan, err := planRequests(now, from, now, reqs, mdp, false, 0, true, 0, 0, 0)
+			if err != nil {
+				t.Fatalf("%s (mdp %d): expected no error, got %v", c.name, mdp, err)
+			}
+			for _, r := range plan.List() {
+				var exp uint32
+				for i, s := range c.series {
+					if r.MKey == test.GetMKey(i) {
+						exp = s.expInterval
+					}
+				}
+				if r.OutInterval != exp {
+					t.Errorf("%s (mdp %d): expected series of schema %d at interval %d, got %d (archive interval %d)", c.name, mdp, r.SchemaId, exp, r.OutInterval, r.ArchInterval)
+				}
+			}
+		}
+	}
+}
+
+// TestPlanRequestsNormalizationRatio verifies that the normalization ratios of pre-normalized series are reported per schema
+func TestPlanRequestsNormalizationRatio(t *testing.T) {
+	mdata.Schemas = conf.NewSchemas([]conf.Schema{
+		{
+			Name:       "normratio-a",
+			Pattern:    regexp.MustCompile("^a"),
+			Retentions: conf.MustParseRetentions("10s:1d"),
+		},
+		{
+			Name:       "normratio-b",
+			Pattern:    regexp.MustCompile("^b"),
+			Retentions: conf.MustParseRetentions("15s:1d"),
+		},
+		{
+			Name:       "normratio-c",
+			Pattern:    regexp.MustCompile(".*"),
+			Retentions: conf.MustParseRetentions("30s:1d"),
+		},
+	})
+	reqs := NewReqMap()
+	for i, s := range []struct {
+		schemaID    uint16
+		rawInterval uint32
+	}{{0, 10}, {0, 10}, {1, 15}} {
+		r := reqRaw(test.GetMKey(i), 0, 3600, 0, s.rawInterval, consolidation.Avg, s.schemaID, 0)
+		r.PNGroup = 1
+		reqs.Add(r)
+	}
+	// this one is not part of a PNGroup, so it won't be normalized
+	reqs.Add(reqRaw(test.GetMKey(3), 0, 3600, 0, 10, consolidation.Avg, 0, 0))
+	// as is this one, as its interval matches the common interval
+	c := reqRaw(test.GetMKey(4), 0, 3600, 0, 30, consolidation.Avg, 2, 0)
+	c.PNGroup = 1
+	reqs.Add(c)
+
+	if _, err := planRequests(3600, 0, 3600, reqs, 0, false, 0, false, 0, 0, 0); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	// values returns the normalization ratios reported for the given schema, as max ratio and count
+	values := func(schema string) (string, string) {
+		reqRenderNormalizationRatio.Lock()
+		meter, ok := reqRenderNormalizationRatio.meters[schema]
+		reqRenderNormalizationRatio.Unlock()
+		if !ok {
+			return "", ""
+		}
+		var max, count string
+		for _, line := range strings.Split(string(meter.WriteGraphiteLine(nil, nil, time.Now())), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) != 3 {
+				continue
+			}
+			switch fields[0] {
+			case "api.request.render.normalization_ratio.max.gauge32;schema=" + schema:
+				max = fields[1]
+			case "api.request.render.normalization_ratio.values.count32;schema=" + schema:
+				count = fields[1]
+			}
+		}
+		return max, count
+	}
+	cases := []struct {
+		schema   string
+		expMax   string
+		expCount string
+	}{
+		{"normratio-a", "3", "2"},
+		{"normratio-b", "2", "1"},
+		{"normratio-c", "", ""},
+	}
+	for _, c := range cases {
+		if max, count := values(c.schema); max != c.expMax || count != c.expCount {
+			t.Errorf("schema %s: expected max ratio %q over %q series, got %q over %q", c.schema, c.expMax, c.expCount, max, count)
+		}
+	}
+}
+
+// TestPlanLowestResForMDPSinglesHysteresis verifies that, with archive hysteresis enabled, repeated requests
+// for a pattern keep the same archive as their window nudges back and forth across an archive boundary
+func TestPlanLowestResForMDPSinglesHysteresis(t *testing.T) {
+	mdata.Schemas = conf.NewSchemas([]conf.Schema{
+		{
+			Pattern:    regexp.MustCompile(".*"),
+			Retentions: conf.MustParseRetentions("10s:1d,60s:30d"),
+		},
+		{
+			Pattern:    regexp.MustCompile("^b"),
+			Retentions: conf.MustParseRetentions("10s:1d,60s:30d"),
+		},
+	})
+	defer func() { archiveHysteresis = nil }()
+
+	now := uint32(30 * 24 * 3600)
+	// with an mdp of 800, the 60s archive is chosen for windows of at least 24000s, which yield >= 400 points.
+	// all these windows round to the same size.
+	windows := []uint32{24060, 23940, 24000, 23880, 24120}
+	planSchema := func(pattern string, schemaID uint16, window uint32) int {
+		req := reqRaw(test.GetMKey(0), now-window, now, 800, 10, consolidation.Avg, schemaID, 0)
+		req.Pattern = pattern
+		reqs := []models.Req{req}
+		if !planLowestResForMDPSingles(&mdata.Schemas, now, now-window, now, 800, false, schemaID, reqs) {
+			t.Fatalf("pattern %s window %d: expected planning to succeed", pattern, window)
+		}
+		return int(reqs[0].Archive)
+	}
+	plan := func(pattern string, window uint32) int {
+		return planSchema(pattern, 0, window)
+	}
+
+	// without hysteresis, the archive flips as the window nudges
+	archiveHysteresis = nil
+	var archives []int
+	for _, w := range windows {
+		archives = append(archives, plan("a", w))
+	}
+	if exp := []int{1, 0, 1, 0, 1}; !reflect.DeepEqual(archives, exp) {
+		t.Errorf("without hysteresis: expected archives %v, got %v", exp, archives)
+	}
+
+	var err error
+	archiveHysteresis, err = newArchiveMemory(2, 0.1)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	pre := reqRenderArchiveHysteresisKept.Peek()
+	archives = archives[:0]
+	for _, w := range windows {
+		archives = append(archives, plan("a", w))
+	}
+	if exp := []int{1, 1, 1, 1, 1}; !reflect.DeepEqual(archives, exp) {
+		t.Errorf("with hysteresis: expected archives %v, got %v", exp, archives)
+	}
+	if got := reqRenderArchiveHysteresisKept.Peek() - pre; got != 2 {
+		t.Errorf("expected the remembered archive to be kept 2 times, got %d", got)
+	}
+
+	// other patterns, schemas, and windows that are not similar, are planned independently
+	if got := planSchema("a", 1, 23940); got != 0 {
+		t.Errorf("expected pattern a with another schema to get archive 0, got %d", got)
+	}
+	if got := plan("b", 23940); got != 0 {
+		t.Errorf("expected pattern b to get archive 0, got %d", got)
+	}
+	if got := plan("a", 3600); got != 0 {
+		t.Errorf("expected a small window to get archive 0, got %d", got)
+	}
+
+	// the memory is bounded: the other schema, b and the small window of a evicted the first window of a
+	if got := plan("a", 23940); got != 0 {
+		t.Errorf("expected the first window of a to be forgotten, got archive %d", got)
+	}
+}
@@ -0,0 +1,75 @@
+package response
+
+import (
+	"io"
+	"net/http"
+)
+
+// NDJSON is a list of values that get written as newline-delimited JSON: each value on its own line
+type NDJSON interface {
+	Len() int
+	MarshalJSONFastAt(b []byte, i int) ([]byte, error)
+}
+
+// NDJson is a response that streams its values, flushing after each line,
+// so that line-oriented consumers can process them as they come in
+type NDJson struct {
+	code int
+	body NDJSON
+	buf  []byte
+}
+
+func NewNDJson(code int, body NDJSON) *NDJson {
+	return &NDJson{
+		code: code,
+		body: body,
+		buf:  BufferPool.Get(),
+	}
+}
+
+func (r *NDJson) Code() int {
+	return r.code
+}
+
+func (r *NDJson) Close() {
+	BufferPool.Put(r.buf)
+}
+
+// Body returns all lines at once. Write uses Stream instead.
+func (r *NDJson) Body() ([]byte, error) {
+	var err error
+	for i := 0; i < r.body.Len(); i++ {
+		r.buf, err = r.body.MarshalJSONFastAt(r.buf, i)
+		if err != nil {
+			return nil, err
+		}
+		r.buf = append(r.buf, '\n')
+	}
+	return r.buf, nil
+}
+
+// Stream writes the values to w, one line at a time. If w is a http.Flusher, each line is flushed.
+// note that once streaming started, errors can't be reported via the status code anymore.
+func (r *NDJson) Stream(w io.Writer) error {
+	flusher, _ := w.(http.Flusher)
+	for i := 0; i < r.body.Len(); i++ {
+		var err error
+		r.buf, err = r.body.MarshalJSONFastAt(r.buf[:0], i)
+		if err != nil {
+			return err
+		}
+		r.buf = append(r.buf, '\n')
+		if _, err := w.Write(r.buf); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	return nil
+}
+
+func (r *NDJson) Headers() (headers map[string]string) {
+	headers = map[string]string{"content-type": "application/x-ndjson"}
+	return headers
+}
@@ -0,0 +1,53 @@
+package response
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/grafana/metrictank/api/models"
+)
+
+// TestNDJson verifies that each line is a valid json object by itself, and that together they are the same as the json output
+func TestNDJson(t *testing.T) {
+	for i, c := range testSeries() {
+		w := httptest.NewRecorder()
+		Write(w, NewNDJson(200, models.SeriesByTarget(c.in)))
+		if ct := w.Header().Get("content-type"); ct != "application/x-ndjson" {
+			t.Fatalf("case %d: expected content-type application/x-ndjson, got %q", i, ct)
+		}
+		if len(c.in) > 0 && !w.Flushed {
+			t.Fatalf("case %d: expected the lines to be flushed", i)
+		}
+
+		var got []interface{}
+		scanner := bufio.NewScanner(strings.NewReader(w.Body.String()))
+		scanner.Buffer(nil, 1024*1024)
+		for scanner.Scan() {
+			var line interface{}
+			if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+				t.Fatalf("case %d: line %d is not valid json: %s. line: %s", i, len(got), err, scanner.Text())
+			}
+			got = append(got, line)
+		}
+
+		var exp []interface{}
+		if err := json.Unmarshal([]byte(c.out), &exp); err != nil {
+			t.Fatalf("case %d: failed to unmarshal json output: %s", i, err)
+		}
+		if len(got) != len(exp) || (len(exp) > 0 && !reflect.DeepEqual(got, exp)) {
+			t.Fatalf("case %d: bad ndjson output.\nexpected lines of: %s\ngot:\n%s", i, c.out, w.Body.String())
+		}
+
+		// Body returns the same as what gets streamed
+		resp := NewNDJson(200, models.SeriesByTarget(c.in))
+		body, _ := resp.Body()
+		if string(body) != w.Body.String() {
+			t.Fatalf("case %d: expected Body() to return the streamed output.\nexpected:%s\ngot:     %s", i, w.Body.String(), body)
+		}
+		resp.Close()
+	}
+}
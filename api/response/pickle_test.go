@@ -1,11 +1,14 @@
 package response
 
 import (
+	"bytes"
 	"math"
+	"reflect"
 	"testing"
 
 	"github.com/grafana/metrictank/api/models"
 	"github.com/grafana/metrictank/schema"
+	pickle "github.com/kisielk/og-rek"
 )
 
 func BenchmarkHttpRespPickleEmptySeries(b *testing.B) {
@@ -126,3 +129,61 @@ func BenchmarkHttpRespPickleNulls(b *testing.B) {
 	}
 	b.Log("body size", size)
 }
+
+// TestPickle verifies that series are encoded in the structure graphite-web expects from its cluster peers:
+// a list with a dict per series, holding the name, start, end, step, values (with None for nulls) and pathExpression.
+func TestPickle(t *testing.T) {
+	data := []models.Series{
+		{
+			Target:    "a.b.c",
+			QueryPatt: "a.b.*",
+			Interval:  10,
+			Datapoints: []schema.Point{
+				{Val: 1, Ts: 1500000010},
+				{Val: math.NaN(), Ts: 1500000020},
+				{Val: 2.5, Ts: 1500000030},
+			},
+		},
+		{
+			Target:    "an.empty.series",
+			QueryPatt: "an.empty.series",
+			Interval:  60,
+			QueryFrom: 1500000000,
+			QueryTo:   1500003600,
+		},
+	}
+	resp := NewPickle(200, models.SeriesByTarget(data))
+	body, err := resp.Body()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if resp.Headers()["content-type"] != "application/pickle" {
+		t.Errorf("expected content-type application/pickle, got %q", resp.Headers()["content-type"])
+	}
+
+	decoded, err := pickle.NewDecoder(bytes.NewReader(body)).Decode()
+	if err != nil {
+		t.Fatalf("failed to decode pickle: %v", err)
+	}
+	exp := []interface{}{
+		map[interface{}]interface{}{
+			"name":           "a.b.c",
+			"pathExpression": "a.b.*",
+			"start":          int64(1500000010),
+			"end":            int64(1500000040),
+			"step":           int64(10),
+			"values":         []interface{}{1.0, pickle.None{}, 2.5},
+		},
+		map[interface{}]interface{}{
+			"name":           "an.empty.series",
+			"pathExpression": "an.empty.series",
+			"start":          int64(1500000000),
+			"end":            int64(1500003600),
+			"step":           int64(60),
+			"values":         []interface{}{},
+		},
+	}
+	if !reflect.DeepEqual(decoded, exp) {
+		t.Errorf("expected %#v, got %#v", exp, decoded)
+	}
+}
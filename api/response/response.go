@@ -2,6 +2,7 @@ package response
 
 import (
 	"errors"
+	"io"
 	"net/http"
 
 	"github.com/grafana/metrictank/util"
@@ -13,6 +14,14 @@ var BufferPool = util.NewBufferPool() // used by pickle, fastjson and msgp respo
 
 func Write(w http.ResponseWriter, resp Response) {
 	defer resp.Close()
+	if s, ok := resp.(Streamer); ok {
+		for k, v := range resp.Headers() {
+			w.Header().Set(k, v)
+		}
+		w.WriteHeader(resp.Code())
+		s.Stream(w)
+		return
+	}
 	body, err := resp.Body()
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
@@ -33,3 +42,9 @@ type Response interface {
 	Headers() map[string]string
 	Close()
 }
+
+// Streamer is implemented by responses that write their body progressively, rather than all at once.
+// Write uses Stream rather than Body for them.
+type Streamer interface {
+	Stream(w io.Writer) error
+}
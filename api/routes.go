@@ -16,13 +16,14 @@ func (s *Server) RegisterRoutes() {
 	r.Use(middleware.OrgMiddleware(multiTenant))
 	r.Use(middleware.Logger())
 	if useGzip {
-		r.Use(gziper.Gziper())
+		r.Use(gzipExcept("/tail"))
 	}
 	r.Use(macaron.Renderer())
 	r.Use(middleware.CorsHandler())
 	bind := binding.Bind
 	withOrg := middleware.RequireOrg()
 	cBody := middleware.CaptureBody
+	decompress := middleware.DecompressBody(int64(maxDecompressedBodySize))
 	ready := middleware.NodeReady()
 	noTrace := middleware.DisableTracing
 
@@ -56,12 +57,16 @@ func (s *Server) RegisterRoutes() {
 	})
 
 	// Miscellaneous Metrictank-only user facing endpoints
-	r.Combo("/showplan", cBody, withOrg, ready, bind(models.GraphiteRender{})).Get(s.showPlan).Post(s.showPlan)
+	r.Combo("/showplan", decompress, cBody, withOrg, ready, bind(models.GraphiteRender{})).Get(s.showPlan).Post(s.showPlan)
 	r.Combo("/tags/terms", ready, bind(models.GraphiteTagTerms{})).Get(s.graphiteTagTerms).Post(s.graphiteTagTerms)
 	r.Combo("/ccache/delete", bind(models.CCacheDelete{})).Post(s.ccacheDelete).Get(s.ccacheDelete)
+	r.Combo("/normalization", bind(models.Normalization{})).Get(s.normalization).Post(s.normalization)
+	r.Post("/schemas/diff", bind(models.SchemasDiff{}), s.schemasDiff)
+	r.Combo("/index/intervals", withOrg, ready, bind(models.Intervals{})).Get(s.intervals).Post(s.intervals)
+	r.Get("/tail", withOrg, ready, bind(models.Tail{}), s.tail)
 
 	// Graphite endpoints
-	r.Combo("/render", cBody, withOrg, ready, bind(models.GraphiteRender{})).Get(s.renderMetrics).Post(s.renderMetrics)
+	r.Combo("/render", decompress, cBody, withOrg, ready, bind(models.GraphiteRender{})).Get(s.renderMetrics).Post(s.renderMetrics)
 	r.Combo("/metrics/find", withOrg, ready, bind(models.GraphiteFind{})).Get(s.metricsFind).Post(s.metricsFind)
 	r.Get("/metrics/index.json", withOrg, ready, s.metricsIndex)
 	r.Post("/metrics/delete", withOrg, ready, bind(models.MetricsDelete{}), s.metricsDelete)
@@ -82,3 +87,17 @@ func (s *Server) RegisterRoutes() {
 	// Prometheus metrics endpoint
 	r.Get("/prometheus/metrics", promhttp.Handler())
 }
+
+// gzipExcept compresses responses, except those of the given paths.
+// these stream their response, which would otherwise be held back in the gzip buffer.
+func gzipExcept(paths ...string) macaron.Handler {
+	gzip := gziper.Gziper().(func(*macaron.Context))
+	return func(ctx *macaron.Context) {
+		for _, path := range paths {
+			if ctx.Req.URL.Path == path {
+				return
+			}
+		}
+		gzip(ctx)
+	}
+}
@@ -0,0 +1,143 @@
+package api
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/grafana/metrictank/api/middleware"
+	"github.com/grafana/metrictank/api/models"
+	"github.com/grafana/metrictank/api/response"
+	"github.com/grafana/metrictank/conf"
+	"github.com/grafana/metrictank/mdata"
+	"github.com/grafana/metrictank/schema"
+	"github.com/raintank/dur"
+)
+
+// maxSchemasDiffQueries is the maximum number of queries (targets times windows) a schemas diff may compare
+const maxSchemasDiffQueries = 10000
+
+// schemasDiff reports which of the given queries would get planned differently with the proposed storage schemas
+func (s *Server) schemasDiff(ctx *middleware.Context, req models.SchemasDiff) {
+	resp, err := explainSchemasDiff(uint32(time.Now().Unix()), mdata.SchemasSnapshot(), req)
+	if err != nil {
+		response.Write(ctx, response.WrapError(err))
+		return
+	}
+	response.Write(ctx, response.NewJson(200, resp, ""))
+}
+
+func explainSchemasDiff(now uint32, current *conf.Schemas, req models.SchemasDiff) (models.SchemasDiffResp, error) {
+	var resp models.SchemasDiffResp
+	if len(req.Targets) == 0 || len(req.Windows) == 0 {
+		return resp, response.NewError(http.StatusBadRequest, "at least one target and window are required")
+	}
+	if len(req.Targets)*len(req.Windows) > maxSchemasDiffQueries {
+		return resp, response.NewError(http.StatusBadRequest, fmt.Sprintf("too many queries: at most %d targets times windows are allowed", maxSchemasDiffQueries))
+	}
+	if req.Interval < 0 {
+		return resp, response.NewError(http.StatusBadRequest, "interval must be >= 0")
+	}
+	windows := make([]uint32, 0, len(req.Windows))
+	for _, w := range req.Windows {
+		window, err := dur.ParseNDuration(w)
+		if err != nil {
+			return resp, response.NewError(http.StatusBadRequest, fmt.Sprintf("could not parse window %q: %s", w, err.Error()))
+		}
+		windows = append(windows, window)
+	}
+	proposed, err := parseSchemas(req.Schemas)
+	if err != nil {
+		return resp, response.NewError(http.StatusBadRequest, fmt.Sprintf("could not parse schemas: %s", err.Error()))
+	}
+
+	queries := make([]models.SchemasDiffQuery, 0, len(req.Targets)*len(windows))
+	for _, target := range req.Targets {
+		for _, window := range windows {
+			queries = append(queries, models.SchemasDiffQuery{Target: target, Interval: req.Interval, Window: window})
+		}
+	}
+	resp.Queries = len(queries)
+	resp.Results = []models.SchemasDiffResult{}
+	for _, res := range PlanDiff(current, &proposed, now, req.MaxDataPoints, queries) {
+		if res.Changed {
+			resp.Changed++
+		}
+		if res.Changed || req.All {
+			resp.Results = append(resp.Results, res)
+		}
+	}
+	return resp, nil
+}
+
+// parseSchemas parses the given storage-schemas.conf contents. conf.ReadSchemas only reads files, so we write them to one first.
+func parseSchemas(contents string) (conf.Schemas, error) {
+	if contents == "" {
+		return conf.Schemas{}, fmt.Errorf("no schemas given")
+	}
+	f, err := ioutil.TempFile("", "storage-schemas")
+	if err != nil {
+		return conf.Schemas{}, err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(contents)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return conf.Schemas{}, err
+	}
+	return conf.ReadSchemas(f.Name())
+}
+
+// PlanDiff plans each of the given queries with both the current and the proposed schemas, and reports which of them changed their
+// archive, interval, number of points or satisfiability. It uses the same planners as render requests, but each query
+// is planned by itself, and neither pre-normalization nor max-points-per-req-soft are taken into account.
+func PlanDiff(current, proposed *conf.Schemas, now, mdp uint32, queries []models.SchemasDiffQuery) []models.SchemasDiffResult {
+	out := make([]models.SchemasDiffResult, 0, len(queries))
+	for _, q := range queries {
+		res := models.SchemasDiffResult{
+			SchemasDiffQuery: q,
+			Current:          planQuery(current, now, mdp, q),
+			Proposed:         planQuery(proposed, now, mdp, q),
+		}
+		c, p := res.Current, res.Proposed
+		res.Changed = c.Archive != p.Archive || c.ArchInterval != p.ArchInterval || c.Points != p.Points || c.Unsatisfiable != p.Unsatisfiable
+		out = append(out, res)
+	}
+	return out
+}
+
+// planQuery plans the given query with the given schemas, see PlanDiff
+func planQuery(schemas *conf.Schemas, now, mdp uint32, q models.SchemasDiffQuery) models.SchemasDiffPlan {
+	schemaID, s := schemas.Match(q.Target, q.Interval)
+	plan := models.SchemasDiffPlan{
+		Schema:     s.Name,
+		Retentions: s.Retentions.Orig,
+	}
+	interval := uint32(q.Interval)
+	if interval == 0 && len(s.Retentions.Rets) > 0 {
+		// without an interval, assume the series has the interval of the first archive
+		interval = uint32(s.Retentions.Rets[0].SecondsPerPoint)
+	}
+	var from uint32
+	if q.Window < now {
+		from = now - q.Window
+	}
+
+	reqs := NewReqMap()
+	reqs.Add(models.NewReq(schema.MKey{}, q.Target, q.Target, from, now, mdp, interval, 0, 0, 0, nil, schemaID, 0))
+	rp := NewReqsPlan(schemas, *reqs)
+	unsatisfiable, _ := planInitial(schemas, now, from, now, &rp, mdp, false, false, true)
+	if len(unsatisfiable) > 0 {
+		plan.Unsatisfiable = unsatisfiable[0].Reason
+		return plan
+	}
+	req := rp.List()[0]
+	plan.Archive = int(req.Archive)
+	plan.ArchInterval = req.ArchInterval
+	plan.Points = req.PointsFetch()
+	return plan
+}
@@ -0,0 +1,154 @@
+package api
+
+import (
+	"net/http"
+	"reflect"
+	"regexp"
+	"testing"
+
+	"github.com/grafana/metrictank/api/models"
+	"github.com/grafana/metrictank/api/response"
+	"github.com/grafana/metrictank/conf"
+)
+
+func TestExplainSchemasDiff(t *testing.T) {
+	current := conf.NewSchemas([]conf.Schema{
+		{
+			Name:       "a",
+			Pattern:    regexp.MustCompile("^a"),
+			Retentions: conf.MustParseRetentions("10s:1d,60s:7d"),
+		},
+		{
+			Name:       "b",
+			Pattern:    regexp.MustCompile("^b"),
+			Retentions: conf.MustParseRetentions("10s:1d"),
+		},
+	})
+	// a gets a longer raw retention and b gets a rollup
+	proposed := `
+[a]
+pattern = ^a
+retentions = 10s:7d,60s:30d
+
+[b]
+pattern = ^b
+retentions = 10s:1d,60s:30d
+`
+	now := uint32(100 * 24 * 3600)
+	plan := func(schema, retentions string, archive int, archInterval, points uint32) models.SchemasDiffPlan {
+		return models.SchemasDiffPlan{Schema: schema, Retentions: retentions, Archive: archive, ArchInterval: archInterval, Points: points}
+	}
+	query := func(target string, window uint32) models.SchemasDiffQuery {
+		return models.SchemasDiffQuery{Target: target, Window: window}
+	}
+
+	cases := []struct {
+		name    string
+		req     models.SchemasDiff
+		expResp models.SchemasDiffResp
+		expCode int
+	}{
+		{
+			// with an mdp of 100, a reads its 60s archive over 3d with either schemas,
+			// whereas b gets a rollup covering 3d, rather than falling back to its raw archive
+			"Changed",
+			models.SchemasDiff{Schemas: proposed, Targets: []string{"a.x", "b.x"}, Windows: []string{"3d"}, MaxDataPoints: 100},
+			models.SchemasDiffResp{
+				Queries: 2,
+				Changed: 1,
+				Results: []models.SchemasDiffResult{
+					{
+						SchemasDiffQuery: query("b.x", 3*86400),
+						Current:          plan("b", "10s:1d", 0, 10, 3*8640),
+						Proposed:         plan("b", "10s:1d,60s:30d", 1, 60, 3*1440),
+						Changed:          true,
+					},
+				},
+			},
+			0,
+		},
+		{
+			// with an mdp of 100000, a reads the finest archive that covers 3d, which is now its raw archive
+			"HighMDP",
+			models.SchemasDiff{Schemas: proposed, Targets: []string{"a.x"}, Windows: []string{"3d"}, MaxDataPoints: 100000},
+			models.SchemasDiffResp{
+				Queries: 1,
+				Changed: 1,
+				Results: []models.SchemasDiffResult{
+					{
+						SchemasDiffQuery: query("a.x", 3*86400),
+						Current:          plan("a", "10s:1d,60s:7d", 1, 60, 3*1440),
+						Proposed:         plan("a", "10s:7d,60s:30d", 0, 10, 3*8640),
+						Changed:          true,
+					},
+				},
+			},
+			0,
+		},
+		{
+			// the plan doesn't change, but is returned nonetheless
+			"All",
+			models.SchemasDiff{Schemas: proposed, Targets: []string{"a.x"}, Windows: []string{"1h"}, All: true},
+			models.SchemasDiffResp{
+				Queries: 1,
+				Results: []models.SchemasDiffResult{
+					{
+						SchemasDiffQuery: query("a.x", 3600),
+						Current:          plan("a", "10s:1d,60s:7d", 0, 10, 360),
+						Proposed:         plan("a", "10s:7d,60s:30d", 0, 10, 360),
+					},
+				},
+			},
+			0,
+		},
+		{"NoTargets", models.SchemasDiff{Schemas: proposed, Windows: []string{"1h"}}, models.SchemasDiffResp{}, http.StatusBadRequest},
+		{"NoWindows", models.SchemasDiff{Schemas: proposed, Targets: []string{"a.x"}}, models.SchemasDiffResp{}, http.StatusBadRequest},
+		{"BadWindow", models.SchemasDiff{Schemas: proposed, Targets: []string{"a.x"}, Windows: []string{"foo"}}, models.SchemasDiffResp{}, http.StatusBadRequest},
+		{"NoSchemas", models.SchemasDiff{Targets: []string{"a.x"}, Windows: []string{"1h"}}, models.SchemasDiffResp{}, http.StatusBadRequest},
+		{"BadSchemas", models.SchemasDiff{Schemas: "[a]\npattern = ^a\n", Targets: []string{"a.x"}, Windows: []string{"1h"}}, models.SchemasDiffResp{}, http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			resp, err := explainSchemasDiff(now, &current, c.req)
+			if c.expCode != 0 {
+				if err == nil {
+					t.Fatalf("expected error with code %d, got none", c.expCode)
+				}
+				if code := response.WrapError(err).HTTPStatusCode(); code != c.expCode {
+					t.Fatalf("expected error with code %d, got %d: %s", c.expCode, code, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected no error, got %s", err)
+			}
+			if !reflect.DeepEqual(resp, c.expResp) {
+				t.Errorf("expected %+v, got %+v", c.expResp, resp)
+			}
+		})
+	}
+}
+
+// TestPlanDiffUnsatisfiable verifies that a query that becomes unsatisfiable is reported as changed
+func TestPlanDiffUnsatisfiable(t *testing.T) {
+	current := conf.NewSchemas([]conf.Schema{
+		{
+			Name:       "a",
+			Pattern:    regexp.MustCompile("^a"),
+			Retentions: conf.MustParseRetentions("10s:1d"),
+		},
+	})
+	// a rollup that is not ready yet is fine, but a raw archive that isn't ready makes the query unsatisfiable
+	proposed := conf.NewSchemas([]conf.Schema{
+		{
+			Name:       "a",
+			Pattern:    regexp.MustCompile("^a"),
+			Retentions: conf.MustParseRetentions("10s:1d:10min:2:2000000000"),
+		},
+	})
+	now := uint32(100 * 24 * 3600)
+	got := PlanDiff(&current, &proposed, now, 0, []models.SchemasDiffQuery{{Target: "a.x", Window: 3600}})
+	if len(got) != 1 || !got[0].Changed || got[0].Proposed.Unsatisfiable != unsatisfiableNoReadyArchive || got[0].Current.Unsatisfiable != "" {
+		t.Errorf("expected the query to become unsatisfiable due to no ready archive, got %+v", got)
+	}
+}
@@ -0,0 +1,251 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/grafana/metrictank/api/middleware"
+	"github.com/grafana/metrictank/api/models"
+	"github.com/grafana/metrictank/api/response"
+	"github.com/grafana/metrictank/conf"
+	"github.com/grafana/metrictank/consolidation"
+	"github.com/grafana/metrictank/mdata"
+	"github.com/grafana/metrictank/schema"
+	"github.com/grafana/metrictank/stats"
+	"github.com/raintank/dur"
+	log "github.com/sirupsen/logrus"
+)
+
+// tailMaxLag is the number of output intervals a point may arrive late and still be streamed.
+// it bounds how far back we look for points of series that stopped receiving data.
+const tailMaxLag = 10
+
+var (
+	// metric api.tail.subscriptions is the number of active /tail subscriptions
+	tailSubscriptionsActive = stats.NewGauge32("api.tail.subscriptions")
+	// metric api.tail.rejected is the number of /tail subscriptions rejected due to tail-max-subscriptions or tail-max-points-per-sec
+	tailSubscriptionsRejected = stats.NewCounter32("api.tail.rejected")
+
+	tailSubscriptions int32
+
+	errTooManyTailSubscriptions = response.NewError(http.StatusTooManyRequests, "too many tail subscriptions")
+)
+
+// tailSubscription is a live tail of the series matching a target
+type tailSubscription struct {
+	reqs    []models.Req // one per series, planned to read the raw data and normalize it to the output interval
+	cursors []uint32     // for each series, the timestamp of the last point that was streamed
+	step    uint32       // how often to look for new points: the finest output interval amongst the series
+}
+
+// newTailSubscription creates a subscription to the given series, streaming them at the given interval (0 means their native interval),
+// starting with the last point that is complete as of now.
+// raw data is always read, as that's where new points arrive first. series found on multiple peers are only streamed once.
+func newTailSubscription(schemas *conf.Schemas, series []Series, interval uint32, consReq consolidation.Consolidator, now uint32) (*tailSubscription, error) {
+	sub := &tailSubscription{}
+	seen := make(map[schema.MKey]struct{})
+	for _, s := range series {
+		for _, node := range s.Series {
+			for _, archive := range node.Defs {
+				if _, ok := seen[archive.Id]; ok {
+					continue
+				}
+				seen[archive.Id] = struct{}{}
+				rets := schemas.Get(archive.SchemaId).Retentions.Rets
+				if len(rets) == 0 {
+					return nil, errNoRetentions
+				}
+				// the raw data can be consolidated with any function, so we only fall back to the
+				// storage-aggregations rules if the user didn't request one
+				cons := consReq
+				if cons == 0 {
+					cons = consolidation.Consolidator(mdata.Aggregations.Get(archive.AggId).AggregationMethod[0])
+				}
+				req := models.NewReq(archive.Id, archive.NameWithTags(), s.Pattern, 0, 0, 0, uint32(archive.Interval), 0, cons, consReq, s.Node, archive.SchemaId, archive.AggId)
+				req.Plan(0, rets[0])
+				if interval > req.ArchInterval {
+					req.PlanNormalization((interval + req.ArchInterval - 1) / req.ArchInterval * req.ArchInterval)
+				}
+				sub.reqs = append(sub.reqs, req)
+				sub.cursors = append(sub.cursors, now-now%req.OutInterval-req.OutInterval)
+				if sub.step == 0 || req.OutInterval < sub.step {
+					sub.step = req.OutInterval
+				}
+			}
+		}
+	}
+	return sub, nil
+}
+
+// rate returns the number of points per second the subscription streams
+func (sub *tailSubscription) rate() float64 {
+	var rate float64
+	for _, req := range sub.reqs {
+		rate += 1 / float64(req.OutInterval)
+	}
+	return rate
+}
+
+// pollTail returns, for each series that has any, the points that were not streamed yet.
+// only points of which the interval has completed as of now are returned, so that each is only streamed once,
+// and the points of each series are always streamed in order.
+func (s *Server) pollTail(ctx context.Context, sub *tailSubscription, now uint32) ([]models.Series, error) {
+	var out []models.Series
+	for i := range sub.reqs {
+		req := sub.reqs[i]
+		// the last point that is complete, see newRequestContext for how from and to map to points
+		last := now - now%req.OutInterval
+		from := sub.cursors[i] + req.ArchInterval
+		if last > tailMaxLag*req.OutInterval && from < last-tailMaxLag*req.OutInterval {
+			from = last - tailMaxLag*req.OutInterval + req.ArchInterval
+		}
+		if from > last {
+			continue
+		}
+		req.From, req.To = from, last+1
+		series, err := s.getTargets(ctx, &models.StorageStats{}, []models.Req{req})
+		if err != nil {
+			return nil, err
+		}
+		for _, serie := range series {
+			// points that are still null may get data later, so we only move the cursor past the last point with a value
+			points := make([]schema.Point, 0, len(serie.Datapoints))
+			for _, p := range serie.Datapoints {
+				if !math.IsNaN(p.Val) && p.Ts > sub.cursors[i] {
+					points = append(points, p)
+				}
+			}
+			if len(points) == 0 {
+				continue
+			}
+			sub.cursors[i] = points[len(points)-1].Ts
+			serie.Datapoints = points
+			out = append(out, serie)
+		}
+	}
+	return out, nil
+}
+
+// streamTail streams the new points of the subscription as server-sent events: once as of now, and then on every tick,
+// until the ticks stop or the context is canceled.
+// each event holds the new points of all series that have any, in the json render format. If there are none, a comment is sent instead,
+// so that clients that went away are noticed.
+func (s *Server) streamTail(ctx context.Context, w io.Writer, sub *tailSubscription, now time.Time, ticks <-chan time.Time) error {
+	for {
+		series, err := s.pollTail(ctx, sub, uint32(now.Unix()))
+		if err != nil {
+			fmt.Fprintf(w, "event: error\ndata: %s\n\n", strings.Replace(err.Error(), "\n", " ", -1))
+			return err
+		}
+		var buf []byte
+		if len(series) == 0 {
+			buf = []byte(": keepalive\n\n")
+		} else {
+			buf = append(buf, "event: points\ndata: "...)
+			buf, err = models.SeriesByTarget(series).MarshalJSONFast(buf)
+			if err != nil {
+				return err
+			}
+			buf = append(buf, "\n\n"...)
+		}
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+
+		var ok bool
+		select {
+		case <-ctx.Done():
+			return nil
+		case now, ok = <-ticks:
+			if !ok {
+				return nil
+			}
+		}
+	}
+}
+
+// acquireTailSubscription registers a new subscription, unless that would exceed tail-max-subscriptions
+func acquireTailSubscription() bool {
+	if n := atomic.AddInt32(&tailSubscriptions, 1); tailMaxSubscriptions > 0 && int(n) > tailMaxSubscriptions {
+		atomic.AddInt32(&tailSubscriptions, -1)
+		return false
+	}
+	tailSubscriptionsActive.Inc()
+	return true
+}
+
+func releaseTailSubscription() {
+	atomic.AddInt32(&tailSubscriptions, -1)
+	tailSubscriptionsActive.Dec()
+}
+
+// tail streams the points of the series matching the target as server-sent events, as they arrive
+func (s *Server) tail(ctx *middleware.Context, request models.Tail) {
+	if strings.ContainsAny(request.Target, "()") {
+		response.Write(ctx, response.NewError(http.StatusBadRequest, "tail only supports series names and patterns, not functions"))
+		return
+	}
+	var interval uint32
+	if request.Interval != "" {
+		var err error
+		interval, err = dur.ParseDuration(request.Interval)
+		if err != nil {
+			response.Write(ctx, response.NewError(http.StatusBadRequest, fmt.Sprintf("invalid interval %q: %s", request.Interval, err.Error())))
+			return
+		}
+	}
+	consReq := consolidation.None
+	if request.ConsolidateBy != "" {
+		if err := consolidation.Validate(request.ConsolidateBy); err != nil {
+			response.Write(ctx, response.NewError(http.StatusBadRequest, err.Error()))
+			return
+		}
+		consReq = consolidation.FromConsolidateBy(request.ConsolidateBy)
+	}
+
+	series, err := s.findSeries(ctx.Req.Context(), ctx.OrgId, []string{request.Target}, 0)
+	if err != nil {
+		response.Write(ctx, response.WrapError(err))
+		return
+	}
+	now := time.Now()
+	sub, err := newTailSubscription(mdata.SchemasSnapshot(), series, interval, consReq, uint32(now.Unix()))
+	if err != nil {
+		response.Write(ctx, response.WrapError(err))
+		return
+	}
+	if len(sub.reqs) == 0 {
+		response.Write(ctx, response.NewError(http.StatusNotFound, "no series match the target"))
+		return
+	}
+	if rate := sub.rate(); tailMaxPointsPerSec > 0 && rate > float64(tailMaxPointsPerSec) {
+		tailSubscriptionsRejected.Inc()
+		response.Write(ctx, response.NewError(http.StatusBadRequest, fmt.Sprintf("the %d series matching the target would stream %.1f points per second, more than tail-max-points-per-sec (%d). use a coarser interval or a narrower target", len(sub.reqs), rate, tailMaxPointsPerSec)))
+		return
+	}
+	if !acquireTailSubscription() {
+		tailSubscriptionsRejected.Inc()
+		response.Write(ctx, errTooManyTailSubscriptions)
+		return
+	}
+	defer releaseTailSubscription()
+
+	ctx.Resp.Header().Set("Content-Type", "text/event-stream")
+	ctx.Resp.Header().Set("Cache-Control", "no-cache")
+	ctx.Resp.WriteHeader(http.StatusOK)
+
+	ticker := time.NewTicker(time.Duration(sub.step) * time.Second)
+	defer ticker.Stop()
+	if err := s.streamTail(ctx.Req.Context(), ctx.Resp, sub, now, ticker.C); err != nil {
+		log.Debugf("HTTP tail: stream of %q ended: %s", request.Target, err.Error())
+	}
+}
@@ -0,0 +1,202 @@
+package api
+
+import (
+	"encoding/json"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/metrictank/cluster"
+	"github.com/grafana/metrictank/conf"
+	"github.com/grafana/metrictank/consolidation"
+	"github.com/grafana/metrictank/idx"
+	"github.com/grafana/metrictank/mdata"
+	"github.com/grafana/metrictank/mdata/cache"
+	"github.com/grafana/metrictank/schema"
+	"github.com/grafana/metrictank/test"
+)
+
+// eventWriter passes each write of the stream, i.e. each event, to the test
+type eventWriter chan string
+
+func (w eventWriter) Write(p []byte) (int, error) {
+	w <- string(p)
+	return len(p), nil
+}
+
+// TestStreamTail injects points while a subscription is streamed, and verifies each point is streamed once, in order,
+// once its interval has passed.
+func TestStreamTail(t *testing.T) {
+	cluster.Init("default", "test", time.Now(), "http", 6060)
+	store := mdata.NewMockStore()
+	store.Drop = true
+
+	mdata.SetSingleAgg(conf.Avg, conf.Min, conf.Max)
+	mdata.SetSingleSchema(conf.MustParseRetentions("10s:1h"))
+
+	metrics := mdata.NewAggMetrics(store, &cache.MockCache{}, false, nil, 0, 0, 0)
+	srv, _ := NewServer()
+	srv.BindBackendStore(store)
+	srv.BindMemoryStore(metrics)
+	getTargetsConcurrency = 1
+	defer func() { getTargetsConcurrency = 0 }()
+
+	// each step first adds the points in the given range (values equal their timestamp), then ticks at the given time
+	type step struct {
+		from, to uint32
+		now      uint32
+	}
+	steps := []step{
+		{10, 100, 100},
+		{110, 150, 155},
+		{0, 0, 175},     // 160 and 170 are late
+		{160, 190, 195}, // they arrive along with the next points
+	}
+	cases := []struct {
+		name     string
+		interval uint32
+		cons     consolidation.Consolidator
+		exp      [][]schema.Point // points of each event. nil means a keepalive
+	}{
+		{
+			"native",
+			0,
+			0,
+			[][]schema.Point{
+				{{Val: 100, Ts: 100}},
+				{{Val: 110, Ts: 110}, {Val: 120, Ts: 120}, {Val: 130, Ts: 130}, {Val: 140, Ts: 140}, {Val: 150, Ts: 150}},
+				nil,
+				{{Val: 160, Ts: 160}, {Val: 170, Ts: 170}, {Val: 180, Ts: 180}, {Val: 190, Ts: 190}},
+			},
+		},
+		{
+			"consolidated",
+			30,
+			consolidation.Sum,
+			[][]schema.Point{
+				{{Val: 70 + 80 + 90, Ts: 90}},
+				{{Val: 100 + 110 + 120, Ts: 120}, {Val: 130 + 140 + 150, Ts: 150}},
+				nil,
+				{{Val: 160 + 170 + 180, Ts: 180}},
+			},
+		},
+	}
+	for i, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			archive := idx.NewArchiveBare("a.b")
+			archive.OrgId = 1
+			archive.Interval = 10
+			archive.SetId()
+			metric := metrics.GetOrCreate(archive.Id, 0, 0, 10)
+			series := []Series{{Pattern: "a.*", Node: cluster.Manager.ThisNode(), Series: []idx.Node{{Path: "a.b", Leaf: true, Defs: []idx.Archive{archive}}}}}
+			add := func(from, to uint32) {
+				for ts := from; ts != 0 && ts <= to; ts += 10 {
+					metric.Add(ts, float64(ts))
+				}
+			}
+
+			sub, err := newTailSubscription(mdata.SchemasSnapshot(), series, c.interval, c.cons, steps[0].now)
+			if err != nil {
+				t.Fatalf("case %d: unexpected error %s", i, err)
+			}
+			add(steps[0].from, steps[0].to)
+			ticks := make(chan time.Time)
+			events := make(eventWriter)
+			done := make(chan error)
+			go func() {
+				done <- srv.streamTail(test.NewContext(), events, sub, time.Unix(int64(steps[0].now), 0), ticks)
+			}()
+			// each event is read before the points of the next step are added, so they can't make it into an earlier event
+			var got [][]schema.Point
+			for j := range steps {
+				if j > 0 {
+					add(steps[j].from, steps[j].to)
+					ticks <- time.Unix(int64(steps[j].now), 0)
+				}
+				event := strings.TrimSuffix(<-events, "\n\n")
+				if event == ": keepalive" {
+					got = append(got, nil)
+					continue
+				}
+				lines := strings.Split(event, "\n")
+				if len(lines) != 2 || lines[0] != "event: points" || !strings.HasPrefix(lines[1], "data: ") {
+					t.Fatalf("unexpected event %q", event)
+				}
+				var data []struct {
+					Target     string
+					Datapoints [][2]float64
+				}
+				if err := json.Unmarshal([]byte(strings.TrimPrefix(lines[1], "data: ")), &data); err != nil {
+					t.Fatalf("failed to decode event %q: %s", event, err)
+				}
+				if len(data) != 1 || data[0].Target != "a.b" {
+					t.Fatalf("expected an event with the points of a.b, got %q", event)
+				}
+				var points []schema.Point
+				for _, p := range data[0].Datapoints {
+					points = append(points, schema.Point{Val: p[0], Ts: uint32(p[1])})
+				}
+				got = append(got, points)
+			}
+			close(ticks)
+			if err := <-done; err != nil {
+				t.Fatalf("unexpected error %s", err)
+			}
+			if !reflect.DeepEqual(c.exp, got) {
+				t.Errorf("expected events:\n%v\ngot:\n%v", c.exp, got)
+			}
+		})
+	}
+}
+
+func TestTailLimits(t *testing.T) {
+	mdata.SetSingleSchema(conf.MustParseRetentions("10s:1h"))
+	var series []Series
+	for i, name := range []string{"a.b", "a.c"} {
+		archive := idx.NewArchiveBare(name)
+		archive.Interval = 10 * (i + 1)
+		archive.SetId()
+		series = append(series, Series{Pattern: "a.*", Series: []idx.Node{{Path: name, Leaf: true, Defs: []idx.Archive{archive}}}})
+	}
+	// a.c is also found on a replica
+	series = append(series, series[1])
+
+	cases := []struct {
+		interval uint32
+		expRate  float64
+		expStep  uint32
+	}{
+		{0, 1.0/10 + 1.0/20, 10},
+		{15, 1.0/20 + 1.0/20, 20},
+		{60, 1.0/60 + 1.0/60, 60},
+	}
+	for _, c := range cases {
+		sub, err := newTailSubscription(mdata.SchemasSnapshot(), series, c.interval, 0, 1000)
+		if err != nil {
+			t.Fatalf("interval %d: unexpected error %s", c.interval, err)
+		}
+		if len(sub.reqs) != 2 {
+			t.Fatalf("interval %d: expected 2 series, got %d", c.interval, len(sub.reqs))
+		}
+		if math.Abs(sub.rate()-c.expRate) > 1e-9 || sub.step != c.expStep {
+			t.Errorf("interval %d: expected rate %f and step %d, got %f and %d", c.interval, c.expRate, c.expStep, sub.rate(), sub.step)
+		}
+	}
+
+	tailMaxSubscriptions = 2
+	defer func() { tailMaxSubscriptions = 0 }()
+	if !acquireTailSubscription() || !acquireTailSubscription() {
+		t.Fatalf("expected to acquire 2 subscriptions")
+	}
+	if acquireTailSubscription() {
+		t.Fatalf("expected the third subscription to be rejected")
+	}
+	releaseTailSubscription()
+	if !acquireTailSubscription() {
+		t.Fatalf("expected to acquire a subscription after one was released")
+	}
+	releaseTailSubscription()
+	releaseTailSubscription()
+}
@@ -26,6 +26,11 @@ func (n *MockNode) IsReady() bool {
 	return n.isReady
 }
 
+// SetReady sets whether the node is ready to serve queries
+func (n *MockNode) SetReady(ready bool) {
+	n.isReady = ready
+}
+
 func (n *MockNode) GetPartitions() []int32 {
 	return n.partitions
 }
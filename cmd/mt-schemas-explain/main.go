@@ -5,11 +5,15 @@ import (
 	"fmt"
 	"os"
 	"runtime"
+	"strings"
 	"time"
 
+	"github.com/grafana/metrictank/api"
 	"github.com/grafana/metrictank/conf"
 	"github.com/grafana/metrictank/logger"
+	"github.com/grafana/metrictank/mdata"
 	"github.com/grafana/metrictank/store/cassandra"
+	"github.com/raintank/dur"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -19,6 +23,7 @@ var (
 	windowFactor = flag.Int("window-factor", 20, "size of compaction window relative to TTL")
 	metric       = flag.String("metric", "", "specify a metric name to see which schema it matches")
 	interval     = flag.Int("int", 0, "specify an interval to apply interval-based matching in addition to metric matching (e.g. to simulate kafka-mdm input)")
+	windows      = flag.String("windows", "", "comma separated list of query windows (e.g. 1h,6h,1d,30d) to show how a query for the given metric would be planned for each of them. requires -metric")
 )
 
 func init() {
@@ -64,6 +69,9 @@ func main() {
 		fmt.Printf("metric %q with interval %d gets schemaI %d\n", *metric, *interval, schemaI)
 		fmt.Printf("## [%q] pattern=%q prio=%d retentions=%v\n", s.Name, s.Pattern, s.Priority, s.Retentions)
 		fmt.Println()
+		if *windows != "" {
+			sweep(schemas, schemaI, uint32(*interval))
+		}
 	}
 
 	s, def := schemas.ListRaw()
@@ -74,6 +82,30 @@ func main() {
 	fmt.Println("built-in default:")
 	display(def)
 }
+
+// sweep shows how a query (ending now) would be planned for each of the requested windows
+func sweep(schemas conf.Schemas, schemaI uint16, interval uint32) {
+	var wins []uint32
+	for _, w := range strings.Split(*windows, ",") {
+		wins = append(wins, dur.MustParseNDuration("windows", strings.TrimSpace(w)))
+	}
+	if interval == 0 {
+		// without an interval, assume the series has the interval of the first archive
+		interval = uint32(schemas.Get(schemaI).Retentions.Rets[0].SecondsPerPoint)
+	}
+	mdata.Schemas = schemas
+	fmt.Printf("planning for a series with interval %d:\n", interval)
+	fmt.Printf("%10s %10s %10s %10s %10s\n", "window", "archive", "interval", "ttl", "points")
+	for _, res := range api.PlanSweep(schemaI, interval, uint32(time.Now().Unix()), wins) {
+		if !res.Satisfiable {
+			fmt.Printf("%10s %10s\n", dur.FormatDuration(res.Window), "unsatisfiable")
+			continue
+		}
+		fmt.Printf("%10s %10d %10d %10s %10d\n", dur.FormatDuration(res.Window), res.Archive, res.ArchInterval, dur.FormatDuration(res.TTL), res.Points)
+	}
+	fmt.Println()
+}
+
 func display(schema conf.Schema) {
 	fmt.Println("#", schema.Name)
 	fmt.Printf("pattern:   %10s\n", schema.Pattern)
@@ -90,5 +122,8 @@ func display(schema conf.Schema) {
 		windowSizeStr := time.Duration(time.Duration(table.WindowSize) * time.Hour).String()
 		fmt.Printf("           %10d %10s %10s %10d %12d %15s %10s\n", ret.SecondsPerPoint, retStr, chunkSpanStr, ret.NumChunks, ret.Ready, table.Name, windowSizeStr)
 	}
+	if err := schema.Retentions.ValidateReady(uint32(time.Now().Unix())); err != nil {
+		fmt.Println("WARNING:", err)
+	}
 	fmt.Println()
 }
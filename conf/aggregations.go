@@ -110,3 +110,17 @@ func (a Aggregations) Get(i uint16) Aggregation {
 	}
 	return a.Data[i]
 }
+
+// Stores returns whether the given archive (0 being the raw data, 1 the first rollup, etc) has data stored for the given method:
+// any method can be derived from raw data, whereas rollups only store the aggregation methods of the setting.
+func (a Aggregation) Stores(archive int, method Method) bool {
+	if archive == 0 {
+		return true
+	}
+	for _, m := range a.AggregationMethod {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
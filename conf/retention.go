@@ -16,6 +16,7 @@ import (
 const Month_sec = 60 * 60 * 24 * 28
 
 var errReadyFormat = errors.New("'ready' field must be a bool or unsigned integer")
+var errDisabledFormat = errors.New("'disabled' field must be a bool")
 
 type Retentions struct {
 	Orig string
@@ -69,7 +70,7 @@ func (r Retentions) Validate() error {
 		}
 
 		if prev.MaxRetention() >= ret.MaxRetention() {
-			return fmt.Errorf("lower resolution archives must have longer retention than higher resolution archives")
+			return fmt.Errorf("lower resolution archives must have longer retention than higher resolution archives (archive%v has a retention of %s but archive%v has %s)", i, dur.FormatDuration(uint32(ret.MaxRetention())), i-1, dur.FormatDuration(uint32(prev.MaxRetention())))
 		}
 
 		if prev.NumberOfPoints < (ret.SecondsPerPoint / prev.SecondsPerPoint) {
@@ -79,6 +80,23 @@ func (r Retentions) Validate() error {
 	return nil
 }
 
+// ValidateReady assures that, as of now, all enabled archives become ready within their retention.
+// An archive that only becomes ready after its MaxRetention has passed will not have any of the data
+// that is currently being written by the time it becomes usable, which is almost certainly a misconfiguration
+// (e.g. a ready timestamp in the wrong unit). Rather than silently skipping it in planning, we flag it.
+// Note that archives which are deliberately marked as not ready (ready:false) are accepted.
+func (r Retentions) ValidateReady(now uint32) error {
+	for i, ret := range r.Rets {
+		if ret.Disabled || ret.Ready == math.MaxUint32 || ret.Ready <= now {
+			continue
+		}
+		if uint64(ret.Ready-now) > uint64(ret.MaxRetention()) {
+			return fmt.Errorf("archive%d only becomes ready in %s, which exceeds its retention of %s. It will never be usable for the data currently written to it", i, dur.FormatDuration(ret.Ready-now), dur.FormatDuration(uint32(ret.MaxRetention())))
+		}
+	}
+	return nil
+}
+
 /*
   A retention level.
 
@@ -91,15 +109,21 @@ type Retention struct {
 	ChunkSpan       uint32 // duration of chunk of aggregated metric for storage, controls how many aggregated points go into 1 chunk
 	NumChunks       uint32 // number of chunks to keep in memory. remember, for a query from now until 3 months ago, we will end up querying the memory server as well.
 	Ready           uint32 // ready for reads for data as of this timestamp (or as of now-TTL, whichever is highest)
+	Disabled        bool   // archive is never read from, as if it wasn't configured. (but it is still written to)
 }
 
 func (r Retention) MaxRetention() int {
 	return r.SecondsPerPoint * r.NumberOfPoints
 }
 
-// Valid returns whether the given retention has been ready long enough (wrt from), and has a sufficient retention (wrt ttl)
+// Readable returns whether the given retention is enabled and has been ready long enough (wrt from)
+func (r Retention) Readable(from uint32) bool {
+	return !r.Disabled && r.Ready <= from
+}
+
+// Valid returns whether the given retention is readable (wrt from), and has a sufficient retention (wrt ttl)
 func (r Retention) Valid(from, ttl uint32) bool {
-	return r.Ready <= from && uint32(r.MaxRetention()) >= ttl
+	return r.Readable(from) && uint32(r.MaxRetention()) >= ttl
 }
 
 func (r Retention) String() string {
@@ -115,6 +139,9 @@ func (r Retention) String() string {
 	default:
 		s += ":" + strconv.FormatUint(uint64(r.Ready), 10)
 	}
+	if r.Disabled {
+		s += ":true"
+	}
 	return s
 }
 
@@ -155,7 +182,7 @@ func ParseRetentions(defs string) (Retentions, error) {
 	for i, def := range strings.Split(defs, ",") {
 		def = strings.TrimSpace(def)
 		parts := strings.Split(def, ":")
-		if len(parts) < 2 || len(parts) > 5 {
+		if len(parts) < 2 || len(parts) > 6 {
 			return retentions, fmt.Errorf("bad retentions spec %q", def)
 		}
 
@@ -209,7 +236,7 @@ func ParseRetentions(defs string) (Retentions, error) {
 			}
 			retention.NumChunks = uint32(i)
 		}
-		if len(parts) == 5 {
+		if len(parts) >= 5 {
 			// user is allowed to specify both a bool or a timestamp.
 			// internally we map both to timestamp.
 			// 0 (default) is effectively the same as 'true'
@@ -227,6 +254,12 @@ func ParseRetentions(defs string) (Retentions, error) {
 				}
 			}
 		}
+		if len(parts) == 6 {
+			retention.Disabled, err = strconv.ParseBool(parts[5])
+			if err != nil {
+				return retentions, errDisabledFormat
+			}
+		}
 
 		retentions.Rets = append(retentions.Rets, retention)
 	}
@@ -242,6 +275,10 @@ func ParseRetentionNew(def string) (Retention, error) {
 	if err != nil {
 		return Retention{}, fmt.Errorf("Failed to parse interval in %q: %s", def, err)
 	}
+	// timestamps are stored, and intervals are computed, with second precision
+	if interval == 0 {
+		return Retention{}, fmt.Errorf("Invalid interval in %q: sub-second intervals are not supported", def)
+	}
 
 	ttl, err := dur.ParseDuration(parts[1])
 	if err != nil {
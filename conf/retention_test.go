@@ -48,6 +48,40 @@ func TestParseRetentions(t *testing.T) {
 				},
 			},
 		},
+		{
+			in:             "10s:1d:1h:2:true:false,1m:8d:4h:2:1234567890:true",
+			acceptableOrig: "10s:1d:1h:2:true,1m:1w1d:4h:2:1234567890:true", // equivalent to 'in'
+			err:            false,
+			out: []Retention{
+				{
+					SecondsPerPoint: 10,
+					NumberOfPoints:  24 * 3600 / 10,
+					ChunkSpan:       60 * 60,
+					NumChunks:       2,
+					Ready:           0,
+				},
+				{
+					SecondsPerPoint: 60,
+					NumberOfPoints:  8 * 24 * 3600 / 60,
+					ChunkSpan:       4 * 60 * 60,
+					NumChunks:       2,
+					Ready:           1234567890,
+					Disabled:        true,
+				},
+			},
+		},
+		{
+			in:  "10s:1d:1h:2:true:maybe",
+			err: true,
+		},
+		{
+			in:  "0s:1d",
+			err: true,
+		},
+		{
+			in:  "100ms:1d,1s:2d",
+			err: true,
+		},
 	}
 	for i, c := range cases {
 		got, err := ParseRetentions(c.in)
@@ -71,3 +105,85 @@ func TestParseRetentions(t *testing.T) {
 
 	}
 }
+
+func TestRetentionsValidate(t *testing.T) {
+	cases := []struct {
+		in     string
+		expErr string
+	}{
+		{"1s:1d,1m:7d,1h:1y", ""},
+		{
+			"1s:7d,1m:1d",
+			"lower resolution archives must have longer retention than higher resolution archives (archive1 has a retention of 1d but archive0 has 1w)",
+		},
+		{
+			"1s:1d,1m:7d,1h:7d",
+			"lower resolution archives must have longer retention than higher resolution archives (archive2 has a retention of 1w but archive1 has 1w)",
+		},
+		{"1h:1d,1m:7d", "retention must have lower resolution than prior retention"},
+		{"10s:1d,15s:7d", "lower resolution retentions must be evenly divisible by higher resolution retentions (15 does not divide by 10)"},
+	}
+	for _, c := range cases {
+		_, err := ParseRetentions(c.in)
+		if c.expErr == "" {
+			if err != nil {
+				t.Errorf("%q: expected no error, got %q", c.in, err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != c.expErr {
+			t.Errorf("%q: expected error %q, got %v", c.in, c.expErr, err)
+		}
+	}
+}
+
+func TestRetentionsValidateReady(t *testing.T) {
+	now := uint32(1000000000)
+	cases := []struct {
+		name   string
+		rets   Retentions
+		expErr string
+	}{
+		{
+			"AllReady",
+			BuildFromRetentions(NewRetentionMT(10, 24*3600, 600, 2, 0), NewRetentionMT(60, 7*24*3600, 3600, 2, now)),
+			"",
+		},
+		{
+			"ReadyWithinRetention",
+			BuildFromRetentions(NewRetentionMT(10, 24*3600, 600, 2, 0), NewRetentionMT(60, 7*24*3600, 3600, 2, now+6*24*3600)),
+			"",
+		},
+		{
+			"ReadyFalse",
+			BuildFromRetentions(NewRetentionMT(10, 24*3600, 600, 2, 0), NewRetentionMT(60, 7*24*3600, 3600, 2, math.MaxUint32)),
+			"",
+		},
+		{
+			"ReadyBeyondRetention",
+			BuildFromRetentions(NewRetentionMT(10, 24*3600, 600, 2, 0), NewRetentionMT(60, 7*24*3600, 3600, 2, now+8*24*3600)),
+			"archive1 only becomes ready in 1w1d, which exceeds its retention of 1w. It will never be usable for the data currently written to it",
+		},
+		{
+			"ReadyBeyondRetentionDisabled",
+			BuildFromRetentions(NewRetentionMT(10, 24*3600, 600, 2, 0), func() Retention {
+				r := NewRetentionMT(60, 7*24*3600, 3600, 2, now+8*24*3600)
+				r.Disabled = true
+				return r
+			}()),
+			"",
+		},
+	}
+	for _, c := range cases {
+		err := c.rets.ValidateReady(now)
+		if c.expErr == "" {
+			if err != nil {
+				t.Errorf("%s: expected no error, got %q", c.name, err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != c.expErr {
+			t.Errorf("%s: expected error %q, got %v", c.name, c.expErr, err)
+		}
+	}
+}
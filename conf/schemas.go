@@ -2,7 +2,9 @@ package conf
 
 import (
 	"fmt"
+	"math"
 	"regexp"
+	"regexp/syntax"
 	"sort"
 	"strconv"
 	"strings"
@@ -22,7 +24,7 @@ type SchemaSlice []Schema
 
 func (s SchemaSlice) Len() int           { return len(s) }
 func (s SchemaSlice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
-func (s SchemaSlice) Less(i, j int) bool { return s[i].Priority >= s[j].Priority }
+func (s SchemaSlice) Less(i, j int) bool { return s[i].Priority > s[j].Priority }
 
 // Schema represents one schema setting
 type Schema struct {
@@ -32,6 +34,11 @@ type Schema struct {
 	Priority           int64
 	ReorderWindow      uint32
 	ReorderAllowUpdate bool
+
+	// the LCM and GCD of the intervals of the retentions, computed when the index is built. 0 if not known.
+	// any interval that the archives can be combined into is a multiple of the GCD, and the LCM is an interval all of them can deliver.
+	IntervalsLcm uint32
+	IntervalsGcd uint32
 }
 
 func NewSchemas(schemas []Schema) Schemas {
@@ -61,26 +68,98 @@ func (s *Schemas) BuildIndex() {
 	s.index = make([]Schema, 0)
 	for _, schema := range s.raw {
 		for pos := range schema.Retentions.Rets {
-			s.index = append(s.index, Schema{
-				Name:               schema.Name,
-				Pattern:            schema.Pattern,
-				Retentions:         schema.Retentions.Sub(pos),
-				Priority:           schema.Priority,
-				ReorderWindow:      schema.ReorderWindow,
-				ReorderAllowUpdate: schema.ReorderAllowUpdate,
-			})
+			s.index = append(s.index, indexEntry(schema, pos))
 		}
 	}
 	// add the default schema
 	for pos := range s.DefaultSchema.Retentions.Rets {
-		s.index = append(s.index, Schema{
-			Name:               s.DefaultSchema.Name,
-			Pattern:            s.DefaultSchema.Pattern,
-			Retentions:         s.DefaultSchema.Retentions.Sub(pos),
-			Priority:           s.DefaultSchema.Priority,
-			ReorderWindow:      s.DefaultSchema.ReorderWindow,
-			ReorderAllowUpdate: s.DefaultSchema.ReorderAllowUpdate,
-		})
+		s.index = append(s.index, indexEntry(s.DefaultSchema, pos))
+	}
+}
+
+// WithMinInterval returns a copy of the schemas in which the retentions with an interval finer than the given one are disabled,
+// so that they are not read from. The coarsest enabled retention of each schema is never disabled, so that the data remains readable.
+// The retentions keep their position, so that archive numbers remain valid.
+func (s Schemas) WithMinInterval(interval uint32) Schemas {
+	if interval == 0 {
+		return s
+	}
+	out := Schemas{
+		raw:           s.raw,
+		index:         make([]Schema, len(s.index)),
+		DefaultSchema: s.DefaultSchema.withMinInterval(interval),
+	}
+	for i, schema := range s.index {
+		out.index[i] = schema.withMinInterval(interval)
+	}
+	return out
+}
+
+func (s Schema) withMinInterval(interval uint32) Schema {
+	rets := make([]Retention, len(s.Retentions.Rets))
+	copy(rets, s.Retentions.Rets)
+	// the coarsest enabled retention, which we must keep
+	last := len(rets) - 1
+	for last > 0 && rets[last].Disabled {
+		last--
+	}
+	for i := 0; i < last && uint32(rets[i].SecondsPerPoint) < interval; i++ {
+		rets[i].Disabled = true
+	}
+	s.Retentions.Rets = rets
+	return s
+}
+
+// WithIntervalReady returns a copy of the schemas in which the Ready timestamp of each retention is moved to just after the end
+// of the bucket it falls in (i.e. rounded up to the interval of the retention, plus one second), so that retentions are only
+// read for windows of which the first bucket started after they became ready, rather than for windows that begin within
+// a bucket that was only partially written. Retentions that are always ready, or never, are kept as is.
+func (s Schemas) WithIntervalReady() Schemas {
+	out := Schemas{
+		raw:           s.raw,
+		index:         make([]Schema, len(s.index)),
+		DefaultSchema: s.DefaultSchema.withIntervalReady(),
+	}
+	for i, schema := range s.index {
+		out.index[i] = schema.withIntervalReady()
+	}
+	return out
+}
+
+func (s Schema) withIntervalReady() Schema {
+	rets := make([]Retention, len(s.Retentions.Rets))
+	copy(rets, s.Retentions.Rets)
+	for i := range rets {
+		ready, interval := uint64(rets[i].Ready), uint64(rets[i].SecondsPerPoint)
+		if ready == 0 || ready == math.MaxUint32 || interval == 0 {
+			continue
+		}
+		ready = (ready+interval-1)/interval*interval + 1
+		if ready >= math.MaxUint32 {
+			ready = math.MaxUint32 - 1
+		}
+		rets[i].Ready = uint32(ready)
+	}
+	s.Retentions.Rets = rets
+	return s
+}
+
+// indexEntry returns the entry of the expanded index for the given schema, starting at the given retention
+func indexEntry(schema Schema, pos int) Schema {
+	rets := schema.Retentions.Sub(pos)
+	intervals := make([]uint32, len(rets.Rets))
+	for i, ret := range rets.Rets {
+		intervals[i] = uint32(ret.SecondsPerPoint)
+	}
+	return Schema{
+		Name:               schema.Name,
+		Pattern:            schema.Pattern,
+		Retentions:         rets,
+		Priority:           schema.Priority,
+		ReorderWindow:      schema.ReorderWindow,
+		ReorderAllowUpdate: schema.ReorderAllowUpdate,
+		IntervalsLcm:       util.Lcm(intervals),
+		IntervalsGcd:       util.Gcd(intervals),
 	}
 }
 
@@ -114,6 +193,9 @@ func ReadSchemas(file string) (Schemas, error) {
 			return Schemas{}, fmt.Errorf("[%s]: failed to parse pattern %q: %s", schema.Name, sec.ValueOf("pattern"), err.Error())
 		}
 
+		if strings.TrimSpace(sec.ValueOf("retentions")) == "" {
+			return Schemas{}, fmt.Errorf("[%s]: no retentions", schema.Name)
+		}
 		schema.Retentions, err = ParseRetentions(sec.ValueOf("retentions"))
 		if err != nil {
 			return Schemas{}, fmt.Errorf("[%s]: failed to parse retentions %q: %s", schema.Name, sec.ValueOf("retentions"), err.Error())
@@ -151,11 +233,93 @@ func ReadSchemas(file string) (Schemas, error) {
 		schemas = append(schemas, schema)
 	}
 
-	sort.Sort(SchemaSlice(schemas))
+	// Priority already breaks ties by position in the file, but a stable sort makes sure that,
+	// should two schemas ever have the same Priority, they also keep their order of declaration.
+	sort.Stable(SchemaSlice(schemas))
 
 	return NewSchemas(schemas), nil
 }
 
+// configuredPriority returns the priority as set in the config file: Priority is that value << 32, minus the position
+// of the schema in the file (see ReadSchemas). rounding up undoes the latter.
+func (s Schema) configuredPriority() int64 {
+	return (s.Priority + 1<<32 - 1) >> 32
+}
+
+// Shadowed returns a description of each schema that does not match (some of) the metrics that it was written for,
+// because an earlier schema of the same priority matches them first. Schemas with the same priority are matched in
+// order of declaration, so e.g. a specific pattern declared after a broader one only gets the metrics that the broader
+// one doesn't match. This is often unintended, so should be reported to the user.
+// note that this is best effort: we only check a single example metric of each schema
+func (s Schemas) Shadowed() []string {
+	var out []string
+	for j, later := range s.raw {
+		example, ok := exampleMatch(later.Pattern)
+		if !ok {
+			continue
+		}
+		for _, earlier := range s.raw[:j] {
+			if earlier.configuredPriority() == later.configuredPriority() && earlier.Pattern.MatchString(example) {
+				out = append(out, fmt.Sprintf("[%s] (pattern %q) is shadowed by the earlier [%s] (pattern %q) of the same priority: e.g. %q matches both, but gets the retentions of [%s]. Declare the more specific schema first, or give it a higher priority", later.Name, later.Pattern.String(), earlier.Name, earlier.Pattern.String(), example, earlier.Name))
+				break
+			}
+		}
+	}
+	return out
+}
+
+// exampleMatch returns the simplest string we can come up with that matches the given pattern
+func exampleMatch(pattern *regexp.Regexp) (string, bool) {
+	re, err := syntax.Parse(pattern.String(), syntax.Perl)
+	if err != nil {
+		return "", false
+	}
+	var b strings.Builder
+	var walk func(re *syntax.Regexp) bool
+	walk = func(re *syntax.Regexp) bool {
+		switch re.Op {
+		case syntax.OpLiteral:
+			b.WriteString(string(re.Rune))
+		case syntax.OpCharClass:
+			if len(re.Rune) == 0 {
+				return false
+			}
+			b.WriteRune(re.Rune[0])
+		case syntax.OpAnyChar, syntax.OpAnyCharNotNL:
+			b.WriteByte('a')
+		case syntax.OpCapture, syntax.OpPlus:
+			return walk(re.Sub[0])
+		case syntax.OpRepeat:
+			for i := 0; i < re.Min; i++ {
+				if !walk(re.Sub[0]) {
+					return false
+				}
+			}
+		case syntax.OpConcat:
+			for _, sub := range re.Sub {
+				if !walk(sub) {
+					return false
+				}
+			}
+		case syntax.OpAlternate:
+			return walk(re.Sub[0])
+		case syntax.OpNoMatch:
+			return false
+		}
+		// anything else (e.g. anchors, star and quest) can match the empty string
+		return true
+	}
+	if !walk(re) {
+		return "", false
+	}
+	// the walk above ignores e.g. word boundaries, so verify that the example really matches
+	example := b.String()
+	if !pattern.MatchString(example) {
+		return "", false
+	}
+	return example, true
+}
+
 // Match returns the correct schema setting for the given metric
 // it can always find a valid setting, because there's a default catch all
 // also returns the index of the setting, to efficiently reference it.
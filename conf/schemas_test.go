@@ -4,9 +4,11 @@ import (
 	"math"
 	"reflect"
 	"regexp"
+	"strings"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/grafana/metrictank/util"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
@@ -177,6 +179,107 @@ func TestMaxRawRetention(t *testing.T) {
 	})
 }
 
+// TestIntervalsLcmGcd verifies the LCM and GCD cached for each entry of the index against computing them on the fly
+func TestIntervalsLcmGcd(t *testing.T) {
+	schemas := schemasForTest()
+	// entries that don't form a proper chain, as BuildFromRetentions does not validate them
+	schemas.raw = append(schemas.raw, Schema{
+		Name:       "c",
+		Pattern:    regexp.MustCompile("^c\\..*"),
+		Retentions: BuildFromRetentions(NewRetentionMT(10, 3600, 600, 0, 0), NewRetentionMT(15, 86400, 600, 0, 0), NewRetentionMT(4, 86400, 600, 0, 0)),
+	})
+	schemas.BuildIndex()
+
+	exp := []struct {
+		lcm, gcd uint32
+	}{
+		{3600, 10}, {3600, 3600}, // a
+		{600, 1}, {600, 30}, {600, 600}, // b
+		{3600, 1}, {3600, 60}, {3600, 600}, {3600, 3600}, // default
+		{60, 1}, {60, 1}, {4, 4}, // c
+		{1, 1}, // DefaultSchema
+	}
+	if len(schemas.index) != len(exp) {
+		t.Fatalf("expected %d index entries, got %d", len(exp), len(schemas.index))
+	}
+	for i, schema := range schemas.index {
+		var intervals []uint32
+		for _, ret := range schema.Retentions.Rets {
+			intervals = append(intervals, uint32(ret.SecondsPerPoint))
+		}
+		if schema.IntervalsLcm != util.Lcm(intervals) || schema.IntervalsGcd != util.Gcd(intervals) {
+			t.Errorf("entry %d (%s): cached lcm %d, gcd %d don't match computed lcm %d, gcd %d", i, schema.Retentions.Orig, schema.IntervalsLcm, schema.IntervalsGcd, util.Lcm(intervals), util.Gcd(intervals))
+		}
+		if schema.IntervalsLcm != exp[i].lcm || schema.IntervalsGcd != exp[i].gcd {
+			t.Errorf("entry %d (%s): expected lcm %d, gcd %d, got %d, %d", i, schema.Retentions.Orig, exp[i].lcm, exp[i].gcd, schema.IntervalsLcm, schema.IntervalsGcd)
+		}
+	}
+}
+
+func TestWithMinInterval(t *testing.T) {
+	schemas := NewSchemas([]Schema{
+		{
+			Name:       "a",
+			Pattern:    regexp.MustCompile(".*"),
+			Retentions: MustParseRetentions("1s:1d,10s:7d,1min:30d,10min:1y:6h:2:true:true"),
+		},
+	})
+	restricted := schemas.WithMinInterval(60)
+
+	// expanded schema ids: 0 (1s), 1 (10s), 2 (1min), 3 (10min)
+	// the 10min archive is disabled, so the 1min archive is the coarsest enabled one, and is always kept
+	exp := [][]bool{
+		{true, true, false, true},
+		{true, false, true},
+		{false, true},
+		{true},
+	}
+	for i, expDisabled := range exp {
+		rets := restricted.Get(uint16(i)).Retentions.Rets
+		for j, ret := range rets {
+			if ret.Disabled != expDisabled[j] {
+				t.Errorf("schema %d retention %d (%s): expected disabled %t, got %t", i, j, ret.String(), expDisabled[j], ret.Disabled)
+			}
+		}
+	}
+	// with a restriction coarser than any archive, the coarsest enabled archive remains
+	rets := schemas.WithMinInterval(86400).Get(0).Retentions.Rets
+	for j, expDisabled := range []bool{true, true, false, true} {
+		if rets[j].Disabled != expDisabled {
+			t.Errorf("retention %d (%s): expected disabled %t with a coarse restriction, got %t", j, rets[j].String(), expDisabled, rets[j].Disabled)
+		}
+	}
+	// the original schemas remain untouched
+	for j, ret := range schemas.Get(0).Retentions.Rets {
+		if ret.Disabled != (j == 3) {
+			t.Errorf("original retention %d (%s) was modified", j, ret.String())
+		}
+	}
+}
+
+func TestWithIntervalReady(t *testing.T) {
+	schemas := NewSchemas([]Schema{
+		{
+			Name:       "a",
+			Pattern:    regexp.MustCompile(".*"),
+			Retentions: MustParseRetentions("10s:1d,1min:30d:6h:2:3630,10min:1y:6h:2:3600,1h:2y:6h:2:false"),
+		},
+	})
+	rets := schemas.WithIntervalReady().Get(0).Retentions.Rets
+	// the 1min archive became ready mid-bucket, the 10min one on a bucket boundary. the raw and 1h ones are always and never ready.
+	for j, exp := range []uint32{0, 3661, 3601, math.MaxUint32} {
+		if rets[j].Ready != exp {
+			t.Errorf("retention %d (%s): expected ready %d, got %d", j, rets[j].String(), exp, rets[j].Ready)
+		}
+	}
+	// the original schemas remain untouched
+	for j, exp := range []uint32{0, 3630, 3600, math.MaxUint32} {
+		if ready := schemas.Get(0).Retentions.Rets[j].Ready; ready != exp {
+			t.Errorf("original retention %d: expected ready %d, got %d", j, exp, ready)
+		}
+	}
+}
+
 func TestReadSchemas(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -202,12 +305,24 @@ func TestReadSchemas(t *testing.T) {
 			want:    Schemas{},
 			wantErr: true,
 		},
+		{
+			name:    "no_retentions",
+			file:    "schemas_test_files/no_retentions.schemas",
+			want:    Schemas{},
+			wantErr: true,
+		},
 		{
 			name:    "bad_retention",
 			file:    "schemas_test_files/bad_retention.schemas",
 			want:    Schemas{},
 			wantErr: true,
 		},
+		{
+			name:    "shrinking_ttl",
+			file:    "schemas_test_files/shrinking_ttl.schemas",
+			want:    Schemas{},
+			wantErr: true,
+		},
 		{
 			name: "simple",
 			file: "schemas_test_files/simple.schemas",
@@ -332,6 +447,73 @@ func TestReadSchemas(t *testing.T) {
 		})
 	}
 }
+// TestReadSchemasEqualPriority verifies that overlapping schemas of the same priority are matched in order of declaration,
+// and that the ones that are shadowed get reported
+func TestReadSchemasEqualPriority(t *testing.T) {
+	for i := 0; i < 10; i++ {
+		schemas, err := ReadSchemas("schemas_test_files/equal_priority.schemas")
+		if err != nil {
+			t.Fatalf("ReadSchemas() error = %v", err)
+		}
+		cases := []struct {
+			metric string
+			exp    string
+		}{
+			{"servers.www.cpu", "broad"}, // [specific] is declared after [broad]
+			{"servers.db.cpu", "prioritized"},
+			{"servers.mail.cpu", "broad"},
+			{"other", "default"},
+		}
+		for _, c := range cases {
+			if _, schema := schemas.Match(c.metric, 0); schema.Name != c.exp {
+				t.Errorf("expected %q to match schema %q, got %q", c.metric, c.exp, schema.Name)
+			}
+		}
+
+		// [prioritized] is also matched by [broad], but takes precedence by priority
+		shadowed := schemas.Shadowed()
+		if len(shadowed) != 1 || !strings.HasPrefix(shadowed[0], "[specific]") || !strings.Contains(shadowed[0], "shadowed by the earlier [broad]") {
+			t.Fatalf("expected [specific] to be reported as shadowed by [broad], got %v", shadowed)
+		}
+	}
+}
+
+func TestShadowed(t *testing.T) {
+	// the catch-all is declared before [wpUsageMetrics]
+	schemas, err := ReadSchemas("schemas_test_files/multiple.schemas")
+	if err != nil {
+		t.Fatalf("ReadSchemas() error = %v", err)
+	}
+	if shadowed := schemas.Shadowed(); len(shadowed) != 1 || !strings.HasPrefix(shadowed[0], "[wpUsageMetrics]") {
+		t.Errorf("expected [wpUsageMetrics] to be reported as shadowed, got %v", shadowed)
+	}
+	// a catch-all at the end, and patterns that don't overlap, are fine
+	if shadowed := schemasForTest().Shadowed(); len(shadowed) != 0 {
+		t.Errorf("expected no shadowed schemas, got %v", shadowed)
+	}
+}
+
+func TestExampleMatch(t *testing.T) {
+	cases := []struct {
+		pattern string
+		exp     string
+		expOk   bool
+	}{
+		{"^servers\\.www\\.", "servers.www.", true},
+		{"^a\\..*", "a.", true},
+		{".*", "", true},
+		{"(foo|bar)+\\.[0-9]{2}$", "foo.00", true},
+		{"^stats\\.\\w+\\.count$", "stats.0.count", true},
+		{"a\\bb", "", false},
+	}
+	for _, c := range cases {
+		example, ok := exampleMatch(regexp.MustCompile(c.pattern))
+		if example != c.exp || ok != c.expOk {
+			t.Errorf("pattern %q: expected example %q (ok %t), got %q (ok %t)", c.pattern, c.exp, c.expOk, example, ok)
+		}
+	}
+}
+
 func TestSub(t *testing.T) {
 	in := Retentions{
 		Orig: "10s:600s:60s:2:true,30s:1h:60s:2:false",
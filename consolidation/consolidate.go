@@ -23,6 +23,11 @@ func ConsolidateContext(ctx context.Context, in []schema.Point, aggNum uint32, c
 // interval is the interval between the input points
 func ConsolidateNudged(points []schema.Point, interval, maxDataPoints uint32, consolidator Consolidator) ([]schema.Point, uint32) {
 	aggNum := AggEvery(uint32(len(points)), maxDataPoints)
+	return ConsolidateNudgedAggNum(points, interval, aggNum, consolidator)
+}
+
+// ConsolidateNudgedAggNum is like ConsolidateNudged, but for a given aggNum rather than maxDataPoints
+func ConsolidateNudgedAggNum(points []schema.Point, interval, aggNum uint32, consolidator Consolidator) ([]schema.Point, uint32) {
 	points = nudgeMaybe(points, aggNum, interval)
 	points = Consolidate(points, aggNum, consolidator)
 	return points, interval * aggNum
@@ -86,6 +91,23 @@ func AggEvery(numPoints, maxPoints uint32) uint32 {
 	return (numPoints + maxPoints - 1) / maxPoints
 }
 
+// AggClosest returns how many points should be aggregated together so that you end up with
+// as close to targetPoints points as possible (above or below). In case of a tie, the most points win.
+func AggClosest(numPoints, targetPoints uint32) uint32 {
+	if numPoints <= targetPoints || targetPoints == 0 {
+		return 1
+	}
+	// the outcome is between the aggNum that yields more points than the target, and the one that yields fewer points
+	more := numPoints / targetPoints
+	fewer := more + 1
+	outMore := (numPoints + more - 1) / more
+	outFewer := (numPoints + fewer - 1) / fewer
+	if outMore-targetPoints <= targetPoints-outFewer {
+		return more
+	}
+	return fewer
+}
+
 func nudgeMaybe(points []schema.Point, aggNum, interval uint32) []schema.Point {
 	// note that the amount of points to strip by nudging is always < 1 postAggInterval's worth.
 	// there's 2 important considerations here:
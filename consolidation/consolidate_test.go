@@ -392,6 +392,32 @@ func TestAggEvery(t *testing.T) {
 	}
 }
 
+func TestAggClosest(t *testing.T) {
+	cases := []c{
+		{0, 1, 1},
+		{1, 1, 1},
+		{2, 1, 2},
+		{3, 2, 2},
+		{5, 2, 3},
+		{14, 6, 2}, // 7 points is as close to 6 as 5 points, prefer more points
+		{0, 80, 1},
+		{79, 80, 1},
+		{80, 80, 1},
+		{81, 80, 1},
+		{100, 80, 1},   // 100 points is closer to 80 than 50 points
+		{120, 80, 2},   // 60 points is closer to 80 than 120 points
+		{200, 80, 3},   // 67 points
+		{1000, 80, 13}, // 77 points is closer to 80 than 84 points
+		{100, 0, 1},
+	}
+	for i, c := range cases {
+		every := AggClosest(c.numPoints, c.maxDataPoints)
+		if every != c.every {
+			t.Fatalf("output for testcase %d mismatch: expected: %v, got: %v", i, c.every, every)
+		}
+	}
+}
+
 // each "operation" is a consolidation of 1M+1 points
 func BenchmarkConsolidateAvgRand1M_1(b *testing.B) {
 	benchmarkConsolidate(test.RandFloats1M, 1, Avg, b)
@@ -507,3 +533,11 @@ func benchmarkConsolidate(fn func() []schema.Point, aggNum uint32, consolidator
 	}
 	b.SetBytes(int64(l * 12))
 }
+
+func TestConsolidateByRoundTrip(t *testing.T) {
+	for _, c := range []Consolidator{None, Avg, Cnt, Lst, Min, Max, Mult, Med, Diff, StdDev, Range, Sum} {
+		if got := FromConsolidateBy(c.ConsolidateBy()); got != c {
+			t.Errorf("expected %q to parse back into %s, got %s", c.ConsolidateBy(), c, got)
+		}
+	}
+}
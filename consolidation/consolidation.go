@@ -63,6 +63,37 @@ func (c Consolidator) String() string {
 	panic(fmt.Sprintf("Consolidator.String(): unknown consolidator %d", c))
 }
 
+// ConsolidateBy returns the name of the consolidator as it is specified in consolidateBy(), the inverse of FromConsolidateBy
+func (c Consolidator) ConsolidateBy() string {
+	switch c {
+	case None:
+		return "none"
+	case Avg:
+		return "avg"
+	case Cnt:
+		return "count"
+	case Lst:
+		return "last"
+	case Min:
+		return "min"
+	case Max:
+		return "max"
+	case Mult:
+		return "multiply"
+	case Med:
+		return "median"
+	case Diff:
+		return "diff"
+	case StdDev:
+		return "stddev"
+	case Range:
+		return "range"
+	case Sum:
+		return "sum"
+	}
+	panic(fmt.Sprintf("Consolidator.ConsolidateBy(): unknown consolidator %d", c))
+}
+
 // provide the name of a stored archive
 // see aggregator.go for which archives are available
 func (c Consolidator) Archive() schema.Method {
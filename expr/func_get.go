@@ -22,7 +22,7 @@ func (s FuncGet) Context(context Context) Context {
 }
 
 func (s FuncGet) Exec(dataMap DataMap) ([]models.Series, error) {
-	series := dataMap[s.req]
+	series := dataMap[s.req.DataKey()]
 
 	// this function is the only exception to the COW pattern
 	// it is allowed to modify the series directly to set the needed tags
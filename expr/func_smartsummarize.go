@@ -23,6 +23,9 @@ func (s *FuncSmartSummarize) Signature() ([]Arg, []Arg) {
 }
 
 func (s *FuncSmartSummarize) Context(context Context) Context {
+	if context.MDP != 0 {
+		context.mdpReason = MDPReasonGR
+	}
 	context.MDP = 0
 	context.PNGroup = 0
 	context.consol = 0
@@ -32,9 +32,17 @@ func (s *FuncSummarize) Signature() ([]Arg, []Arg) {
 }
 
 func (s *FuncSummarize) Context(context Context) Context {
+	if context.MDP != 0 {
+		context.mdpReason = MDPReasonGR
+	}
 	context.MDP = 0
 	context.PNGroup = 0
 	context.consol = 0
+	// an outer summarize() determines the output interval
+	if context.summarize == 0 {
+		interval, _ := dur.ParseDuration(s.intervalString)
+		context.summarize = interval
+	}
 	return context
 }
 
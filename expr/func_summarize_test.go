@@ -851,6 +851,66 @@ func TestSummarizeLargeIntervalTimestamps(t *testing.T) {
 	testSummarize("LongIntervals", input, outputSum[1], "30d", "sum", true, t)
 }
 
+// TestSummarizePointsReturn verifies that the estimate of the points returned for a request that gets summarize()'d
+// matches the amount of points that summarize() actually returns
+func TestSummarizePointsReturn(t *testing.T) {
+	cases := []struct {
+		target   string
+		from, to uint32
+		interval uint32
+	}{
+		{"summarize(a,'1h')", 3600, 7 * 3600, 10},
+		{"summarize(a,'1h')", 3600, 7*3600 + 1800, 10},
+		{"summarize(a,'1h')", 1800, 24 * 3600, 60},
+		{"summarize(a,'5min')", 1000, 2000, 10},
+		{"summarize(a,'1d')", 0, 7 * 24 * 3600, 3600},
+		{"summarize(scale(a,2),'1h')", 3600, 7 * 3600, 10},
+		// the outer summarize() determines the output
+		{"summarize(summarize(a,'1min'),'1h')", 3600, 7 * 3600, 10},
+	}
+	for _, c := range cases {
+		exprs, err := ParseMany([]string{c.target})
+		if err != nil {
+			t.Fatal(err)
+		}
+		plan, err := NewPlan(exprs, c.from, c.to, 0, false, Optimizations{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(plan.Reqs) != 1 {
+			t.Fatalf("case %q: expected 1 request, got %d", c.target, len(plan.Reqs))
+		}
+		req := plan.Reqs[0].ToModel()
+		req.OutInterval = c.interval
+
+		// the fetched data covers [from, to)
+		serie := models.Series{
+			Target:    "a",
+			QueryPatt: req.Pattern,
+			QueryFrom: req.From,
+			QueryTo:   req.To,
+			Interval:  c.interval,
+		}
+		for ts := c.from - c.from%c.interval; ts < c.to; ts += c.interval {
+			if ts >= c.from {
+				serie.Datapoints = append(serie.Datapoints, schema.Point{Val: 1, Ts: ts})
+			}
+		}
+		dataMap := NewDataMap()
+		dataMap.Add(NewReqFromSerie(serie), serie)
+		out, err := plan.Run(dataMap)
+		if err != nil {
+			t.Fatalf("case %q: expected no error, got %v", c.target, err)
+		}
+		if len(out) != 1 {
+			t.Fatalf("case %q: expected 1 output series, got %d", c.target, len(out))
+		}
+		if est := req.PointsReturn(0); est != uint32(len(out[0].Datapoints)) {
+			t.Errorf("case %q from %d to %d: estimated %d points returned, but got %d", c.target, c.from, c.to, est, len(out[0].Datapoints))
+		}
+	}
+}
+
 func testSummarize(name string, in []models.Series, out []models.Series, intervalString, fn string, alignToFrom bool, t *testing.T) {
 	f := NewSummarize()
 
@@ -12,6 +12,8 @@ type Context struct {
 	consol        consolidation.Consolidator // can be 0 to mean undefined
 	PNGroup       models.PNGroup             // pre-normalization group. if the data can be safely pre-normalized
 	MDP           uint32                     // if we can MDP-optimize, reflects runtime consolidation MaxDataPoints. 0 otherwise
+	summarize     uint32                     // if the data gets summarize()'d, the interval of the buckets. 0 otherwise
+	mdpReason     string                     // if a function disabled MDP-optimization, why. see Req.MDPReason
 	optimizations Optimizations
 }
 
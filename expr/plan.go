@@ -40,6 +40,16 @@ func (o Optimizations) ApplyUserPrefs(s string) (Optimizations, error) {
 	return o, nil
 }
 
+// reasons why a Req was classified as MDP-optimizable or not. see Req.MDPReason
+const (
+	MDPReasonOptimizable    = "optimizable"
+	MDPReasonDisabled       = "mdp-optimization disabled"  // via the optimizations setting or request parameter
+	MDPReasonNoMDP          = "no maxDataPoints"           // the plan has no maxDataPoints to optimize for
+	MDPReasonGraphiteOrigin = "graphite-origin request"    // graphite needs the high-res data for its own processing
+	MDPReasonInterval       = "interval requested"         // the client asked for an exact resolution
+	MDPReasonGR             = "greedy-resolution function" // the data goes through a function such as summarize() that determines its own interval
+)
+
 // Req represents a request for one/more series
 type Req struct {
 	Query   string // whatever was parsed as the query out of a graphite target. e.g. target=sum(foo.{b,a}r.*) -> foo.{b,a}r.* -> this will go straight to index lookup
@@ -48,6 +58,13 @@ type Req struct {
 	Cons    consolidation.Consolidator // can be 0 to mean undefined
 	PNGroup models.PNGroup
 	MDP     uint32 // if we can MDP-optimize, reflects runtime consolidation MaxDataPoints. 0 otherwise.
+
+	// if the data gets summarize()'d, the interval of the buckets. 0 otherwise.
+	// only used to estimate the returned points, it does not identify the data: see DataKey()
+	Summarize uint32
+
+	// why MDP is (not) set, for debugging. it does not identify the data either
+	MDPReason string
 }
 
 // NewReq creates a new Req. pass cons=0 to leave consolidator undefined,
@@ -65,16 +82,25 @@ func NewReq(query string, from, to uint32, cons consolidation.Consolidator, PNGr
 
 func NewReqFromContext(query string, c Context) Req {
 	r := Req{
-		Query: query,
-		From:  c.from,
-		To:    c.to,
-		Cons:  c.consol,
+		Query:     query,
+		From:      c.from,
+		To:        c.to,
+		Cons:      c.consol,
+		Summarize: c.summarize,
 	}
 	if c.optimizations.PreNormalization {
 		r.PNGroup = c.PNGroup
 	}
-	if c.optimizations.MDP {
+	switch {
+	case !c.optimizations.MDP:
+		r.MDPReason = MDPReasonDisabled
+	case c.mdpReason != "":
+		r.MDPReason = c.mdpReason
+	case c.MDP == 0:
+		r.MDPReason = MDPReasonNoMDP
+	default:
 		r.MDP = c.MDP
+		r.MDPReason = MDPReasonOptimizable
 	}
 	return r
 }
@@ -94,6 +120,13 @@ func NewReqFromSerie(serie models.Series) Req {
 
 }
 
+// DataKey returns the Req as it is tied back from the series that are fetched for it (see NewReqFromSerie)
+func (r Req) DataKey() Req {
+	r.Summarize = 0
+	r.MDPReason = ""
+	return r
+}
+
 func (r Req) ToModel() models.Req {
 	return models.Req{
 		Pattern:   r.Query,
@@ -102,17 +135,34 @@ func (r Req) ToModel() models.Req {
 		MaxPoints: r.MDP,
 		PNGroup:   r.PNGroup,
 		ConsReq:   r.Cons,
+		MDPReason: r.MDPReason,
+
+		SummarizeInterval: r.Summarize,
 	}
 }
 
 type Plan struct {
-	Reqs          []Req          // data that needs to be fetched before functions can be executed
-	funcs         []GraphiteFunc // top-level funcs to execute, the head of each tree for each target
-	exprs         []*expr
-	MaxDataPoints uint32
-	From          uint32  // global request scoped from
-	To            uint32  // global request scoped to
-	dataMap       DataMap // set via Run()
+	Reqs             []Req          // data that needs to be fetched before functions can be executed
+	funcs            []GraphiteFunc // top-level funcs to execute, the head of each tree for each target
+	exprs            []*expr
+	MaxDataPoints    uint32
+	TargetDataPoints bool                      // treat MaxDataPoints as a target to get as close to as possible, rather than as a ceiling
+	MaxPointsFetch   uint32                    // per series, read the finest resolution that fetches no more than this many points. 0 disables
+	Cheapest         bool                      // read the coarsest data that still covers the requested range, regardless of MDP-optimizations
+	AlignStrict      bool                      // normalize all series to a common interval, so that they can be aligned onto the same timestamps
+	Interval         uint32                    // if set, plan all series to exactly this output interval, in seconds
+	IgnoreSoftLimit  bool                      // don't coarsen the series to honor max-points-per-req-soft
+	EqualizePoints   float64                   // if > 0, coarsen the densest series until all return the same amount of points, within this relative tolerance
+	ValidateOnly     bool                      // don't fetch any data, only report the series that can't be planned
+	MaxIntervals     uint32                    // if > 0, coarsen series until there are at most this many distinct output intervals
+	PlanOnly         bool                      // don't fetch any data, only report how the series would be planned
+	MetaOnly         bool                      // don't fetch any data, only report how each series would be read and returned
+	RawTimestamps    bool                      // return the raw data at the timestamps it was stored with, without running any functions
+	Counters         []string                  // patterns of which the series are counters, see models.Req.Counter
+	PNGroups         map[string]models.PNGroup // the PNGroup declared for the series of each pattern, see models.Req.DeclaredPNGroup
+	From             uint32                    // global request scoped from
+	To               uint32                    // global request scoped to
+	dataMap          DataMap                   // set via Run()
 }
 
 func (p Plan) Dump(w io.Writer) {
@@ -130,18 +180,28 @@ func (p Plan) Dump(w io.Writer) {
 		}
 	}
 	// ! PNGroups are pointers which can be upto 21 characters long on 64bit
-	headPatt := fmt.Sprintf("%%%ds %%12s %%12s %%25s %%21s %%6s\n", maxQueryLen)
-	linePatt := fmt.Sprintf("%%%ds %%12d %%12d %%25s %%21d %%6d\n", maxQueryLen)
-	fmt.Fprintf(w, headPatt, "query", "from", "to", "consolidator", "PNGroup", "MDP")
+	headPatt := fmt.Sprintf("%%%ds %%12s %%12s %%25s %%21s %%6s  %%s\n", maxQueryLen)
+	linePatt := fmt.Sprintf("%%%ds %%12d %%12d %%25s %%21d %%6d  %%s\n", maxQueryLen)
+	fmt.Fprintf(w, headPatt, "query", "from", "to", "consolidator", "PNGroup", "MDP", "MDP reason")
 
 	for _, r := range p.Reqs {
-		fmt.Fprintf(w, linePatt, r.Query, r.From, r.To, r.Cons, r.PNGroup, r.MDP)
+		fmt.Fprintf(w, linePatt, r.Query, r.From, r.To, r.Cons, r.PNGroup, r.MDP, r.MDPReason)
 	}
 	fmt.Fprintf(w, "MaxDataPoints: %d\n", p.MaxDataPoints)
 	fmt.Fprintf(w, "From: %d\n", p.From)
 	fmt.Fprintf(w, "To: %d\n", p.To)
 }
 
+// SetNoMDPReason sets the reason for the Reqs that aren't MDP-optimizable because the plan has no MaxDataPoints.
+// this is for callers that set mdp to 0 themselves, to report why they did
+func (p *Plan) SetNoMDPReason(reason string) {
+	for i := range p.Reqs {
+		if p.Reqs[i].MDPReason == MDPReasonNoMDP {
+			p.Reqs[i].MDPReason = reason
+		}
+	}
+}
+
 // NewPlan validates the expressions and comes up with the initial (potentially non-optimal) execution plan
 // which is just a list of requests and the expressions.
 // traverse tree and as we go down:
@@ -314,14 +374,21 @@ func (p Plan) Run(dataMap DataMap) ([]models.Series, error) {
 	}
 	for i, o := range out {
 		if p.MaxDataPoints != 0 && len(o.Datapoints) > int(p.MaxDataPoints) {
+			aggNum := consolidation.AggEvery(uint32(len(o.Datapoints)), p.MaxDataPoints)
+			if p.TargetDataPoints {
+				aggNum = consolidation.AggClosest(uint32(len(o.Datapoints)), p.MaxDataPoints)
+				if aggNum == 1 {
+					continue
+				}
+			}
 			// series may have been created by a function that didn't know which consolidation function to default to.
 			// in the future maybe we can do more clever things here. e.g. perSecond maybe consolidate by max.
 			if o.Consolidator == 0 {
 				o.Consolidator = consolidation.Avg
 			}
-			out[i].Datapoints, out[i].Interval = consolidation.ConsolidateNudged(o.Datapoints, o.Interval, p.MaxDataPoints, o.Consolidator)
+			out[i].Datapoints, out[i].Interval = consolidation.ConsolidateNudgedAggNum(o.Datapoints, o.Interval, aggNum, o.Consolidator)
 			out[i].Meta = out[i].Meta.CopyWithChange(func(in models.SeriesMetaProperties) models.SeriesMetaProperties {
-				in.AggNumRC = consolidation.AggEvery(uint32(len(o.Datapoints)), p.MaxDataPoints)
+				in.AggNumRC = aggNum
 				in.ConsolidatorRC = o.Consolidator
 				return in
 			})
@@ -8,6 +8,7 @@ import (
 	"github.com/google/go-cmp/cmp"
 	"github.com/grafana/metrictank/api/models"
 	"github.com/grafana/metrictank/consolidation"
+	"github.com/grafana/metrictank/schema"
 )
 
 // TestArgs tests that after planning the given args against smartSummarize, the right error or requests come out
@@ -192,6 +193,10 @@ func TestArgs(t *testing.T) {
 
 	fn := NewSmartSummarize()
 	for i, c := range cases {
+		// the context has no optimizations enabled
+		for j := range c.expReq {
+			c.expReq[j].MDPReason = MDPReasonDisabled
+		}
 		e := &expr{
 			etype:     etFunc,
 			str:       "smartSummarize",
@@ -439,6 +444,17 @@ func TestArgInIntKeyword(t *testing.T) {
 	}
 }
 
+// summarized returns the Req as it is for data that gets summarize()'d into buckets of the given interval
+func summarized(r Req, interval uint32) Req {
+	r.Summarize = interval
+	return r
+}
+
+func withMDPReason(r Req, reason string) Req {
+	r.MDPReason = reason
+	return r
+}
+
 // TestOptimizationFlags tests that the optimization (PNGroups and MDP for MDP-optimization) flags are
 // set in line with the optimization settings passed to the planner.
 func TestOptimizationFlags(t *testing.T) {
@@ -470,40 +486,54 @@ func TestOptimizationFlags(t *testing.T) {
 			// no transparent aggregation so don't align the data. Though, could be MDP optimized
 			"a",
 			[]Req{
-				NewReq("a", from, to, 0, 0, 800),
+				withMDPReason(NewReq("a", from, to, 0, 0, 800), MDPReasonOptimizable),
 			},
 		},
 		{
 			"summarize(a,'1h')", // greedy resolution function. disables MDP optimizations
 			[]Req{
-				NewReq("a", from, to, 0, 0, 0),
+				withMDPReason(summarized(NewReq("a", from, to, 0, 0, 0), 3600), MDPReasonGR),
 			},
 		},
 		{
 			"sum(a)", // transparent aggregation. enables PN-optimization
 			[]Req{
-				NewReq("a", from, to, 0, 1, 800),
+				withMDPReason(NewReq("a", from, to, 0, 1, 800), MDPReasonOptimizable),
 			},
 		},
 		{
 			"summarize(sum(a),'1h')",
 			[]Req{
-				NewReq("a", from, to, 0, 1, 0),
+				withMDPReason(summarized(NewReq("a", from, to, 0, 1, 0), 3600), MDPReasonGR),
 			},
 		},
 		{
 			// a will go through some functions that don't matter, then hits a transparent aggregation
 			"summarize(sum(perSecond(min(scale(a,1)))),'1h')",
 			[]Req{
-				NewReq("a", from, to, 0, 1, 0),
+				withMDPReason(summarized(NewReq("a", from, to, 0, 1, 0), 3600), MDPReasonGR),
+			},
+		},
+		{
+			// functions that don't alter the interval, such as scale, offset and alias, leave MDP-optimization enabled
+			"alias(offset(scale(a,2),1),'foo')",
+			[]Req{
+				withMDPReason(NewReq("a", from, to, 0, 0, 800), MDPReasonOptimizable),
+			},
+		},
+		{
+			// but wrapping a greedy resolution function in them doesn't make it MDP-optimizable
+			"alias(scale(summarize(a,'1h'),2),'foo')",
+			[]Req{
+				withMDPReason(summarized(NewReq("a", from, to, 0, 0, 0), 3600), MDPReasonGR),
 			},
 		},
 		{
 			// a is not PN-optimizable due to the opaque aggregation, whereas b is thanks to the transparent aggregation, that they hit first.
 			"sum(group(groupByTags(a,'sum','foo'), avg(b)))",
 			[]Req{
-				NewReq("a", from, to, 0, 0, 800),
-				NewReq("b", from, to, 0, 1, 800),
+				withMDPReason(NewReq("a", from, to, 0, 0, 800), MDPReasonOptimizable),
+				withMDPReason(NewReq("b", from, to, 0, 1, 800), MDPReasonOptimizable),
 			},
 		},
 		{
@@ -512,9 +542,9 @@ func TestOptimizationFlags(t *testing.T) {
 			// c is neither PN-optimizable, nor MDP-optimizable, because it hits an interval altering + GR function, before it hits anything else
 			"groupByTags(group(groupByTags(a,'sum','tag'), avg(b), avg(summarize(c,'1h'))),'sum','tag2')",
 			[]Req{
-				NewReq("a", from, to, 0, 0, 800),
-				NewReq("b", from, to, 0, 1, 800),
-				NewReq("c", from, to, 0, 0, 0),
+				withMDPReason(NewReq("a", from, to, 0, 0, 800), MDPReasonOptimizable),
+				withMDPReason(NewReq("b", from, to, 0, 1, 800), MDPReasonOptimizable),
+				withMDPReason(summarized(NewReq("c", from, to, 0, 0, 0), 3600), MDPReasonGR),
 			},
 		},
 	}
@@ -544,6 +574,7 @@ func TestOptimizationFlags(t *testing.T) {
 		copy(c.wantReq, origWantReqs)
 		for j := range c.wantReq {
 			c.wantReq[j].MDP = 0
+			c.wantReq[j].MDPReason = MDPReasonDisabled
 		}
 
 		plan, err = NewPlan(exprs, from, to, 800, stable, opts)
@@ -573,6 +604,7 @@ func TestOptimizationFlags(t *testing.T) {
 		copy(c.wantReq, origWantReqs)
 		for j := range c.wantReq {
 			c.wantReq[j].MDP = 0
+			c.wantReq[j].MDPReason = MDPReasonDisabled
 			c.wantReq[j].PNGroup = 0
 		}
 
@@ -584,6 +616,51 @@ func TestOptimizationFlags(t *testing.T) {
 	}
 }
 
+// TestMDPReason tests that requests record why they were (not) classified as MDP-optimizable
+func TestMDPReason(t *testing.T) {
+	from := uint32(1000)
+	to := uint32(2000)
+	opts := Optimizations{MDP: true}
+	cases := []struct {
+		in          string
+		mdp         uint32
+		noMDPReason string // reason passed to SetNoMDPReason, if any
+		exp         []string
+	}{
+		{"a", 800, "", []string{MDPReasonOptimizable}},
+		{"a", 0, "", []string{MDPReasonNoMDP}},
+		{"a", 0, MDPReasonGraphiteOrigin, []string{MDPReasonGraphiteOrigin}},
+		{"a", 0, MDPReasonInterval, []string{MDPReasonInterval}},
+		{"smartSummarize(a,'1h')", 800, "", []string{MDPReasonGR}},
+		// without maxDataPoints, summarize() is not what prevents the optimization
+		{"summarize(a,'1h')", 0, MDPReasonGraphiteOrigin, []string{MDPReasonGraphiteOrigin}},
+		{"sum(a, summarize(b,'1h'))", 800, "", []string{MDPReasonOptimizable, MDPReasonGR}},
+	}
+	for i, c := range cases {
+		exprs, err := ParseMany([]string{c.in})
+		if err != nil {
+			t.Fatal(err)
+		}
+		plan, err := NewPlan(exprs, from, to, c.mdp, false, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.noMDPReason != "" {
+			plan.SetNoMDPReason(c.noMDPReason)
+		}
+		var got []string
+		for _, r := range plan.Reqs {
+			got = append(got, r.MDPReason)
+			if r.ToModel().MDPReason != r.MDPReason {
+				t.Errorf("case %d: %q: reason %q not carried to the model", i, c.in, r.MDPReason)
+			}
+		}
+		if !reflect.DeepEqual(c.exp, got) {
+			t.Errorf("case %d: %q with mdp %d: expected reasons %q, got %q", i, c.in, c.mdp, c.exp, got)
+		}
+	}
+}
+
 // TestConsolidateBy tests for a variety of input targets, wether consolidateBy settings are correctly
 // propagated down the tree (to fetch requests) and up the tree (to runtime consolidation of the output)
 func TestConsolidateBy(t *testing.T) {
@@ -695,6 +772,9 @@ func TestConsolidateBy(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
+		for j := range c.expReq {
+			c.expReq[j].MDPReason = MDPReasonDisabled
+		}
 		if !reflect.DeepEqual(err, c.expErr) {
 			t.Errorf("case %d: %q, expected error %v - got %v", i, c.in, c.expErr, err)
 		}
@@ -743,6 +823,175 @@ func TestConsolidateBy(t *testing.T) {
 	}
 }
 
+// TestConsolidateByPreNormalized validates that a consolidateBy wrapping a GR-function that introduces a PNGroup
+// flows down to the fetch request, so that pre-normalization (done with the fetch consolidator) agrees with it.
+func TestConsolidateByPreNormalized(t *testing.T) {
+	from := uint32(10)
+	to := uint32(50)
+	exprs, _ := ParseMany([]string{`consolidateBy(sumSeries(a.*), "max")`})
+	plan, err := NewPlan(exprs, from, to, 800, true, Optimizations{PreNormalization: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Reqs) != 1 {
+		t.Fatalf("expected 1 request, got %d", len(plan.Reqs))
+	}
+	req := plan.Reqs[0]
+	if req.Cons != consolidation.Max {
+		t.Fatalf("expected fetch consolidation %s, got %s", consolidation.Max, req.Cons)
+	}
+	if req.PNGroup == 0 {
+		t.Fatalf("expected request to have a PNGroup")
+	}
+
+	// emulate a fetch which honored the requested consolidation but could not fully pre-normalize
+	dataMap := DataMap{
+		req.DataKey(): {
+			{
+				QueryPatt:    "a.*",
+				Target:       "a.b",
+				Consolidator: consolidation.Max,
+				Interval:     10,
+				Datapoints: []schema.Point{
+					{Val: 1, Ts: 10},
+					{Val: 5, Ts: 20},
+					{Val: 2, Ts: 30},
+					{Val: 8, Ts: 40},
+				},
+			},
+			{
+				QueryPatt:    "a.*",
+				Target:       "a.c",
+				Consolidator: consolidation.Max,
+				Interval:     20,
+				Datapoints: []schema.Point{
+					{Val: 10, Ts: 20},
+					{Val: 20, Ts: 40},
+				},
+			},
+		},
+	}
+	out, err := plan.Run(dataMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 1 {
+		t.Fatalf("expected 1 output series, got %d", len(out))
+	}
+	if out[0].Consolidator != consolidation.Max {
+		t.Errorf("expected output consolidation %s, got %s", consolidation.Max, out[0].Consolidator)
+	}
+	exp := []schema.Point{
+		{Val: 15, Ts: 20},
+		{Val: 28, Ts: 40},
+	}
+	if !reflect.DeepEqual(exp, out[0].Datapoints) {
+		t.Errorf("expected datapoints %v, got %v", exp, out[0].Datapoints)
+	}
+}
+
+// TestRunHonorsMaxDataPoints validates that, irrespective of how many points were fetched,
+// the output never exceeds MaxDataPoints and the runtime consolidation is reflected in the meta.
+func TestRunHonorsMaxDataPoints(t *testing.T) {
+	for _, interval := range []uint32{1, 10, 60, 3600} {
+		for _, numPoints := range []uint32{0, 1, 2, 799, 800, 801, 1599, 1601, 10000} {
+			for _, mdp := range []uint32{1, 2, 3, 100, 800, 1000} {
+				from := uint32(3600)
+				to := from + numPoints*interval
+				exprs, _ := ParseMany([]string{"a"})
+				plan, err := NewPlan(exprs, from, to, mdp, true, Optimizations{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				points := make([]schema.Point, 0, numPoints)
+				for ts := from; ts < to; ts += interval {
+					points = append(points, schema.Point{Val: float64(ts), Ts: ts})
+				}
+				dataMap := DataMap{
+					NewReq("a", from, to, 0, 0, 0): {{
+						QueryPatt:    "a",
+						Target:       "a",
+						Consolidator: consolidation.Avg,
+						Interval:     interval,
+						Datapoints:   points,
+						Meta:         models.SeriesMeta{{Count: 1}},
+					}},
+				}
+				out, err := plan.Run(dataMap)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(out) != 1 {
+					t.Fatalf("interval %d, numPoints %d, mdp %d: expected 1 output series, got %d", interval, numPoints, mdp, len(out))
+				}
+				if uint32(len(out[0].Datapoints)) > mdp {
+					t.Errorf("interval %d, numPoints %d, mdp %d: expected at most %d points, got %d", interval, numPoints, mdp, mdp, len(out[0].Datapoints))
+				}
+				expAggNum := uint32(0)
+				if numPoints > mdp {
+					expAggNum = consolidation.AggEvery(numPoints, mdp)
+				}
+				if out[0].Meta[0].AggNumRC != expAggNum {
+					t.Errorf("interval %d, numPoints %d, mdp %d: expected meta aggnum-rc %d, got %d", interval, numPoints, mdp, expAggNum, out[0].Meta[0].AggNumRC)
+				}
+				if expAggNum != 0 && out[0].Interval != interval*expAggNum {
+					t.Errorf("interval %d, numPoints %d, mdp %d: expected output interval %d, got %d", interval, numPoints, mdp, interval*expAggNum, out[0].Interval)
+				}
+			}
+		}
+	}
+}
+
+// TestRunTargetDataPoints validates that with TargetDataPoints, runtime consolidation gets as close as possible
+// to MaxDataPoints, even if that means returning more points.
+func TestRunTargetDataPoints(t *testing.T) {
+	cases := []struct {
+		numPoints uint32
+		expPoints int
+		expAggNum uint32
+	}{
+		{800, 800, 0},
+		{1000, 1000, 0}, // 1000 points is closer to 800 than 500
+		{1300, 650, 2},
+		{2000, 667, 3}, // 667 points is closer to 800 than 1000
+		{4000, 800, 5},
+	}
+	for _, c := range cases {
+		from := uint32(3600)
+		to := from + c.numPoints*10
+		exprs, _ := ParseMany([]string{"a"})
+		plan, err := NewPlan(exprs, from, to, 800, true, Optimizations{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		plan.TargetDataPoints = true
+		points := make([]schema.Point, 0, c.numPoints)
+		for ts := from; ts < to; ts += 10 {
+			points = append(points, schema.Point{Val: float64(ts), Ts: ts})
+		}
+		dataMap := DataMap{
+			NewReq("a", from, to, 0, 0, 0): {{
+				QueryPatt:    "a",
+				Target:       "a",
+				Consolidator: consolidation.Avg,
+				Interval:     10,
+				Datapoints:   points,
+				Meta:         models.SeriesMeta{{Count: 1}},
+			}},
+		}
+		out, err := plan.Run(dataMap)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(out[0].Datapoints) != c.expPoints {
+			t.Errorf("numPoints %d: expected %d points, got %d", c.numPoints, c.expPoints, len(out[0].Datapoints))
+		}
+		if out[0].Meta[0].AggNumRC != c.expAggNum {
+			t.Errorf("numPoints %d: expected meta aggnum-rc %d, got %d", c.numPoints, c.expAggNum, out[0].Meta[0].AggNumRC)
+		}
+	}
+}
+
 // TestNamingChains tests whether series names (targets) are correct, after a processing chain of multiple functions
 func TestNamingChains(t *testing.T) {
 	from := uint32(1000)
@@ -880,7 +1129,7 @@ func TestNamingChains(t *testing.T) {
 			}
 		}
 		dataMap := DataMap{
-			plan.Reqs[0]: series,
+			plan.Reqs[0].DataKey(): series,
 		}
 		out, err := plan.Run(dataMap)
 		if err != nil {
@@ -156,7 +156,7 @@ func (ms *AggMetrics) GetOrCreate(key schema.MKey, schemaId, aggId uint16, inter
 	}
 
 	agg := Aggregations.Get(aggId)
-	confSchema := Schemas.Get(schemaId)
+	confSchema := SchemasSnapshot().Get(schemaId)
 
 	// if it wasn't there, get the write lock and prepare to add it
 	// but first we need to check again if someone has added it in
@@ -6,6 +6,7 @@ package mdata
 import (
 	"flag"
 	"io/ioutil"
+	"time"
 
 	"github.com/grafana/globalconf"
 	"github.com/grafana/metrictank/conf"
@@ -93,6 +94,7 @@ var (
 	badAggSpan = stats.NewCounter32("recovered_errors.aggmetric.getaggregated.bad-aggspan")
 
 	// set either via ConfigProcess or from the unit tests. other code should not touch
+	// once the process is running, Schemas is accessed via the functions in schema.go, see schemasLock
 	Aggregations conf.Aggregations
 	Schemas      conf.Schemas
 
@@ -136,6 +138,16 @@ func ConfigProcess() {
 	if err != nil {
 		log.Fatalf("can't read schemas file %q: %s", schemasFile, err.Error())
 	}
+	for _, shadowed := range Schemas.Shadowed() {
+		log.Warnf("storage-schemas.conf: %s", shadowed)
+	}
+	now := uint32(time.Now().Unix())
+	schemas, def := Schemas.ListRaw()
+	for _, schema := range append(schemas, def) {
+		if err := schema.Retentions.ValidateReady(now); err != nil {
+			log.Warnf("schema %q: %s", schema.Name, err.Error())
+		}
+	}
 
 	// === read storage-aggregation.conf ===
 
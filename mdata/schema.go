@@ -1,16 +1,50 @@
 package mdata
 
 import (
+	"sync"
+	"sync/atomic"
+
 	"github.com/grafana/metrictank/conf"
 )
 
+// schemasLock protects Schemas when it gets replaced via SetSchemas.
+// once the process is running, Schemas must only be accessed through the functions of this file, which take it.
+var schemasLock sync.RWMutex
+
+// schemasGeneration is incremented every time Schemas gets replaced via SetSchemas
+var schemasGeneration uint32
+
+// SchemasSnapshot returns a snapshot of the current Schemas.
+// Schemas are not modified after they have been built, so the snapshot can be used consistently
+// for the duration of a request (e.g. across all of its planning), even if Schemas gets replaced via SetSchemas.
+func SchemasSnapshot() *conf.Schemas {
+	schemasLock.RLock()
+	s := Schemas
+	schemasLock.RUnlock()
+	return &s
+}
+
+// SetSchemas replaces Schemas. It is safe to call concurrently with the other functions of this file
+func SetSchemas(s conf.Schemas) {
+	schemasLock.Lock()
+	Schemas = s
+	atomic.AddUint32(&schemasGeneration, 1)
+	schemasLock.Unlock()
+}
+
+// SchemasGeneration returns how many times Schemas got replaced via SetSchemas,
+// so that anything derived from them can tell when it needs to be rebuilt.
+func SchemasGeneration() uint32 {
+	return atomic.LoadUint32(&schemasGeneration)
+}
+
 func MaxChunkSpan() uint32 {
-	return Schemas.MaxChunkSpan()
+	return SchemasSnapshot().MaxChunkSpan()
 }
 
 // TTLs returns the full set of unique TTLs (in seconds) used by the current schema config.
 func TTLs() []uint32 {
-	return Schemas.TTLs()
+	return SchemasSnapshot().TTLs()
 }
 
 // MatchAgg returns the aggregation definition for the given metric key, and the index of it (to efficiently reference it)
@@ -22,13 +56,14 @@ func MatchAgg(key string) (uint16, conf.Aggregation) {
 // MatchSchema returns the schema for the given metric key, and the index of the schema (to efficiently reference it)
 // it will always find the schema because Schemas has a catchall default
 func MatchSchema(key string, interval int) (uint16, conf.Schema) {
-	return Schemas.Match(key, interval)
+	return SchemasSnapshot().Match(key, interval)
 }
 
 func SetSingleSchema(ret conf.Retentions) {
-	Schemas = conf.NewSchemas(nil)
-	Schemas.DefaultSchema.Retentions = ret
-	Schemas.BuildIndex()
+	s := conf.NewSchemas(nil)
+	s.DefaultSchema.Retentions = ret
+	s.BuildIndex()
+	SetSchemas(s)
 }
 
 func SetSingleAgg(met ...conf.Method) {
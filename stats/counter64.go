@@ -34,6 +34,10 @@ func (c *Counter64) AddUint64(val uint64) {
 	atomic.AddUint64(&c.val, val)
 }
 
+func (c *Counter64) Peek() uint64 {
+	return atomic.LoadUint64(&c.val)
+}
+
 func (c *Counter64) WriteGraphiteLine(buf, prefix []byte, now time.Time) []byte {
 	val := atomic.LoadUint64(&c.val)
 	buf = WriteUint64(buf, prefix, c.name, []byte(".counter64"), c.tags, val, now)
@@ -1,13 +1,20 @@
 package util
 
 // AllCombinationsUint32 returns all combinations of the input
+// if there are no parts, or any of the parts is empty, there are no combinations.
 func AllCombinationsUint32(parts [][]uint32) (out [][]uint32) {
+	if len(parts) == 0 {
+		return nil
+	}
 
 	// allocate a slice to host all combinations
 	num := 1
 	for _, part := range parts {
 		num *= len(part)
 	}
+	if num == 0 {
+		return nil
+	}
 	out = make([][]uint32, 0, num)
 
 	// will contain idx of which one to pick for each part
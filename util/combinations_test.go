@@ -12,6 +12,17 @@ func TestAllCombinationsUint32(t *testing.T) {
 		out [][]uint32
 	}
 	testCases := []testCase{
+		{
+			in:  nil,
+			out: nil,
+		},
+		{
+			in: [][]uint32{
+				{1, 10},
+				{},
+			},
+			out: nil,
+		},
 		{
 			in: [][]uint32{
 				{1, 10},
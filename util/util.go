@@ -1,5 +1,7 @@
 package util
 
+import "math"
+
 func Min(a, b uint32) uint32 {
 	if a < b {
 		return a
@@ -22,24 +24,40 @@ func MaxInt(a, b int) int {
 }
 
 // Lcm returns the least common multiple
+// it returns 0 if vals is empty, contains a 0, or if the result does not fit in a uint32
 func Lcm(vals []uint32) uint32 {
-	out := vals[0]
-	for i := 1; i < len(vals); i++ {
-		max := Max(uint32(vals[i]), out)
-		min := Min(uint32(vals[i]), out)
-		r := max % min
-		if r != 0 {
-			for j := uint32(2); j <= min; j++ {
-				if (j*max)%min == 0 {
-					out = j * max
-					break
-				}
-			}
-		} else {
-			out = max
+	if len(vals) == 0 {
+		return 0
+	}
+	out := uint64(vals[0])
+	for _, v := range vals {
+		if v == 0 {
+			return 0
+		}
+		out = out / gcd(out, uint64(v)) * uint64(v)
+		if out > math.MaxUint32 {
+			return 0
 		}
 	}
-	return out
+	return uint32(out)
+}
+
+// Gcd returns the greatest common divisor
+// it returns 0 if vals is empty or only contains 0's
+func Gcd(vals []uint32) uint32 {
+	var out uint64
+	for _, v := range vals {
+		out = gcd(out, uint64(v))
+	}
+	return uint32(out)
+}
+
+// gcd returns the greatest common divisor, using Euclid's algorithm
+func gcd(a, b uint64) uint64 {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
 }
 
 func IsDigit(r byte) bool {
@@ -13,6 +13,12 @@ func TestLCM(t *testing.T) {
 		{[]uint32{20, 30}, 60},
 		{[]uint32{40, 60}, 120},
 		{[]uint32{1, 3}, 3},
+		{[]uint32{7}, 7},
+		{[]uint32{10, 15, 4}, 60},
+		{[]uint32{65521, 65537}, 4294049777},  // large coprimes
+		{[]uint32{4294967291, 4294967279}, 0}, // overflow
+		{[]uint32{10, 0}, 0},
+		{[]uint32{}, 0},
 	}
 	for i, c := range cases {
 		out := Lcm(c.in)
@@ -21,3 +27,28 @@ func TestLCM(t *testing.T) {
 		}
 	}
 }
+
+func TestGCD(t *testing.T) {
+	cases := []struct {
+		in  []uint32
+		out uint32
+	}{
+		{[]uint32{10, 60}, 10},
+		{[]uint32{20, 30}, 10},
+		{[]uint32{40, 60}, 20},
+		{[]uint32{1, 3}, 1},
+		{[]uint32{7}, 7},
+		{[]uint32{10, 15, 4}, 1},
+		{[]uint32{65521, 65537}, 1},
+		{[]uint32{4294967290, 4294967280}, 10},
+		{[]uint32{10, 0}, 10},
+		{[]uint32{0}, 0},
+		{[]uint32{}, 0},
+	}
+	for i, c := range cases {
+		out := Gcd(c.in)
+		if out != c.out {
+			t.Errorf("case %d -> expected %d, got %d", i, c.out, out)
+		}
+	}
+}